@@ -0,0 +1,156 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"plantopo-strava-sync/internal/database"
+)
+
+// apiKeyCommand is an API key management command requested on the command line
+type apiKeyCommand struct {
+	create     string // Name of the key to create
+	list       bool
+	revoke     string // Name of the key to revoke
+	scopes     string // Comma separated scopes of the key to create
+	athleteID  string // Athlete of an athlete:read key
+	jsonOutput bool
+}
+
+// requested returns true if any API key command was requested
+func (c apiKeyCommand) requested() bool {
+	return c.create != "" || c.list || c.revoke != ""
+}
+
+// createdAPIKey is the output of --create-api-key
+type createdAPIKey struct {
+	*database.APIKey
+	Key string `json:"key"`
+}
+
+// runAPIKeyCLI creates, lists and revokes internal API keys
+func runAPIKeyCLI(cmd apiKeyCommand) {
+	_, db := openCLIDatabase()
+	defer db.Close()
+
+	switch {
+	case cmd.create != "":
+		handleCreateAPIKey(db, cmd.create, cmd.scopes, cmd.athleteID, cmd.jsonOutput)
+	case cmd.list:
+		handleListAPIKeys(db, cmd.jsonOutput)
+	case cmd.revoke != "":
+		handleRevokeAPIKey(db, cmd.revoke, cmd.jsonOutput)
+	}
+}
+
+func handleCreateAPIKey(db *database.DB, name, scopes, athleteIDStr string, jsonOutput bool) {
+	if scopes == "" {
+		fmt.Fprintln(os.Stderr, "Usage: --create-api-key <name> --scopes <scopes> [--athlete-id <athlete_id>]")
+		fmt.Fprintf(os.Stderr, "Scopes: %s\n", strings.Join(database.APIKeyScopes, ", "))
+		os.Exit(1)
+	}
+
+	var athleteID *int64
+	if athleteIDStr != "" {
+		id := parseIDArg("athlete", athleteIDStr)
+		athleteID = &id
+	}
+
+	var scopeList []string
+	for _, scope := range strings.Split(scopes, ",") {
+		if scope = strings.TrimSpace(scope); scope != "" {
+			scopeList = append(scopeList, scope)
+		}
+	}
+
+	key, apiKey, err := db.CreateAPIKey(name, scopeList, athleteID)
+	if err != nil {
+		switch {
+		case errors.Is(err, database.ErrAPIKeyExists):
+			fmt.Fprintf(os.Stderr, "Error: API key %s already exists\n", name)
+		case errors.Is(err, database.ErrAPIKeyNameReserved):
+			fmt.Fprintf(os.Stderr, "Error: API key name %s is reserved\n", name)
+		case errors.Is(err, database.ErrInvalidAPIKeyScopes):
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			fmt.Fprintf(os.Stderr, "Scopes: %s\n", strings.Join(database.APIKeyScopes, ", "))
+		default:
+			fmt.Fprintf(os.Stderr, "Error: Failed to create API key: %v\n", err)
+		}
+		os.Exit(1)
+	}
+
+	if jsonOutput {
+		printJSON(createdAPIKey{APIKey: apiKey, Key: key})
+		return
+	}
+
+	fmt.Printf("✓ Created API key %s with scopes %s\n", name, strings.Join(apiKey.Scopes, ", "))
+	fmt.Printf("  Key: %s\n", key)
+	fmt.Println("  The key can't be shown again, store it now.")
+}
+
+func handleListAPIKeys(db *database.DB, jsonOutput bool) {
+	apiKeys, err := db.ListAPIKeys()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: Failed to list API keys: %v\n", err)
+		os.Exit(1)
+	}
+
+	if jsonOutput {
+		printJSON(apiKeys)
+		return
+	}
+
+	if len(apiKeys) == 0 {
+		fmt.Println("No API keys.")
+		return
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAME\tPREFIX\tSCOPES\tATHLETE\tCREATED\tLAST USED\tSTATUS")
+	for _, apiKey := range apiKeys {
+		athlete := "-"
+		if apiKey.AthleteID != nil {
+			athlete = fmt.Sprint(*apiKey.AthleteID)
+		}
+		lastUsed := "never"
+		if apiKey.LastUsedAt != nil {
+			lastUsed = apiKey.LastUsedAt.UTC().Format(time.RFC3339)
+		}
+		status := "active"
+		if apiKey.RevokedAt != nil {
+			status = "revoked " + apiKey.RevokedAt.UTC().Format(time.RFC3339)
+		}
+		fmt.Fprintf(tw, "%s\t%s…\t%s\t%s\t%s\t%s\t%s\n",
+			apiKey.Name,
+			apiKey.Prefix,
+			strings.Join(apiKey.Scopes, ","),
+			athlete,
+			apiKey.CreatedAt.UTC().Format(time.RFC3339),
+			lastUsed,
+			status)
+	}
+	tw.Flush()
+}
+
+func handleRevokeAPIKey(db *database.DB, name string, jsonOutput bool) {
+	if err := db.RevokeAPIKey(name, time.Now()); err != nil {
+		if errors.Is(err, database.ErrAPIKeyNotFound) {
+			fmt.Fprintf(os.Stderr, "Error: API key %s not found\n", name)
+		} else {
+			fmt.Fprintf(os.Stderr, "Error: Failed to revoke API key: %v\n", err)
+		}
+		os.Exit(1)
+	}
+
+	if jsonOutput {
+		printJSON(map[string]interface{}{"name": name, "revoked": true})
+		return
+	}
+
+	fmt.Printf("✓ Revoked API key %s\n", name)
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"plantopo-strava-sync/internal/config"
+	"plantopo-strava-sync/internal/database"
+	"plantopo-strava-sync/internal/oauth"
+	"plantopo-strava-sync/internal/strava"
+)
+
+// athleteCommand is an athlete management command requested on the command line
+type athleteCommand struct {
+	list        bool
+	show        string
+	disconnect  string
+	move        string // Same as migrate
+	migrate     string
+	listClients bool
+	clientID    string // Target client for move and migrate
+	force       bool   // Disconnect even if Strava can't be reached
+	jsonOutput  bool
+}
+
+// requested returns true if any athlete command was requested
+func (c athleteCommand) requested() bool {
+	return c.list || c.show != "" || c.disconnect != "" || c.move != "" || c.migrate != "" || c.listClients
+}
+
+// athleteDetails is the output of --show-athlete
+type athleteDetails struct {
+	*database.AthleteOverview
+	AthleteSummary json.RawMessage         `json:"athlete_summary"`
+	Backfill       *database.BackfillState `json:"backfill"`
+}
+
+// runAthleteCLI lists and manages connected athletes
+func runAthleteCLI(cmd athleteCommand) {
+	cfg, db := openCLIDatabase()
+	defer db.Close()
+
+	switch {
+	case cmd.list:
+		handleListAthletes(db, cmd.jsonOutput)
+	case cmd.show != "":
+		handleShowAthlete(db, parseIDArg("athlete", cmd.show), cmd.jsonOutput)
+	case cmd.disconnect != "":
+		stravaClient := strava.NewClient(cfg, db)
+		manager := oauth.NewManager(cfg, db, stravaClient)
+		handleDisconnectAthlete(manager, parseIDArg("athlete", cmd.disconnect), cmd.force, cmd.jsonOutput)
+	case cmd.move != "":
+		// Strava tokens only work with the client which issued them, so the
+		// athlete has to authorize the new client themselves
+		fmt.Fprintln(os.Stderr, "Athletes can only be moved by authorizing the new client, creating a migration link")
+		stravaClient := strava.NewClient(cfg, db)
+		manager := oauth.NewManager(cfg, db, stravaClient)
+		handleMigrateAthleteClient(cfg, db, manager, parseIDArg("athlete", cmd.move), cmd.clientID, cmd.jsonOutput)
+	case cmd.migrate != "":
+		stravaClient := strava.NewClient(cfg, db)
+		manager := oauth.NewManager(cfg, db, stravaClient)
+		handleMigrateAthleteClient(cfg, db, manager, parseIDArg("athlete", cmd.migrate), cmd.clientID, cmd.jsonOutput)
+	case cmd.listClients:
+		handleListClients(cfg, db, cmd.jsonOutput)
+	}
+}
+
+func handleListAthletes(db *database.DB, jsonOutput bool) {
+	athletes, err := db.ListAthleteOverviews()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: Failed to list athletes: %v\n", err)
+		os.Exit(1)
+	}
+
+	if jsonOutput {
+		printJSON(athletes)
+		return
+	}
+
+	if len(athletes) == 0 {
+		fmt.Println("No athletes connected.")
+		return
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "ATHLETE ID\tCLIENT\tCONNECTED\tTOKEN EXPIRES\tEVENTS\tSYNC JOBS\tWEBHOOKS")
+	for _, athlete := range athletes {
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%d\t%d\t%d\n",
+			athlete.AthleteID,
+			athlete.ClientID,
+			athlete.ConnectedAt.UTC().Format(time.RFC3339),
+			athlete.TokenExpiresAt.UTC().Format(time.RFC3339),
+			athlete.EventCount,
+			athlete.PendingSyncJobs,
+			athlete.PendingWebhooks)
+	}
+	tw.Flush()
+}
+
+func handleShowAthlete(db *database.DB, athleteID int64, jsonOutput bool) {
+	overview, err := db.GetAthleteOverview(athleteID)
+	if err != nil {
+		exitAthleteError(athleteID, "Failed to get athlete", err)
+	}
+
+	athlete, err := db.GetAthlete(athleteID)
+	if err != nil {
+		exitAthleteError(athleteID, "Failed to get athlete", err)
+	}
+
+	backfill, err := db.GetBackfillState(athleteID)
+	if err != nil {
+		exitAthleteError(athleteID, "Failed to get backfill state", err)
+	}
+
+	if jsonOutput {
+		printJSON(athleteDetails{
+			AthleteOverview: overview,
+			AthleteSummary:  athlete.AthleteSummary,
+			Backfill:        backfill,
+		})
+		return
+	}
+
+	fmt.Printf("Athlete ID: %d\n", overview.AthleteID)
+	fmt.Printf("  Client: %s\n", overview.ClientID)
+	fmt.Printf("  Connected: %s\n", overview.ConnectedAt.UTC().Format(time.RFC3339))
+	fmt.Printf("  Token Expires: %s\n", overview.TokenExpiresAt.UTC().Format(time.RFC3339))
+	fmt.Printf("  Events: %d\n", overview.EventCount)
+	fmt.Printf("  Pending Sync Jobs: %d\n", overview.PendingSyncJobs)
+	fmt.Printf("  Pending Webhooks: %d\n", overview.PendingWebhooks)
+	if backfill.Cursor > 0 {
+		fmt.Printf("  Backfilled To: %s (%d activities)\n", time.Unix(backfill.Cursor, 0).UTC().Format(time.RFC3339), backfill.ListedCount)
+	}
+	fmt.Printf("  Summary: %s\n", athlete.AthleteSummary)
+}
+
+func handleDisconnectAthlete(manager *oauth.Manager, athleteID int64, force, jsonOutput bool) {
+	eventID, err := manager.DisconnectAthlete(athleteID, force)
+	if err != nil {
+		if !errors.Is(err, database.ErrAthleteNotFound) && !force {
+			fmt.Fprintln(os.Stderr, "Use --force to disconnect the athlete without deauthorizing on Strava")
+		}
+		exitAthleteError(athleteID, "Failed to disconnect athlete", err)
+	}
+
+	if jsonOutput {
+		printJSON(map[string]int64{"athlete_id": athleteID, "event_id": eventID})
+		return
+	}
+
+	fmt.Printf("✓ Disconnected athlete %d (event %d)\n", athleteID, eventID)
+}
+
+// openCLIDatabase loads the configuration and opens the database for a CLI command,
+// exiting on failure
+func openCLIDatabase() (*config.Config, *database.DB) {
+	// Only show errors so that output can be parsed
+	slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{
+		Level: slog.LevelError,
+	})))
+
+	cfg, err := config.Load()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: Failed to load configuration: %v\n", err)
+		os.Exit(1)
+	}
+
+	db, err := database.Open(cfg.DatabasePath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: Failed to open database: %v\n", err)
+		os.Exit(1)
+	}
+
+	return cfg, db
+}
+
+// exitAthleteError reports an error affecting an athlete and exits
+func exitAthleteError(athleteID int64, message string, err error) {
+	if errors.Is(err, database.ErrAthleteNotFound) {
+		fmt.Fprintf(os.Stderr, "Error: Athlete %d not found\n", athleteID)
+	} else {
+		fmt.Fprintf(os.Stderr, "Error: %s: %v\n", message, err)
+	}
+	os.Exit(1)
+}
+
+// printJSON writes a value to stdout as indented JSON
+func printJSON(value interface{}) {
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(value); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: Failed to encode output: %v\n", err)
+		os.Exit(1)
+	}
+}
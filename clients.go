@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"text/template"
+	"time"
+
+	"plantopo-strava-sync/internal/config"
+	"plantopo-strava-sync/internal/database"
+	"plantopo-strava-sync/internal/oauth"
+)
+
+// migrationEmail is a suggested email sending an athlete their migration link
+var migrationEmail = template.Must(template.New("email").Parse(`Subject: Please reconnect your Strava account
+
+Hi {{.Name}},
+
+We're moving your Strava connection to keep your activities syncing reliably.
+Please follow this link and authorize access on Strava:
+
+{{.URL}}
+
+It only takes a moment, and the activities already synced won't be affected.
+The link expires on {{.Expires}}.
+`))
+
+// migrationLink is the output of --migrate-athlete-client
+type migrationLink struct {
+	*database.ClientMigration
+	URL string `json:"url"`
+}
+
+func handleListClients(cfg *config.Config, db *database.DB, jsonOutput bool) {
+	clients, err := db.GetClientUsage(cfg.GetClientIDs(), time.Now())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: Failed to get client usage: %v\n", err)
+		os.Exit(1)
+	}
+
+	if jsonOutput {
+		printJSON(clients)
+		return
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "CLIENT\tATHLETES\tMIGRATING\tREQUESTS TODAY\tREQUESTS 7 DAYS")
+	for _, client := range clients {
+		name := client.ClientID
+		if !client.Configured {
+			name += " (not configured)"
+		}
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%d\t%d\n",
+			name,
+			client.Athletes,
+			client.PendingMigrations,
+			client.RequestsToday,
+			client.RequestsLast7Days)
+	}
+	tw.Flush()
+}
+
+func handleMigrateAthleteClient(cfg *config.Config, db *database.DB, manager *oauth.Manager, athleteID int64, clientID string, jsonOutput bool) {
+	if clientID == "" {
+		fmt.Fprintln(os.Stderr, "Usage: --migrate-athlete-client <athlete_id> --client-id <client>")
+		os.Exit(1)
+	}
+
+	migration, err := manager.CreateClientMigration(athleteID, clientID)
+	if err != nil {
+		switch {
+		case errors.Is(err, oauth.ErrUnknownClient):
+			fmt.Fprintf(os.Stderr, "Error: Unknown client_id: %s\n", clientID)
+			fmt.Fprintf(os.Stderr, "Available clients: %v\n", cfg.GetClientIDs())
+			os.Exit(1)
+		case errors.Is(err, oauth.ErrClientDisabled):
+			fmt.Fprintf(os.Stderr, "Error: Client %s is disabled\n", clientID)
+			os.Exit(1)
+		case errors.Is(err, database.ErrAlreadyOnClient):
+			fmt.Fprintf(os.Stderr, "Error: Athlete %d already uses client %s\n", athleteID, clientID)
+			os.Exit(1)
+		}
+		exitAthleteError(athleteID, "Failed to create migration", err)
+	}
+
+	link := migrationLink{ClientMigration: migration, URL: manager.MigrationURL(migration)}
+	if jsonOutput {
+		printJSON(link)
+		return
+	}
+
+	fmt.Printf("✓ Created migration of athlete %d from client %s to %s\n", athleteID, migration.FromClientID, migration.ToClientID)
+	fmt.Printf("  Link: %s\n", link.URL)
+	fmt.Printf("  Expires: %s\n\n", migration.ExpiresAt.UTC().Format(time.RFC3339))
+
+	athlete, err := db.GetAthlete(athleteID)
+	if err != nil || athlete == nil {
+		return
+	}
+	if err := migrationEmail.Execute(os.Stdout, map[string]string{
+		"Name":    athleteFirstName(athlete.AthleteSummary),
+		"URL":     link.URL,
+		"Expires": migration.ExpiresAt.UTC().Format("2 January 2006"),
+	}); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: Failed to write email: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// athleteFirstName returns the athlete's first name from their Strava summary
+func athleteFirstName(summary json.RawMessage) string {
+	var athlete struct {
+		FirstName string `json:"firstname"`
+	}
+	if err := json.Unmarshal(summary, &athlete); err != nil || strings.TrimSpace(athlete.FirstName) == "" {
+		return "there"
+	}
+	return strings.TrimSpace(athlete.FirstName)
+}
@@ -1,9 +1,16 @@
 package config
 
 import (
+	"crypto/subtle"
+	"errors"
 	"fmt"
+	"math/rand/v2"
 	"os"
-	"strconv"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
 )
 
 // StravaClientConfig holds configuration for a single Strava client
@@ -11,10 +18,42 @@ type StravaClientConfig struct {
 	ClientID     string
 	ClientSecret string
 	VerifyToken  string
+
+	// Backfill horizon for athletes connected through the client, 0 = unlimited
+	BackfillMaxAgeDays    int // Only backfill activities started in the last N days
+	BackfillMaxActivities int // Only backfill the newest N activities
+
+	// OAuth scopes requested from athletes connecting through the client
+	Scopes []string
+
+	// Use PKCE (RFC 7636) in authorization requests through the client
+	PKCE bool
+
+	// Share of new athletes assigned to the client when none is requested
+	Weight int
+
+	// Disabled clients accept no new athletes but keep syncing existing ones
+	Disabled bool
 }
 
+// defaultScopes reads all activities including private ones
+const defaultScopes = "activity:read_all"
+
+// clientNamePattern matches client names, which appear in environment
+// variable names and webhook callback URLs
+var clientNamePattern = regexp.MustCompile(`^[a-z][a-z0-9_]*$`)
+
+// logLevels are the valid values of LOG_LEVEL
+var logLevels = []string{"debug", "info", "warn", "error"}
+
+// ErrNoClientAvailable is returned when no enabled client can be assigned to a new athlete
+var ErrNoClientAvailable = errors.New("no Strava client is accepting new athletes")
+
 // Config holds all application configuration
 type Config struct {
+	// Config file settings were read from, empty = environment only
+	File string
+
 	// Publicly accessible domain pointing to server
 	Domain string
 
@@ -27,9 +66,15 @@ type Config struct {
 
 	// Strava API configuration (multi-client)
 	StravaClients map[string]*StravaClientConfig
+	ClientOrder   []string // Client names in configured order, the first is the default
 
 	// Internal API configuration
-	InternalAPIKey string
+	InternalAPIKey  string   // Current key
+	InternalAPIKeys []string // Every accepted key including InternalAPIKey, for rotation
+
+	// OAuth flow configuration
+	PlantopoUserSecret     string   // HMAC key verifying plantopo_user tokens, empty = not accepted
+	OAuthReturnToAllowlist []string // URL prefixes users may be returned to after authorization
 
 	// Logging configuration
 	LogLevel string
@@ -43,165 +88,233 @@ type Config struct {
 	RateLimitWebhookReservePercent float64 // Percentage of quota reserved for webhooks (0.0-1.0)
 	RateLimitThrottleThreshold     float64 // Usage threshold to start throttling backfill (0.0-1.0)
 	RateLimitCircuitRecoveryCount  int     // Successful requests before circuit closes
+
+	// Backfill configuration
+	BackfillSummaryOnly bool // Emit backfill events from list summaries instead of fetching detail
+
+	// Webhook configuration
+	WebhookDedupWindow    time.Duration // How long delivery keys are retained to ignore redelivered webhooks
+	WebhookUpdateDebounce time.Duration // How long activity update webhooks wait so bursts can be coalesced
+
+	// Subscription reconciliation configuration
+	SubscriptionCheckInterval time.Duration // How often webhook subscriptions are checked, 0 = only at startup
+	SubscriptionAutoFix       bool          // Create or replace missing and mismatched subscriptions
+
+	// Gap detection configuration
+	GapDowntimeThreshold time.Duration // Downtime longer than this is synced on startup
+	GapDeliveryThreshold time.Duration // A client receiving no webhooks for this long is synced, 0 = disabled
+	GapSyncLookback      time.Duration // Gap sync also lists activities started this long before the gap
+
+	// Reconciliation configuration
+	ReconcileInterval time.Duration // How often each athlete's recent activities are reconciled, 0 = disabled
+	ReconcileWindow   time.Duration // Activities started within this long are reconciled
+
+	// Client migration configuration
+	ClientMigrationTTL time.Duration // How long links inviting athletes to move to another client are valid
+
+	// Guards settings which can change on reload
+	mu sync.RWMutex
+
+	// Resolved value of each setting, for detecting changes on reload
+	settings map[string]string
 }
 
-// Load reads configuration from environment variables
-// It fails fast if required variables are missing
+// Load reads configuration from environment variables and the optional
+// config file named by CONFIG_FILE, with environment variables taking
+// precedence. It fails fast with a ValidationError listing every missing or
+// invalid setting.
 func Load() (*Config, error) {
+	src, err := newSource(os.Getenv("CONFIG_FILE"))
+	if err != nil {
+		return nil, err
+	}
+
 	cfg := &Config{
+		File: src.path,
+
 		// Optional values with defaults
-		Host:         getEnv("HOST", "127.0.0.1"),
-		Port:         getEnvInt("PORT", 4101),
-		DatabasePath: getEnv("DATABASE_PATH", "./data.db"),
-		LogLevel:     getEnv("LOG_LEVEL", "info"),
+		Host:         src.string("HOST", "127.0.0.1"),
+		Port:         src.int("PORT", 4101),
+		DatabasePath: src.string("DATABASE_PATH", "./data.db"),
+		LogLevel:     src.string("LOG_LEVEL", "info"),
 
 		// Metrics defaults
-		MetricsEnabled: getEnvBool("METRICS_ENABLED", true),
-		MetricsHost:    getEnv("METRICS_HOST", "127.0.0.1"),
-		MetricsPort:    getEnvInt("METRICS_PORT", 4102),
+		MetricsEnabled: src.bool("METRICS_ENABLED", true),
+		MetricsHost:    src.string("METRICS_HOST", "127.0.0.1"),
+		MetricsPort:    src.int("METRICS_PORT", 4102),
 
 		// Rate limiting defaults
-		RateLimitWebhookReservePercent: getEnvFloat("RATE_LIMIT_WEBHOOK_RESERVE_PCT", 0.20),
-		RateLimitThrottleThreshold:     getEnvFloat("RATE_LIMIT_THROTTLE_THRESHOLD", 0.70),
-		RateLimitCircuitRecoveryCount:  getEnvInt("RATE_LIMIT_CIRCUIT_RECOVERY_COUNT", 3),
+		RateLimitWebhookReservePercent: src.float("RATE_LIMIT_WEBHOOK_RESERVE_PCT", 0.20),
+		RateLimitThrottleThreshold:     src.float("RATE_LIMIT_THROTTLE_THRESHOLD", 0.70),
+		RateLimitCircuitRecoveryCount:  src.int("RATE_LIMIT_CIRCUIT_RECOVERY_COUNT", 3),
 
-		// Initialize Strava clients map
-		StravaClients: make(map[string]*StravaClientConfig),
-	}
+		// Backfill defaults
+		BackfillSummaryOnly: src.bool("BACKFILL_SUMMARY_ONLY", false),
 
-	// Required values
-	var missingVars []string
+		// Webhook defaults
+		WebhookDedupWindow:    src.duration("WEBHOOK_DEDUP_WINDOW", 24*time.Hour),
+		WebhookUpdateDebounce: src.duration("WEBHOOK_UPDATE_DEBOUNCE", 10*time.Second),
 
-	domain := os.Getenv("DOMAIN")
-	if domain == "" {
-		missingVars = append(missingVars, "DOMAIN")
-	}
-	cfg.Domain = domain
+		// Subscription reconciliation defaults
+		SubscriptionCheckInterval: src.duration("SUBSCRIPTION_CHECK_INTERVAL", 1*time.Hour),
+		SubscriptionAutoFix:       src.bool("SUBSCRIPTION_AUTO_FIX", false),
 
-	// Load primary client
-	primaryClientID := os.Getenv("STRAVA_PRIMARY_CLIENT_ID")
-	if primaryClientID == "" {
-		missingVars = append(missingVars, "STRAVA_PRIMARY_CLIENT_ID")
-	}
-	primaryClientSecret := os.Getenv("STRAVA_PRIMARY_CLIENT_SECRET")
-	if primaryClientSecret == "" {
-		missingVars = append(missingVars, "STRAVA_PRIMARY_CLIENT_SECRET")
-	}
-	primaryVerifyToken := os.Getenv("STRAVA_PRIMARY_VERIFY_TOKEN")
-	if primaryVerifyToken == "" {
-		missingVars = append(missingVars, "STRAVA_PRIMARY_VERIFY_TOKEN")
-	}
+		// Gap detection defaults
+		GapDowntimeThreshold: src.duration("GAP_DOWNTIME_THRESHOLD", 5*time.Minute),
+		GapDeliveryThreshold: src.duration("GAP_DELIVERY_THRESHOLD", 24*time.Hour),
+		GapSyncLookback:      src.duration("GAP_SYNC_LOOKBACK", 7*24*time.Hour),
 
-	// Load secondary client (optional)
-	secondaryClientID := os.Getenv("STRAVA_SECONDARY_CLIENT_ID")
-	secondaryClientSecret := os.Getenv("STRAVA_SECONDARY_CLIENT_SECRET")
-	secondaryVerifyToken := os.Getenv("STRAVA_SECONDARY_VERIFY_TOKEN")
+		// Reconciliation defaults
+		ReconcileInterval: src.duration("RECONCILE_INTERVAL", 24*time.Hour),
+		ReconcileWindow:   src.duration("RECONCILE_WINDOW", 30*24*time.Hour),
 
-	// Check if any secondary variable is set
-	hasAnySecondary := secondaryClientID != "" || secondaryClientSecret != "" || secondaryVerifyToken != ""
+		// Client migration defaults
+		ClientMigrationTTL: src.duration("CLIENT_MIGRATION_TTL", 14*24*time.Hour),
 
-	cfg.InternalAPIKey = os.Getenv("INTERNAL_API_KEY")
-	if cfg.InternalAPIKey == "" {
-		missingVars = append(missingVars, "INTERNAL_API_KEY")
-	}
+		// OAuth flow defaults
+		PlantopoUserSecret:     src.secret("PLANTOPO_USER_SECRET", false),
+		OAuthReturnToAllowlist: src.list("OAUTH_RETURN_TO_ALLOWLIST", ""),
 
-	// If any secondary variable is set, all must be set
-	if hasAnySecondary {
-		if secondaryClientID == "" {
-			missingVars = append(missingVars, "STRAVA_SECONDARY_CLIENT_ID")
-		}
-		if secondaryClientSecret == "" {
-			missingVars = append(missingVars, "STRAVA_SECONDARY_CLIENT_SECRET")
-		}
-		if secondaryVerifyToken == "" {
-			missingVars = append(missingVars, "STRAVA_SECONDARY_VERIFY_TOKEN")
-		}
+		// Initialize Strava clients map
+		StravaClients: make(map[string]*StravaClientConfig),
 	}
 
-	if len(missingVars) > 0 {
-		return nil, fmt.Errorf("missing required environment variables: %v", missingVars)
+	// Required values
+	cfg.Domain = src.required("DOMAIN")
+
+	// Several keys can be given, separated by commas or newlines, so clients
+	// can move to a new key before the old one is removed
+	cfg.InternalAPIKeys = strings.FieldsFunc(src.secret("INTERNAL_API_KEY", true), func(r rune) bool {
+		return r == ',' || r == '\n' || r == ' ' || r == '\t' || r == '\r'
+	})
+	if len(cfg.InternalAPIKeys) > 0 {
+		cfg.InternalAPIKey = cfg.InternalAPIKeys[0]
 	}
 
-	// Populate Strava clients map
-	cfg.StravaClients["primary"] = &StravaClientConfig{
-		ClientID:     primaryClientID,
-		ClientSecret: primaryClientSecret,
-		VerifyToken:  primaryVerifyToken,
+	// Clients are named by STRAVA_CLIENTS. Without it the primary client is
+	// required and the secondary client is added if any of its variables are set.
+	clientNames := src.list("STRAVA_CLIENTS", "")
+	if clientNames == nil {
+		clientNames = []string{"primary"}
+		if src.string("STRAVA_SECONDARY_CLIENT_ID", "") != "" || src.secret("STRAVA_SECONDARY_CLIENT_SECRET", false) != "" || src.secret("STRAVA_SECONDARY_VERIFY_TOKEN", false) != "" {
+			clientNames = append(clientNames, "secondary")
+		}
 	}
 
-	// Only add secondary client if all variables are present
-	if hasAnySecondary && secondaryClientID != "" && secondaryClientSecret != "" && secondaryVerifyToken != "" {
-		cfg.StravaClients["secondary"] = &StravaClientConfig{
-			ClientID:     secondaryClientID,
-			ClientSecret: secondaryClientSecret,
-			VerifyToken:  secondaryVerifyToken,
+	for _, name := range clientNames {
+		if !clientNamePattern.MatchString(name) {
+			src.invalid("STRAVA_CLIENTS", "invalid client name %q, must be lowercase letters, digits and underscores", name)
+			continue
+		}
+		if cfg.HasClient(name) {
+			src.invalid("STRAVA_CLIENTS", "duplicate client name %q", name)
+			continue
 		}
+		cfg.StravaClients[name] = loadClient(src, name)
+		cfg.ClientOrder = append(cfg.ClientOrder, name)
 	}
 
-	return cfg, nil
-}
+	cfg.validate(src)
+	src.checkUnknown()
 
-// getEnv gets an environment variable or returns a default value
-func getEnv(key, defaultValue string) string {
-	value := os.Getenv(key)
-	if value == "" {
-		return defaultValue
+	if err := src.err(); err != nil {
+		return nil, err
 	}
-	return value
+
+	cfg.settings = src.values
+	return cfg, nil
 }
 
-// getEnvInt gets an integer environment variable or returns a default value
-func getEnvInt(key string, defaultValue int) int {
-	valueStr := os.Getenv(key)
-	if valueStr == "" {
-		return defaultValue
+// validate records settings which are out of range or conflict
+func (c *Config) validate(src *source) {
+	if !slices.Contains(logLevels, c.LogLevel) {
+		src.invalid("LOG_LEVEL", "must be one of %s", strings.Join(logLevels, ", "))
 	}
 
-	value, err := strconv.Atoi(valueStr)
-	if err != nil {
-		return defaultValue
+	src.check(c.Port > 0 && c.Port <= 65535, "PORT", "must be between 1 and 65535")
+	if c.MetricsEnabled {
+		src.check(c.MetricsPort > 0 && c.MetricsPort <= 65535, "METRICS_PORT", "must be between 1 and 65535")
+		src.check(c.MetricsPort != c.Port, "METRICS_PORT", "must differ from PORT (%d)", c.Port)
 	}
 
-	return value
-}
-
-// getEnvBool gets a boolean environment variable or returns a default value
-func getEnvBool(key string, defaultValue bool) bool {
-	valueStr := os.Getenv(key)
-	if valueStr == "" {
-		return defaultValue
+	src.check(c.RateLimitWebhookReservePercent >= 0 && c.RateLimitWebhookReservePercent < 1, "RATE_LIMIT_WEBHOOK_RESERVE_PCT", "must be at least 0 and less than 1")
+	src.check(c.RateLimitThrottleThreshold > 0 && c.RateLimitThrottleThreshold <= 1, "RATE_LIMIT_THROTTLE_THRESHOLD", "must be greater than 0 and at most 1")
+	src.check(c.RateLimitCircuitRecoveryCount >= 1, "RATE_LIMIT_CIRCUIT_RECOVERY_COUNT", "must be at least 1")
+
+	for key, value := range map[string]time.Duration{
+		"WEBHOOK_DEDUP_WINDOW":        c.WebhookDedupWindow,
+		"WEBHOOK_UPDATE_DEBOUNCE":     c.WebhookUpdateDebounce,
+		"SUBSCRIPTION_CHECK_INTERVAL": c.SubscriptionCheckInterval,
+		"GAP_DOWNTIME_THRESHOLD":      c.GapDowntimeThreshold,
+		"GAP_DELIVERY_THRESHOLD":      c.GapDeliveryThreshold,
+		"GAP_SYNC_LOOKBACK":           c.GapSyncLookback,
+		"RECONCILE_INTERVAL":          c.ReconcileInterval,
+		"RECONCILE_WINDOW":            c.ReconcileWindow,
+	} {
+		src.check(value >= 0, key, "must not be negative")
 	}
-
-	value, err := strconv.ParseBool(valueStr)
-	if err != nil {
-		return defaultValue
+	src.check(c.ClientMigrationTTL > 0, "CLIENT_MIGRATION_TTL", "must be positive")
+
+	for _, name := range c.ClientOrder {
+		client := c.StravaClients[name]
+		prefix := clientPrefix(name)
+		src.check(client.BackfillMaxAgeDays >= 0, prefix+"BACKFILL_MAX_AGE_DAYS", "must not be negative")
+		src.check(client.BackfillMaxActivities >= 0, prefix+"BACKFILL_MAX_ACTIVITIES", "must not be negative")
+		src.check(client.Weight >= 0, prefix+"WEIGHT", "must not be negative")
+		src.check(slices.Contains(client.Scopes, "activity:read") || slices.Contains(client.Scopes, "activity:read_all"),
+			prefix+"SCOPES", "must include activity:read or activity:read_all")
 	}
-
-	return value
 }
 
-// getEnvFloat gets a float environment variable or returns a default value
-func getEnvFloat(key string, defaultValue float64) float64 {
-	valueStr := os.Getenv(key)
-	if valueStr == "" {
-		return defaultValue
-	}
+// clientPrefix returns the prefix of a client's settings
+func clientPrefix(name string) string {
+	return "STRAVA_" + strings.ToUpper(name) + "_"
+}
 
-	value, err := strconv.ParseFloat(valueStr, 64)
-	if err != nil {
-		return defaultValue
+// loadClient reads the configuration of a named Strava client
+func loadClient(src *source, name string) *StravaClientConfig {
+	prefix := clientPrefix(name)
+
+	return &StravaClientConfig{
+		ClientID:              src.required(prefix + "CLIENT_ID"),
+		ClientSecret:          src.secret(prefix+"CLIENT_SECRET", true),
+		VerifyToken:           src.secret(prefix+"VERIFY_TOKEN", true),
+		BackfillMaxAgeDays:    src.int(prefix+"BACKFILL_MAX_AGE_DAYS", 0),
+		BackfillMaxActivities: src.int(prefix+"BACKFILL_MAX_ACTIVITIES", 0),
+		Scopes:                src.list(prefix+"SCOPES", defaultScopes),
+		PKCE:                  src.bool(prefix+"PKCE", false),
+		Weight:                src.int(prefix+"WEIGHT", 1),
+		Disabled:              !src.bool(prefix+"ENABLED", true),
 	}
-
-	return value
 }
 
-// GetClient returns the Strava client configuration for the given client ID
+// GetClient returns a copy of the Strava client configuration for the given
+// client ID, as its secrets can change on reload
 func (c *Config) GetClient(clientID string) (*StravaClientConfig, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
 	client, exists := c.StravaClients[clientID]
 	if !exists {
 		return nil, fmt.Errorf("unknown client ID: %s", clientID)
 	}
-	return client, nil
+	clientCopy := *client
+	return &clientCopy, nil
+}
+
+// IsInternalAPIKey returns true if key is one of the accepted internal API
+// keys, comparing in constant time
+func (c *Config) IsInternalAPIKey(key string) bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	valid := 0
+	for _, accepted := range c.InternalAPIKeys {
+		if accepted != "" {
+			valid |= subtle.ConstantTimeCompare([]byte(key), []byte(accepted))
+		}
+	}
+	return valid == 1
 }
 
 // HasClient returns true if the given client ID is configured
@@ -210,16 +323,77 @@ func (c *Config) HasClient(clientID string) bool {
 	return exists
 }
 
-// GetDefaultClientID returns the default client ID ("primary")
+// WebhookCallbackURL returns the callback URL Strava should deliver the client's webhooks to
+func (c *Config) WebhookCallbackURL(clientID string) string {
+	return fmt.Sprintf("https://%s/webhook-callback/%s", c.Domain, clientID)
+}
+
+// GetDefaultClientID returns the default client ID, the first configured
+// client or "primary"
 func (c *Config) GetDefaultClientID() string {
+	if len(c.ClientOrder) > 0 {
+		return c.ClientOrder[0]
+	}
 	return "primary"
 }
 
-// GetClientIDs returns a list of all configured client IDs
+// GetClientIDs returns a list of all configured client IDs in configured order
 func (c *Config) GetClientIDs() []string {
 	ids := make([]string, 0, len(c.StravaClients))
+	for _, id := range c.ClientOrder {
+		if c.HasClient(id) {
+			ids = append(ids, id)
+		}
+	}
+	var others []string
 	for id := range c.StravaClients {
-		ids = append(ids, id)
+		if !slices.Contains(ids, id) {
+			others = append(others, id)
+		}
+	}
+	slices.Sort(others)
+	return append(ids, others...)
+}
+
+// AssignClient picks the client a new athlete connects through when none is
+// requested, choosing among enabled clients in proportion to their weights
+// Returns ErrNoClientAvailable if every client is disabled
+func (c *Config) AssignClient() (string, error) {
+	return c.assignClient(rand.IntN)
+}
+
+// assignClient picks a client using pick, which returns a number in [0, n)
+func (c *Config) assignClient(pick func(n int) int) (string, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	var enabled []string
+	total := 0
+	for _, id := range c.GetClientIDs() {
+		if client := c.StravaClients[id]; !client.Disabled {
+			enabled = append(enabled, id)
+			total += client.Weight
+		}
+	}
+
+	if len(enabled) == 0 {
+		return "", ErrNoClientAvailable
+	}
+
+	// Without weights every athlete goes to the default client, or the first
+	// enabled client if the default is disabled
+	if total == 0 {
+		if defaultID := c.GetDefaultClientID(); slices.Contains(enabled, defaultID) {
+			return defaultID, nil
+		}
+		return enabled[0], nil
+	}
+
+	n := pick(total)
+	for _, id := range enabled {
+		if n -= c.StravaClients[id].Weight; n < 0 {
+			return id, nil
+		}
 	}
-	return ids
+	return enabled[len(enabled)-1], nil
 }
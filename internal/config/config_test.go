@@ -1,7 +1,10 @@
 package config
 
 import (
+	"errors"
 	"os"
+	"slices"
+	"strings"
 	"testing"
 )
 
@@ -161,14 +164,396 @@ func TestLoad(t *testing.T) {
 		os.Setenv("INTERNAL_API_KEY", "test_api_key")
 		os.Setenv("PORT", "not_a_number")
 
+		// Invalid values are rejected rather than replaced by the default
+		_, err := Load()
+		var validationErr *ValidationError
+		if !errors.As(err, &validationErr) {
+			t.Fatalf("Expected ValidationError, got %v", err)
+		}
+		if !slices.Equal(validationErr.Problems, []string{`PORT: invalid integer "not_a_number"`}) {
+			t.Errorf("Expected invalid PORT problem, got %v", validationErr.Problems)
+		}
+	})
+
+	t.Run("Validation", func(t *testing.T) {
+		os.Clearenv()
+		os.Setenv("DOMAIN", "example.com")
+		os.Setenv("STRAVA_PRIMARY_CLIENT_ID", "test_client_id")
+		os.Setenv("STRAVA_PRIMARY_CLIENT_SECRET", "test_client_secret")
+		os.Setenv("STRAVA_PRIMARY_VERIFY_TOKEN", "test_verify_token")
+		os.Setenv("INTERNAL_API_KEY", "test_api_key")
+		os.Setenv("PORT", "4102")
+		os.Setenv("RATE_LIMIT_THROTTLE_THRESHOLD", "70")
+		os.Setenv("LOG_LEVEL", "verbose")
+		os.Setenv("STRAVA_PRIMARY_WEIGHT", "-1")
+
+		_, err := Load()
+		var validationErr *ValidationError
+		if !errors.As(err, &validationErr) {
+			t.Fatalf("Expected ValidationError, got %v", err)
+		}
+		expected := []string{
+			"LOG_LEVEL: must be one of debug, info, warn, error",
+			"METRICS_PORT: must differ from PORT (4102)",
+			"RATE_LIMIT_THROTTLE_THRESHOLD: must be greater than 0 and at most 1",
+			"STRAVA_PRIMARY_WEIGHT: must not be negative",
+		}
+		if !slices.Equal(validationErr.Problems, expected) {
+			t.Errorf("Expected problems %v, got %v", expected, validationErr.Problems)
+		}
+
+		// The ports only conflict if the metrics server is enabled
+		os.Setenv("RATE_LIMIT_THROTTLE_THRESHOLD", "0.7")
+		os.Setenv("LOG_LEVEL", "warn")
+		os.Setenv("STRAVA_PRIMARY_WEIGHT", "0")
+		os.Setenv("METRICS_ENABLED", "false")
+		if _, err := Load(); err != nil {
+			t.Errorf("Expected no error, got %v", err)
+		}
+	})
+
+	t.Run("ConfigFile", func(t *testing.T) {
+		os.Clearenv()
+		path := t.TempDir() + "/config.yaml"
+		os.Setenv("CONFIG_FILE", path)
+		os.Setenv("PORT", "8080")
+		writeFile(t, path, `
+domain: example.com
+internal_api_key: test_api_key
+port: 9000
+log_level: debug
+rate_limit:
+  throttle_threshold: 0.8
+strava:
+  clients: [eu, beta]
+  eu:
+    client_id: 12345
+    client_secret: eu_secret
+    verify_token: eu_token
+    scopes: [read, activity:read]
+  beta:
+    client_id: 67890
+    client_secret: beta_secret
+    verify_token: beta_token
+    enabled: false
+`)
+
 		cfg, err := Load()
 		if err != nil {
 			t.Fatalf("Expected no error, got %v", err)
 		}
+		if cfg.File != path {
+			t.Errorf("Expected File=%s, got %s", path, cfg.File)
+		}
+		if cfg.Domain != "example.com" || cfg.LogLevel != "debug" || cfg.RateLimitThrottleThreshold != 0.8 {
+			t.Errorf("Expected settings from file, got domain=%s log_level=%s throttle=%v", cfg.Domain, cfg.LogLevel, cfg.RateLimitThrottleThreshold)
+		}
 
-		// Should fall back to default
-		if cfg.Port != 4101 {
-			t.Errorf("Expected Port to fallback to 4101, got %d", cfg.Port)
+		// Environment variables override the file
+		if cfg.Port != 8080 {
+			t.Errorf("Expected Port=8080 from environment, got %d", cfg.Port)
+		}
+
+		if ids := cfg.GetClientIDs(); !slices.Equal(ids, []string{"eu", "beta"}) {
+			t.Errorf("Expected clients [eu beta], got %v", ids)
+		}
+		eu := cfg.StravaClients["eu"]
+		if eu.ClientID != "12345" || !slices.Equal(eu.Scopes, []string{"read", "activity:read"}) {
+			t.Errorf("Expected eu client from file, got %+v", eu)
+		}
+		if !cfg.StravaClients["beta"].Disabled {
+			t.Error("Expected beta client to be disabled")
+		}
+
+		// Misspelt settings are rejected
+		writeFile(t, path, `
+domain: example.com
+internal_api_key: test_api_key
+rate_limit:
+  throtle_threshold: 0.8
+strava:
+  primary: {client_id: "1", client_secret: secret, verify_token: token}
+`)
+		_, err = Load()
+		var validationErr *ValidationError
+		if !errors.As(err, &validationErr) {
+			t.Fatalf("Expected ValidationError, got %v", err)
+		}
+		if expected := "RATE_LIMIT_THROTLE_THRESHOLD: unknown setting in " + path; !slices.Equal(validationErr.Problems, []string{expected}) {
+			t.Errorf("Expected problems [%s], got %v", expected, validationErr.Problems)
+		}
+
+		// As are files which aren't YAML
+		writeFile(t, path, "domain = \"example.com\"\n")
+		if _, err := Load(); err == nil {
+			t.Error("Expected error for invalid YAML, got nil")
+		}
+		os.Setenv("CONFIG_FILE", t.TempDir()+"/config.toml")
+		if _, err := Load(); err == nil {
+			t.Error("Expected error for unsupported format, got nil")
+		}
+	})
+
+	t.Run("ClientScopes", func(t *testing.T) {
+		os.Clearenv()
+		os.Setenv("DOMAIN", "example.com")
+		os.Setenv("STRAVA_PRIMARY_CLIENT_ID", "test_client_id")
+		os.Setenv("STRAVA_PRIMARY_CLIENT_SECRET", "test_client_secret")
+		os.Setenv("STRAVA_PRIMARY_VERIFY_TOKEN", "test_verify_token")
+		os.Setenv("INTERNAL_API_KEY", "test_api_key")
+
+		cfg, err := Load()
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		if scopes := cfg.StravaClients["primary"].Scopes; !slices.Equal(scopes, []string{"activity:read_all"}) {
+			t.Errorf("Expected default scopes [activity:read_all], got %v", scopes)
+		}
+
+		os.Setenv("STRAVA_PRIMARY_SCOPES", "read, activity:read")
+		cfg, err = Load()
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		if scopes := cfg.StravaClients["primary"].Scopes; !slices.Equal(scopes, []string{"read", "activity:read"}) {
+			t.Errorf("Expected scopes [read activity:read], got %v", scopes)
+		}
+
+		// Scopes without activity access are rejected
+		os.Setenv("STRAVA_PRIMARY_SCOPES", "read,profile:read_all")
+		if _, err := Load(); err == nil {
+			t.Fatal("Expected error for scopes without activity access, got nil")
 		}
 	})
+	t.Run("NamedClients", func(t *testing.T) {
+		os.Clearenv()
+		os.Setenv("DOMAIN", "example.com")
+		os.Setenv("INTERNAL_API_KEY", "test_api_key")
+		os.Setenv("STRAVA_CLIENTS", "eu, beta")
+		for _, prefix := range []string{"STRAVA_EU_", "STRAVA_BETA_"} {
+			os.Setenv(prefix+"CLIENT_ID", prefix+"id")
+			os.Setenv(prefix+"CLIENT_SECRET", prefix+"secret")
+			os.Setenv(prefix+"VERIFY_TOKEN", prefix+"token")
+		}
+		os.Setenv("STRAVA_BETA_WEIGHT", "3")
+		os.Setenv("STRAVA_BETA_ENABLED", "false")
+
+		cfg, err := Load()
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		if ids := cfg.GetClientIDs(); !slices.Equal(ids, []string{"eu", "beta"}) {
+			t.Errorf("Expected clients [eu beta], got %v", ids)
+		}
+		if id := cfg.GetDefaultClientID(); id != "eu" {
+			t.Errorf("Expected default client eu, got %s", id)
+		}
+		if client := cfg.StravaClients["eu"]; client.Weight != 1 || client.Disabled {
+			t.Errorf("Expected eu client enabled with weight 1, got %+v", client)
+		}
+		if client := cfg.StravaClients["beta"]; client.ClientID != "STRAVA_BETA_id" || client.Weight != 3 || !client.Disabled {
+			t.Errorf("Expected beta client disabled with weight 3, got %+v", client)
+		}
+
+		// Each listed client must be fully configured
+		os.Setenv("STRAVA_CLIENTS", "eu,beta,us")
+		if _, err := Load(); err == nil {
+			t.Fatal("Expected error for unconfigured client, got nil")
+		}
+
+		for _, names := range []string{"eu,eu", "EU", "eu-west"} {
+			os.Setenv("STRAVA_CLIENTS", names)
+			if _, err := Load(); err == nil {
+				t.Errorf("Expected error for STRAVA_CLIENTS=%s, got nil", names)
+			}
+		}
+	})
+
+	t.Run("SecondaryClient", func(t *testing.T) {
+		os.Clearenv()
+		os.Setenv("DOMAIN", "example.com")
+		os.Setenv("INTERNAL_API_KEY", "test_api_key")
+		os.Setenv("STRAVA_PRIMARY_CLIENT_ID", "test_client_id")
+		os.Setenv("STRAVA_PRIMARY_CLIENT_SECRET", "test_client_secret")
+		os.Setenv("STRAVA_PRIMARY_VERIFY_TOKEN", "test_verify_token")
+		os.Setenv("STRAVA_SECONDARY_CLIENT_ID", "secondary_client_id")
+
+		// Any secondary variable requires all of them
+		if _, err := Load(); err == nil {
+			t.Fatal("Expected error for partial secondary client, got nil")
+		}
+
+		os.Setenv("STRAVA_SECONDARY_CLIENT_SECRET", "secondary_client_secret")
+		os.Setenv("STRAVA_SECONDARY_VERIFY_TOKEN", "secondary_verify_token")
+		cfg, err := Load()
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		if ids := cfg.GetClientIDs(); !slices.Equal(ids, []string{"primary", "secondary"}) {
+			t.Errorf("Expected clients [primary secondary], got %v", ids)
+		}
+	})
+}
+
+func TestAssignClient(t *testing.T) {
+	cfg := &Config{
+		StravaClients: map[string]*StravaClientConfig{
+			"primary": {Weight: 1},
+			"eu":      {Weight: 3},
+			"beta":    {Weight: 0},
+		},
+		ClientOrder: []string{"primary", "eu", "beta"},
+	}
+
+	// Clients take a share of the weighted range in configured order
+	counts := make(map[string]int)
+	for n := 0; n < 4; n++ {
+		id, err := cfg.assignClient(func(int) int { return n })
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		counts[id]++
+	}
+	if counts["primary"] != 1 || counts["eu"] != 3 || counts["beta"] != 0 {
+		t.Errorf("Expected assignments primary=1 eu=3 beta=0, got %v", counts)
+	}
+
+	// Without weights the default client is used while it's enabled
+	cfg.StravaClients["eu"].Disabled = true
+	cfg.StravaClients["primary"].Weight = 0
+	if id, _ := cfg.AssignClient(); id != "primary" {
+		t.Errorf("Expected primary, got %s", id)
+	}
+	cfg.StravaClients["primary"].Disabled = true
+	if id, _ := cfg.AssignClient(); id != "beta" {
+		t.Errorf("Expected beta, got %s", id)
+	}
+
+	cfg.StravaClients["beta"].Disabled = true
+	if _, err := cfg.AssignClient(); !errors.Is(err, ErrNoClientAvailable) {
+		t.Errorf("Expected ErrNoClientAvailable, got %v", err)
+	}
+}
+
+func TestReload(t *testing.T) {
+	t.Setenv("DOMAIN", "example.com")
+	t.Setenv("INTERNAL_API_KEY", "test_api_key")
+	t.Setenv("STRAVA_PRIMARY_CLIENT_ID", "test_client_id")
+	t.Setenv("STRAVA_PRIMARY_CLIENT_SECRET", "test_client_secret")
+	t.Setenv("STRAVA_PRIMARY_VERIFY_TOKEN", "test_verify_token")
+
+	cfg, err := Load()
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	client, _ := cfg.GetClient("primary")
+
+	t.Setenv("LOG_LEVEL", "debug")
+	t.Setenv("RATE_LIMIT_THROTTLE_THRESHOLD", "0.5")
+	t.Setenv("STRAVA_PRIMARY_CLIENT_SECRET", "rotated_secret")
+	t.Setenv("STRAVA_PRIMARY_ENABLED", "false")
+	t.Setenv("PORT", "8080")
+	next, err := Load()
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	applied, needRestart := cfg.Reload(next)
+	expectedApplied := []string{"LOG_LEVEL", "RATE_LIMIT_THROTTLE_THRESHOLD", "STRAVA_PRIMARY_CLIENT_SECRET", "STRAVA_PRIMARY_ENABLED"}
+	if !slices.Equal(applied, expectedApplied) {
+		t.Errorf("Expected applied %v, got %v", expectedApplied, applied)
+	}
+	if !slices.Equal(needRestart, []string{"PORT"}) {
+		t.Errorf("Expected [PORT] to need restart, got %v", needRestart)
+	}
+
+	if level := cfg.GetLogLevel(); level != "debug" {
+		t.Errorf("Expected log level debug, got %s", level)
+	}
+	if _, threshold, _ := cfg.RateLimitSettings(); threshold != 0.5 {
+		t.Errorf("Expected throttle threshold 0.5, got %v", threshold)
+	}
+	if cfg.Port != 4101 {
+		t.Errorf("Expected Port to stay 4101 until restart, got %d", cfg.Port)
+	}
+
+	reloaded, _ := cfg.GetClient("primary")
+	if reloaded.ClientSecret != "rotated_secret" || !reloaded.Disabled {
+		t.Errorf("Expected rotated secret and disabled client, got %+v", reloaded)
+	}
+	if client.ClientSecret != "test_client_secret" {
+		t.Error("Expected client copies returned before reload to be unchanged")
+	}
+
+	// Reloading the same configuration again changes nothing, but settings
+	// needing a restart are still reported
+	applied, needRestart = cfg.Reload(next)
+	if len(applied) != 0 || !slices.Equal(needRestart, []string{"PORT"}) {
+		t.Errorf("Expected only PORT to differ, got applied %v and restart %v", applied, needRestart)
+	}
+}
+
+func TestSecretFiles(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, dir+"/api_keys", "new_key\nold_key\n")
+	writeFile(t, dir+"/client_secret", "file_client_secret\n")
+	writeFile(t, dir+"/verify_token", "file_verify_token")
+
+	t.Setenv("DOMAIN", "example.com")
+	t.Setenv("INTERNAL_API_KEY_FILE", dir+"/api_keys")
+	t.Setenv("STRAVA_PRIMARY_CLIENT_ID", "test_client_id")
+	t.Setenv("STRAVA_PRIMARY_CLIENT_SECRET_FILE", dir+"/client_secret")
+	t.Setenv("STRAVA_PRIMARY_VERIFY_TOKEN_FILE", dir+"/verify_token")
+
+	cfg, err := Load()
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	client := cfg.StravaClients["primary"]
+	if client.ClientSecret != "file_client_secret" || client.VerifyToken != "file_verify_token" {
+		t.Errorf("Expected secrets read from files, got %+v", client)
+	}
+	if cfg.InternalAPIKey != "new_key" || !slices.Equal(cfg.InternalAPIKeys, []string{"new_key", "old_key"}) {
+		t.Errorf("Expected keys [new_key old_key], got %s %v", cfg.InternalAPIKey, cfg.InternalAPIKeys)
+	}
+	for key, valid := range map[string]bool{"new_key": true, "old_key": true, "other_key": false, "": false, "new_key\nold_key": false} {
+		if cfg.IsInternalAPIKey(key) != valid {
+			t.Errorf("Expected IsInternalAPIKey(%q)=%v", key, valid)
+		}
+	}
+
+	// Rotating the file and reloading retires the old key
+	writeFile(t, dir+"/api_keys", "new_key\n")
+	next, err := Load()
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if applied, _ := cfg.Reload(next); !slices.Equal(applied, []string{"INTERNAL_API_KEY"}) {
+		t.Errorf("Expected INTERNAL_API_KEY to be applied, got %v", applied)
+	}
+	if cfg.IsInternalAPIKey("old_key") {
+		t.Error("Expected old_key to be rejected after reload")
+	}
+
+	// A secret can't be set both ways, and its file must be readable
+	t.Setenv("STRAVA_PRIMARY_CLIENT_SECRET", "env_client_secret")
+	t.Setenv("STRAVA_PRIMARY_VERIFY_TOKEN_FILE", dir+"/missing")
+	_, err = Load()
+	var validationErr *ValidationError
+	if !errors.As(err, &validationErr) {
+		t.Fatalf("Expected ValidationError, got %v", err)
+	}
+	if len(validationErr.Problems) != 2 ||
+		validationErr.Problems[0] != "STRAVA_PRIMARY_CLIENT_SECRET: set only one of STRAVA_PRIMARY_CLIENT_SECRET and STRAVA_PRIMARY_CLIENT_SECRET_FILE" ||
+		!strings.HasPrefix(validationErr.Problems[1], "STRAVA_PRIMARY_VERIFY_TOKEN_FILE: failed to read secret") {
+		t.Errorf("Expected conflicting and unreadable secret problems, got %v", validationErr.Problems)
+	}
+}
+
+func writeFile(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatalf("Failed to write %s: %v", path, err)
+	}
 }
@@ -0,0 +1,106 @@
+package config
+
+import (
+	"slices"
+	"strings"
+)
+
+// reloadableSettings can be changed by Reload without restarting
+var reloadableSettings = []string{
+	"INTERNAL_API_KEY",
+	"LOG_LEVEL",
+	"RATE_LIMIT_WEBHOOK_RESERVE_PCT",
+	"RATE_LIMIT_THROTTLE_THRESHOLD",
+	"RATE_LIMIT_CIRCUIT_RECOVERY_COUNT",
+}
+
+// reloadableClientSettings can be changed by Reload for each existing client
+var reloadableClientSettings = []string{
+	"CLIENT_SECRET",
+	"VERIFY_TOKEN",
+	"WEIGHT",
+	"ENABLED",
+}
+
+// isReloadable returns true if a setting can be changed without restarting
+func (c *Config) isReloadable(key string) bool {
+	key = strings.TrimSuffix(key, "_FILE")
+	if slices.Contains(reloadableSettings, key) {
+		return true
+	}
+	for name := range c.StravaClients {
+		if suffix, ok := strings.CutPrefix(key, clientPrefix(name)); ok && slices.Contains(reloadableClientSettings, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// Reload applies the settings of next, a freshly loaded configuration, which
+// can be changed while running: the internal API keys, log level, rate
+// limiting thresholds and each client's secrets, weight and enabled state.
+// It returns the names of the changed settings which were applied and of
+// those which need a restart.
+func (c *Config) Reload(next *Config) (applied, needRestart []string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for key, value := range next.settings {
+		if c.settings[key] == value {
+			continue
+		}
+		if c.isReloadable(key) {
+			applied = append(applied, key)
+		} else {
+			needRestart = append(needRestart, key)
+		}
+	}
+	for key := range c.settings {
+		if _, ok := next.settings[key]; !ok {
+			needRestart = append(needRestart, key)
+		}
+	}
+	slices.Sort(applied)
+	slices.Sort(needRestart)
+
+	for _, key := range applied {
+		c.settings[key] = next.settings[key]
+	}
+
+	c.InternalAPIKey = next.InternalAPIKey
+	c.InternalAPIKeys = next.InternalAPIKeys
+	c.LogLevel = next.LogLevel
+	c.RateLimitWebhookReservePercent = next.RateLimitWebhookReservePercent
+	c.RateLimitThrottleThreshold = next.RateLimitThrottleThreshold
+	c.RateLimitCircuitRecoveryCount = next.RateLimitCircuitRecoveryCount
+
+	for name, client := range c.StravaClients {
+		nextClient, ok := next.StravaClients[name]
+		if !ok {
+			continue
+		}
+		client.ClientSecret = nextClient.ClientSecret
+		client.VerifyToken = nextClient.VerifyToken
+		client.Weight = nextClient.Weight
+		client.Disabled = nextClient.Disabled
+	}
+
+	return applied, needRestart
+}
+
+// RateLimitSettings returns the rate limiting configuration, which can change
+// on reload
+func (c *Config) RateLimitSettings() (webhookReservePercent, throttleThreshold float64, circuitRecoveryCount int) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return c.RateLimitWebhookReservePercent, c.RateLimitThrottleThreshold, c.RateLimitCircuitRecoveryCount
+}
+
+// GetLogLevel returns the configured log level, which can change on reload
+func (c *Config) GetLogLevel() string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return c.LogLevel
+}
@@ -0,0 +1,274 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.yaml.in/yaml/v2"
+)
+
+// ValidationError lists every missing or invalid setting found while loading
+// configuration
+type ValidationError struct {
+	Problems []string // One per setting, e.g. "PORT: invalid integer \"abc\""
+}
+
+func (e *ValidationError) Error() string {
+	return "invalid configuration: " + strings.Join(e.Problems, "; ")
+}
+
+// source resolves settings from environment variables, falling back to the
+// config file, and records the problems found with them
+type source struct {
+	path     string            // Config file, empty if none
+	file     map[string]string // Config file settings by environment variable name
+	values   map[string]string // Resolved value of each setting read
+	problems []string
+}
+
+// newSource reads the config file at path, if any
+//
+// The file is YAML. Nested keys are joined with underscores and upper cased to
+// give the environment variable they set, so rate_limit: {throttle_threshold:
+// 0.8} sets RATE_LIMIT_THROTTLE_THRESHOLD. Lists are joined with commas.
+func newSource(path string) (*source, error) {
+	src := &source{
+		path:   path,
+		file:   make(map[string]string),
+		values: make(map[string]string),
+	}
+	if path == "" {
+		return src, nil
+	}
+
+	switch ext := filepath.Ext(path); ext {
+	case ".yaml", ".yml":
+	default:
+		return nil, fmt.Errorf("unsupported config file format %q: must be .yaml or .yml", ext)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config file: %w", err)
+	}
+
+	var doc map[string]interface{}
+	if err := yaml.UnmarshalStrict(data, &doc); err != nil {
+		return nil, fmt.Errorf("failed to parse config file %s: %w", path, err)
+	}
+
+	for key, value := range doc {
+		if err := flattenSetting(strings.ToUpper(key), value, src.file); err != nil {
+			return nil, fmt.Errorf("invalid config file %s: %w", path, err)
+		}
+	}
+
+	return src, nil
+}
+
+// flattenSetting adds a config file value to settings under its environment
+// variable name
+func flattenSetting(key string, value interface{}, settings map[string]string) error {
+	switch v := value.(type) {
+	case nil:
+		return nil
+
+	case map[interface{}]interface{}:
+		for k, nested := range v {
+			if err := flattenSetting(key+"_"+strings.ToUpper(fmt.Sprint(k)), nested, settings); err != nil {
+				return err
+			}
+		}
+		return nil
+
+	case []interface{}:
+		items := make([]string, 0, len(v))
+		for _, item := range v {
+			switch item.(type) {
+			case map[interface{}]interface{}, []interface{}:
+				return fmt.Errorf("%s: lists may only contain values", key)
+			}
+			items = append(items, fmt.Sprint(item))
+		}
+		value = strings.Join(items, ",")
+	}
+
+	if _, exists := settings[key]; exists {
+		return fmt.Errorf("%s: set more than once", key)
+	}
+	settings[key] = fmt.Sprint(value)
+	return nil
+}
+
+// lookup returns a setting's value, or "" if it isn't set
+func (s *source) lookup(key string) string {
+	value := os.Getenv(key)
+	if value == "" {
+		value = s.file[key]
+	}
+	s.values[key] = value
+	return value
+}
+
+// invalid records a problem with a setting
+func (s *source) invalid(key, format string, args ...interface{}) {
+	s.problems = append(s.problems, key+": "+fmt.Sprintf(format, args...))
+}
+
+// check records a problem with a setting unless ok
+func (s *source) check(ok bool, key, format string, args ...interface{}) {
+	if !ok {
+		s.invalid(key, format, args...)
+	}
+}
+
+// checkUnknown records config file settings which were never read, which are
+// most likely misspelt
+func (s *source) checkUnknown() {
+	var unknown []string
+	for key := range s.file {
+		if _, read := s.values[key]; !read {
+			unknown = append(unknown, key)
+		}
+	}
+	slices.Sort(unknown)
+	for _, key := range unknown {
+		s.invalid(key, "unknown setting in %s", s.path)
+	}
+}
+
+// err returns a ValidationError if any problems were recorded
+func (s *source) err() error {
+	if len(s.problems) == 0 {
+		return nil
+	}
+	return &ValidationError{Problems: s.problems}
+}
+
+// required gets a setting which must be set
+func (s *source) required(key string) string {
+	value := s.lookup(key)
+	if value == "" {
+		s.invalid(key, "required")
+	}
+	return value
+}
+
+// secret gets a setting which may instead be read from the file named by
+// <key>_FILE, such as a mounted Docker or Kubernetes secret, so that it isn't
+// exposed in the process environment. Surrounding whitespace is trimmed from
+// the file's contents.
+func (s *source) secret(key string, required bool) string {
+	value := s.lookup(key)
+	path := s.lookup(key + "_FILE")
+
+	switch {
+	case value != "" && path != "":
+		s.invalid(key, "set only one of %s and %s_FILE", key, key)
+	case path != "":
+		data, err := os.ReadFile(path)
+		if err != nil {
+			s.invalid(key+"_FILE", "failed to read secret: %v", err)
+			return ""
+		}
+		value = strings.TrimSpace(string(data))
+		if value == "" {
+			s.invalid(key+"_FILE", "secret file %s is empty", path)
+		}
+		// Recorded so that changes to the file are detected on reload
+		s.values[key] = value
+	case value == "" && required:
+		s.invalid(key, "required (or set %s_FILE)", key)
+	}
+
+	return value
+}
+
+// string gets a setting or returns a default value
+func (s *source) string(key, defaultValue string) string {
+	value := s.lookup(key)
+	if value == "" {
+		return defaultValue
+	}
+	return value
+}
+
+// list gets a comma separated setting or returns a default value
+func (s *source) list(key, defaultValue string) []string {
+	var values []string
+	for _, value := range strings.Split(s.string(key, defaultValue), ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			values = append(values, value)
+		}
+	}
+	return values
+}
+
+// int gets an integer setting or returns a default value
+func (s *source) int(key string, defaultValue int) int {
+	valueStr := s.lookup(key)
+	if valueStr == "" {
+		return defaultValue
+	}
+
+	value, err := strconv.Atoi(valueStr)
+	if err != nil {
+		s.invalid(key, "invalid integer %q", valueStr)
+		return defaultValue
+	}
+
+	return value
+}
+
+// bool gets a boolean setting or returns a default value
+func (s *source) bool(key string, defaultValue bool) bool {
+	valueStr := s.lookup(key)
+	if valueStr == "" {
+		return defaultValue
+	}
+
+	value, err := strconv.ParseBool(valueStr)
+	if err != nil {
+		s.invalid(key, "invalid boolean %q", valueStr)
+		return defaultValue
+	}
+
+	return value
+}
+
+// float gets a float setting or returns a default value
+func (s *source) float(key string, defaultValue float64) float64 {
+	valueStr := s.lookup(key)
+	if valueStr == "" {
+		return defaultValue
+	}
+
+	value, err := strconv.ParseFloat(valueStr, 64)
+	if err != nil {
+		s.invalid(key, "invalid number %q", valueStr)
+		return defaultValue
+	}
+
+	return value
+}
+
+// duration gets a duration setting or returns a default value
+func (s *source) duration(key string, defaultValue time.Duration) time.Duration {
+	valueStr := s.lookup(key)
+	if valueStr == "" {
+		return defaultValue
+	}
+
+	value, err := time.ParseDuration(valueStr)
+	if err != nil {
+		s.invalid(key, "invalid duration %q (e.g. 30s, 10m, 24h)", valueStr)
+		return defaultValue
+	}
+
+	return value
+}
@@ -0,0 +1,239 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"plantopo-strava-sync/internal/metrics"
+)
+
+// Activity state sources
+const (
+	ActivitySourceWebhook   = "webhook"
+	ActivitySourceBackfill  = "backfill"
+	ActivitySourceReconcile = "reconcile"
+)
+
+// ActivityState records the version of an activity last written to the event stream
+type ActivityState struct {
+	ActivityID  int64
+	AthleteID   int64
+	Fingerprint string // See strava.ActivitySummary.Fingerprint
+	Source      string // webhook, backfill or reconcile
+	Deleted     bool
+	// LastEventTime is the event_time of the latest webhook applied (zero if none)
+	LastEventTime int64
+	UpdatedAt     time.Time
+}
+
+// RecordActivityState records the fingerprint of an activity that has just been written to the event stream
+// startDate is the Unix time the activity started, 0 if unknown
+func (d *DB) RecordActivityState(athleteID, activityID int64, fingerprint string, startDate int64, source string) error {
+	timer := prometheus.NewTimer(metrics.DBOperationDuration.WithLabelValues(metrics.DBOpRecordActivityState))
+	defer timer.ObserveDuration()
+
+	query := `
+		INSERT INTO activities (activity_id, athlete_id, fingerprint, source, deleted, start_date, updated_at)
+		VALUES (?, ?, ?, ?, 0, NULLIF(?, 0), ?)
+		ON CONFLICT(activity_id) DO UPDATE SET
+			athlete_id = excluded.athlete_id,
+			fingerprint = excluded.fingerprint,
+			source = excluded.source,
+			deleted = 0,
+			start_date = IFNULL(excluded.start_date, start_date),
+			updated_at = excluded.updated_at
+	`
+
+	_, err := d.db.Exec(query, activityID, athleteID, fingerprint, source, startDate, time.Now().Unix())
+	if err != nil {
+		metrics.DBOperationErrorsTotal.WithLabelValues(metrics.DBOpRecordActivityState).Inc()
+		return fmt.Errorf("failed to record activity state: %w", err)
+	}
+
+	return nil
+}
+
+// MarkActivityDeleted records that an activity has been deleted
+func (d *DB) MarkActivityDeleted(athleteID, activityID int64, source string) error {
+	timer := prometheus.NewTimer(metrics.DBOperationDuration.WithLabelValues(metrics.DBOpRecordActivityState))
+	defer timer.ObserveDuration()
+
+	query := `
+		INSERT INTO activities (activity_id, athlete_id, fingerprint, source, deleted, updated_at)
+		VALUES (?, ?, '', ?, 1, ?)
+		ON CONFLICT(activity_id) DO UPDATE SET
+			fingerprint = '',
+			source = excluded.source,
+			deleted = 1,
+			updated_at = excluded.updated_at
+	`
+
+	_, err := d.db.Exec(query, activityID, athleteID, source, time.Now().Unix())
+	if err != nil {
+		metrics.DBOperationErrorsTotal.WithLabelValues(metrics.DBOpRecordActivityState).Inc()
+		return fmt.Errorf("failed to mark activity deleted: %w", err)
+	}
+
+	return nil
+}
+
+// RecordActivityEventTime records the event_time of a webhook applied to an activity
+// The stored time only ever moves forward. The activity must already have been recorded.
+func (d *DB) RecordActivityEventTime(activityID, eventTime int64) error {
+	timer := prometheus.NewTimer(metrics.DBOperationDuration.WithLabelValues(metrics.DBOpRecordActivityState))
+	defer timer.ObserveDuration()
+
+	query := `
+		UPDATE activities
+		SET last_event_time = MAX(IFNULL(last_event_time, 0), ?)
+		WHERE activity_id = ?
+	`
+
+	_, err := d.db.Exec(query, eventTime, activityID)
+	if err != nil {
+		metrics.DBOperationErrorsTotal.WithLabelValues(metrics.DBOpRecordActivityState).Inc()
+		return fmt.Errorf("failed to record activity event time: %w", err)
+	}
+
+	return nil
+}
+
+// ResetActivityFingerprints clears the stored fingerprints of an athlete's activities
+// so that the next backfill treats every listed activity as changed
+func (d *DB) ResetActivityFingerprints(athleteID int64) error {
+	timer := prometheus.NewTimer(metrics.DBOperationDuration.WithLabelValues(metrics.DBOpRecordActivityState))
+	defer timer.ObserveDuration()
+
+	query := `UPDATE activities SET fingerprint = '' WHERE athlete_id = ? AND deleted = 0`
+
+	if _, err := d.db.Exec(query, athleteID); err != nil {
+		metrics.DBOperationErrorsTotal.WithLabelValues(metrics.DBOpRecordActivityState).Inc()
+		return fmt.Errorf("failed to reset activity fingerprints: %w", err)
+	}
+
+	return nil
+}
+
+// GetActivityFingerprints returns the stored fingerprints of an athlete's activities,
+// keyed by activity ID. Activities which are unknown or deleted are omitted.
+func (d *DB) GetActivityFingerprints(athleteID int64, activityIDs []int64) (map[int64]string, error) {
+	timer := prometheus.NewTimer(metrics.DBOperationDuration.WithLabelValues(metrics.DBOpGetActivityFingerprints))
+	defer timer.ObserveDuration()
+
+	fingerprints := make(map[int64]string, len(activityIDs))
+	if len(activityIDs) == 0 {
+		return fingerprints, nil
+	}
+
+	placeholders := strings.TrimSuffix(strings.Repeat("?,", len(activityIDs)), ",")
+	query := `
+		SELECT activity_id, fingerprint
+		FROM activities
+		WHERE athlete_id = ? AND deleted = 0 AND activity_id IN (` + placeholders + `)
+	`
+
+	args := make([]interface{}, 0, len(activityIDs)+1)
+	args = append(args, athleteID)
+	for _, id := range activityIDs {
+		args = append(args, id)
+	}
+
+	rows, err := d.db.Query(query, args...)
+	if err != nil {
+		metrics.DBOperationErrorsTotal.WithLabelValues(metrics.DBOpGetActivityFingerprints).Inc()
+		return nil, fmt.Errorf("failed to query activity fingerprints: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var activityID int64
+		var fingerprint string
+		if err := rows.Scan(&activityID, &fingerprint); err != nil {
+			return nil, fmt.Errorf("failed to scan activity fingerprint: %w", err)
+		}
+		fingerprints[activityID] = fingerprint
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating activity fingerprints: %w", err)
+	}
+
+	return fingerprints, nil
+}
+
+// ListReconcilableActivities returns the IDs of an athlete's activities which
+// are in the event stream and started in [from, to), excluding those recorded
+// at or after updatedBefore as they may be newer than a listing made then.
+// Activities whose start date is unknown are omitted.
+func (d *DB) ListReconcilableActivities(athleteID, from, to, updatedBefore int64) ([]int64, error) {
+	query := `
+		SELECT activity_id
+		FROM activities
+		WHERE athlete_id = ? AND deleted = 0
+		  AND start_date >= ? AND start_date < ?
+		  AND updated_at < ?
+		ORDER BY activity_id
+	`
+
+	rows, err := d.db.Query(query, athleteID, from, to, updatedBefore)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query reconcilable activities: %w", err)
+	}
+	defer rows.Close()
+
+	var activityIDs []int64
+	for rows.Next() {
+		var activityID int64
+		if err := rows.Scan(&activityID); err != nil {
+			return nil, fmt.Errorf("failed to scan activity: %w", err)
+		}
+		activityIDs = append(activityIDs, activityID)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating activities: %w", err)
+	}
+
+	return activityIDs, nil
+}
+
+// GetActivityState retrieves the stored state of an activity
+// Returns nil if the activity has never been written to the event stream
+func (d *DB) GetActivityState(activityID int64) (*ActivityState, error) {
+	timer := prometheus.NewTimer(metrics.DBOperationDuration.WithLabelValues(metrics.DBOpGetActivityState))
+	defer timer.ObserveDuration()
+
+	query := `
+		SELECT activity_id, athlete_id, fingerprint, source, deleted, IFNULL(last_event_time, 0), updated_at
+		FROM activities
+		WHERE activity_id = ?
+	`
+
+	var state ActivityState
+	var updatedAt int64
+
+	err := d.db.QueryRow(query, activityID).Scan(
+		&state.ActivityID,
+		&state.AthleteID,
+		&state.Fingerprint,
+		&state.Source,
+		&state.Deleted,
+		&state.LastEventTime,
+		&updatedAt,
+	)
+
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil // Activity not seen
+	}
+	if err != nil {
+		metrics.DBOperationErrorsTotal.WithLabelValues(metrics.DBOpGetActivityState).Inc()
+		return nil, fmt.Errorf("failed to get activity state: %w", err)
+	}
+
+	state.UpdatedAt = time.Unix(updatedAt, 0)
+
+	return &state, nil
+}
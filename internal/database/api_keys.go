@@ -0,0 +1,249 @@
+package database
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	"plantopo-strava-sync/internal/metrics"
+)
+
+// API key scopes
+const (
+	ScopeEventsRead  = "events:read"  // Read every athlete's events
+	ScopeAthleteRead = "athlete:read" // Read the events of the key's athlete
+	ScopeAdmin       = "admin"        // Everything, including the admin and athletes APIs
+)
+
+// APIKeyScopes are the scopes API keys can be created with
+var APIKeyScopes = []string{ScopeEventsRead, ScopeAthleteRead, ScopeAdmin}
+
+// apiKeyPrefix starts every API key so that leaked keys are recognisable
+const apiKeyPrefix = "pss_"
+
+// reservedAPIKeyNames can't be used for API keys since they label other
+// requests in metrics
+var reservedAPIKeyNames = []string{metrics.APIKeyInternal, metrics.APIKeyUnknown}
+
+// apiKeyTouchInterval limits how often a key's last use is recorded, so that
+// busy keys don't write on every request
+const apiKeyTouchInterval = time.Minute
+
+var (
+	// ErrAPIKeyExists is returned when creating a key with the name of an active key
+	ErrAPIKeyExists = errors.New("api key already exists")
+
+	// ErrAPIKeyNameReserved is returned when creating a key with a reserved name
+	ErrAPIKeyNameReserved = errors.New("api key name is reserved")
+
+	// ErrAPIKeyNotFound is returned when revoking a key which doesn't exist or is already revoked
+	ErrAPIKeyNotFound = errors.New("api key not found")
+
+	// ErrInvalidAPIKeyScopes is returned when creating a key with unknown scopes,
+	// or with athlete:read but no athlete
+	ErrInvalidAPIKeyScopes = errors.New("invalid api key scopes")
+)
+
+// APIKey is an internal API key. The key itself isn't stored.
+type APIKey struct {
+	ID         int64      `json:"id"`
+	Name       string     `json:"name"`
+	Prefix     string     `json:"prefix"`
+	Scopes     []string   `json:"scopes"`
+	AthleteID  *int64     `json:"athlete_id"` // Set for athlete:read keys
+	LastUsedAt *time.Time `json:"last_used_at"`
+	RevokedAt  *time.Time `json:"revoked_at"`
+	CreatedAt  time.Time  `json:"created_at"`
+}
+
+// HasScope returns true if the key grants scope, which admin keys always do
+func (k *APIKey) HasScope(scope string) bool {
+	return slices.Contains(k.Scopes, scope) || slices.Contains(k.Scopes, ScopeAdmin)
+}
+
+// hashAPIKey returns the stored hash of a key. Keys are random so a fast
+// hash is enough.
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// CreateAPIKey generates and stores a new API key, returning the key, which
+// can't be retrieved again, and its details
+// Returns ErrAPIKeyExists if an active key has the name, ErrAPIKeyNameReserved
+// if the name is reserved, or ErrInvalidAPIKeyScopes if the scopes are invalid
+func (d *DB) CreateAPIKey(name string, scopes []string, athleteID *int64) (string, *APIKey, error) {
+	if slices.Contains(reservedAPIKeyNames, name) {
+		return "", nil, ErrAPIKeyNameReserved
+	}
+	if len(scopes) == 0 {
+		return "", nil, fmt.Errorf("%w: at least one scope is required", ErrInvalidAPIKeyScopes)
+	}
+	for _, scope := range scopes {
+		if !slices.Contains(APIKeyScopes, scope) {
+			return "", nil, fmt.Errorf("%w: unknown scope %q", ErrInvalidAPIKeyScopes, scope)
+		}
+	}
+	if slices.Contains(scopes, ScopeAthleteRead) != (athleteID != nil) {
+		return "", nil, fmt.Errorf("%w: %s keys require an athlete, and only they can have one", ErrInvalidAPIKeyScopes, ScopeAthleteRead)
+	}
+
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", nil, fmt.Errorf("failed to generate api key: %w", err)
+	}
+	key := apiKeyPrefix + base64.RawURLEncoding.EncodeToString(secret)
+
+	scopesJSON, err := json.Marshal(scopes)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to marshal scopes: %w", err)
+	}
+
+	apiKey := &APIKey{
+		Name:      name,
+		Prefix:    key[:len(apiKeyPrefix)+6],
+		Scopes:    scopes,
+		AthleteID: athleteID,
+		CreatedAt: time.Unix(time.Now().Unix(), 0),
+	}
+
+	result, err := d.db.Exec(`
+		INSERT INTO api_keys (name, key_hash, prefix, scopes, athlete_id, created_at)
+		SELECT ?, ?, ?, ?, ?, ?
+		WHERE NOT EXISTS (SELECT 1 FROM api_keys WHERE name = ? AND revoked_at IS NULL)
+	`, name, hashAPIKey(key), apiKey.Prefix, string(scopesJSON), athleteID, apiKey.CreatedAt.Unix(), name)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to create api key: %w", err)
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to check api key creation: %w", err)
+	}
+	if rows == 0 {
+		return "", nil, ErrAPIKeyExists
+	}
+
+	if apiKey.ID, err = result.LastInsertId(); err != nil {
+		return "", nil, fmt.Errorf("failed to get api key ID: %w", err)
+	}
+
+	return key, apiKey, nil
+}
+
+// AuthenticateAPIKey returns the active API key matching key, or nil if there
+// isn't one, and records that it was used
+func (d *DB) AuthenticateAPIKey(key string, now time.Time) (*APIKey, error) {
+	apiKey, err := d.scanAPIKey(d.db.QueryRow(`
+		SELECT id, name, prefix, scopes, athlete_id, last_used_at, revoked_at, created_at
+		FROM api_keys
+		WHERE key_hash = ? AND revoked_at IS NULL
+	`, hashAPIKey(key)))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if apiKey.LastUsedAt == nil || now.Sub(*apiKey.LastUsedAt) >= apiKeyTouchInterval {
+		if _, err := d.db.Exec(`UPDATE api_keys SET last_used_at = ? WHERE id = ?`, now.Unix(), apiKey.ID); err != nil {
+			return nil, fmt.Errorf("failed to record api key use: %w", err)
+		}
+		lastUsedAt := time.Unix(now.Unix(), 0)
+		apiKey.LastUsedAt = &lastUsedAt
+	}
+
+	return apiKey, nil
+}
+
+// ListAPIKeys returns every API key, including revoked keys, ordered by creation
+func (d *DB) ListAPIKeys() ([]*APIKey, error) {
+	rows, err := d.db.Query(`
+		SELECT id, name, prefix, scopes, athlete_id, last_used_at, revoked_at, created_at
+		FROM api_keys
+		ORDER BY id
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list api keys: %w", err)
+	}
+	defer rows.Close()
+
+	apiKeys := []*APIKey{}
+	for rows.Next() {
+		apiKey, err := d.scanAPIKey(rows)
+		if err != nil {
+			return nil, err
+		}
+		apiKeys = append(apiKeys, apiKey)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating api keys: %w", err)
+	}
+
+	return apiKeys, nil
+}
+
+// RevokeAPIKey revokes the active API key with a name
+// Returns ErrAPIKeyNotFound if there isn't one
+func (d *DB) RevokeAPIKey(name string, now time.Time) error {
+	result, err := d.db.Exec(`UPDATE api_keys SET revoked_at = ? WHERE name = ? AND revoked_at IS NULL`, now.Unix(), name)
+	if err != nil {
+		return fmt.Errorf("failed to revoke api key: %w", err)
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to check api key revocation: %w", err)
+	}
+	if rows == 0 {
+		return ErrAPIKeyNotFound
+	}
+
+	return nil
+}
+
+// scanAPIKey scans an API key from a row
+func (d *DB) scanAPIKey(row interface{ Scan(...any) error }) (*APIKey, error) {
+	var apiKey APIKey
+	var scopes string
+	var athleteID, lastUsedAt, revokedAt sql.NullInt64
+	var createdAt int64
+
+	err := row.Scan(
+		&apiKey.ID,
+		&apiKey.Name,
+		&apiKey.Prefix,
+		&scopes,
+		&athleteID,
+		&lastUsedAt,
+		&revokedAt,
+		&createdAt,
+	)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, err
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to scan api key: %w", err)
+	}
+
+	if err := json.Unmarshal([]byte(scopes), &apiKey.Scopes); err != nil {
+		return nil, fmt.Errorf("failed to parse api key scopes: %w", err)
+	}
+	if athleteID.Valid {
+		apiKey.AthleteID = &athleteID.Int64
+	}
+	apiKey.LastUsedAt = nullableTime(lastUsedAt)
+	apiKey.RevokedAt = nullableTime(revokedAt)
+	apiKey.CreatedAt = time.Unix(createdAt, 0)
+
+	return &apiKey, nil
+}
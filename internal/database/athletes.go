@@ -5,6 +5,8 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"slices"
+	"strings"
 	"time"
 
 	"plantopo-strava-sync/internal/metrics"
@@ -12,6 +14,9 @@ import (
 	"github.com/prometheus/client_golang/prometheus"
 )
 
+// ErrAthleteNotFound is returned when an operation requires an athlete which doesn't exist
+var ErrAthleteNotFound = errors.New("athlete not found")
+
 // Athlete represents an athlete's authentication data in the database
 type Athlete struct {
 	AthleteID      int64
@@ -20,24 +25,32 @@ type Athlete struct {
 	RefreshToken   string
 	TokenExpiresAt time.Time
 	AthleteSummary json.RawMessage // JSON blob from Strava
+	Scopes         []string        // OAuth scopes granted by the athlete, nil if unknown
 	CreatedAt      time.Time
 	UpdatedAt      time.Time
 }
 
+// HasScope returns true if the athlete granted the scope. Athletes connected
+// before granted scopes were recorded are assumed to have granted it.
+func (a *Athlete) HasScope(scope string) bool {
+	return a.Scopes == nil || slices.Contains(a.Scopes, scope)
+}
+
 // UpsertAthlete inserts or updates an athlete's data
 func (d *DB) UpsertAthlete(athlete *Athlete) error {
 	timer := prometheus.NewTimer(metrics.DBOperationDuration.WithLabelValues(metrics.DBOpUpsertAthlete))
 	defer timer.ObserveDuration()
 
 	query := `
-		INSERT INTO athletes (athlete_id, client_id, access_token, refresh_token, token_expires_at, athlete_summary, created_at, updated_at)
-		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+		INSERT INTO athletes (athlete_id, client_id, access_token, refresh_token, token_expires_at, athlete_summary, scopes, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
 		ON CONFLICT(athlete_id) DO UPDATE SET
 			client_id = excluded.client_id,
 			access_token = excluded.access_token,
 			refresh_token = excluded.refresh_token,
 			token_expires_at = excluded.token_expires_at,
 			athlete_summary = excluded.athlete_summary,
+			scopes = IFNULL(excluded.scopes, scopes),
 			updated_at = excluded.updated_at
 	`
 
@@ -48,6 +61,7 @@ func (d *DB) UpsertAthlete(athlete *Athlete) error {
 		athlete.RefreshToken,
 		athlete.TokenExpiresAt.Unix(),
 		athlete.AthleteSummary,
+		joinScopes(athlete.Scopes),
 		athlete.CreatedAt.Unix(),
 		athlete.UpdatedAt.Unix(),
 	)
@@ -66,13 +80,14 @@ func (d *DB) GetAthlete(athleteID int64) (*Athlete, error) {
 	defer timer.ObserveDuration()
 
 	query := `
-		SELECT athlete_id, client_id, access_token, refresh_token, token_expires_at, athlete_summary, created_at, updated_at
+		SELECT athlete_id, client_id, access_token, refresh_token, token_expires_at, athlete_summary, scopes, created_at, updated_at
 		FROM athletes
 		WHERE athlete_id = ?
 	`
 
 	var athlete Athlete
 	var expiresAt, createdAt, updatedAt int64
+	var scopes sql.NullString
 
 	err := d.db.QueryRow(query, athleteID).Scan(
 		&athlete.AthleteID,
@@ -81,6 +96,7 @@ func (d *DB) GetAthlete(athleteID int64) (*Athlete, error) {
 		&athlete.RefreshToken,
 		&expiresAt,
 		&athlete.AthleteSummary,
+		&scopes,
 		&createdAt,
 		&updatedAt,
 	)
@@ -94,6 +110,7 @@ func (d *DB) GetAthlete(athleteID int64) (*Athlete, error) {
 	}
 
 	athlete.TokenExpiresAt = time.Unix(expiresAt, 0)
+	athlete.Scopes = splitScopes(scopes)
 	athlete.CreatedAt = time.Unix(createdAt, 0)
 	athlete.UpdatedAt = time.Unix(updatedAt, 0)
 
@@ -101,7 +118,7 @@ func (d *DB) GetAthlete(athleteID int64) (*Athlete, error) {
 }
 
 // DeleteAthlete deletes an athlete record
-// Note: This does not delete their events - use DeleteAthleteEvents separately if needed
+// Note: This does not delete their events - use DisconnectAthlete to remove everything stored about them
 func (d *DB) DeleteAthlete(athleteID int64) error {
 	query := `DELETE FROM athletes WHERE athlete_id = ?`
 
@@ -112,3 +129,225 @@ func (d *DB) DeleteAthlete(athleteID int64) error {
 
 	return nil
 }
+
+// ListAthleteIDs returns the IDs of all athletes ordered by ID
+func (d *DB) ListAthleteIDs() ([]int64, error) {
+	rows, err := d.db.Query(`SELECT athlete_id FROM athletes ORDER BY athlete_id ASC`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list athletes: %w", err)
+	}
+	defer rows.Close()
+
+	var athleteIDs []int64
+	for rows.Next() {
+		var athleteID int64
+		if err := rows.Scan(&athleteID); err != nil {
+			return nil, fmt.Errorf("failed to scan athlete id: %w", err)
+		}
+		athleteIDs = append(athleteIDs, athleteID)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating athletes: %w", err)
+	}
+
+	return athleteIDs, nil
+}
+
+// AthleteOverview summarises an athlete's connection and sync state
+type AthleteOverview struct {
+	AthleteID       int64     `json:"athlete_id"`
+	ClientID        string    `json:"client_id"`
+	ConnectedAt     time.Time `json:"connected_at"`
+	TokenExpiresAt  time.Time `json:"token_expires_at"`
+	Scopes          []string  `json:"scopes"` // nil if unknown
+	EventCount      int       `json:"event_count"`
+	PendingSyncJobs int       `json:"pending_sync_jobs"`
+	PendingWebhooks int       `json:"pending_webhooks"`
+}
+
+// athleteOverviewQuery selects AthleteOverview columns, filtered by the caller
+const athleteOverviewQuery = `
+	SELECT
+		a.athlete_id,
+		a.client_id,
+		a.created_at,
+		a.token_expires_at,
+		a.scopes,
+		(SELECT COUNT(*) FROM events e WHERE e.athlete_id = a.athlete_id),
+		(SELECT COUNT(*) FROM sync_jobs j WHERE j.athlete_id = a.athlete_id),
+		(SELECT COUNT(*) FROM webhook_queue w
+		 WHERE CASE WHEN json_valid(w.data) THEN json_extract(w.data, '$.owner_id') = a.athlete_id END)
+	FROM athletes a
+`
+
+// ListAthleteOverviews returns an overview of every athlete ordered by ID
+func (d *DB) ListAthleteOverviews() ([]*AthleteOverview, error) {
+	rows, err := d.db.Query(athleteOverviewQuery + ` ORDER BY a.athlete_id ASC`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list athletes: %w", err)
+	}
+	defer rows.Close()
+
+	overviews := []*AthleteOverview{}
+	for rows.Next() {
+		overview, err := scanAthleteOverview(rows)
+		if err != nil {
+			return nil, err
+		}
+		overviews = append(overviews, overview)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating athletes: %w", err)
+	}
+
+	return overviews, nil
+}
+
+// GetAthleteOverview returns an overview of an athlete
+// Returns ErrAthleteNotFound if the athlete doesn't exist
+func (d *DB) GetAthleteOverview(athleteID int64) (*AthleteOverview, error) {
+	row := d.db.QueryRow(athleteOverviewQuery+` WHERE a.athlete_id = ?`, athleteID)
+
+	overview, err := scanAthleteOverview(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrAthleteNotFound
+	}
+	return overview, err
+}
+
+// scanAthleteOverview scans a row selected by athleteOverviewQuery
+func scanAthleteOverview(row interface{ Scan(...any) error }) (*AthleteOverview, error) {
+	var overview AthleteOverview
+	var connectedAt, expiresAt int64
+	var scopes sql.NullString
+
+	err := row.Scan(
+		&overview.AthleteID,
+		&overview.ClientID,
+		&connectedAt,
+		&expiresAt,
+		&scopes,
+		&overview.EventCount,
+		&overview.PendingSyncJobs,
+		&overview.PendingWebhooks,
+	)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, err
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to scan athlete overview: %w", err)
+	}
+
+	overview.ConnectedAt = time.Unix(connectedAt, 0)
+	overview.TokenExpiresAt = time.Unix(expiresAt, 0)
+	overview.Scopes = splitScopes(scopes)
+
+	return &overview, nil
+}
+
+// DisconnectAthlete removes an athlete and everything stored about them: their
+// tokens, events, activity state and queued work. A deauthorization event built
+// from webhookEventData replaces their events, as when Strava reports that the
+// athlete revoked access. Returns the deauthorization event ID.
+func (d *DB) DisconnectAthlete(athleteID int64, webhookEventData json.RawMessage) (int64, error) {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`
+		INSERT INTO events (event_type, athlete_id, webhook_event)
+		VALUES (?, ?, ?)
+	`, EventTypeWebhook, athleteID, webhookEventData)
+	if err != nil {
+		return 0, fmt.Errorf("failed to insert deauthorization event: %w", err)
+	}
+
+	eventID, err := result.LastInsertId()
+	if err != nil {
+		return 0, fmt.Errorf("failed to get event_id: %w", err)
+	}
+
+	staleThreshold := time.Now().Add(-StaleLockTimeout).Unix()
+
+	statements := []struct {
+		query string
+		args  []interface{}
+	}{
+		{`DELETE FROM events WHERE athlete_id = ? AND event_id != ?`, []interface{}{athleteID, eventID}},
+		{`DELETE FROM athletes WHERE athlete_id = ?`, []interface{}{athleteID}},
+		// Without their events the fingerprints are stale, and would stop a
+		// backfill after reconnecting from emitting the athlete's history
+		{`DELETE FROM activities WHERE athlete_id = ?`, []interface{}{athleteID}},
+		{`DELETE FROM sync_jobs WHERE athlete_id = ?`, []interface{}{athleteID}},
+		{`DELETE FROM sync_job_athletes WHERE athlete_id = ?`, []interface{}{athleteID}},
+		{`DELETE FROM backfill_state WHERE athlete_id = ?`, []interface{}{athleteID}},
+		{`DELETE FROM gap_sync_state WHERE athlete_id = ?`, []interface{}{athleteID}},
+		{`DELETE FROM reconcile_state WHERE athlete_id = ?`, []interface{}{athleteID}},
+		// Webhooks the worker is processing are left to fail on the missing athlete
+		{`DELETE FROM webhook_queue
+		  WHERE CASE WHEN json_valid(data) THEN json_extract(data, '$.owner_id') = ? END
+		    AND (processing_started_at IS NULL OR processing_started_at < ?)`, []interface{}{athleteID, staleThreshold}},
+	}
+
+	for _, statement := range statements {
+		if _, err := tx.Exec(statement.query, statement.args...); err != nil {
+			return 0, fmt.Errorf("failed to disconnect athlete: %w", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("failed to commit athlete disconnect: %w", err)
+	}
+
+	return eventID, nil
+}
+
+// IsAthleteDisconnected returns true if the athlete has no tokens and their
+// latest event is a deauthorization, i.e. nothing has happened since they were
+// disconnected
+func (d *DB) IsAthleteDisconnected(athleteID int64) (bool, error) {
+	query := `
+		SELECT
+			NOT EXISTS (SELECT 1 FROM athletes WHERE athlete_id = ?)
+			AND IFNULL((
+				SELECT CASE WHEN json_valid(webhook_event)
+					THEN json_extract(webhook_event, '$.object_type') = 'athlete'
+					 AND json_extract(webhook_event, '$.updates.authorized') = 'false'
+				END
+				FROM events
+				WHERE athlete_id = ?
+				ORDER BY event_id DESC
+				LIMIT 1
+			), 0)
+	`
+
+	var disconnected bool
+	if err := d.db.QueryRow(query, athleteID, athleteID).Scan(&disconnected); err != nil {
+		return false, fmt.Errorf("failed to check athlete disconnected: %w", err)
+	}
+
+	return disconnected, nil
+}
+
+// joinScopes formats scopes as Strava does, comma separated, NULL if unknown
+func joinScopes(scopes []string) sql.NullString {
+	if scopes == nil {
+		return sql.NullString{}
+	}
+	return sql.NullString{String: strings.Join(scopes, ","), Valid: true}
+}
+
+// splitScopes parses scopes formatted by joinScopes
+func splitScopes(scopes sql.NullString) []string {
+	if !scopes.Valid {
+		return nil
+	}
+	if scopes.String == "" {
+		return []string{}
+	}
+	return strings.Split(scopes.String, ",")
+}
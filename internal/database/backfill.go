@@ -0,0 +1,93 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// BackfillState tracks how far back an athlete's activities have been listed
+type BackfillState struct {
+	AthleteID     int64 `json:"athlete_id"`
+	Cursor        int64 `json:"cursor"`         // Unix timestamp, the next page lists activities started before this, 0 = now
+	ListedCount   int   `json:"listed_count"`   // Activities listed within the horizon so far
+	MaxAgeDays    *int  `json:"max_age_days"`   // Overrides the client's horizon, nil = client default
+	MaxActivities *int  `json:"max_activities"` // Overrides the client's horizon, nil = client default
+}
+
+// GetBackfillState returns an athlete's backfill state
+// Athletes without a recorded state get a state starting from now
+func (d *DB) GetBackfillState(athleteID int64) (*BackfillState, error) {
+	query := `
+		SELECT cursor, listed_count, max_age_days, max_activities
+		FROM backfill_state
+		WHERE athlete_id = ?
+	`
+
+	state := BackfillState{AthleteID: athleteID}
+	err := d.db.QueryRow(query, athleteID).Scan(&state.Cursor, &state.ListedCount, &state.MaxAgeDays, &state.MaxActivities)
+	if err == sql.ErrNoRows {
+		return &state, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get backfill state: %w", err)
+	}
+
+	return &state, nil
+}
+
+// StartBackfill starts listing an athlete's activities again from the newest
+// and queues the first list_activities job. Horizon overrides are kept.
+func (d *DB) StartBackfill(athleteID int64, priority int) (int64, error) {
+	query := `
+		INSERT INTO backfill_state (athlete_id, cursor, listed_count)
+		VALUES (?, 0, 0)
+		ON CONFLICT (athlete_id) DO UPDATE SET cursor = 0, listed_count = 0
+	`
+
+	if _, err := d.db.Exec(query, athleteID); err != nil {
+		return 0, fmt.Errorf("failed to reset backfill state: %w", err)
+	}
+
+	return d.EnqueueSyncJobWithPriority(athleteID, "list_activities", nil, priority)
+}
+
+// AdvanceBackfill records that a page of activities has been listed
+func (d *DB) AdvanceBackfill(athleteID int64, cursor int64, listed int) error {
+	query := `
+		INSERT INTO backfill_state (athlete_id, cursor, listed_count)
+		VALUES (?, ?, ?)
+		ON CONFLICT (athlete_id) DO UPDATE SET
+			cursor = excluded.cursor,
+			listed_count = listed_count + excluded.listed_count
+	`
+
+	if _, err := d.db.Exec(query, athleteID, cursor, listed); err != nil {
+		return fmt.Errorf("failed to advance backfill state: %w", err)
+	}
+
+	return nil
+}
+
+// ExtendBackfill overrides an athlete's backfill horizon and queues a
+// list_activities job which continues from the oldest activity listed so far,
+// so activities which have already been backfilled aren't listed again.
+// Nil values leave the current override unchanged, 0 means unlimited.
+func (d *DB) ExtendBackfill(athleteID int64, maxAgeDays, maxActivities *int) (int64, error) {
+	if err := d.requireAthlete(athleteID); err != nil {
+		return 0, err
+	}
+
+	query := `
+		INSERT INTO backfill_state (athlete_id, max_age_days, max_activities)
+		VALUES (?, ?, ?)
+		ON CONFLICT (athlete_id) DO UPDATE SET
+			max_age_days = IFNULL(excluded.max_age_days, max_age_days),
+			max_activities = IFNULL(excluded.max_activities, max_activities)
+	`
+
+	if _, err := d.db.Exec(query, athleteID, maxAgeDays, maxActivities); err != nil {
+		return 0, fmt.Errorf("failed to extend backfill: %w", err)
+	}
+
+	return d.EnqueueSyncJobWithPriority(athleteID, "list_activities", nil, PriorityResync)
+}
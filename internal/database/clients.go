@@ -0,0 +1,266 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+)
+
+var (
+	// ErrClientMigrationNotFound is returned for a migration token which was never issued
+	ErrClientMigrationNotFound = errors.New("client migration not found")
+
+	// ErrClientMigrationExpired is returned for a migration which expired before it was completed
+	ErrClientMigrationExpired = errors.New("client migration expired")
+
+	// ErrClientMigrationCompleted is returned for a migration which has already been completed
+	ErrClientMigrationCompleted = errors.New("client migration already completed")
+
+	// ErrAlreadyOnClient is returned when migrating an athlete to the client they already use
+	ErrAlreadyOnClient = errors.New("athlete already uses client")
+
+	// ErrClientMigrationAthleteMismatch is returned when completing a migration
+	// for a different athlete than the one it was created for
+	ErrClientMigrationAthleteMismatch = errors.New("client migration is for a different athlete")
+)
+
+// ClientMigration invites an athlete to authorize again under a different
+// Strava client
+type ClientMigration struct {
+	Token        string     `json:"token"`
+	AthleteID    int64      `json:"athlete_id"`
+	FromClientID string     `json:"from_client_id"`
+	ToClientID   string     `json:"to_client_id"`
+	ExpiresAt    time.Time  `json:"expires_at"`
+	CompletedAt  *time.Time `json:"completed_at"` // nil if not completed
+	CreatedAt    time.Time  `json:"created_at"`
+}
+
+// ClientUsage summarises the athletes and API usage of a Strava client
+type ClientUsage struct {
+	ClientID          string `json:"client_id"`
+	Athletes          int    `json:"athletes"`
+	PendingMigrations int    `json:"pending_migrations"` // Athletes invited to move to another client
+	RequestsToday     int    `json:"requests_today"`     // API requests since midnight UTC
+	RequestsLast7Days int    `json:"requests_last_7_days"`
+	Configured        bool   `json:"configured"` // False for clients athletes use which are no longer configured
+}
+
+// usageDay returns the api_usage day of a time
+func usageDay(t time.Time) int64 {
+	return t.Unix() / int64(24*time.Hour/time.Second)
+}
+
+// RecordAPIRequests adds to the count of Strava API requests made with a
+// client on the day of at
+func (d *DB) RecordAPIRequests(clientID string, at time.Time, requests int) error {
+	_, err := d.db.Exec(`
+		INSERT INTO api_usage (client_id, day, requests)
+		VALUES (?, ?, ?)
+		ON CONFLICT (client_id, day) DO UPDATE SET requests = requests + excluded.requests
+	`, clientID, usageDay(at), requests)
+	if err != nil {
+		return fmt.Errorf("failed to record api requests: %w", err)
+	}
+
+	return nil
+}
+
+// GetClientUsage returns the usage of the configured clients, in the order
+// given, followed by any other clients which have athletes or have made API
+// requests in the last 7 days ordered by ID
+func (d *DB) GetClientUsage(configured []string, now time.Time) ([]*ClientUsage, error) {
+	today := usageDay(now)
+
+	rows, err := d.db.Query(`
+		SELECT
+			c.client_id,
+			(SELECT COUNT(*) FROM athletes a WHERE a.client_id = c.client_id),
+			(SELECT COUNT(*) FROM client_migrations m
+			 WHERE m.from_client_id = c.client_id AND m.completed_at IS NULL AND m.expires_at >= ?),
+			(SELECT IFNULL(SUM(u.requests), 0) FROM api_usage u WHERE u.client_id = c.client_id AND u.day = ?),
+			(SELECT IFNULL(SUM(u.requests), 0) FROM api_usage u WHERE u.client_id = c.client_id AND u.day > ?)
+		FROM (
+			SELECT client_id FROM athletes
+			UNION
+			SELECT client_id FROM api_usage WHERE day > ?
+		) c
+	`, now.Unix(), today, today-7, today-7)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get client usage: %w", err)
+	}
+	defer rows.Close()
+
+	usage := make(map[string]*ClientUsage)
+	for rows.Next() {
+		var client ClientUsage
+		if err := rows.Scan(&client.ClientID, &client.Athletes, &client.PendingMigrations, &client.RequestsToday, &client.RequestsLast7Days); err != nil {
+			return nil, fmt.Errorf("failed to scan client usage: %w", err)
+		}
+		usage[client.ClientID] = &client
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating client usage: %w", err)
+	}
+
+	clients := []*ClientUsage{}
+	for _, clientID := range configured {
+		client, ok := usage[clientID]
+		if !ok {
+			client = &ClientUsage{ClientID: clientID}
+		}
+		client.Configured = true
+		clients = append(clients, client)
+		delete(usage, clientID)
+	}
+
+	others := make([]*ClientUsage, 0, len(usage))
+	for _, client := range usage {
+		others = append(others, client)
+	}
+	sort.Slice(others, func(i, j int) bool { return others[i].ClientID < others[j].ClientID })
+
+	return append(clients, others...), nil
+}
+
+// CreateClientMigration records a migration of an athlete to another client
+// identified by token, which expires after ttl
+// Returns ErrAthleteNotFound if the athlete doesn't exist, or ErrAlreadyOnClient
+// if they already use the client
+func (d *DB) CreateClientMigration(token string, athleteID int64, toClientID string, ttl time.Duration) (*ClientMigration, error) {
+	athlete, err := d.GetAthlete(athleteID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get athlete: %w", err)
+	}
+	if athlete == nil {
+		return nil, ErrAthleteNotFound
+	}
+	if athlete.ClientID == toClientID {
+		return nil, ErrAlreadyOnClient
+	}
+
+	now := time.Now()
+	migration := &ClientMigration{
+		Token:        token,
+		AthleteID:    athleteID,
+		FromClientID: athlete.ClientID,
+		ToClientID:   toClientID,
+		ExpiresAt:    now.Add(ttl),
+		CreatedAt:    now,
+	}
+
+	_, err = d.db.Exec(`
+		INSERT INTO client_migrations (token, athlete_id, from_client_id, to_client_id, expires_at, created_at)
+		VALUES (?, ?, ?, ?, ?, ?)
+	`, migration.Token, migration.AthleteID, migration.FromClientID, migration.ToClientID, migration.ExpiresAt.Unix(), migration.CreatedAt.Unix())
+	if err != nil {
+		return nil, fmt.Errorf("failed to create client migration: %w", err)
+	}
+
+	return migration, nil
+}
+
+// GetClientMigration returns a migration which can still be completed
+// Returns ErrClientMigrationNotFound, ErrClientMigrationExpired or
+// ErrClientMigrationCompleted if it can't
+func (d *DB) GetClientMigration(token string, now time.Time) (*ClientMigration, error) {
+	query := `
+		SELECT athlete_id, from_client_id, to_client_id, expires_at, completed_at, created_at
+		FROM client_migrations
+		WHERE token = ?
+	`
+
+	migration := ClientMigration{Token: token}
+	var expiresAt, createdAt int64
+	var completedAt sql.NullInt64
+	err := d.db.QueryRow(query, token).Scan(
+		&migration.AthleteID,
+		&migration.FromClientID,
+		&migration.ToClientID,
+		&expiresAt,
+		&completedAt,
+		&createdAt,
+	)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrClientMigrationNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get client migration: %w", err)
+	}
+
+	migration.ExpiresAt = time.Unix(expiresAt, 0)
+	migration.CompletedAt = nullableTime(completedAt)
+	migration.CreatedAt = time.Unix(createdAt, 0)
+
+	if migration.CompletedAt != nil {
+		return nil, ErrClientMigrationCompleted
+	}
+	if now.After(migration.ExpiresAt) {
+		return nil, ErrClientMigrationExpired
+	}
+
+	return &migration, nil
+}
+
+// ClaimClientMigration marks a migration completed by the athlete it was
+// created for, so that it can only be completed once. Returns the migration,
+// ErrClientMigrationAthleteMismatch if it is for another athlete, or the
+// errors of GetClientMigration if it can't be completed.
+func (d *DB) ClaimClientMigration(token string, athleteID int64, now time.Time) (*ClientMigration, error) {
+	query := `
+		UPDATE client_migrations
+		SET completed_at = ?
+		WHERE token = ? AND athlete_id = ? AND completed_at IS NULL AND expires_at >= ?
+		RETURNING from_client_id, to_client_id, expires_at, created_at
+	`
+
+	migration := ClientMigration{Token: token, AthleteID: athleteID}
+	var expiresAt, createdAt int64
+	err := d.db.QueryRow(query, now.Unix(), token, athleteID, now.Unix()).Scan(
+		&migration.FromClientID,
+		&migration.ToClientID,
+		&expiresAt,
+		&createdAt,
+	)
+	if errors.Is(err, sql.ErrNoRows) {
+		// Find out why the migration couldn't be claimed
+		if _, err := d.GetClientMigration(token, now); err != nil {
+			return nil, err
+		}
+		return nil, ErrClientMigrationAthleteMismatch
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to claim client migration: %w", err)
+	}
+
+	migration.ExpiresAt = time.Unix(expiresAt, 0)
+	migration.CompletedAt = &now
+	migration.CreatedAt = time.Unix(createdAt, 0)
+
+	return &migration, nil
+}
+
+// HasLeftClient returns true if an athlete reconnected from a client to a
+// different one and hasn't returned to it since. Their authorization of the
+// old client may remain, so its webhooks duplicate those of the new client.
+func (d *DB) HasLeftClient(athleteID int64, clientID string) (bool, error) {
+	var left bool
+	err := d.db.QueryRow(`
+		SELECT EXISTS (
+			SELECT 1 FROM athletes a
+			JOIN events e ON e.athlete_id = a.athlete_id
+			WHERE a.athlete_id = ?
+			  AND a.client_id != ?
+			  AND e.event_type = 'athlete_reconnected'
+			  AND json_extract(e.reconnection, '$.previous_client_id') = ?
+		)
+	`, athleteID, clientID, clientID).Scan(&left)
+	if err != nil {
+		return false, fmt.Errorf("failed to check athlete client history: %w", err)
+	}
+
+	return left, nil
+}
@@ -30,12 +30,34 @@ func Open(dbPath string) (*DB, error) {
 		return nil, fmt.Errorf("failed to set busy_timeout: %w", err)
 	}
 
+	isNew, err := isNewDatabase(db)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	// Bring databases created by earlier versions up to date before the schema
+	// (which may reference new columns) is applied
+	if !isNew {
+		if err := migrate(db); err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+
 	// Execute schema to ensure tables exist
 	if _, err := db.Exec(schemaSQL); err != nil {
 		db.Close()
 		return nil, fmt.Errorf("failed to initialize schema: %w", err)
 	}
 
+	if isNew {
+		if err := setSchemaVersion(db, len(migrations)); err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+
 	return &DB{db: db}, nil
 }
 
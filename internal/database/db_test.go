@@ -2,8 +2,13 @@ package database
 
 import (
 	"encoding/json"
+	"errors"
+	"slices"
+	"strings"
 	"testing"
 	"time"
+
+	"plantopo-strava-sync/internal/metrics"
 )
 
 func TestDatabaseOperations(t *testing.T) {
@@ -44,6 +49,33 @@ func TestDatabaseOperations(t *testing.T) {
 		if retrieved.AccessToken != athlete.AccessToken {
 			t.Errorf("Expected access token %s, got %s", athlete.AccessToken, retrieved.AccessToken)
 		}
+
+		// Athletes connected before scopes were recorded are assumed to have every scope
+		if retrieved.Scopes != nil || !retrieved.HasScope("activity:read_all") {
+			t.Errorf("Expected unknown scopes, got %v", retrieved.Scopes)
+		}
+
+		athlete.Scopes = []string{"read", "activity:read"}
+		if err := db.UpsertAthlete(athlete); err != nil {
+			t.Fatalf("Failed to upsert athlete: %v", err)
+		}
+
+		// Refreshing tokens without scopes keeps the recorded scopes
+		athlete.Scopes = nil
+		if err := db.UpsertAthlete(athlete); err != nil {
+			t.Fatalf("Failed to upsert athlete: %v", err)
+		}
+
+		retrieved, err = db.GetAthlete(12345)
+		if err != nil {
+			t.Fatalf("Failed to get athlete: %v", err)
+		}
+		if !slices.Equal(retrieved.Scopes, []string{"read", "activity:read"}) {
+			t.Errorf("Expected scopes [read activity:read], got %v", retrieved.Scopes)
+		}
+		if retrieved.HasScope("activity:read_all") {
+			t.Error("Expected athlete not to have activity:read_all")
+		}
 	})
 
 	// Test webhook queue operations
@@ -333,11 +365,274 @@ func TestDatabaseOperations(t *testing.T) {
 		}
 	})
 
+	// Test webhook delivery deduplication
+	t.Run("WebhookDeliveryDeduplication", func(t *testing.T) {
+		webhookData := json.RawMessage(`{"object_type": "activity", "object_id": 777}`)
+
+		queueID, enqueued, err := db.EnqueueWebhookDelivery("delivery-1", "primary", webhookData, time.Hour, 0)
+		if err != nil {
+			t.Fatalf("Failed to enqueue webhook delivery: %v", err)
+		}
+		if !enqueued || queueID == 0 {
+			t.Fatal("Expected first delivery to be enqueued")
+		}
+
+		_, enqueued, err = db.EnqueueWebhookDelivery("delivery-1", "primary", webhookData, time.Hour, 0)
+		if err != nil {
+			t.Fatalf("Failed to enqueue duplicate webhook delivery: %v", err)
+		}
+		if enqueued {
+			t.Error("Expected duplicate delivery to be ignored")
+		}
+
+		// The key is retained after the webhook has been processed
+		if err := db.DeleteWebhook(queueID); err != nil {
+			t.Fatalf("Failed to delete webhook: %v", err)
+		}
+		_, enqueued, err = db.EnqueueWebhookDelivery("delivery-1", "primary", webhookData, time.Hour, 0)
+		if err != nil {
+			t.Fatalf("Failed to enqueue duplicate webhook delivery: %v", err)
+		}
+		if enqueued {
+			t.Error("Expected processed delivery to still be ignored within the window")
+		}
+
+		// Once the key expires the delivery is accepted again
+		_, err = db.db.Exec("UPDATE webhook_deliveries SET received_at = ?", time.Now().Add(-2*time.Hour).Unix())
+		if err != nil {
+			t.Fatalf("Failed to age delivery: %v", err)
+		}
+		queueID, enqueued, err = db.EnqueueWebhookDelivery("delivery-1", "primary", webhookData, time.Hour, 0)
+		if err != nil {
+			t.Fatalf("Failed to enqueue expired webhook delivery: %v", err)
+		}
+		if !enqueued {
+			t.Error("Expected delivery to be enqueued after the window expired")
+		}
+
+		// Clean up
+		db.DeleteWebhook(queueID)
+	})
+
+	// Test sync job deduplication
+	t.Run("SyncJobDeduplication", func(t *testing.T) {
+		firstID, err := db.EnqueueActivitySyncJob(12345, 555)
+		if err != nil {
+			t.Fatalf("Failed to enqueue activity sync job: %v", err)
+		}
+
+		secondID, err := db.EnqueueActivitySyncJob(12345, 555)
+		if err != nil {
+			t.Fatalf("Failed to enqueue duplicate activity sync job: %v", err)
+		}
+
+		if secondID != firstID {
+			t.Errorf("Expected duplicate enqueue to return existing job %d, got %d", firstID, secondID)
+		}
+
+		// A different activity is a different job
+		if _, err := db.EnqueueActivitySyncJob(12345, 556); err != nil {
+			t.Fatalf("Failed to enqueue activity sync job: %v", err)
+		}
+
+		// Jobs without an activity are deduplicated too
+		listID, err := db.EnqueueSyncJob(12345, "list_activities")
+		if err != nil {
+			t.Fatalf("Failed to enqueue list job: %v", err)
+		}
+		duplicateListID, err := db.EnqueueSyncJob(12345, "list_activities")
+		if err != nil {
+			t.Fatalf("Failed to enqueue duplicate list job: %v", err)
+		}
+		if duplicateListID != listID {
+			t.Errorf("Expected duplicate list enqueue to return existing job %d, got %d", listID, duplicateListID)
+		}
+
+		length, err := db.GetSyncJobQueueLength()
+		if err != nil {
+			t.Fatalf("Failed to get sync job queue length: %v", err)
+		}
+		if length != 3 {
+			t.Errorf("Expected 3 sync jobs, got %d", length)
+		}
+
+		// Clean up
+		if _, err := db.db.Exec("DELETE FROM sync_jobs"); err != nil {
+			t.Fatalf("Failed to clean up sync jobs: %v", err)
+		}
+	})
+
+	// Test jobs can be queued again while being processed
+	t.Run("SyncJobRequeueWhileProcessing", func(t *testing.T) {
+		runningID, err := db.EnqueueSyncJob(12345, "sync_since")
+		if err != nil {
+			t.Fatalf("Failed to enqueue sync job: %v", err)
+		}
+		if job, err := db.ClaimSyncJob(); err != nil || job == nil || job.ID != runningID {
+			t.Fatalf("Failed to claim sync job %d: %v, %v", runningID, job, err)
+		}
+
+		queuedID, err := db.EnqueueSyncJob(12345, "sync_since")
+		if err != nil {
+			t.Fatalf("Failed to enqueue sync job while processing: %v", err)
+		}
+		if queuedID == runningID {
+			t.Fatal("Expected a new job to be queued while the existing job is processing")
+		}
+		if duplicateID, _ := db.EnqueueSyncJob(12345, "sync_since"); duplicateID != queuedID {
+			t.Errorf("Expected duplicate enqueue to return queued job %d, got %d", queuedID, duplicateID)
+		}
+
+		// The running job fails, and the queued job retries it
+		released, err := db.ReleaseSyncJob(runningID, 0, "failed")
+		if err != nil {
+			t.Fatalf("Failed to release sync job: %v", err)
+		}
+		if !released {
+			t.Error("Expected the failed job to be retried")
+		}
+		length, _ := db.GetSyncJobQueueLength()
+		if length != 1 {
+			t.Errorf("Expected only the queued job to remain, got %d jobs", length)
+		}
+
+		// Clean up
+		if _, err := db.db.Exec("DELETE FROM sync_jobs"); err != nil {
+			t.Fatalf("Failed to clean up sync jobs: %v", err)
+		}
+	})
+
+	// Test sync jobs are claimed round-robin across athletes
+	t.Run("SyncJobFairScheduling", func(t *testing.T) {
+		// A long backfill for one athlete is queued before a new athlete connects
+		for activityID := int64(1); activityID <= 3; activityID++ {
+			if _, err := db.EnqueueActivitySyncJob(111, activityID); err != nil {
+				t.Fatalf("Failed to enqueue activity sync job: %v", err)
+			}
+		}
+		if _, err := db.EnqueueActivitySyncJob(222, 10); err != nil {
+			t.Fatalf("Failed to enqueue activity sync job: %v", err)
+		}
+		if _, err := db.EnqueueActivitySyncJob(222, 11); err != nil {
+			t.Fatalf("Failed to enqueue activity sync job: %v", err)
+		}
+		// Resyncs wait for everything else
+		if _, err := db.EnqueueSyncJobWithPriority(333, "list_activities", nil, PriorityResync); err != nil {
+			t.Fatalf("Failed to enqueue resync job: %v", err)
+		}
+
+		var claimed []int64
+		for {
+			job, err := db.ClaimSyncJob()
+			if err != nil {
+				t.Fatalf("Failed to claim sync job: %v", err)
+			}
+			if job == nil {
+				break
+			}
+			claimed = append(claimed, job.AthleteID)
+			if err := db.DeleteSyncJob(job.ID); err != nil {
+				t.Fatalf("Failed to delete sync job: %v", err)
+			}
+		}
+
+		expected := []int64{111, 222, 111, 222, 111, 333}
+		if !slices.Equal(claimed, expected) {
+			t.Errorf("Expected athletes to be served in order %v, got %v", expected, claimed)
+		}
+	})
+
+	// Test athlete overviews
+	t.Run("AthleteOverview", func(t *testing.T) {
+		if _, err := db.EnqueueSyncJob(12345, "list_activities"); err != nil {
+			t.Fatalf("Failed to enqueue sync job: %v", err)
+		}
+		webhookID, err := db.EnqueueWebhook(json.RawMessage(`{"object_type": "activity", "object_id": 1, "owner_id": 12345}`))
+		if err != nil {
+			t.Fatalf("Failed to enqueue webhook: %v", err)
+		}
+
+		overviews, err := db.ListAthleteOverviews()
+		if err != nil {
+			t.Fatalf("Failed to list athlete overviews: %v", err)
+		}
+		if len(overviews) != 1 {
+			t.Fatalf("Expected 1 athlete, got %d", len(overviews))
+		}
+		if overviews[0].PendingSyncJobs != 1 || overviews[0].PendingWebhooks != 1 {
+			t.Errorf("Expected 1 pending sync job and webhook, got %+v", overviews[0])
+		}
+
+		overview, err := db.GetAthleteOverview(12345)
+		if err != nil {
+			t.Fatalf("Failed to get athlete overview: %v", err)
+		}
+		if overview.AthleteID != 12345 || overview.PendingSyncJobs != 1 {
+			t.Errorf("Unexpected athlete overview: %+v", overview)
+		}
+
+		if _, err := db.GetAthleteOverview(99999); err != ErrAthleteNotFound {
+			t.Errorf("Expected ErrAthleteNotFound, got %v", err)
+		}
+
+		// Clean up
+		db.DeleteWebhook(webhookID)
+		if _, err := db.db.Exec("DELETE FROM sync_jobs"); err != nil {
+			t.Fatalf("Failed to clean up sync jobs: %v", err)
+		}
+	})
+
+	t.Run("GapSyncMergesWindows", func(t *testing.T) {
+		now := time.Now().Truncate(time.Second)
+		if _, err := db.db.Exec(`UPDATE athletes SET client_id = 'primary' WHERE athlete_id = 12345`); err != nil {
+			t.Fatalf("Failed to set athlete client: %v", err)
+		}
+
+		count, err := db.StartGapSync("primary", now.Add(-1*time.Hour))
+		if err != nil {
+			t.Fatalf("Failed to start gap sync: %v", err)
+		}
+		if count != 1 {
+			t.Errorf("Expected gap sync for 1 athlete, got %d", count)
+		}
+		if count, _ := db.StartGapSync("secondary", now); count != 0 {
+			t.Errorf("Expected no gap sync for athletes of another client, got %d", count)
+		}
+		if err := db.AdvanceGapSync(12345, now.Add(-30*time.Minute).Unix()); err != nil {
+			t.Fatalf("Failed to advance gap sync: %v", err)
+		}
+
+		// A later gap restarts listing from the newest activity, keeping the earlier start
+		if _, err := db.StartGapSync("", now.Add(-10*time.Minute)); err != nil {
+			t.Fatalf("Failed to start gap sync: %v", err)
+		}
+		state, err := db.GetGapSyncState(12345)
+		if err != nil {
+			t.Fatalf("Failed to get gap sync state: %v", err)
+		}
+		if state == nil || state.Since != now.Add(-1*time.Hour).Unix() || state.Cursor != 0 {
+			t.Errorf("Expected merged gap sync from an hour ago, got %+v", state)
+		}
+
+		length, _ := db.GetSyncJobQueueLength()
+		if length != 1 {
+			t.Errorf("Expected a single sync_since job, got %d", length)
+		}
+
+		// Clean up
+		if err := db.FinishGapSync(12345); err != nil {
+			t.Fatalf("Failed to finish gap sync: %v", err)
+		}
+		if _, err := db.db.Exec("DELETE FROM sync_jobs"); err != nil {
+			t.Fatalf("Failed to clean up sync jobs: %v", err)
+		}
+	})
+
 	// Test event operations
 	t.Run("Events", func(t *testing.T) {
 		athleteSummary := json.RawMessage(`{"id": 12345, "username": "testuser"}`)
 
-		eventID, err := db.InsertAthleteConnectedEvent(12345, athleteSummary)
+		eventID, err := db.InsertAthleteConnectedEvent(12345, athleteSummary, nil, "")
 		if err != nil {
 			t.Fatalf("Failed to insert athlete_connected event: %v", err)
 		}
@@ -359,13 +654,16 @@ func TestDatabaseOperations(t *testing.T) {
 			t.Errorf("Expected event type %s, got %s", EventTypeAthleteConnected, events[0].EventType)
 		}
 
+		if events[0].Scopes != nil {
+			t.Errorf("Expected no scopes, got %v", events[0].Scopes)
+		}
+
 		// Test activity event insertion
 		activityID := int64(99999)
 		activity := json.RawMessage(`{"id": 99999, "name": "Morning Run"}`)
 
 		webhookData := json.RawMessage(`{"aspect_type":"create","object_type":"activity","object_id":99999,"owner_id":12345}`)
-		activityEventID, err := db.InsertActivityEvent(12345, &activityID, activity, webhookData)
-		if err != nil {
+		if _, err := db.InsertActivityEvent(12345, &activityID, activity, webhookData); err != nil {
 			t.Fatalf("Failed to insert activity event: %v", err)
 		}
 
@@ -382,20 +680,217 @@ func TestDatabaseOperations(t *testing.T) {
 			t.Errorf("Expected event type 'webhook', got %s", events[0].EventType)
 		}
 
-		// Test deleting athlete events (except deauth event)
-		err = db.DeleteAthleteEvents(12345, activityEventID)
-		if err != nil {
-			t.Fatalf("Failed to delete athlete events: %v", err)
+	})
+}
+
+func TestClientMigrations(t *testing.T) {
+	db, err := Open(t.TempDir() + "/test.db")
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer db.Close()
+
+	athleteID := int64(12345)
+	if err := db.UpsertAthlete(&Athlete{
+		AthleteID:      athleteID,
+		ClientID:       "primary",
+		AccessToken:    "access_token",
+		RefreshToken:   "refresh_token",
+		TokenExpiresAt: time.Now().Add(time.Hour),
+		AthleteSummary: json.RawMessage(`{"id": 12345}`),
+		CreatedAt:      time.Now(),
+		UpdatedAt:      time.Now(),
+	}); err != nil {
+		t.Fatalf("Failed to upsert athlete: %v", err)
+	}
+
+	if _, err := db.CreateClientMigration("token-same", athleteID, "primary", time.Hour); !errors.Is(err, ErrAlreadyOnClient) {
+		t.Errorf("Expected ErrAlreadyOnClient, got %v", err)
+	}
+	if _, err := db.CreateClientMigration("token-missing", 999, "secondary", time.Hour); !errors.Is(err, ErrAthleteNotFound) {
+		t.Errorf("Expected ErrAthleteNotFound, got %v", err)
+	}
+
+	migration, err := db.CreateClientMigration("token-1", athleteID, "secondary", time.Hour)
+	if err != nil {
+		t.Fatalf("Failed to create migration: %v", err)
+	}
+	if migration.FromClientID != "primary" || migration.ToClientID != "secondary" {
+		t.Errorf("Expected migration from primary to secondary, got %+v", migration)
+	}
+
+	now := time.Now()
+	if _, err := db.GetClientMigration("token-1", now.Add(2*time.Hour)); !errors.Is(err, ErrClientMigrationExpired) {
+		t.Errorf("Expected ErrClientMigrationExpired, got %v", err)
+	}
+	if _, err := db.GetClientMigration("unknown", now); !errors.Is(err, ErrClientMigrationNotFound) {
+		t.Errorf("Expected ErrClientMigrationNotFound, got %v", err)
+	}
+
+	got, err := db.GetClientMigration("token-1", now)
+	if err != nil {
+		t.Fatalf("Failed to get migration: %v", err)
+	}
+	if got.AthleteID != athleteID || got.ToClientID != "secondary" {
+		t.Errorf("Unexpected migration %+v", got)
+	}
+
+	// Usage counts the athlete's pending migration and each client's requests
+	for range 2 {
+		if err := db.RecordAPIRequests("primary", now, 2); err != nil {
+			t.Fatalf("Failed to record API requests: %v", err)
 		}
+	}
+	if err := db.RecordAPIRequests("primary", now.Add(-48*time.Hour), 1); err != nil {
+		t.Fatalf("Failed to record API requests: %v", err)
+	}
+	if err := db.RecordAPIRequests("retired", now, 1); err != nil {
+		t.Fatalf("Failed to record API requests: %v", err)
+	}
 
-		// Should only have 1 event left (the webhook event we excluded)
-		allEvents, err := db.GetEvents(0, 100)
-		if err != nil {
-			t.Fatalf("Failed to get all events: %v", err)
+	usage, err := db.GetClientUsage([]string{"primary", "secondary"}, now)
+	if err != nil {
+		t.Fatalf("Failed to get client usage: %v", err)
+	}
+	want := []ClientUsage{
+		{ClientID: "primary", Athletes: 1, PendingMigrations: 1, RequestsToday: 4, RequestsLast7Days: 5, Configured: true},
+		{ClientID: "secondary", Configured: true},
+		{ClientID: "retired", RequestsToday: 1, RequestsLast7Days: 1},
+	}
+	if len(usage) != len(want) {
+		t.Fatalf("Expected %d clients, got %d", len(want), len(usage))
+	}
+	for i := range want {
+		if *usage[i] != want[i] {
+			t.Errorf("Expected client usage %+v, got %+v", want[i], *usage[i])
 		}
+	}
+
+	// Only the athlete the migration was created for can complete it, once
+	if _, err := db.ClaimClientMigration("token-1", 999, now); !errors.Is(err, ErrClientMigrationAthleteMismatch) {
+		t.Errorf("Expected ErrClientMigrationAthleteMismatch, got %v", err)
+	}
+	if _, err := db.ClaimClientMigration("token-1", athleteID, now.Add(2*time.Hour)); !errors.Is(err, ErrClientMigrationExpired) {
+		t.Errorf("Expected ErrClientMigrationExpired, got %v", err)
+	}
+	claimed, err := db.ClaimClientMigration("token-1", athleteID, now)
+	if err != nil {
+		t.Fatalf("Failed to claim migration: %v", err)
+	}
+	if claimed.ToClientID != "secondary" || claimed.CompletedAt == nil {
+		t.Errorf("Unexpected claimed migration %+v", claimed)
+	}
+	if _, err := db.ClaimClientMigration("token-1", athleteID, now); !errors.Is(err, ErrClientMigrationCompleted) {
+		t.Errorf("Expected ErrClientMigrationCompleted, got %v", err)
+	}
+	if _, err := db.GetClientMigration("token-1", now); !errors.Is(err, ErrClientMigrationCompleted) {
+		t.Errorf("Expected ErrClientMigrationCompleted, got %v", err)
+	}
+
+	// The athlete has only left a client once they've reconnected under another
+	if left, _ := db.HasLeftClient(athleteID, "primary"); left {
+		t.Error("Expected athlete not to have left their current client")
+	}
+	if _, err := db.db.Exec(`UPDATE athletes SET client_id = 'secondary' WHERE athlete_id = ?`, athleteID); err != nil {
+		t.Fatalf("Failed to set athlete client: %v", err)
+	}
+	reconnection := &Reconnection{PreviousClientID: "primary", ClientID: "secondary"}
+	if _, err := db.InsertAthleteReconnectedEvent(athleteID, json.RawMessage(`{"id": 12345}`), reconnection, ""); err != nil {
+		t.Fatalf("Failed to insert reconnected event: %v", err)
+	}
+	if left, _ := db.HasLeftClient(athleteID, "primary"); !left {
+		t.Error("Expected athlete to have left the primary client")
+	}
+	if left, _ := db.HasLeftClient(athleteID, "secondary"); left {
+		t.Error("Expected athlete not to have left the secondary client")
+	}
+}
+
+func TestAPIKeys(t *testing.T) {
+	db, err := Open(t.TempDir() + "/test.db")
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer db.Close()
 
-		if len(allEvents) != 1 {
-			t.Errorf("Expected 1 event remaining, got %d", len(allEvents))
+	key, apiKey, err := db.CreateAPIKey("reader", []string{ScopeEventsRead}, nil)
+	if err != nil {
+		t.Fatalf("Failed to create api key: %v", err)
+	}
+	if !strings.HasPrefix(key, apiKey.Prefix) || apiKey.Prefix == key {
+		t.Errorf("Expected prefix %s to start key without revealing it", apiKey.Prefix)
+	}
+	if !apiKey.HasScope(ScopeEventsRead) || apiKey.HasScope(ScopeAdmin) {
+		t.Errorf("Expected only events:read scope, got %v", apiKey.Scopes)
+	}
+
+	// Only the hash is stored
+	var stored int
+	if err := db.db.QueryRow(`SELECT COUNT(*) FROM api_keys WHERE key_hash = ? OR prefix = ?`, key, key).Scan(&stored); err != nil || stored != 0 {
+		t.Errorf("Expected key not to be stored, got %d rows (%v)", stored, err)
+	}
+
+	// Invalid keys and scopes are rejected
+	if _, _, err := db.CreateAPIKey("reader", []string{ScopeAdmin}, nil); !errors.Is(err, ErrAPIKeyExists) {
+		t.Errorf("Expected ErrAPIKeyExists, got %v", err)
+	}
+	for _, name := range []string{metrics.APIKeyInternal, metrics.APIKeyUnknown} {
+		if _, _, err := db.CreateAPIKey(name, []string{ScopeAdmin}, nil); !errors.Is(err, ErrAPIKeyNameReserved) {
+			t.Errorf("Expected ErrAPIKeyNameReserved for %s, got %v", name, err)
 		}
-	})
+	}
+	athleteID := int64(12345)
+	for _, tt := range []struct {
+		scopes    []string
+		athleteID *int64
+	}{
+		{nil, nil},
+		{[]string{"write"}, nil},
+		{[]string{ScopeAthleteRead}, nil},
+		{[]string{ScopeEventsRead}, &athleteID},
+	} {
+		if _, _, err := db.CreateAPIKey("invalid", tt.scopes, tt.athleteID); !errors.Is(err, ErrInvalidAPIKeyScopes) {
+			t.Errorf("Expected ErrInvalidAPIKeyScopes for %v, got %v", tt.scopes, err)
+		}
+	}
+
+	// Authenticating records the last use, at most once a minute
+	now := time.Now()
+	authenticated, err := db.AuthenticateAPIKey(key, now)
+	if err != nil || authenticated == nil || authenticated.ID != apiKey.ID {
+		t.Fatalf("Expected key to authenticate, got %+v (%v)", authenticated, err)
+	}
+	if authenticated.LastUsedAt == nil || authenticated.LastUsedAt.Unix() != now.Unix() {
+		t.Errorf("Expected last use at %v, got %v", now, authenticated.LastUsedAt)
+	}
+	authenticated, _ = db.AuthenticateAPIKey(key, now.Add(30*time.Second))
+	if authenticated.LastUsedAt.Unix() != now.Unix() {
+		t.Errorf("Expected last use to be unchanged within a minute, got %v", authenticated.LastUsedAt)
+	}
+
+	if unknown, err := db.AuthenticateAPIKey("pss_unknown", now); err != nil || unknown != nil {
+		t.Errorf("Expected unknown key not to authenticate, got %+v (%v)", unknown, err)
+	}
+
+	// Revoked keys no longer authenticate and free their name
+	if err := db.RevokeAPIKey("reader", now); err != nil {
+		t.Fatalf("Failed to revoke api key: %v", err)
+	}
+	if err := db.RevokeAPIKey("reader", now); !errors.Is(err, ErrAPIKeyNotFound) {
+		t.Errorf("Expected ErrAPIKeyNotFound, got %v", err)
+	}
+	if revoked, err := db.AuthenticateAPIKey(key, now); err != nil || revoked != nil {
+		t.Errorf("Expected revoked key not to authenticate, got %+v (%v)", revoked, err)
+	}
+	if _, _, err := db.CreateAPIKey("reader", []string{ScopeAthleteRead}, &athleteID); err != nil {
+		t.Errorf("Expected name of revoked key to be reusable, got %v", err)
+	}
+
+	apiKeys, err := db.ListAPIKeys()
+	if err != nil {
+		t.Fatalf("Failed to list api keys: %v", err)
+	}
+	if len(apiKeys) != 2 || apiKeys[0].RevokedAt == nil || apiKeys[1].RevokedAt != nil || *apiKeys[1].AthleteID != athleteID {
+		t.Errorf("Expected revoked and athlete:read keys, got %+v %+v", apiKeys[0], apiKeys[1])
+	}
 }
@@ -14,31 +14,54 @@ import (
 type EventType string
 
 const (
-	EventTypeAthleteConnected EventType = "athlete_connected"
-	EventTypeWebhook          EventType = "webhook"
-	EventTypeBackfill         EventType = "backfill"
+	EventTypeAthleteConnected   EventType = "athlete_connected"
+	EventTypeAthleteReconnected EventType = "athlete_reconnected"
+	EventTypeWebhook            EventType = "webhook"
+	EventTypeBackfill           EventType = "backfill"
+	EventTypeReconciledDelete   EventType = "reconciled_delete"
+	EventTypeReconciledUpdate   EventType = "reconciled_update"
 )
 
 // Event represents an event in the event stream
 type Event struct {
-	EventID        int64           `json:"event_id"`
-	EventType      EventType       `json:"event_type"`
-	AthleteID      int64           `json:"athlete_id"`
-	ActivityID     *int64          `json:"activity_id,omitempty"` // Nullable
-	AthleteSummary json.RawMessage `json:"athlete_summary,omitempty"` // For athlete_connected events
-	Activity       json.RawMessage `json:"activity,omitempty"` // For webhook events (detailed activity)
-	WebhookEvent   json.RawMessage `json:"event,omitempty"` // For webhook events (raw webhook data)
-	CreatedAt      time.Time       `json:"created_at"`
+	EventID         int64           `json:"event_id"`
+	EventType       EventType       `json:"event_type"`
+	AthleteID       int64           `json:"athlete_id"`
+	ActivityID      *int64          `json:"activity_id,omitempty"`      // Nullable
+	AthleteSummary  json.RawMessage `json:"athlete_summary,omitempty"`  // For athlete_connected and athlete_reconnected events
+	Activity        json.RawMessage `json:"activity,omitempty"`         // For webhook events (detailed activity)
+	WebhookEvent    json.RawMessage `json:"event,omitempty"`            // For webhook events (raw webhook data)
+	CoalescedEvents json.RawMessage `json:"coalesced_events,omitempty"` // For webhook events built from several webhooks (raw data of each)
+	Scopes          []string        `json:"scopes,omitempty"`           // For athlete_connected and athlete_reconnected events (OAuth scopes granted)
+	PlantopoUser    string          `json:"plantopo_user,omitempty"`    // For athlete_connected and athlete_reconnected events (plantopo user who connected the athlete)
+	Reconnection    json.RawMessage `json:"reconnection,omitempty"`     // For athlete_reconnected events (see Reconnection)
+	CreatedAt       time.Time       `json:"created_at"`
+}
+
+// Reconnection describes how an athlete's connection changed when they
+// authorized again while already connected
+type Reconnection struct {
+	PreviousClientID string   `json:"previous_client_id"`
+	ClientID         string   `json:"client_id"`
+	PreviousScopes   []string `json:"previous_scopes"` // nil if unknown
+	Scopes           []string `json:"scopes"`          // nil if unknown
 }
 
 // InsertAthleteConnectedEvent inserts an athlete_connected event
-func (d *DB) InsertAthleteConnectedEvent(athleteID int64, athleteSummary json.RawMessage) (int64, error) {
+// scopes are the OAuth scopes granted by the athlete, nil if unknown
+// plantopoUser references the plantopo user who connected the athlete, empty if unknown
+func (d *DB) InsertAthleteConnectedEvent(athleteID int64, athleteSummary json.RawMessage, scopes []string, plantopoUser string) (int64, error) {
 	query := `
-		INSERT INTO events (event_type, athlete_id, athlete_summary)
-		VALUES (?, ?, ?)
+		INSERT INTO events (event_type, athlete_id, athlete_summary, scopes, plantopo_user)
+		VALUES (?, ?, ?, ?, NULLIF(?, ''))
 	`
 
-	result, err := d.db.Exec(query, EventTypeAthleteConnected, athleteID, athleteSummary)
+	scopesJSON, err := marshalScopes(scopes)
+	if err != nil {
+		return 0, err
+	}
+
+	result, err := d.db.Exec(query, EventTypeAthleteConnected, athleteID, athleteSummary, scopesJSON, plantopoUser)
 	if err != nil {
 		return 0, fmt.Errorf("failed to insert athlete_connected event: %w", err)
 	}
@@ -51,6 +74,38 @@ func (d *DB) InsertAthleteConnectedEvent(athleteID int64, athleteSummary json.Ra
 	return eventID, nil
 }
 
+// InsertAthleteReconnectedEvent inserts an athlete_reconnected event for an
+// athlete who authorized again while already connected
+// plantopoUser references the plantopo user who reconnected the athlete, empty if unknown
+func (d *DB) InsertAthleteReconnectedEvent(athleteID int64, athleteSummary json.RawMessage, reconnection *Reconnection, plantopoUser string) (int64, error) {
+	query := `
+		INSERT INTO events (event_type, athlete_id, athlete_summary, scopes, plantopo_user, reconnection)
+		VALUES (?, ?, ?, ?, NULLIF(?, ''), ?)
+	`
+
+	scopesJSON, err := marshalScopes(reconnection.Scopes)
+	if err != nil {
+		return 0, err
+	}
+
+	reconnectionJSON, err := json.Marshal(reconnection)
+	if err != nil {
+		return 0, fmt.Errorf("failed to marshal reconnection: %w", err)
+	}
+
+	result, err := d.db.Exec(query, EventTypeAthleteReconnected, athleteID, athleteSummary, scopesJSON, plantopoUser, string(reconnectionJSON))
+	if err != nil {
+		return 0, fmt.Errorf("failed to insert athlete_reconnected event: %w", err)
+	}
+
+	eventID, err := result.LastInsertId()
+	if err != nil {
+		return 0, fmt.Errorf("failed to get event_id: %w", err)
+	}
+
+	return eventID, nil
+}
+
 // InsertWebhookEvent inserts a webhook event with activity data
 func (d *DB) InsertWebhookEvent(athleteID int64, activityID *int64, activity, webhookEvent json.RawMessage) (int64, error) {
 	query := `
@@ -79,7 +134,7 @@ func (d *DB) GetEvents(cursor int64, limit int) ([]*Event, error) {
 	defer timer.ObserveDuration()
 
 	query := `
-		SELECT event_id, event_type, athlete_id, activity_id, athlete_summary, activity, webhook_event, created_at
+		SELECT event_id, event_type, athlete_id, activity_id, athlete_summary, activity, webhook_event, coalesced_webhook_events, scopes, IFNULL(plantopo_user, ''), reconnection, created_at
 		FROM events
 		WHERE event_id > ?
 		ORDER BY event_id ASC
@@ -97,7 +152,7 @@ func (d *DB) GetEvents(cursor int64, limit int) ([]*Event, error) {
 	for rows.Next() {
 		var event Event
 		var activityID sql.NullInt64
-		var athleteSummary, activity, webhookEvent sql.NullString
+		var athleteSummary, activity, webhookEvent, coalescedEvents, scopes, reconnection sql.NullString
 		var createdAt int64
 
 		err := rows.Scan(
@@ -108,6 +163,10 @@ func (d *DB) GetEvents(cursor int64, limit int) ([]*Event, error) {
 			&athleteSummary,
 			&activity,
 			&webhookEvent,
+			&coalescedEvents,
+			&scopes,
+			&event.PlantopoUser,
+			&reconnection,
 			&createdAt,
 		)
 		if err != nil {
@@ -126,6 +185,17 @@ func (d *DB) GetEvents(cursor int64, limit int) ([]*Event, error) {
 		if webhookEvent.Valid {
 			event.WebhookEvent = json.RawMessage(webhookEvent.String)
 		}
+		if coalescedEvents.Valid {
+			event.CoalescedEvents = json.RawMessage(coalescedEvents.String)
+		}
+		if scopes.Valid {
+			if err := json.Unmarshal([]byte(scopes.String), &event.Scopes); err != nil {
+				return nil, fmt.Errorf("failed to parse event scopes: %w", err)
+			}
+		}
+		if reconnection.Valid {
+			event.Reconnection = json.RawMessage(reconnection.String)
+		}
 		event.CreatedAt = time.Unix(createdAt, 0)
 
 		events = append(events, &event)
@@ -144,6 +214,13 @@ func (d *DB) GetEvents(cursor int64, limit int) ([]*Event, error) {
 // activityData: full activity details from Strava API (nil for delete/deauth events)
 // webhookEventData: raw webhook event data from Strava (must not be nil)
 func (d *DB) InsertActivityEvent(athleteID int64, activityID *int64, activityData, webhookEventData json.RawMessage) (int64, error) {
+	return d.InsertCoalescedActivityEvent(athleteID, activityID, activityData, webhookEventData, nil)
+}
+
+// InsertCoalescedActivityEvent inserts a webhook event resulting from one or more webhooks
+// coalescedEvents: raw data of every webhook the event was built from, oldest first
+// (nil if the event was built from webhookEventData alone)
+func (d *DB) InsertCoalescedActivityEvent(athleteID int64, activityID *int64, activityData, webhookEventData json.RawMessage, coalescedEvents []json.RawMessage) (int64, error) {
 	timer := prometheus.NewTimer(metrics.DBOperationDuration.WithLabelValues(metrics.DBOpInsertActivityEvent))
 	defer timer.ObserveDuration()
 
@@ -151,12 +228,21 @@ func (d *DB) InsertActivityEvent(athleteID int64, activityID *int64, activityDat
 		return 0, fmt.Errorf("webhookEventData is required for webhook events")
 	}
 
+	var coalescedData json.RawMessage
+	if len(coalescedEvents) > 0 {
+		var err error
+		coalescedData, err = json.Marshal(coalescedEvents)
+		if err != nil {
+			return 0, fmt.Errorf("failed to marshal coalesced webhook events: %w", err)
+		}
+	}
+
 	query := `
-		INSERT INTO events (event_type, athlete_id, activity_id, activity, webhook_event)
-		VALUES (?, ?, ?, ?, ?)
+		INSERT INTO events (event_type, athlete_id, activity_id, activity, webhook_event, coalesced_webhook_events)
+		VALUES (?, ?, ?, ?, ?, ?)
 	`
 
-	result, err := d.db.Exec(query, "webhook", athleteID, activityID, activityData, webhookEventData)
+	result, err := d.db.Exec(query, "webhook", athleteID, activityID, activityData, webhookEventData, coalescedData)
 	if err != nil {
 		metrics.DBOperationErrorsTotal.WithLabelValues(metrics.DBOpInsertActivityEvent).Inc()
 		return 0, fmt.Errorf("failed to insert activity event: %w", err)
@@ -196,12 +282,38 @@ func (d *DB) InsertBackfillEvent(athleteID int64, activityID int64, activityData
 	return eventID, nil
 }
 
+// InsertReconciledEvent inserts a reconciled_delete or reconciled_update event
+// for an activity whose webhook was lost. activityData is nil for deletes.
+func (d *DB) InsertReconciledEvent(eventType EventType, athleteID int64, activityID int64, activityData json.RawMessage) (int64, error) {
+	timer := prometheus.NewTimer(metrics.DBOperationDuration.WithLabelValues(metrics.DBOpInsertActivityEvent))
+	defer timer.ObserveDuration()
+
+	query := `
+		INSERT INTO events (event_type, athlete_id, activity_id, activity)
+		VALUES (?, ?, ?, ?)
+	`
+
+	result, err := d.db.Exec(query, eventType, athleteID, activityID, activityData)
+	if err != nil {
+		metrics.DBOperationErrorsTotal.WithLabelValues(metrics.DBOpInsertActivityEvent).Inc()
+		return 0, fmt.Errorf("failed to insert %s event: %w", eventType, err)
+	}
+
+	eventID, err := result.LastInsertId()
+	if err != nil {
+		metrics.DBOperationErrorsTotal.WithLabelValues(metrics.DBOpInsertActivityEvent).Inc()
+		return 0, fmt.Errorf("failed to get event_id: %w", err)
+	}
+
+	return eventID, nil
+}
+
 // ListEvents retrieves events for a specific athlete with cursor-based pagination
 // cursor: the last event_id seen (0 for first page)
 // limit: maximum number of events to return
 func (d *DB) ListEvents(athleteID int64, cursor int64, limit int) ([]*Event, error) {
 	query := `
-		SELECT event_id, event_type, athlete_id, activity_id, athlete_summary, activity, webhook_event, created_at
+		SELECT event_id, event_type, athlete_id, activity_id, athlete_summary, activity, webhook_event, coalesced_webhook_events, scopes, IFNULL(plantopo_user, ''), reconnection, created_at
 		FROM events
 		WHERE athlete_id = ? AND event_id > ?
 		ORDER BY event_id ASC
@@ -218,7 +330,7 @@ func (d *DB) ListEvents(athleteID int64, cursor int64, limit int) ([]*Event, err
 	for rows.Next() {
 		var event Event
 		var activityID sql.NullInt64
-		var athleteSummary, activity, webhookEvent sql.NullString
+		var athleteSummary, activity, webhookEvent, coalescedEvents, scopes, reconnection sql.NullString
 		var createdAt int64
 
 		err := rows.Scan(
@@ -229,6 +341,10 @@ func (d *DB) ListEvents(athleteID int64, cursor int64, limit int) ([]*Event, err
 			&athleteSummary,
 			&activity,
 			&webhookEvent,
+			&coalescedEvents,
+			&scopes,
+			&event.PlantopoUser,
+			&reconnection,
 			&createdAt,
 		)
 		if err != nil {
@@ -247,6 +363,17 @@ func (d *DB) ListEvents(athleteID int64, cursor int64, limit int) ([]*Event, err
 		if webhookEvent.Valid {
 			event.WebhookEvent = json.RawMessage(webhookEvent.String)
 		}
+		if coalescedEvents.Valid {
+			event.CoalescedEvents = json.RawMessage(coalescedEvents.String)
+		}
+		if scopes.Valid {
+			if err := json.Unmarshal([]byte(scopes.String), &event.Scopes); err != nil {
+				return nil, fmt.Errorf("failed to parse event scopes: %w", err)
+			}
+		}
+		if reconnection.Valid {
+			event.Reconnection = json.RawMessage(reconnection.String)
+		}
 		event.CreatedAt = time.Unix(createdAt, 0)
 
 		events = append(events, &event)
@@ -259,22 +386,15 @@ func (d *DB) ListEvents(athleteID int64, cursor int64, limit int) ([]*Event, err
 	return events, nil
 }
 
-// DeleteAthleteEvents deletes all events for an athlete except the deauthorization event
-// This should be called when an athlete revokes access
-func (d *DB) DeleteAthleteEvents(athleteID int64, exceptEventID int64) error {
-	timer := prometheus.NewTimer(metrics.DBOperationDuration.WithLabelValues(metrics.DBOpDeleteAthleteEvents))
-	defer timer.ObserveDuration()
-
-	query := `
-		DELETE FROM events
-		WHERE athlete_id = ? AND event_id != ?
-	`
+// marshalScopes formats scopes for the events table, NULL if unknown
+func marshalScopes(scopes []string) (sql.NullString, error) {
+	if scopes == nil {
+		return sql.NullString{}, nil
+	}
 
-	_, err := d.db.Exec(query, athleteID, exceptEventID)
+	data, err := json.Marshal(scopes)
 	if err != nil {
-		metrics.DBOperationErrorsTotal.WithLabelValues(metrics.DBOpDeleteAthleteEvents).Inc()
-		return fmt.Errorf("failed to delete athlete events: %w", err)
+		return sql.NullString{}, fmt.Errorf("failed to marshal scopes: %w", err)
 	}
-
-	return nil
+	return sql.NullString{String: string(data), Valid: true}, nil
 }
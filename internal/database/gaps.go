@@ -0,0 +1,216 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// WebhookHealth records webhook receipt for a client, used to detect periods
+// in which webhooks may have been lost
+type WebhookHealth struct {
+	ClientID       string     `json:"client_id"`
+	LastReceivedAt *time.Time `json:"last_received_at"` // Latest webhook delivery
+	LastHealthyAt  *time.Time `json:"last_healthy_at"`  // Subscription last confirmed healthy
+	SubscriptionID *int       `json:"subscription_id"`  // Subscription last confirmed healthy
+	LastGapSyncAt  *time.Time `json:"last_gap_sync_at"` // Gap sync last queued for a delivery gap
+}
+
+// GapSyncState tracks how far back a sync_since job has listed an athlete's activities
+type GapSyncState struct {
+	AthleteID int64 `json:"athlete_id"`
+	Since     int64 `json:"since"`  // Unix timestamp, activities started before this aren't listed
+	Cursor    int64 `json:"cursor"` // Unix timestamp, the next page lists activities started before this, 0 = now
+}
+
+// GetWebhookHealth returns the webhook receipt health of a client
+// Clients which have never been recorded get empty health
+func (d *DB) GetWebhookHealth(clientID string) (*WebhookHealth, error) {
+	query := `
+		SELECT last_received_at, last_healthy_at, subscription_id, last_gap_sync_at
+		FROM webhook_health
+		WHERE client_id = ?
+	`
+
+	health := WebhookHealth{ClientID: clientID}
+	var lastReceivedAt, lastHealthyAt, lastGapSyncAt sql.NullInt64
+	err := d.db.QueryRow(query, clientID).Scan(&lastReceivedAt, &lastHealthyAt, &health.SubscriptionID, &lastGapSyncAt)
+	if err == sql.ErrNoRows {
+		return &health, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get webhook health: %w", err)
+	}
+
+	health.LastReceivedAt = nullableTime(lastReceivedAt)
+	health.LastHealthyAt = nullableTime(lastHealthyAt)
+	health.LastGapSyncAt = nullableTime(lastGapSyncAt)
+
+	return &health, nil
+}
+
+// RecordWebhookReceived records that a webhook delivery was received for a client
+func (d *DB) RecordWebhookReceived(clientID string, at time.Time) error {
+	query := `
+		INSERT INTO webhook_health (client_id, last_received_at)
+		VALUES (?, ?)
+		ON CONFLICT (client_id) DO UPDATE SET last_received_at = MAX(IFNULL(last_received_at, 0), excluded.last_received_at)
+	`
+
+	if _, err := d.db.Exec(query, clientID, at.Unix()); err != nil {
+		return fmt.Errorf("failed to record webhook receipt: %w", err)
+	}
+
+	return nil
+}
+
+// RecordSubscriptionHealthy records that a client's subscription was confirmed healthy
+func (d *DB) RecordSubscriptionHealthy(clientID string, subscriptionID int, at time.Time) error {
+	query := `
+		INSERT INTO webhook_health (client_id, last_healthy_at, subscription_id)
+		VALUES (?, ?, ?)
+		ON CONFLICT (client_id) DO UPDATE SET
+			last_healthy_at = excluded.last_healthy_at,
+			subscription_id = excluded.subscription_id
+	`
+
+	if _, err := d.db.Exec(query, clientID, at.Unix(), subscriptionID); err != nil {
+		return fmt.Errorf("failed to record subscription health: %w", err)
+	}
+
+	return nil
+}
+
+// RecordGapSyncQueued records that gap sync was queued for a client's delivery gap
+func (d *DB) RecordGapSyncQueued(clientID string, at time.Time) error {
+	query := `
+		INSERT INTO webhook_health (client_id, last_gap_sync_at)
+		VALUES (?, ?)
+		ON CONFLICT (client_id) DO UPDATE SET last_gap_sync_at = excluded.last_gap_sync_at
+	`
+
+	if _, err := d.db.Exec(query, clientID, at.Unix()); err != nil {
+		return fmt.Errorf("failed to record gap sync: %w", err)
+	}
+
+	return nil
+}
+
+// GetLastHeartbeat returns when the server last recorded a heartbeat, nil if never
+func (d *DB) GetLastHeartbeat() (*time.Time, error) {
+	var lastSeenAt sql.NullInt64
+	err := d.db.QueryRow(`SELECT last_seen_at FROM server_heartbeat WHERE id = 1`).Scan(&lastSeenAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get heartbeat: %w", err)
+	}
+
+	return nullableTime(lastSeenAt), nil
+}
+
+// RecordHeartbeat records that the server is running
+func (d *DB) RecordHeartbeat(at time.Time) error {
+	query := `
+		INSERT INTO server_heartbeat (id, last_seen_at)
+		VALUES (1, ?)
+		ON CONFLICT (id) DO UPDATE SET last_seen_at = excluded.last_seen_at
+	`
+
+	if _, err := d.db.Exec(query, at.Unix()); err != nil {
+		return fmt.Errorf("failed to record heartbeat: %w", err)
+	}
+
+	return nil
+}
+
+// StartGapSync queues a sync_since job for every athlete of the client (every
+// athlete if clientID is empty) listing their activities back to since.
+// Athletes with a gap sync already in progress are listed again from the
+// newest activity back to the earlier of the two times.
+// Returns the number of athletes queued.
+func (d *DB) StartGapSync(clientID string, since time.Time) (int, error) {
+	query := `
+		SELECT athlete_id FROM athletes
+		WHERE ? = '' OR client_id = ?
+		ORDER BY athlete_id
+	`
+
+	rows, err := d.db.Query(query, clientID, clientID)
+	if err != nil {
+		return 0, fmt.Errorf("failed to list athletes: %w", err)
+	}
+
+	var athleteIDs []int64
+	for rows.Next() {
+		var athleteID int64
+		if err := rows.Scan(&athleteID); err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("failed to scan athlete: %w", err)
+		}
+		athleteIDs = append(athleteIDs, athleteID)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, fmt.Errorf("failed to iterate athletes: %w", err)
+	}
+
+	for _, athleteID := range athleteIDs {
+		if err := d.StartAthleteGapSync(athleteID, since); err != nil {
+			return 0, err
+		}
+	}
+
+	return len(athleteIDs), nil
+}
+
+// StartAthleteGapSync queues a sync_since job listing an athlete's activities
+// back to since, merging with any gap sync already in progress
+func (d *DB) StartAthleteGapSync(athleteID int64, since time.Time) error {
+	_, err := d.db.Exec(`
+		INSERT INTO gap_sync_state (athlete_id, since, cursor)
+		VALUES (?, ?, 0)
+		ON CONFLICT (athlete_id) DO UPDATE SET
+			since = MIN(since, excluded.since),
+			cursor = 0
+	`, athleteID, since.Unix())
+	if err != nil {
+		return fmt.Errorf("failed to start gap sync: %w", err)
+	}
+
+	_, err = d.EnqueueSyncJobWithPriority(athleteID, "sync_since", nil, PriorityGapSync)
+	return err
+}
+
+// GetGapSyncState returns an athlete's gap sync progress, nil if none is in progress
+func (d *DB) GetGapSyncState(athleteID int64) (*GapSyncState, error) {
+	state := GapSyncState{AthleteID: athleteID}
+	err := d.db.QueryRow(`SELECT since, cursor FROM gap_sync_state WHERE athlete_id = ?`, athleteID).Scan(&state.Since, &state.Cursor)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get gap sync state: %w", err)
+	}
+
+	return &state, nil
+}
+
+// AdvanceGapSync records that a page of activities has been listed by gap sync
+func (d *DB) AdvanceGapSync(athleteID int64, cursor int64) error {
+	if _, err := d.db.Exec(`UPDATE gap_sync_state SET cursor = ? WHERE athlete_id = ?`, cursor, athleteID); err != nil {
+		return fmt.Errorf("failed to advance gap sync state: %w", err)
+	}
+
+	return nil
+}
+
+// FinishGapSync removes an athlete's gap sync state once listing is complete
+func (d *DB) FinishGapSync(athleteID int64) error {
+	if _, err := d.db.Exec(`DELETE FROM gap_sync_state WHERE athlete_id = ?`, athleteID); err != nil {
+		return fmt.Errorf("failed to finish gap sync: %w", err)
+	}
+
+	return nil
+}
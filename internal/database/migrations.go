@@ -0,0 +1,304 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// migration upgrades a database created by an earlier version of schema.sql
+type migration func(tx *sql.Tx) error
+
+// migrations are applied in order to existing databases before schema.sql is
+// executed. PRAGMA user_version records how many have been applied. New
+// databases are created directly from schema.sql and skip them.
+var migrations = []migration{
+	// 1: Remove duplicate sync jobs before the unique index is created
+	func(tx *sql.Tx) error {
+		_, err := tx.Exec(`
+			DELETE FROM sync_jobs
+			WHERE id NOT IN (
+				SELECT MIN(id)
+				FROM sync_jobs
+				GROUP BY athlete_id, job_type, IFNULL(activity_id, 0)
+			)
+		`)
+		return err
+	},
+
+	// 2: Record the raw payloads of coalesced webhooks on events
+	func(tx *sql.Tx) error {
+		return addColumn(tx, "events", "coalesced_webhook_events", "TEXT")
+	},
+
+	// 3: Track the event_time of the latest webhook applied to each activity
+	func(tx *sql.Tx) error {
+		return addColumn(tx, "activities", "last_event_time", "INTEGER")
+	},
+
+	// 4: Allow queue items to be prioritised
+	func(tx *sql.Tx) error {
+		if err := addColumn(tx, "webhook_queue", "priority", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+			return err
+		}
+		return addColumn(tx, "sync_jobs", "priority", "INTEGER NOT NULL DEFAULT 0")
+	},
+
+	// 5: Allow reconciled events and track when activities started
+	func(tx *sql.Tx) error {
+		if err := rebuildEventsTable(tx, []string{"athlete_connected", "webhook", "backfill", "reconciled_delete", "reconciled_update"}); err != nil {
+			return err
+		}
+		return addColumn(tx, "activities", "start_date", "INTEGER")
+	},
+
+	// 6: Record the OAuth scopes granted by athletes
+	func(tx *sql.Tx) error {
+		if err := addColumn(tx, "athletes", "scopes", "TEXT"); err != nil {
+			return err
+		}
+		return addColumn(tx, "events", "scopes", "TEXT")
+	},
+
+	// 7: Carry plantopo users and return URLs through the OAuth flow
+	func(tx *sql.Tx) error {
+		for _, table := range []string{"oauth_states", "events"} {
+			if err := addColumn(tx, table, "plantopo_user", "TEXT"); err != nil {
+				return err
+			}
+		}
+		return addColumn(tx, "oauth_states", "return_to", "TEXT")
+	},
+
+	// 8: Bind OAuth states to browsers, support PKCE and detect replays
+	func(tx *sql.Tx) error {
+		for _, column := range []struct{ name, definition string }{
+			{"binding_hash", "TEXT"},
+			{"code_verifier", "TEXT"},
+			{"used_at", "INTEGER"},
+		} {
+			if err := addColumn(tx, "oauth_states", column.name, column.definition); err != nil {
+				return err
+			}
+		}
+		return nil
+	},
+
+	// 9: Allow athlete_reconnected events
+	func(tx *sql.Tx) error {
+		return rebuildEventsTable(tx, []string{"athlete_connected", "webhook", "backfill", "reconciled_delete", "reconciled_update", "athlete_reconnected"})
+	},
+
+	// 10: Record the client webhooks were delivered for and the client
+	// migration an OAuth flow completes
+	func(tx *sql.Tx) error {
+		if err := addColumn(tx, "webhook_queue", "client_id", "TEXT"); err != nil {
+			return err
+		}
+		return addColumn(tx, "oauth_states", "migration_token", "TEXT")
+	},
+
+	// 11: Only deduplicate sync jobs waiting to be claimed. schema.sql
+	// recreates the index.
+	func(tx *sql.Tx) error {
+		_, err := tx.Exec(`DROP INDEX IF EXISTS idx_sync_jobs_unique`)
+		return err
+	},
+
+	// 12: Fill in the start dates of activities recorded before they were
+	// tracked, from their latest event, so that reconciliation covers them
+	func(tx *sql.Tx) error {
+		var tables int
+		err := tx.QueryRow(`SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'activities'`).Scan(&tables)
+		if err != nil || tables == 0 {
+			return err
+		}
+		// SQLite takes the bare columns from the row with the MAX(event_id)
+		_, err = tx.Exec(`
+			UPDATE activities
+			SET start_date = latest.start_date
+			FROM (
+				SELECT activity_id, unixepoch(json_extract(activity, '$.start_date')) AS start_date, MAX(event_id)
+				FROM events
+				WHERE activity_id IS NOT NULL AND json_valid(activity)
+				GROUP BY activity_id
+			) AS latest
+			WHERE activities.activity_id = latest.activity_id
+			  AND activities.start_date IS NULL
+		`)
+		return err
+	},
+}
+
+// isNewDatabase returns true if the schema has never been initialized
+func isNewDatabase(db *sql.DB) (bool, error) {
+	var count int
+	err := db.QueryRow(`SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'athletes'`).Scan(&count)
+	if err != nil {
+		return false, fmt.Errorf("failed to inspect schema: %w", err)
+	}
+	return count == 0, nil
+}
+
+// migrate applies any migrations which haven't been applied yet
+func migrate(db *sql.DB) error {
+	var version int
+	if err := db.QueryRow(`PRAGMA user_version`).Scan(&version); err != nil {
+		return fmt.Errorf("failed to get schema version: %w", err)
+	}
+
+	for i := version; i < len(migrations); i++ {
+		tx, err := db.Begin()
+		if err != nil {
+			return fmt.Errorf("failed to begin migration %d: %w", i+1, err)
+		}
+
+		if err := migrations[i](tx); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("failed to apply migration %d: %w", i+1, err)
+		}
+
+		if err := setSchemaVersion(tx, i+1); err != nil {
+			tx.Rollback()
+			return err
+		}
+
+		if err := tx.Commit(); err != nil {
+			return fmt.Errorf("failed to commit migration %d: %w", i+1, err)
+		}
+	}
+
+	return nil
+}
+
+// addColumn adds a column to a table unless it already exists. Tables which
+// don't exist yet are skipped as schema.sql creates them with the column.
+func addColumn(tx *sql.Tx, table, column, definition string) error {
+	var tables int
+	err := tx.QueryRow(`SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = ?`, table).Scan(&tables)
+	if err != nil {
+		return fmt.Errorf("failed to inspect table %s: %w", table, err)
+	}
+	if tables == 0 {
+		return nil
+	}
+
+	exists, err := hasColumn(tx, table, column)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return nil
+	}
+
+	if _, err := tx.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition)); err != nil {
+		return fmt.Errorf("failed to add column %s.%s: %w", table, column, err)
+	}
+	return nil
+}
+
+// rebuildEventsTable recreates the events table to change the event types
+// allowed by its CHECK constraint, which SQLite can't alter in place. The new
+// table has every current column, copying those the old table has, so later
+// migrations adding columns are no-ops. Indexes are recreated by schema.sql.
+// The AUTOINCREMENT sequence is carried over so that the IDs of deleted events
+// are never reused, as consumers' cursors may already be past them.
+func rebuildEventsTable(tx *sql.Tx, eventTypes []string) error {
+	var seq int64
+	err := tx.QueryRow(`SELECT IFNULL(MAX(seq), 0) FROM sqlite_sequence WHERE name = 'events'`).Scan(&seq)
+	if err != nil {
+		return fmt.Errorf("failed to get events sequence: %w", err)
+	}
+
+	columns, err := tableColumns(tx, "events")
+	if err != nil {
+		return err
+	}
+	copied := strings.Join(columns, ", ")
+
+	quoted := make([]string, len(eventTypes))
+	for i, eventType := range eventTypes {
+		quoted[i] = "'" + eventType + "'"
+	}
+
+	statements := []string{
+		fmt.Sprintf(`CREATE TABLE events_new (
+			event_id INTEGER PRIMARY KEY AUTOINCREMENT,
+			event_type TEXT NOT NULL CHECK(event_type IN (%s)),
+			athlete_id INTEGER NOT NULL,
+			activity_id INTEGER,
+			athlete_summary TEXT,
+			activity TEXT,
+			webhook_event TEXT,
+			coalesced_webhook_events TEXT,
+			scopes TEXT,
+			plantopo_user TEXT,
+			reconnection TEXT,
+			created_at INTEGER NOT NULL DEFAULT (unixepoch())
+		)`, strings.Join(quoted, ", ")),
+		fmt.Sprintf(`INSERT INTO events_new (%s) SELECT %s FROM events`, copied, copied),
+		`DROP TABLE events`,
+		`ALTER TABLE events_new RENAME TO events`,
+	}
+
+	for _, statement := range statements {
+		if _, err := tx.Exec(statement); err != nil {
+			return fmt.Errorf("failed to rebuild events table: %w", err)
+		}
+	}
+
+	// The copied rows only restore the sequence up to the latest remaining event
+	if _, err := tx.Exec(`DELETE FROM sqlite_sequence WHERE name = 'events'`); err != nil {
+		return fmt.Errorf("failed to reset events sequence: %w", err)
+	}
+	if _, err := tx.Exec(`INSERT INTO sqlite_sequence (name, seq) VALUES ('events', MAX(?, IFNULL((SELECT MAX(event_id) FROM events), 0)))`, seq); err != nil {
+		return fmt.Errorf("failed to restore events sequence: %w", err)
+	}
+	return nil
+}
+
+// hasColumn returns true if the table has a column with the given name
+func hasColumn(tx *sql.Tx, table, column string) (bool, error) {
+	columns, err := tableColumns(tx, table)
+	if err != nil {
+		return false, err
+	}
+	return slices.Contains(columns, column), nil
+}
+
+// tableColumns returns the names of a table's columns in order
+func tableColumns(tx *sql.Tx, table string) ([]string, error) {
+	rows, err := tx.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get columns of %s: %w", table, err)
+	}
+	defer rows.Close()
+
+	var columns []string
+	for rows.Next() {
+		var cid, notNull, pk int
+		var name, colType string
+		var defaultValue sql.NullString
+		if err := rows.Scan(&cid, &name, &colType, &notNull, &defaultValue, &pk); err != nil {
+			return nil, fmt.Errorf("failed to scan column of %s: %w", table, err)
+		}
+		columns = append(columns, name)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating columns of %s: %w", table, err)
+	}
+
+	return columns, nil
+}
+
+// setSchemaVersion records the number of migrations applied
+func setSchemaVersion(execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}, version int) error {
+	// PRAGMA does not support bound parameters
+	if _, err := execer.Exec(fmt.Sprintf("PRAGMA user_version = %d", version)); err != nil {
+		return fmt.Errorf("failed to set schema version: %w", err)
+	}
+	return nil
+}
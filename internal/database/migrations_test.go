@@ -0,0 +1,192 @@
+package database
+
+import (
+	"database/sql"
+	"encoding/json"
+	"testing"
+)
+
+// baselineSchema is the original schema, before any migrations
+const baselineSchema = `
+CREATE TABLE athletes (
+    athlete_id INTEGER PRIMARY KEY,
+    client_id TEXT NOT NULL,
+    access_token TEXT NOT NULL,
+    refresh_token TEXT NOT NULL,
+    token_expires_at INTEGER NOT NULL,
+    athlete_summary TEXT NOT NULL,
+    created_at INTEGER NOT NULL DEFAULT (unixepoch()),
+    updated_at INTEGER NOT NULL DEFAULT (unixepoch())
+);
+CREATE TABLE webhook_queue (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    data TEXT NOT NULL,
+    retry_count INTEGER NOT NULL DEFAULT 0,
+    last_error TEXT,
+    next_retry_at INTEGER,
+    processing_started_at INTEGER
+);
+CREATE TABLE events (
+    event_id INTEGER PRIMARY KEY AUTOINCREMENT,
+    event_type TEXT NOT NULL CHECK(event_type IN ('athlete_connected', 'webhook', 'backfill')),
+    athlete_id INTEGER NOT NULL,
+    activity_id INTEGER,
+    athlete_summary TEXT,
+    activity TEXT,
+    webhook_event TEXT,
+    created_at INTEGER NOT NULL DEFAULT (unixepoch())
+);
+CREATE TABLE sync_jobs (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    athlete_id INTEGER NOT NULL,
+    job_type TEXT NOT NULL DEFAULT 'sync_all_activities',
+    activity_id INTEGER,
+    retry_count INTEGER NOT NULL DEFAULT 0,
+    last_error TEXT,
+    next_retry_at INTEGER,
+    processing_started_at INTEGER,
+    created_at INTEGER NOT NULL DEFAULT (unixepoch())
+);
+`
+
+func TestMigrations(t *testing.T) {
+	dbPath := t.TempDir() + "/test.db"
+
+	// Create a database as an earlier version would have
+	raw, err := sql.Open("sqlite", dbPath)
+	if err != nil {
+		t.Fatalf("Failed to open raw database: %v", err)
+	}
+	if _, err := raw.Exec(baselineSchema); err != nil {
+		t.Fatalf("Failed to create baseline schema: %v", err)
+	}
+	_, err = raw.Exec(`
+		INSERT INTO sync_jobs (athlete_id, job_type, activity_id) VALUES
+			(1, 'list_activities', NULL),
+			(1, 'list_activities', NULL),
+			(1, 'sync_activity', 100),
+			(1, 'sync_activity', 100),
+			(1, 'sync_activity', 101)
+	`)
+	if err != nil {
+		t.Fatalf("Failed to insert duplicate sync jobs: %v", err)
+	}
+	// A deleted event whose ID must not be reused
+	_, err = raw.Exec(`
+		INSERT INTO events (event_type, athlete_id) VALUES ('webhook', 1);
+		DELETE FROM events;
+	`)
+	if err != nil {
+		t.Fatalf("Failed to insert deleted event: %v", err)
+	}
+	raw.Close()
+
+	db, err := Open(dbPath)
+	if err != nil {
+		t.Fatalf("Failed to open and migrate database: %v", err)
+	}
+	defer db.Close()
+
+	var version int
+	if err := db.db.QueryRow("PRAGMA user_version").Scan(&version); err != nil {
+		t.Fatalf("Failed to get schema version: %v", err)
+	}
+	if version != len(migrations) {
+		t.Errorf("Expected schema version %d, got %d", len(migrations), version)
+	}
+
+	// Duplicate sync jobs are removed before the unique index is created
+	length, err := db.GetSyncJobQueueLength()
+	if err != nil {
+		t.Fatalf("Failed to get sync job queue length: %v", err)
+	}
+	if length != 3 {
+		t.Errorf("Expected 3 sync jobs after deduplication, got %d", length)
+	}
+
+	// Events can be written and read with the added columns
+	activityID := int64(100)
+	coalesced := []json.RawMessage{json.RawMessage(`{"object_id": 100}`), json.RawMessage(`{"object_id": 100}`)}
+	if _, err := db.InsertCoalescedActivityEvent(1, &activityID, json.RawMessage(`{"id": 100}`), coalesced[1], coalesced); err != nil {
+		t.Fatalf("Failed to insert event after migration: %v", err)
+	}
+	events, err := db.GetEvents(0, 10)
+	if err != nil {
+		t.Fatalf("Failed to get events after migration: %v", err)
+	}
+	if len(events) != 1 || len(events[0].CoalescedEvents) == 0 {
+		t.Fatal("Expected event with coalesced webhook events after migration")
+	}
+	if events[0].EventID != 2 {
+		t.Errorf("Expected event IDs to continue after the deleted event, got %d", events[0].EventID)
+	}
+
+	// Event types added since the baseline are allowed
+	if _, err := db.InsertReconciledEvent(EventTypeReconciledDelete, 1, 100, nil); err != nil {
+		t.Errorf("Failed to insert reconciled event after migration: %v", err)
+	}
+}
+
+func TestNewDatabaseSkipsMigrations(t *testing.T) {
+	dbPath := t.TempDir() + "/test.db"
+
+	db, err := Open(dbPath)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	db.Close()
+
+	// Reopening an up-to-date database should be a no-op
+	db, err = Open(dbPath)
+	if err != nil {
+		t.Fatalf("Failed to reopen database: %v", err)
+	}
+	defer db.Close()
+
+	var version int
+	if err := db.db.QueryRow("PRAGMA user_version").Scan(&version); err != nil {
+		t.Fatalf("Failed to get schema version: %v", err)
+	}
+	if version != len(migrations) {
+		t.Errorf("Expected schema version %d, got %d", len(migrations), version)
+	}
+}
+
+func TestMigrationFillsActivityStartDates(t *testing.T) {
+	dbPath := t.TempDir() + "/test.db"
+
+	db, err := Open(dbPath)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+
+	// An activity recorded before start dates were tracked, with an older
+	// event from before it was edited
+	if _, err := db.InsertBackfillEvent(1, 100, json.RawMessage(`{"id": 100, "start_date": "2024-01-01T09:00:00Z"}`)); err != nil {
+		t.Fatalf("Failed to insert event: %v", err)
+	}
+	if _, err := db.InsertBackfillEvent(1, 100, json.RawMessage(`{"id": 100, "start_date": "2024-01-01T10:00:00Z"}`)); err != nil {
+		t.Fatalf("Failed to insert event: %v", err)
+	}
+	if err := db.RecordActivityState(1, 100, "fingerprint", 0, ActivitySourceBackfill); err != nil {
+		t.Fatalf("Failed to record activity state: %v", err)
+	}
+	if _, err := db.db.Exec(`PRAGMA user_version = 11`); err != nil {
+		t.Fatalf("Failed to set schema version: %v", err)
+	}
+	db.Close()
+
+	db, err = Open(dbPath)
+	if err != nil {
+		t.Fatalf("Failed to open and migrate database: %v", err)
+	}
+	defer db.Close()
+
+	var startDate sql.NullInt64
+	if err := db.db.QueryRow(`SELECT start_date FROM activities WHERE activity_id = 100`).Scan(&startDate); err != nil {
+		t.Fatalf("Failed to get start date: %v", err)
+	}
+	if expected := int64(1704103200); !startDate.Valid || startDate.Int64 != expected {
+		t.Errorf("Expected start date %d from the latest event, got %v", expected, startDate)
+	}
+}
@@ -0,0 +1,124 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+var (
+	// ErrOAuthStateNotFound is returned for a state which was never issued or has been cleaned up
+	ErrOAuthStateNotFound = errors.New("oauth state not found")
+
+	// ErrOAuthStateExpired is returned for a state which expired before it was used
+	ErrOAuthStateExpired = errors.New("oauth state expired")
+
+	// ErrOAuthStateUsed is returned for a state which has already been used
+	ErrOAuthStateUsed = errors.New("oauth state already used")
+)
+
+// OAuthState is the state of an OAuth authorization flow in progress
+type OAuthState struct {
+	State          string    `json:"state"`
+	ClientID       string    `json:"client_id"`
+	PlantopoUser   string    `json:"plantopo_user,omitempty"`   // Plantopo user connecting, empty if not given
+	ReturnTo       string    `json:"return_to,omitempty"`       // URL the user is redirected to once the flow ends, empty if not given
+	BindingHash    string    `json:"-"`                         // SHA-256 of the browser binding cookie, empty if not bound
+	CodeVerifier   string    `json:"-"`                         // PKCE code verifier, empty if PKCE isn't used
+	MigrationToken string    `json:"migration_token,omitempty"` // Client migration the flow completes, empty if none
+	ExpiresAt      time.Time `json:"expires_at"`
+}
+
+// SaveOAuthState records the state of an authorization flow which has been started
+func (d *DB) SaveOAuthState(state *OAuthState) error {
+	query := `
+		INSERT INTO oauth_states (state, client_id, plantopo_user, return_to, binding_hash, code_verifier, migration_token, expires_at)
+		VALUES (?, ?, NULLIF(?, ''), NULLIF(?, ''), NULLIF(?, ''), NULLIF(?, ''), NULLIF(?, ''), ?)
+	`
+
+	_, err := d.db.Exec(query,
+		state.State,
+		state.ClientID,
+		state.PlantopoUser,
+		state.ReturnTo,
+		state.BindingHash,
+		state.CodeVerifier,
+		state.MigrationToken,
+		state.ExpiresAt.Unix(),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to save oauth state: %w", err)
+	}
+
+	return nil
+}
+
+// ConsumeOAuthState marks a state as used so that it can't be used again and
+// returns it. Returns ErrOAuthStateNotFound, ErrOAuthStateExpired or
+// ErrOAuthStateUsed if the state can't be used. Used states are kept until
+// they expire so that replays can be told apart from unknown states.
+func (d *DB) ConsumeOAuthState(state string, now time.Time) (*OAuthState, error) {
+	query := `
+		SELECT client_id, IFNULL(plantopo_user, ''), IFNULL(return_to, ''), IFNULL(binding_hash, ''), IFNULL(code_verifier, ''), IFNULL(migration_token, ''), expires_at, used_at
+		FROM oauth_states
+		WHERE state = ?
+	`
+
+	entry := OAuthState{State: state}
+	var expiresAt int64
+	var usedAt sql.NullInt64
+	err := d.db.QueryRow(query, state).Scan(
+		&entry.ClientID,
+		&entry.PlantopoUser,
+		&entry.ReturnTo,
+		&entry.BindingHash,
+		&entry.CodeVerifier,
+		&entry.MigrationToken,
+		&expiresAt,
+		&usedAt,
+	)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrOAuthStateNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get oauth state: %w", err)
+	}
+	if usedAt.Valid {
+		return nil, ErrOAuthStateUsed
+	}
+
+	entry.ExpiresAt = time.Unix(expiresAt, 0)
+	if now.After(entry.ExpiresAt) {
+		if _, err := d.db.Exec(`DELETE FROM oauth_states WHERE state = ?`, state); err != nil {
+			return nil, fmt.Errorf("failed to delete oauth state: %w", err)
+		}
+		return nil, ErrOAuthStateExpired
+	}
+
+	// Only one of concurrent uses of the same state succeeds
+	result, err := d.db.Exec(`UPDATE oauth_states SET used_at = ? WHERE state = ? AND used_at IS NULL`, now.Unix(), state)
+	if err != nil {
+		return nil, fmt.Errorf("failed to consume oauth state: %w", err)
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return nil, fmt.Errorf("failed to consume oauth state: %w", err)
+	}
+	if affected == 0 {
+		return nil, ErrOAuthStateUsed
+	}
+
+	return &entry, nil
+}
+
+// DeleteExpiredOAuthStates removes states which expired before now
+// Returns the number of states removed
+func (d *DB) DeleteExpiredOAuthStates(now time.Time) (int64, error) {
+	result, err := d.db.Exec(`DELETE FROM oauth_states WHERE expires_at < ?`, now.Unix())
+	if err != nil {
+		return 0, fmt.Errorf("failed to delete expired oauth states: %w", err)
+	}
+
+	return result.RowsAffected()
+}
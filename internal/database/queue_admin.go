@@ -0,0 +1,313 @@
+package database
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"plantopo-strava-sync/internal/metrics"
+)
+
+var (
+	// ErrQueueItemNotFound is returned when a queue item doesn't exist
+	ErrQueueItemNotFound = errors.New("queue item not found")
+	// ErrQueueItemProcessing is returned when a queue item is claimed by the worker
+	ErrQueueItemProcessing = errors.New("queue item is being processed")
+)
+
+// QueueFilter restricts which queue items are listed
+// Zero values are ignored
+type QueueFilter struct {
+	AthleteID     int64
+	JobType       string // Sync jobs only
+	MinRetryCount int
+	LastError     string // Substring of last_error
+	Limit         int    // Defaults to 100
+}
+
+// ListWebhooks returns queued webhooks matching the filter ordered by ID
+// The athlete filter matches the webhook's owner_id
+func (d *DB) ListWebhooks(filter QueueFilter) ([]*WebhookQueueItem, error) {
+	timer := prometheus.NewTimer(metrics.DBOperationDuration.WithLabelValues(metrics.DBOpListQueueItems))
+	defer timer.ObserveDuration()
+
+	var conditions []string
+	var args []interface{}
+
+	if filter.AthleteID != 0 {
+		// Guard json_extract as queued data is not guaranteed to be valid JSON
+		conditions = append(conditions, `CASE WHEN json_valid(data) THEN json_extract(data, '$.owner_id') = ? END`)
+		args = append(args, filter.AthleteID)
+	}
+	conditions, args = appendRetryFilters(conditions, args, filter)
+
+	query := `
+		SELECT id, data, retry_count, last_error, next_retry_at, processing_started_at, priority, IFNULL(client_id, '')
+		FROM webhook_queue
+	` + whereClause(conditions) + `
+		ORDER BY id ASC
+		LIMIT ?
+	`
+	args = append(args, queueLimit(filter))
+
+	rows, err := d.db.Query(query, args...)
+	if err != nil {
+		metrics.DBOperationErrorsTotal.WithLabelValues(metrics.DBOpListQueueItems).Inc()
+		return nil, fmt.Errorf("failed to list webhooks: %w", err)
+	}
+	defer rows.Close()
+
+	items := []*WebhookQueueItem{}
+	for rows.Next() {
+		var item WebhookQueueItem
+		var data string
+		var nextRetryAt, processingStartedAt sql.NullInt64
+
+		err := rows.Scan(
+			&item.ID,
+			&data,
+			&item.RetryCount,
+			&item.LastError,
+			&nextRetryAt,
+			&processingStartedAt,
+			&item.Priority,
+			&item.ClientID,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan webhook: %w", err)
+		}
+
+		item.Data = json.RawMessage(data)
+		item.NextRetryAt = nullableTime(nextRetryAt)
+		item.ProcessingStartedAt = nullableTime(processingStartedAt)
+
+		items = append(items, &item)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating webhooks: %w", err)
+	}
+
+	return items, nil
+}
+
+// ListSyncJobs returns queued sync jobs matching the filter ordered by ID
+func (d *DB) ListSyncJobs(filter QueueFilter) ([]*SyncJob, error) {
+	timer := prometheus.NewTimer(metrics.DBOperationDuration.WithLabelValues(metrics.DBOpListQueueItems))
+	defer timer.ObserveDuration()
+
+	var conditions []string
+	var args []interface{}
+
+	if filter.AthleteID != 0 {
+		conditions = append(conditions, `athlete_id = ?`)
+		args = append(args, filter.AthleteID)
+	}
+	if filter.JobType != "" {
+		conditions = append(conditions, `job_type = ?`)
+		args = append(args, filter.JobType)
+	}
+	conditions, args = appendRetryFilters(conditions, args, filter)
+
+	query := `
+		SELECT id, athlete_id, job_type, activity_id, retry_count, last_error, next_retry_at, processing_started_at, priority, created_at
+		FROM sync_jobs
+	` + whereClause(conditions) + `
+		ORDER BY id ASC
+		LIMIT ?
+	`
+	args = append(args, queueLimit(filter))
+
+	rows, err := d.db.Query(query, args...)
+	if err != nil {
+		metrics.DBOperationErrorsTotal.WithLabelValues(metrics.DBOpListQueueItems).Inc()
+		return nil, fmt.Errorf("failed to list sync jobs: %w", err)
+	}
+	defer rows.Close()
+
+	jobs := []*SyncJob{}
+	for rows.Next() {
+		var job SyncJob
+		var nextRetryAt, processingStartedAt sql.NullInt64
+		var createdAt int64
+
+		err := rows.Scan(
+			&job.ID,
+			&job.AthleteID,
+			&job.JobType,
+			&job.ActivityID,
+			&job.RetryCount,
+			&job.LastError,
+			&nextRetryAt,
+			&processingStartedAt,
+			&job.Priority,
+			&createdAt,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan sync job: %w", err)
+		}
+
+		job.NextRetryAt = nullableTime(nextRetryAt)
+		job.ProcessingStartedAt = nullableTime(processingStartedAt)
+		job.CreatedAt = time.Unix(createdAt, 0)
+
+		jobs = append(jobs, &job)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating sync jobs: %w", err)
+	}
+
+	return jobs, nil
+}
+
+// RetryWebhookNow makes a webhook waiting for a retry ready immediately
+// Returns ErrQueueItemProcessing if the worker has claimed it
+func (d *DB) RetryWebhookNow(id int64) error {
+	return d.updateIdleQueueItem("webhook_queue", id, `UPDATE webhook_queue SET next_retry_at = NULL`)
+}
+
+// CancelWebhook removes a webhook from the queue without processing it
+// Returns ErrQueueItemProcessing if the worker has claimed it
+func (d *DB) CancelWebhook(id int64) error {
+	return d.updateIdleQueueItem("webhook_queue", id, `DELETE FROM webhook_queue`)
+}
+
+// SetWebhookPriority sets the priority of a queued webhook
+// The priority of a webhook being processed can be changed, it applies if it is retried
+func (d *DB) SetWebhookPriority(id int64, priority int) error {
+	return d.setQueueItemPriority("webhook_queue", id, priority)
+}
+
+// RetrySyncJobNow makes a sync job waiting for a retry ready immediately
+// Returns ErrQueueItemProcessing if the worker has claimed it
+func (d *DB) RetrySyncJobNow(id int64) error {
+	return d.updateIdleQueueItem("sync_jobs", id, `UPDATE sync_jobs SET next_retry_at = NULL`)
+}
+
+// CancelSyncJob removes a sync job from the queue without processing it
+// Returns ErrQueueItemProcessing if the worker has claimed it
+func (d *DB) CancelSyncJob(id int64) error {
+	return d.updateIdleQueueItem("sync_jobs", id, `DELETE FROM sync_jobs`)
+}
+
+// SetSyncJobPriority sets the priority of a queued sync job
+// The priority of a job being processed can be changed, it applies if it is retried
+func (d *DB) SetSyncJobPriority(id int64, priority int) error {
+	return d.setQueueItemPriority("sync_jobs", id, priority)
+}
+
+// updateIdleQueueItem runs statement against a queue item unless the worker
+// currently holds its processing lock (the same staleness rule as claiming),
+// so that it can't interfere with an item being processed
+func (d *DB) updateIdleQueueItem(table string, id int64, statement string) error {
+	timer := prometheus.NewTimer(metrics.DBOperationDuration.WithLabelValues(metrics.DBOpUpdateQueueItem))
+	defer timer.ObserveDuration()
+
+	staleThreshold := time.Now().Add(-StaleLockTimeout).Unix()
+
+	query := statement + `
+		WHERE id = ?
+		  AND (processing_started_at IS NULL OR processing_started_at < ?)
+	`
+
+	result, err := d.db.Exec(query, id, staleThreshold)
+	if err != nil {
+		metrics.DBOperationErrorsTotal.WithLabelValues(metrics.DBOpUpdateQueueItem).Inc()
+		return fmt.Errorf("failed to update %s item: %w", table, err)
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		metrics.DBOperationErrorsTotal.WithLabelValues(metrics.DBOpUpdateQueueItem).Inc()
+		return fmt.Errorf("failed to get rows affected: %w", err)
+	}
+
+	if affected == 0 {
+		exists, err := d.queueItemExists(table, id)
+		if err != nil {
+			return err
+		}
+		if exists {
+			return ErrQueueItemProcessing
+		}
+		return ErrQueueItemNotFound
+	}
+
+	return nil
+}
+
+// setQueueItemPriority sets the priority of a queue item
+func (d *DB) setQueueItemPriority(table string, id int64, priority int) error {
+	timer := prometheus.NewTimer(metrics.DBOperationDuration.WithLabelValues(metrics.DBOpUpdateQueueItem))
+	defer timer.ObserveDuration()
+
+	result, err := d.db.Exec(`UPDATE `+table+` SET priority = ? WHERE id = ?`, priority, id)
+	if err != nil {
+		metrics.DBOperationErrorsTotal.WithLabelValues(metrics.DBOpUpdateQueueItem).Inc()
+		return fmt.Errorf("failed to set %s item priority: %w", table, err)
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		metrics.DBOperationErrorsTotal.WithLabelValues(metrics.DBOpUpdateQueueItem).Inc()
+		return fmt.Errorf("failed to get rows affected: %w", err)
+	}
+
+	if affected == 0 {
+		return ErrQueueItemNotFound
+	}
+
+	return nil
+}
+
+// queueItemExists returns true if the queue item is present
+func (d *DB) queueItemExists(table string, id int64) (bool, error) {
+	var exists bool
+	if err := d.db.QueryRow(`SELECT EXISTS (SELECT 1 FROM `+table+` WHERE id = ?)`, id).Scan(&exists); err != nil {
+		return false, fmt.Errorf("failed to check %s item: %w", table, err)
+	}
+	return exists, nil
+}
+
+// appendRetryFilters adds the filters common to both queues
+func appendRetryFilters(conditions []string, args []interface{}, filter QueueFilter) ([]string, []interface{}) {
+	if filter.MinRetryCount > 0 {
+		conditions = append(conditions, `retry_count >= ?`)
+		args = append(args, filter.MinRetryCount)
+	}
+	if filter.LastError != "" {
+		conditions = append(conditions, `instr(last_error, ?) > 0`)
+		args = append(args, filter.LastError)
+	}
+	return conditions, args
+}
+
+// whereClause joins conditions into a WHERE clause, or returns "" if there are none
+func whereClause(conditions []string) string {
+	if len(conditions) == 0 {
+		return ""
+	}
+	return "WHERE " + strings.Join(conditions, " AND ")
+}
+
+// queueLimit returns the filter's limit or the default
+func queueLimit(filter QueueFilter) int {
+	if filter.Limit <= 0 {
+		return 100
+	}
+	return filter.Limit
+}
+
+// nullableTime converts a nullable Unix timestamp
+func nullableTime(value sql.NullInt64) *time.Time {
+	if !value.Valid {
+		return nil
+	}
+	t := time.Unix(value.Int64, 0)
+	return &t
+}
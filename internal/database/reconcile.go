@@ -0,0 +1,113 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// ReconcileState tracks how far back reconciliation has listed an athlete's activities
+type ReconcileState struct {
+	AthleteID   int64      `json:"athlete_id"`
+	StartedAt   time.Time  `json:"started_at"`
+	Since       int64      `json:"since"`        // Unix timestamp, activities started before this aren't reconciled
+	Cursor      int64      `json:"cursor"`       // Unix timestamp, the next page lists activities started before this, 0 = now
+	CompletedAt *time.Time `json:"completed_at"` // nil while in progress
+}
+
+// StartDueReconciliations queues a reconcile_activities job for every athlete
+// who hasn't had a reconciliation started within interval, covering the
+// activities started within window before now.
+// Returns the number of athletes queued.
+func (d *DB) StartDueReconciliations(interval, window time.Duration, now time.Time) (int, error) {
+	query := `
+		SELECT a.athlete_id
+		FROM athletes a
+		LEFT JOIN reconcile_state r ON r.athlete_id = a.athlete_id
+		WHERE r.started_at IS NULL OR r.started_at <= ?
+		ORDER BY a.athlete_id
+	`
+
+	rows, err := d.db.Query(query, now.Add(-interval).Unix())
+	if err != nil {
+		return 0, fmt.Errorf("failed to list athletes due reconciliation: %w", err)
+	}
+
+	var athleteIDs []int64
+	for rows.Next() {
+		var athleteID int64
+		if err := rows.Scan(&athleteID); err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("failed to scan athlete: %w", err)
+		}
+		athleteIDs = append(athleteIDs, athleteID)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, fmt.Errorf("failed to iterate athletes: %w", err)
+	}
+
+	for _, athleteID := range athleteIDs {
+		_, err := d.db.Exec(`
+			INSERT INTO reconcile_state (athlete_id, started_at, since, cursor, completed_at)
+			VALUES (?, ?, ?, 0, NULL)
+			ON CONFLICT (athlete_id) DO UPDATE SET
+				started_at = excluded.started_at,
+				since = excluded.since,
+				cursor = 0,
+				completed_at = NULL
+		`, athleteID, now.Unix(), now.Add(-window).Unix())
+		if err != nil {
+			return 0, fmt.Errorf("failed to start reconciliation: %w", err)
+		}
+
+		if _, err := d.EnqueueSyncJobWithPriority(athleteID, "reconcile_activities", nil, PriorityReconcile); err != nil {
+			return 0, err
+		}
+	}
+
+	return len(athleteIDs), nil
+}
+
+// GetReconcileState returns an athlete's reconciliation progress, nil if never started
+func (d *DB) GetReconcileState(athleteID int64) (*ReconcileState, error) {
+	query := `
+		SELECT started_at, since, cursor, completed_at
+		FROM reconcile_state
+		WHERE athlete_id = ?
+	`
+
+	state := ReconcileState{AthleteID: athleteID}
+	var startedAt int64
+	var completedAt sql.NullInt64
+	err := d.db.QueryRow(query, athleteID).Scan(&startedAt, &state.Since, &state.Cursor, &completedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get reconcile state: %w", err)
+	}
+
+	state.StartedAt = time.Unix(startedAt, 0)
+	state.CompletedAt = nullableTime(completedAt)
+
+	return &state, nil
+}
+
+// AdvanceReconciliation records that a page of activities has been reconciled
+func (d *DB) AdvanceReconciliation(athleteID int64, cursor int64) error {
+	if _, err := d.db.Exec(`UPDATE reconcile_state SET cursor = ? WHERE athlete_id = ?`, cursor, athleteID); err != nil {
+		return fmt.Errorf("failed to advance reconcile state: %w", err)
+	}
+
+	return nil
+}
+
+// FinishReconciliation records that an athlete's reconciliation has completed
+func (d *DB) FinishReconciliation(athleteID int64, at time.Time) error {
+	if _, err := d.db.Exec(`UPDATE reconcile_state SET completed_at = ? WHERE athlete_id = ?`, at.Unix(), athleteID); err != nil {
+		return fmt.Errorf("failed to finish reconciliation: %w", err)
+	}
+
+	return nil
+}
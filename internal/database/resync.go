@@ -0,0 +1,59 @@
+package database
+
+import (
+	"fmt"
+)
+
+// ResyncAthlete queues a resync of an athlete's activities within their backfill horizon
+// Every listed activity is fetched again, even if it hasn't changed since it
+// was last written to the event stream. Returns the list_activities job ID.
+func (d *DB) ResyncAthlete(athleteID int64) (int64, error) {
+	if err := d.requireAthlete(athleteID); err != nil {
+		return 0, err
+	}
+
+	if err := d.ResetActivityFingerprints(athleteID); err != nil {
+		return 0, err
+	}
+
+	return d.StartBackfill(athleteID, PriorityResync)
+}
+
+// ResyncActivity queues a resync of a single activity
+// Returns the sync_activity job ID
+func (d *DB) ResyncActivity(athleteID, activityID int64) (int64, error) {
+	if err := d.requireAthlete(athleteID); err != nil {
+		return 0, err
+	}
+
+	return d.EnqueueSyncJobWithPriority(athleteID, "sync_activity", &activityID, PriorityResync)
+}
+
+// ResyncAllAthletes queues a resync of every athlete's activities
+// Returns the number of athletes queued
+func (d *DB) ResyncAllAthletes() (int, error) {
+	athleteIDs, err := d.ListAthleteIDs()
+	if err != nil {
+		return 0, err
+	}
+
+	for i, athleteID := range athleteIDs {
+		if _, err := d.ResyncAthlete(athleteID); err != nil {
+			return i, fmt.Errorf("failed to resync athlete %d: %w", athleteID, err)
+		}
+	}
+
+	return len(athleteIDs), nil
+}
+
+// requireAthlete returns ErrAthleteNotFound if the athlete doesn't exist
+func (d *DB) requireAthlete(athleteID int64) error {
+	athlete, err := d.GetAthlete(athleteID)
+	if err != nil {
+		return err
+	}
+	if athlete == nil {
+		return ErrAthleteNotFound
+	}
+	return nil
+}
@@ -8,6 +8,7 @@ CREATE TABLE IF NOT EXISTS athletes (
     refresh_token TEXT NOT NULL,
     token_expires_at INTEGER NOT NULL, -- Unix timestamp
     athlete_summary TEXT NOT NULL, -- JSON blob of athlete summary from Strava
+    scopes TEXT, -- Comma separated OAuth scopes granted by the athlete, NULL = unknown (connected before scopes were recorded)
     created_at INTEGER NOT NULL DEFAULT (unixepoch()), -- Unix timestamp
     updated_at INTEGER NOT NULL DEFAULT (unixepoch()) -- Unix timestamp
 );
@@ -23,23 +24,37 @@ CREATE TABLE IF NOT EXISTS webhook_queue (
     retry_count INTEGER NOT NULL DEFAULT 0,
     last_error TEXT,
     next_retry_at INTEGER, -- Unix timestamp, NULL = process immediately
-    processing_started_at INTEGER -- Unix timestamp, NULL = not currently processing
+    processing_started_at INTEGER, -- Unix timestamp, NULL = not currently processing
+    priority INTEGER NOT NULL DEFAULT 0, -- Higher priority items are claimed first
+    client_id TEXT -- Strava client the webhook was delivered for, NULL if unknown
 );
 
 -- Index for efficient retry scheduling and claiming
 CREATE INDEX IF NOT EXISTS idx_webhook_queue_ready ON webhook_queue(next_retry_at, processing_started_at);
 
+-- Delivery keys of recently received webhooks
+-- Strava redelivers webhooks which aren't acknowledged quickly enough, so a
+-- delivery whose key is already present is ignored rather than queued again
+CREATE TABLE IF NOT EXISTS webhook_deliveries (
+    delivery_key TEXT PRIMARY KEY, -- Hash of the identifying webhook fields
+    received_at INTEGER NOT NULL DEFAULT (unixepoch()) -- Unix timestamp
+);
+
+-- Index for expiring old delivery keys
+CREATE INDEX IF NOT EXISTS idx_webhook_deliveries_received_at ON webhook_deliveries(received_at);
+
 -- Sync jobs queue for background sync operations
 -- Separate from webhook_queue to avoid mixing real webhooks with synthetic sync jobs
 CREATE TABLE IF NOT EXISTS sync_jobs (
     id INTEGER PRIMARY KEY AUTOINCREMENT,
     athlete_id INTEGER NOT NULL,
-    job_type TEXT NOT NULL DEFAULT 'sync_all_activities', -- Job types: 'list_activities', 'sync_activity'
+    job_type TEXT NOT NULL DEFAULT 'sync_all_activities', -- Job types: 'list_activities', 'sync_activity', 'sync_since', 'reconcile_activities', 'reconcile_activity'
     activity_id INTEGER, -- For sync_activity jobs
     retry_count INTEGER NOT NULL DEFAULT 0,
     last_error TEXT,
     next_retry_at INTEGER, -- Unix timestamp, NULL = process immediately
     processing_started_at INTEGER, -- Unix timestamp, NULL = not currently processing
+    priority INTEGER NOT NULL DEFAULT 0, -- Higher priority jobs are claimed first
     created_at INTEGER NOT NULL DEFAULT (unixepoch()),
     FOREIGN KEY (athlete_id) REFERENCES athletes(athlete_id) ON DELETE CASCADE
 );
@@ -50,23 +65,148 @@ CREATE INDEX IF NOT EXISTS idx_sync_jobs_ready ON sync_jobs(next_retry_at, proce
 -- Index for athlete lookups
 CREATE INDEX IF NOT EXISTS idx_sync_jobs_athlete_id ON sync_jobs(athlete_id);
 
+-- At most one waiting job per (athlete, job type, activity) so that enqueueing is
+-- idempotent. Jobs being processed are excluded so that they can be queued again.
+CREATE UNIQUE INDEX IF NOT EXISTS idx_sync_jobs_unique ON sync_jobs(athlete_id, job_type, IFNULL(activity_id, 0))
+    WHERE processing_started_at IS NULL;
+
+-- Records when each athlete last had a sync job claimed, so that jobs are
+-- claimed round-robin across athletes within a priority
+CREATE TABLE IF NOT EXISTS sync_job_athletes (
+    athlete_id INTEGER PRIMARY KEY,
+    last_served INTEGER NOT NULL -- Increases with each claim, lower = served less recently
+);
+
+-- Backfill progress per athlete. Backfill lists activities newest first, one
+-- page per list_activities job, until the horizon or the start of history
+CREATE TABLE IF NOT EXISTS backfill_state (
+    athlete_id INTEGER PRIMARY KEY,
+    cursor INTEGER NOT NULL DEFAULT 0, -- Unix timestamp, the next page lists activities started before this, 0 = now
+    listed_count INTEGER NOT NULL DEFAULT 0, -- Activities listed within the horizon so far
+    max_age_days INTEGER, -- Overrides the client's horizon, NULL = client default, 0 = unlimited
+    max_activities INTEGER -- Overrides the client's horizon, NULL = client default, 0 = unlimited
+);
+
+-- Progress of sync_since jobs, which list an athlete's activities newest first
+-- back to a point in time to recover webhooks lost during an outage
+CREATE TABLE IF NOT EXISTS gap_sync_state (
+    athlete_id INTEGER PRIMARY KEY,
+    since INTEGER NOT NULL, -- Unix timestamp, activities started before this aren't listed
+    cursor INTEGER NOT NULL DEFAULT 0 -- Unix timestamp, the next page lists activities started before this, 0 = now
+);
+
+-- Progress of reconcile_activities jobs, which periodically list each
+-- athlete's recent activities to catch deletes and edits whose webhooks were lost
+CREATE TABLE IF NOT EXISTS reconcile_state (
+    athlete_id INTEGER PRIMARY KEY,
+    started_at INTEGER NOT NULL, -- Unix timestamp the current reconciliation started
+    since INTEGER NOT NULL, -- Unix timestamp, activities started before this aren't reconciled
+    cursor INTEGER NOT NULL DEFAULT 0, -- Unix timestamp, the next page lists activities started before this, 0 = now
+    completed_at INTEGER -- Unix timestamp the current reconciliation completed, NULL = in progress
+);
+
+-- Webhook receipt health per client, used to detect periods in which
+-- webhooks may have been lost
+CREATE TABLE IF NOT EXISTS webhook_health (
+    client_id TEXT PRIMARY KEY,
+    last_received_at INTEGER, -- Unix timestamp of the latest webhook delivery
+    last_healthy_at INTEGER, -- Unix timestamp the subscription was last confirmed healthy
+    subscription_id INTEGER, -- Subscription last confirmed healthy
+    last_gap_sync_at INTEGER -- Unix timestamp gap sync was last queued for a delivery gap
+);
+
+-- Heartbeat of the running server, so that downtime can be detected on startup
+-- Singleton table: only ever contains one row (id = 1)
+CREATE TABLE IF NOT EXISTS server_heartbeat (
+    id INTEGER PRIMARY KEY CHECK (id = 1),
+    last_seen_at INTEGER NOT NULL -- Unix timestamp
+);
+
+-- OAuth states of authorization flows in progress, for CSRF protection
+-- Stored in the database so that flows survive restarts and can complete on
+-- any instance sharing the database. Each state can only be used once.
+CREATE TABLE IF NOT EXISTS oauth_states (
+    state TEXT PRIMARY KEY,
+    client_id TEXT NOT NULL, -- Strava client the flow was started with
+    plantopo_user TEXT, -- Reference to the plantopo user connecting, NULL if not given
+    return_to TEXT, -- URL the user is redirected to once the flow ends, NULL if not given
+    binding_hash TEXT, -- SHA-256 of the browser binding cookie the flow was started with, NULL = not bound
+    code_verifier TEXT, -- PKCE code verifier, NULL if PKCE isn't used
+    expires_at INTEGER NOT NULL, -- Unix timestamp
+    used_at INTEGER, -- Unix timestamp the state was used, kept until expiry to detect replays
+    created_at INTEGER NOT NULL DEFAULT (unixepoch()), -- Unix timestamp
+    migration_token TEXT -- Client migration the flow completes, NULL if none
+);
+
+-- Index for removing expired states
+CREATE INDEX IF NOT EXISTS idx_oauth_states_expires_at ON oauth_states(expires_at);
+
+-- Links inviting athletes to authorize again under a different Strava client
+-- Completing a migration moves the athlete to the new client, keeping their
+-- athlete ID, events and sync state
+CREATE TABLE IF NOT EXISTS client_migrations (
+    token TEXT PRIMARY KEY,
+    athlete_id INTEGER NOT NULL,
+    from_client_id TEXT NOT NULL, -- The athlete's client when the link was created
+    to_client_id TEXT NOT NULL,
+    expires_at INTEGER NOT NULL, -- Unix timestamp
+    completed_at INTEGER, -- Unix timestamp, NULL if not completed
+    created_at INTEGER NOT NULL DEFAULT (unixepoch()) -- Unix timestamp
+);
+
+-- Index for finding an athlete's migrations
+CREATE INDEX IF NOT EXISTS idx_client_migrations_athlete_id ON client_migrations(athlete_id);
+
+-- Strava API requests made with each client per UTC day, for rebalancing
+-- athletes between clients
+CREATE TABLE IF NOT EXISTS api_usage (
+    client_id TEXT NOT NULL,
+    day INTEGER NOT NULL, -- Days since the Unix epoch (UTC)
+    requests INTEGER NOT NULL DEFAULT 0,
+    PRIMARY KEY (client_id, day)
+);
+
+-- API keys for the internal API, created with --create-api-key. Only a hash
+-- of each key is stored, the key itself is shown once when it is created.
+CREATE TABLE IF NOT EXISTS api_keys (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    name TEXT NOT NULL,
+    key_hash TEXT NOT NULL UNIQUE, -- Hex SHA-256 of the key
+    prefix TEXT NOT NULL, -- Start of the key, to help identify it
+    scopes TEXT NOT NULL, -- JSON array, e.g. ["events:read"]
+    athlete_id INTEGER, -- Athlete whose events athlete:read keys can read
+    last_used_at INTEGER, -- Unix timestamp, NULL if never used
+    revoked_at INTEGER, -- Unix timestamp, NULL if active
+    created_at INTEGER NOT NULL DEFAULT (unixepoch()) -- Unix timestamp
+);
+
+-- Names are unique among active keys
+CREATE UNIQUE INDEX IF NOT EXISTS idx_api_keys_active_name ON api_keys(name) WHERE revoked_at IS NULL;
+
 -- Events table stores the event stream
 -- Supports event types:
 --   1. athlete_connected: When an athlete authorizes the app
 --   2. webhook: Activity events from Strava webhooks (create/update/delete)
 --   3. backfill: Historical activity from backfill sync
+--   4. reconciled_delete: Activity found deleted on Strava by reconciliation
+--   5. reconciled_update: Activity found changed on Strava by reconciliation
+--   6. athlete_reconnected: When a connected athlete authorizes the app again
 CREATE TABLE IF NOT EXISTS events (
     event_id INTEGER PRIMARY KEY AUTOINCREMENT,
-    event_type TEXT NOT NULL CHECK(event_type IN ('athlete_connected', 'webhook', 'backfill')),
+    event_type TEXT NOT NULL CHECK(event_type IN ('athlete_connected', 'webhook', 'backfill', 'reconciled_delete', 'reconciled_update', 'athlete_reconnected')),
     athlete_id INTEGER NOT NULL,
 
-    -- For webhook and backfill events with activities
+    -- For webhook, backfill and reconciled events with activities
     activity_id INTEGER,
 
     -- JSON data fields (nullable based on event type)
-    athlete_summary TEXT, -- JSON: For athlete_connected events
-    activity TEXT, -- JSON: For webhook and backfill events (detailed activity from API)
+    athlete_summary TEXT, -- JSON: For athlete_connected and athlete_reconnected events
+    activity TEXT, -- JSON: For webhook, backfill and reconciled_update events (detailed activity from API)
     webhook_event TEXT, -- JSON: For webhook events only (raw webhook data)
+    coalesced_webhook_events TEXT, -- JSON array: Raw data of every webhook coalesced into this event
+    scopes TEXT, -- JSON array: OAuth scopes granted, for athlete_connected and athlete_reconnected events
+    plantopo_user TEXT, -- Reference to the plantopo user who connected the athlete, for athlete_connected and athlete_reconnected events
+    reconnection TEXT, -- JSON: Previous and new client and scopes, for athlete_reconnected events
 
     created_at INTEGER NOT NULL DEFAULT (unixepoch()) -- Unix timestamp
 );
@@ -83,6 +223,25 @@ CREATE INDEX IF NOT EXISTS idx_events_activity_id ON events(activity_id) WHERE a
 -- Composite index for event type filtering with pagination
 CREATE INDEX IF NOT EXISTS idx_events_type_id ON events(event_type, event_id);
 
+-- Activities table tracks the version of each activity last written to the
+-- event stream, so that backfill can skip activities which haven't changed
+CREATE TABLE IF NOT EXISTS activities (
+    activity_id INTEGER PRIMARY KEY,
+    athlete_id INTEGER NOT NULL,
+    fingerprint TEXT NOT NULL, -- Hash of key summary fields, empty for deleted activities
+    source TEXT NOT NULL, -- 'webhook', 'backfill' or 'reconcile'
+    deleted INTEGER NOT NULL DEFAULT 0,
+    last_event_time INTEGER, -- event_time of the latest webhook applied, NULL if none
+    start_date INTEGER, -- Unix timestamp the activity started, NULL if unknown
+    updated_at INTEGER NOT NULL DEFAULT (unixepoch()) -- Unix timestamp
+);
+
+-- Index for athlete lookups
+CREATE INDEX IF NOT EXISTS idx_activities_athlete_id ON activities(athlete_id);
+
+-- Index for reconciling an athlete's activities by start date
+CREATE INDEX IF NOT EXISTS idx_activities_athlete_start_date ON activities(athlete_id, start_date);
+
 -- Circuit breaker for rate limit management
 -- Singleton table: only ever contains one row (id = 1)
 CREATE TABLE IF NOT EXISTS rate_limit_circuit_breaker (
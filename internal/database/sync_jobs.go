@@ -10,53 +10,102 @@ import (
 
 // SyncJob represents a sync job awaiting processing
 type SyncJob struct {
-	ID                  int64
-	AthleteID           int64
-	JobType             string
-	ActivityID          *int64 // For sync_activity jobs
-	RetryCount          int
-	LastError           *string
-	NextRetryAt         *time.Time
-	ProcessingStartedAt *time.Time
-	CreatedAt           time.Time
+	ID                  int64      `json:"id"`
+	AthleteID           int64      `json:"athlete_id"`
+	JobType             string     `json:"job_type"`
+	ActivityID          *int64     `json:"activity_id"` // For sync_activity jobs
+	RetryCount          int        `json:"retry_count"`
+	LastError           *string    `json:"last_error"`
+	NextRetryAt         *time.Time `json:"next_retry_at"`
+	ProcessingStartedAt *time.Time `json:"processing_started_at"`
+	Priority            int        `json:"priority"` // Higher priority jobs are claimed first
+	CreatedAt           time.Time  `json:"created_at"`
 }
 
+// Sync job priorities
+// Webhooks are always processed before sync jobs, priority orders sync jobs among themselves
+const (
+	// PriorityGapSync is the priority of recovering activities from webhook
+	// outages, which are more recent than most backfilled activities
+	PriorityGapSync = 10
+	// PriorityDefault is the priority of backfill for newly connected athletes
+	PriorityDefault = 0
+	// PriorityResync is the priority of manually requested resyncs, so they
+	// don't hold up backfill for newly connected athletes
+	PriorityResync = -10
+	// PriorityReconcile is the priority of periodic reconciliation, which only
+	// runs when nothing else is waiting
+	PriorityReconcile = -20
+)
+
 // EnqueueSyncJob adds a sync job to the processing queue
+// If an identical job is already waiting to be claimed the existing job's ID is returned
 func (d *DB) EnqueueSyncJob(athleteID int64, jobType string) (int64, error) {
+	return d.EnqueueSyncJobWithPriority(athleteID, jobType, nil, PriorityDefault)
+}
+
+// EnqueueActivitySyncJob adds an activity sync job to the processing queue
+// If a sync job for the activity is already queued the existing job's ID is returned
+func (d *DB) EnqueueActivitySyncJob(athleteID int64, activityID int64) (int64, error) {
+	return d.EnqueueSyncJobWithPriority(athleteID, "sync_activity", &activityID, PriorityDefault)
+}
+
+// EnqueueSyncJobWithPriority inserts a sync job unless one with the same athlete, job type
+// and activity is already waiting to be claimed (see idx_sync_jobs_unique), in which case
+// the existing job's ID is returned and its priority is left unchanged. A job which is
+// being processed doesn't prevent another being queued, as it may have already read the
+// state the new job is queued for.
+func (d *DB) EnqueueSyncJobWithPriority(athleteID int64, jobType string, activityID *int64, priority int) (int64, error) {
 	timer := prometheus.NewTimer(metrics.DBOperationDuration.WithLabelValues(metrics.DBOpEnqueueSyncJob))
 	defer timer.ObserveDuration()
 
-	query := `INSERT INTO sync_jobs (athlete_id, job_type) VALUES (?, ?)`
+	// The insert and the lookup of an existing job share a transaction, so that
+	// the existing job can't be claimed in between
+	tx, err := d.db.Begin()
+	if err != nil {
+		metrics.DBOperationErrorsTotal.WithLabelValues(metrics.DBOpEnqueueSyncJob).Inc()
+		return 0, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	query := `
+		INSERT INTO sync_jobs (athlete_id, job_type, activity_id, priority)
+		VALUES (?, ?, ?, ?)
+		ON CONFLICT DO NOTHING
+	`
 
-	result, err := d.db.Exec(query, athleteID, jobType)
+	result, err := tx.Exec(query, athleteID, jobType, activityID, priority)
 	if err != nil {
 		metrics.DBOperationErrorsTotal.WithLabelValues(metrics.DBOpEnqueueSyncJob).Inc()
 		return 0, fmt.Errorf("failed to enqueue sync job: %w", err)
 	}
 
-	id, err := result.LastInsertId()
+	inserted, err := result.RowsAffected()
 	if err != nil {
 		metrics.DBOperationErrorsTotal.WithLabelValues(metrics.DBOpEnqueueSyncJob).Inc()
-		return 0, fmt.Errorf("failed to get sync job id: %w", err)
+		return 0, fmt.Errorf("failed to get enqueued sync job count: %w", err)
 	}
 
-	// Record successful enqueue
-	metrics.QueueEnqueueTotal.WithLabelValues(metrics.QueueTypeSyncJob).Inc()
-
-	return id, nil
-}
-
-// EnqueueActivitySyncJob adds an activity sync job to the processing queue
-func (d *DB) EnqueueActivitySyncJob(athleteID int64, activityID int64) (int64, error) {
-	timer := prometheus.NewTimer(metrics.DBOperationDuration.WithLabelValues(metrics.DBOpEnqueueSyncJob))
-	defer timer.ObserveDuration()
+	if inserted == 0 {
+		// Already queued - return the existing job
+		var id int64
+		err := tx.QueryRow(`
+			SELECT id FROM sync_jobs
+			WHERE athlete_id = ? AND job_type = ? AND IFNULL(activity_id, 0) = IFNULL(?, 0)
+			  AND processing_started_at IS NULL
+		`, athleteID, jobType, activityID).Scan(&id)
+		if err != nil {
+			metrics.DBOperationErrorsTotal.WithLabelValues(metrics.DBOpEnqueueSyncJob).Inc()
+			return 0, fmt.Errorf("failed to get existing sync job: %w", err)
+		}
 
-	query := `INSERT INTO sync_jobs (athlete_id, job_type, activity_id) VALUES (?, 'sync_activity', ?)`
+		if err := tx.Commit(); err != nil {
+			metrics.DBOperationErrorsTotal.WithLabelValues(metrics.DBOpEnqueueSyncJob).Inc()
+			return 0, fmt.Errorf("failed to commit sync job enqueue: %w", err)
+		}
 
-	result, err := d.db.Exec(query, athleteID, activityID)
-	if err != nil {
-		metrics.DBOperationErrorsTotal.WithLabelValues(metrics.DBOpEnqueueSyncJob).Inc()
-		return 0, fmt.Errorf("failed to enqueue activity sync job: %w", err)
+		metrics.QueueDeduplicatedTotal.WithLabelValues(metrics.QueueTypeSyncJob).Inc()
+		return id, nil
 	}
 
 	id, err := result.LastInsertId()
@@ -65,6 +114,11 @@ func (d *DB) EnqueueActivitySyncJob(athleteID int64, activityID int64) (int64, e
 		return 0, fmt.Errorf("failed to get sync job id: %w", err)
 	}
 
+	if err := tx.Commit(); err != nil {
+		metrics.DBOperationErrorsTotal.WithLabelValues(metrics.DBOpEnqueueSyncJob).Inc()
+		return 0, fmt.Errorf("failed to commit sync job enqueue: %w", err)
+	}
+
 	// Record successful enqueue
 	metrics.QueueEnqueueTotal.WithLabelValues(metrics.QueueTypeSyncJob).Inc()
 
@@ -76,6 +130,9 @@ func (d *DB) EnqueueActivitySyncJob(athleteID int64, activityID int64) (int64, e
 // Items are considered ready if:
 // - next_retry_at is NULL or in the past
 // - processing_started_at is NULL or stale (older than StaleLockTimeout)
+// Among ready jobs with the highest priority, the oldest job of the athlete
+// served least recently is claimed, so that an athlete with a long backfill
+// doesn't hold up everyone else
 // Uses UPDATE to atomically claim the job, preventing race conditions
 func (d *DB) ClaimSyncJob() (*SyncJob, error) {
 	timer := prometheus.NewTimer(metrics.DBOperationDuration.WithLabelValues(metrics.DBOpClaimSyncJob))
@@ -84,20 +141,28 @@ func (d *DB) ClaimSyncJob() (*SyncJob, error) {
 	now := time.Now()
 	staleThreshold := now.Add(-StaleLockTimeout).Unix()
 
-	// Atomically claim the oldest ready sync job by updating it first
+	tx, err := d.db.Begin()
+	if err != nil {
+		metrics.DBOperationErrorsTotal.WithLabelValues(metrics.DBOpClaimSyncJob).Inc()
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	// Atomically claim the job by updating it first
 	// This prevents race conditions between concurrent workers
 	updateQuery := `
 		UPDATE sync_jobs
 		SET processing_started_at = ?
 		WHERE id = (
-			SELECT id
-			FROM sync_jobs
-			WHERE (next_retry_at IS NULL OR next_retry_at <= ?)
-			  AND (processing_started_at IS NULL OR processing_started_at < ?)
-			ORDER BY id ASC
+			SELECT j.id
+			FROM sync_jobs j
+			LEFT JOIN sync_job_athletes a ON a.athlete_id = j.athlete_id
+			WHERE (j.next_retry_at IS NULL OR j.next_retry_at <= ?)
+			  AND (j.processing_started_at IS NULL OR j.processing_started_at < ?)
+			ORDER BY j.priority DESC, IFNULL(a.last_served, 0) ASC, j.id ASC
 			LIMIT 1
 		)
-		RETURNING id, athlete_id, job_type, activity_id, retry_count, last_error, next_retry_at, created_at
+		RETURNING id, athlete_id, job_type, activity_id, retry_count, last_error, next_retry_at, priority, created_at
 	`
 
 	var job SyncJob
@@ -105,7 +170,7 @@ func (d *DB) ClaimSyncJob() (*SyncJob, error) {
 	var nextRetryAt *int64
 	var createdAt int64
 
-	err := d.db.QueryRow(updateQuery, now.Unix(), now.Unix(), staleThreshold).Scan(
+	err = tx.QueryRow(updateQuery, now.Unix(), now.Unix(), staleThreshold).Scan(
 		&job.ID,
 		&job.AthleteID,
 		&job.JobType,
@@ -113,6 +178,7 @@ func (d *DB) ClaimSyncJob() (*SyncJob, error) {
 		&job.RetryCount,
 		&lastError,
 		&nextRetryAt,
+		&job.Priority,
 		&createdAt,
 	)
 	if err != nil {
@@ -123,6 +189,22 @@ func (d *DB) ClaimSyncJob() (*SyncJob, error) {
 		return nil, fmt.Errorf("failed to claim sync job: %w", err)
 	}
 
+	// Move the athlete to the back of the round-robin
+	servedQuery := `
+		INSERT INTO sync_job_athletes (athlete_id, last_served)
+		VALUES (?, (SELECT IFNULL(MAX(last_served), 0) + 1 FROM sync_job_athletes))
+		ON CONFLICT (athlete_id) DO UPDATE SET last_served = excluded.last_served
+	`
+	if _, err := tx.Exec(servedQuery, job.AthleteID); err != nil {
+		metrics.DBOperationErrorsTotal.WithLabelValues(metrics.DBOpClaimSyncJob).Inc()
+		return nil, fmt.Errorf("failed to record athlete served: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		metrics.DBOperationErrorsTotal.WithLabelValues(metrics.DBOpClaimSyncJob).Inc()
+		return nil, fmt.Errorf("failed to commit sync job claim: %w", err)
+	}
+
 	job.LastError = lastError
 	if nextRetryAt != nil {
 		t := time.Unix(*nextRetryAt, 0)
@@ -152,6 +234,8 @@ func (d *DB) DeleteSyncJob(id int64) error {
 
 // ReleaseSyncJob releases a failed sync job back to the queue with retry tracking
 // Uses exponential backoff: 1min, 5min, 15min, 30min, 1hr, etc.
+// If the same job was queued again while this one ran, this one is deleted as
+// the queued job will do its work
 // Returns true if the job was released, false if it was dropped due to max retries
 func (d *DB) ReleaseSyncJob(id int64, retryCount int, errMsg string) (bool, error) {
 	timer := prometheus.NewTimer(metrics.DBOperationDuration.WithLabelValues(metrics.DBOpReleaseSyncJob))
@@ -177,6 +261,40 @@ func (d *DB) ReleaseSyncJob(id int64, retryCount int, errMsg string) (bool, erro
 
 	nextRetryAt := time.Now().Add(time.Duration(backoffMinutes[backoffIdx]) * time.Minute)
 
+	tx, err := d.db.Begin()
+	if err != nil {
+		metrics.DBOperationErrorsTotal.WithLabelValues(metrics.DBOpReleaseSyncJob).Inc()
+		return false, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	// Releasing the job would otherwise duplicate the queued job (see idx_sync_jobs_unique)
+	result, err := tx.Exec(`
+		DELETE FROM sync_jobs
+		WHERE id = ?
+		  AND EXISTS (
+		    SELECT 1 FROM sync_jobs j
+		    WHERE j.athlete_id = sync_jobs.athlete_id
+		      AND j.job_type = sync_jobs.job_type
+		      AND IFNULL(j.activity_id, 0) = IFNULL(sync_jobs.activity_id, 0)
+		      AND j.processing_started_at IS NULL
+		  )
+	`, id)
+	if err != nil {
+		metrics.DBOperationErrorsTotal.WithLabelValues(metrics.DBOpReleaseSyncJob).Inc()
+		return false, fmt.Errorf("failed to release sync job: %w", err)
+	}
+	if superseded, err := result.RowsAffected(); err != nil {
+		metrics.DBOperationErrorsTotal.WithLabelValues(metrics.DBOpReleaseSyncJob).Inc()
+		return false, fmt.Errorf("failed to check for queued sync job: %w", err)
+	} else if superseded > 0 {
+		if err := tx.Commit(); err != nil {
+			metrics.DBOperationErrorsTotal.WithLabelValues(metrics.DBOpReleaseSyncJob).Inc()
+			return false, fmt.Errorf("failed to commit sync job release: %w", err)
+		}
+		return true, nil // Retried by the queued job
+	}
+
 	query := `
 		UPDATE sync_jobs
 		SET retry_count = ?,
@@ -186,12 +304,17 @@ func (d *DB) ReleaseSyncJob(id int64, retryCount int, errMsg string) (bool, erro
 		WHERE id = ?
 	`
 
-	_, err := d.db.Exec(query, newRetryCount, errMsg, nextRetryAt.Unix(), id)
+	_, err = tx.Exec(query, newRetryCount, errMsg, nextRetryAt.Unix(), id)
 	if err != nil {
 		metrics.DBOperationErrorsTotal.WithLabelValues(metrics.DBOpReleaseSyncJob).Inc()
 		return false, fmt.Errorf("failed to release sync job: %w", err)
 	}
 
+	if err := tx.Commit(); err != nil {
+		metrics.DBOperationErrorsTotal.WithLabelValues(metrics.DBOpReleaseSyncJob).Inc()
+		return false, fmt.Errorf("failed to commit sync job release: %w", err)
+	}
+
 	return true, nil // Released for retry
 }
 
@@ -3,6 +3,7 @@ package database
 import (
 	"encoding/json"
 	"fmt"
+	"sort"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
@@ -11,12 +12,14 @@ import (
 
 // WebhookQueueItem represents a webhook awaiting hydration
 type WebhookQueueItem struct {
-	ID                  int64
-	Data                json.RawMessage
-	RetryCount          int
-	LastError           *string
-	NextRetryAt         *time.Time
-	ProcessingStartedAt *time.Time
+	ID                  int64           `json:"id"`
+	Data                json.RawMessage `json:"data"`
+	RetryCount          int             `json:"retry_count"`
+	LastError           *string         `json:"last_error"`
+	NextRetryAt         *time.Time      `json:"next_retry_at"`
+	ProcessingStartedAt *time.Time      `json:"processing_started_at"`
+	Priority            int             `json:"priority"`            // Higher priority items are claimed first
+	ClientID            string          `json:"client_id,omitempty"` // Strava client the webhook was delivered for, empty if unknown
 }
 
 const (
@@ -51,11 +54,89 @@ func (d *DB) EnqueueWebhook(data json.RawMessage) (int64, error) {
 	return id, nil
 }
 
+// EnqueueWebhookDelivery adds a webhook to the processing queue unless a
+// delivery with the same key was received within the dedup window.
+// clientID is the Strava client the webhook was delivered for.
+// A non-zero delay holds the webhook back before it can be claimed.
+// Returns the queue item ID and true if enqueued, or 0 and false if the
+// delivery was a duplicate. Expired delivery keys are removed as a side effect.
+func (d *DB) EnqueueWebhookDelivery(deliveryKey, clientID string, data json.RawMessage, dedupWindow, delay time.Duration) (int64, bool, error) {
+	timer := prometheus.NewTimer(metrics.DBOperationDuration.WithLabelValues(metrics.DBOpEnqueueWebhookDelivery))
+	defer timer.ObserveDuration()
+
+	now := time.Now()
+	cutoff := now.Add(-dedupWindow).Unix()
+
+	tx, err := d.db.Begin()
+	if err != nil {
+		metrics.DBOperationErrorsTotal.WithLabelValues(metrics.DBOpEnqueueWebhookDelivery).Inc()
+		return 0, false, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`DELETE FROM webhook_deliveries WHERE received_at < ?`, cutoff); err != nil {
+		metrics.DBOperationErrorsTotal.WithLabelValues(metrics.DBOpEnqueueWebhookDelivery).Inc()
+		return 0, false, fmt.Errorf("failed to expire webhook deliveries: %w", err)
+	}
+
+	result, err := tx.Exec(`
+		INSERT INTO webhook_deliveries (delivery_key, received_at)
+		VALUES (?, ?)
+		ON CONFLICT (delivery_key) DO NOTHING
+	`, deliveryKey, now.Unix())
+	if err != nil {
+		metrics.DBOperationErrorsTotal.WithLabelValues(metrics.DBOpEnqueueWebhookDelivery).Inc()
+		return 0, false, fmt.Errorf("failed to record webhook delivery: %w", err)
+	}
+
+	inserted, err := result.RowsAffected()
+	if err != nil {
+		metrics.DBOperationErrorsTotal.WithLabelValues(metrics.DBOpEnqueueWebhookDelivery).Inc()
+		return 0, false, fmt.Errorf("failed to get rows affected: %w", err)
+	}
+
+	if inserted == 0 {
+		// Already received within the window, nothing to commit
+		metrics.WebhookDeliveriesDeduplicatedTotal.Inc()
+		return 0, false, nil
+	}
+
+	var nextRetryAt *int64
+	if delay > 0 {
+		readyAt := now.Add(delay).Unix()
+		nextRetryAt = &readyAt
+	}
+
+	result, err = tx.Exec(`INSERT INTO webhook_queue (data, next_retry_at, client_id) VALUES (?, ?, NULLIF(?, ''))`, data, nextRetryAt, clientID)
+	if err != nil {
+		metrics.DBOperationErrorsTotal.WithLabelValues(metrics.DBOpEnqueueWebhookDelivery).Inc()
+		return 0, false, fmt.Errorf("failed to enqueue webhook: %w", err)
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		metrics.DBOperationErrorsTotal.WithLabelValues(metrics.DBOpEnqueueWebhookDelivery).Inc()
+		return 0, false, fmt.Errorf("failed to get queue item id: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		metrics.DBOperationErrorsTotal.WithLabelValues(metrics.DBOpEnqueueWebhookDelivery).Inc()
+		return 0, false, fmt.Errorf("failed to commit webhook delivery: %w", err)
+	}
+
+	// Record successful enqueue
+	metrics.QueueEnqueueTotal.WithLabelValues(metrics.QueueTypeWebhook).Inc()
+
+	return id, true, nil
+}
+
 // ClaimWebhook claims the next ready webhook for processing
 // Marks it as processing and returns it. Returns nil if no items are ready.
 // Items are considered ready if:
 // - next_retry_at is NULL or in the past
 // - processing_started_at is NULL or stale (older than StaleLockTimeout)
+// The oldest ready webhook with the highest priority is chosen, except that ready webhooks for the same
+// object are claimed in event_time order so that retries can't reorder them.
 // Uses UPDATE to atomically claim the webhook, preventing race conditions
 func (d *DB) ClaimWebhook() (*WebhookQueueItem, error) {
 	timer := prometheus.NewTimer(metrics.DBOperationDuration.WithLabelValues(metrics.DBOpClaimWebhook))
@@ -64,32 +145,50 @@ func (d *DB) ClaimWebhook() (*WebhookQueueItem, error) {
 	now := time.Now()
 	staleThreshold := now.Add(-StaleLockTimeout).Unix()
 
-	// Atomically claim the oldest ready webhook by updating it first
+	// Atomically claim the webhook by updating it first
 	// This prevents race conditions between concurrent workers
+	// Guard json_extract as queued data is not guaranteed to be valid JSON
 	updateQuery := `
 		UPDATE webhook_queue
 		SET processing_started_at = ?
 		WHERE id = (
-			SELECT id
-			FROM webhook_queue
-			WHERE (next_retry_at IS NULL OR next_retry_at <= ?)
-			  AND (processing_started_at IS NULL OR processing_started_at < ?)
-			ORDER BY id ASC
+			SELECT candidate.id
+			FROM webhook_queue AS oldest
+			JOIN webhook_queue AS candidate
+			  ON candidate.id = oldest.id
+			  OR CASE WHEN json_valid(oldest.data) AND json_valid(candidate.data)
+			          THEN json_extract(candidate.data, '$.object_type') = json_extract(oldest.data, '$.object_type')
+			               AND json_extract(candidate.data, '$.object_id') = json_extract(oldest.data, '$.object_id')
+			     END
+			WHERE oldest.id = (
+				SELECT id
+				FROM webhook_queue
+				WHERE (next_retry_at IS NULL OR next_retry_at <= ?)
+				  AND (processing_started_at IS NULL OR processing_started_at < ?)
+				ORDER BY priority DESC, id ASC
+				LIMIT 1
+			)
+			  AND (candidate.next_retry_at IS NULL OR candidate.next_retry_at <= ?)
+			  AND (candidate.processing_started_at IS NULL OR candidate.processing_started_at < ?)
+			ORDER BY CASE WHEN json_valid(candidate.data) THEN json_extract(candidate.data, '$.event_time') END ASC,
+			         candidate.id ASC
 			LIMIT 1
 		)
-		RETURNING id, data, retry_count, last_error, next_retry_at
+		RETURNING id, data, retry_count, last_error, next_retry_at, priority, IFNULL(client_id, '')
 	`
 
 	var item WebhookQueueItem
 	var lastError *string
 	var nextRetryAt *int64
 
-	err := d.db.QueryRow(updateQuery, now.Unix(), now.Unix(), staleThreshold).Scan(
+	err := d.db.QueryRow(updateQuery, now.Unix(), now.Unix(), staleThreshold, now.Unix(), staleThreshold).Scan(
 		&item.ID,
 		&item.Data,
 		&item.RetryCount,
 		&lastError,
 		&nextRetryAt,
+		&item.Priority,
+		&item.ClientID,
 	)
 	if err != nil {
 		if err.Error() == "sql: no rows in result set" {
@@ -109,6 +208,68 @@ func (d *DB) ClaimWebhook() (*WebhookQueueItem, error) {
 	return &item, nil
 }
 
+// ClaimActivityUpdateWebhooks claims every other queued update webhook for an
+// activity, regardless of whether it is ready yet, so that they can be
+// processed together with the webhook identified by excludeID.
+// Returns the claimed webhooks ordered by ID.
+func (d *DB) ClaimActivityUpdateWebhooks(activityID, excludeID int64) ([]*WebhookQueueItem, error) {
+	timer := prometheus.NewTimer(metrics.DBOperationDuration.WithLabelValues(metrics.DBOpClaimActivityUpdateWebhooks))
+	defer timer.ObserveDuration()
+
+	now := time.Now()
+	staleThreshold := now.Add(-StaleLockTimeout).Unix()
+
+	// Guard json_extract as queued data is not guaranteed to be valid JSON
+	query := `
+		UPDATE webhook_queue
+		SET processing_started_at = ?
+		WHERE id != ?
+		  AND (processing_started_at IS NULL OR processing_started_at < ?)
+		  AND CASE WHEN json_valid(data)
+		           THEN json_extract(data, '$.object_type') = 'activity'
+		                AND json_extract(data, '$.aspect_type') = 'update'
+		                AND json_extract(data, '$.object_id') = ?
+		      END
+		RETURNING id, data, retry_count, last_error, next_retry_at, priority
+	`
+
+	rows, err := d.db.Query(query, now.Unix(), excludeID, staleThreshold, activityID)
+	if err != nil {
+		metrics.DBOperationErrorsTotal.WithLabelValues(metrics.DBOpClaimActivityUpdateWebhooks).Inc()
+		return nil, fmt.Errorf("failed to claim activity update webhooks: %w", err)
+	}
+	defer rows.Close()
+
+	var items []*WebhookQueueItem
+	for rows.Next() {
+		var item WebhookQueueItem
+		var nextRetryAt *int64
+
+		if err := rows.Scan(&item.ID, &item.Data, &item.RetryCount, &item.LastError, &nextRetryAt, &item.Priority); err != nil {
+			metrics.DBOperationErrorsTotal.WithLabelValues(metrics.DBOpClaimActivityUpdateWebhooks).Inc()
+			return nil, fmt.Errorf("failed to scan webhook: %w", err)
+		}
+
+		if nextRetryAt != nil {
+			t := time.Unix(*nextRetryAt, 0)
+			item.NextRetryAt = &t
+		}
+		item.ProcessingStartedAt = &now
+
+		items = append(items, &item)
+	}
+
+	if err := rows.Err(); err != nil {
+		metrics.DBOperationErrorsTotal.WithLabelValues(metrics.DBOpClaimActivityUpdateWebhooks).Inc()
+		return nil, fmt.Errorf("error iterating claimed webhooks: %w", err)
+	}
+
+	// RETURNING does not guarantee any order
+	sort.Slice(items, func(i, j int) bool { return items[i].ID < items[j].ID })
+
+	return items, nil
+}
+
 // DeleteWebhook deletes a processed webhook from the queue
 func (d *DB) DeleteWebhook(id int64) error {
 	timer := prometheus.NewTimer(metrics.DBOperationDuration.WithLabelValues(metrics.DBOpDeleteWebhook))
@@ -170,6 +331,59 @@ func (d *DB) ReleaseWebhook(id int64, retryCount int, errMsg string) (bool, erro
 	return true, nil // Released for retry
 }
 
+// HasPendingActivityWebhook returns true if a webhook for the activity is waiting in the queue
+func (d *DB) HasPendingActivityWebhook(activityID int64) (bool, error) {
+	timer := prometheus.NewTimer(metrics.DBOperationDuration.WithLabelValues(metrics.DBOpHasPendingActivityWebhook))
+	defer timer.ObserveDuration()
+
+	// Guard json_extract as queued data is not guaranteed to be valid JSON
+	query := `
+		SELECT EXISTS (
+			SELECT 1
+			FROM webhook_queue
+			WHERE CASE WHEN json_valid(data)
+			           THEN json_extract(data, '$.object_type') = 'activity'
+			                AND json_extract(data, '$.object_id') = ?
+			      END
+		)
+	`
+
+	var exists bool
+	if err := d.db.QueryRow(query, activityID).Scan(&exists); err != nil {
+		metrics.DBOperationErrorsTotal.WithLabelValues(metrics.DBOpHasPendingActivityWebhook).Inc()
+		return false, fmt.Errorf("failed to check for pending activity webhook: %w", err)
+	}
+
+	return exists, nil
+}
+
+// HasPendingActivityDelete returns true if a delete webhook for the activity is waiting in the queue
+func (d *DB) HasPendingActivityDelete(activityID int64) (bool, error) {
+	timer := prometheus.NewTimer(metrics.DBOperationDuration.WithLabelValues(metrics.DBOpHasPendingActivityWebhook))
+	defer timer.ObserveDuration()
+
+	// Guard json_extract as queued data is not guaranteed to be valid JSON
+	query := `
+		SELECT EXISTS (
+			SELECT 1
+			FROM webhook_queue
+			WHERE CASE WHEN json_valid(data)
+			           THEN json_extract(data, '$.object_type') = 'activity'
+			                AND json_extract(data, '$.aspect_type') = 'delete'
+			                AND json_extract(data, '$.object_id') = ?
+			      END
+		)
+	`
+
+	var exists bool
+	if err := d.db.QueryRow(query, activityID).Scan(&exists); err != nil {
+		metrics.DBOperationErrorsTotal.WithLabelValues(metrics.DBOpHasPendingActivityWebhook).Inc()
+		return false, fmt.Errorf("failed to check for pending activity delete: %w", err)
+	}
+
+	return exists, nil
+}
+
 // GetQueueLength returns the number of items in the webhook queue
 func (d *DB) GetQueueLength() (int, error) {
 	query := `SELECT COUNT(*) FROM webhook_queue`
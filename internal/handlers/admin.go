@@ -0,0 +1,391 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"plantopo-strava-sync/internal/config"
+	"plantopo-strava-sync/internal/database"
+)
+
+// AdminHandler handles the admin API for inspecting and managing the queues
+type AdminHandler struct {
+	db     *database.DB
+	config *config.Config
+	logger *slog.Logger
+}
+
+// NewAdminHandler creates a new admin handler
+func NewAdminHandler(db *database.DB, cfg *config.Config) *AdminHandler {
+	return &AdminHandler{
+		db:     db,
+		config: cfg,
+		logger: slog.Default(),
+	}
+}
+
+// queueActions are the operations the admin API can perform on a queue's items
+type queueActions struct {
+	retry       func(id int64) error
+	cancel      func(id int64) error
+	setPriority func(id int64, priority int) error
+}
+
+// HandleListWebhooks handles GET /admin/webhooks
+// Query parameters:
+//   - athlete_id: Only webhooks with this owner_id
+//   - min_retry_count: Only webhooks retried at least this many times
+//   - last_error: Only webhooks whose last error contains this text
+//   - limit: Maximum webhooks to return (default: 100, max: 1000)
+//
+// Authentication: Requires Authorization header
+func (h *AdminHandler) HandleListWebhooks(w http.ResponseWriter, r *http.Request) {
+	filter, ok := h.parseListRequest(w, r)
+	if !ok {
+		return
+	}
+
+	webhooks, err := h.db.ListWebhooks(filter)
+	if err != nil {
+		h.logger.Error("Failed to list webhooks", "error", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	h.writeJSON(w, map[string]interface{}{"webhooks": webhooks})
+}
+
+// HandleListSyncJobs handles GET /admin/sync-jobs
+// Accepts the same query parameters as HandleListWebhooks, plus:
+//   - job_type: Only jobs of this type
+//
+// Authentication: Requires Authorization header
+func (h *AdminHandler) HandleListSyncJobs(w http.ResponseWriter, r *http.Request) {
+	filter, ok := h.parseListRequest(w, r)
+	if !ok {
+		return
+	}
+	filter.JobType = r.URL.Query().Get("job_type")
+
+	jobs, err := h.db.ListSyncJobs(filter)
+	if err != nil {
+		h.logger.Error("Failed to list sync jobs", "error", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	h.writeJSON(w, map[string]interface{}{"sync_jobs": jobs})
+}
+
+// HandleWebhookAction handles POST /admin/webhooks/{id}/{action}
+// See handleAction for the supported actions
+func (h *AdminHandler) HandleWebhookAction(w http.ResponseWriter, r *http.Request) {
+	h.handleAction(w, r, "webhook", queueActions{
+		retry:       h.db.RetryWebhookNow,
+		cancel:      h.db.CancelWebhook,
+		setPriority: h.db.SetWebhookPriority,
+	})
+}
+
+// HandleSyncJobAction handles POST /admin/sync-jobs/{id}/{action}
+// See handleAction for the supported actions
+func (h *AdminHandler) HandleSyncJobAction(w http.ResponseWriter, r *http.Request) {
+	h.handleAction(w, r, "sync_job", queueActions{
+		retry:       h.db.RetrySyncJobNow,
+		cancel:      h.db.CancelSyncJob,
+		setPriority: h.db.SetSyncJobPriority,
+	})
+}
+
+// handleAction performs an action on a single queue item
+// Actions:
+//   - retry: Make an item waiting for a retry ready immediately
+//   - cancel: Remove an item from the queue
+//   - priority: Set an item's priority from the JSON body {"priority": <int>}
+//
+// Items claimed by the worker can't be retried or cancelled (409 Conflict)
+func (h *AdminHandler) handleAction(w http.ResponseWriter, r *http.Request, queueType string, actions queueActions) {
+	if !h.authorizePost(w, r) {
+		return
+	}
+
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid id", http.StatusBadRequest)
+		return
+	}
+
+	action := r.PathValue("action")
+	switch action {
+	case "retry":
+		err = actions.retry(id)
+	case "cancel":
+		err = actions.cancel(id)
+	case "priority":
+		var body struct {
+			Priority *int `json:"priority"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Priority == nil {
+			http.Error(w, "Body must be {\"priority\": <int>}", http.StatusBadRequest)
+			return
+		}
+		err = actions.setPriority(id, *body.Priority)
+	default:
+		http.Error(w, "Unknown action", http.StatusNotFound)
+		return
+	}
+
+	switch {
+	case errors.Is(err, database.ErrQueueItemNotFound):
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	case errors.Is(err, database.ErrQueueItemProcessing):
+		http.Error(w, "Item is being processed", http.StatusConflict)
+		return
+	case err != nil:
+		h.logger.Error("Failed to perform admin action", "queue_type", queueType, "id", id, "action", action, "error", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	h.logger.Info("Performed admin action", "queue_type", queueType, "id", id, "action", action)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// HandleResyncAthlete handles POST /admin/athletes/{athlete_id}/resync
+// Queues a refetch of all of the athlete's activities at resync priority
+//
+// Authentication: Requires Authorization header
+func (h *AdminHandler) HandleResyncAthlete(w http.ResponseWriter, r *http.Request) {
+	if !h.authorizePost(w, r) {
+		return
+	}
+
+	athleteID, err := strconv.ParseInt(r.PathValue("athlete_id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid athlete_id", http.StatusBadRequest)
+		return
+	}
+
+	jobID, err := h.db.ResyncAthlete(athleteID)
+	if !h.checkResyncError(w, err, athleteID) {
+		return
+	}
+
+	h.logger.Info("Queued athlete resync", "athlete_id", athleteID, "job_id", jobID)
+	h.writeJSONStatus(w, http.StatusAccepted, map[string]interface{}{"job_id": jobID})
+}
+
+// HandleResyncActivity handles POST /admin/athletes/{athlete_id}/activities/{activity_id}/resync
+// Queues a refetch of a single activity at resync priority
+//
+// Authentication: Requires Authorization header
+func (h *AdminHandler) HandleResyncActivity(w http.ResponseWriter, r *http.Request) {
+	if !h.authorizePost(w, r) {
+		return
+	}
+
+	athleteID, err := strconv.ParseInt(r.PathValue("athlete_id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid athlete_id", http.StatusBadRequest)
+		return
+	}
+	activityID, err := strconv.ParseInt(r.PathValue("activity_id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid activity_id", http.StatusBadRequest)
+		return
+	}
+
+	jobID, err := h.db.ResyncActivity(athleteID, activityID)
+	if !h.checkResyncError(w, err, athleteID) {
+		return
+	}
+
+	h.logger.Info("Queued activity resync", "athlete_id", athleteID, "activity_id", activityID, "job_id", jobID)
+	h.writeJSONStatus(w, http.StatusAccepted, map[string]interface{}{"job_id": jobID})
+}
+
+// HandleExtendBackfill handles POST /admin/athletes/{athlete_id}/backfill
+// Overrides the athlete's backfill horizon from the JSON body
+// {"max_age_days": <int>, "max_activities": <int>} (omitted = unchanged, 0 = unlimited)
+// and continues backfill from the oldest activity listed so far
+//
+// Authentication: Requires Authorization header
+func (h *AdminHandler) HandleExtendBackfill(w http.ResponseWriter, r *http.Request) {
+	if !h.authorizePost(w, r) {
+		return
+	}
+
+	athleteID, err := strconv.ParseInt(r.PathValue("athlete_id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid athlete_id", http.StatusBadRequest)
+		return
+	}
+
+	var body struct {
+		MaxAgeDays    *int `json:"max_age_days"`
+		MaxActivities *int `json:"max_activities"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+		return
+	}
+	if (body.MaxAgeDays != nil && *body.MaxAgeDays < 0) || (body.MaxActivities != nil && *body.MaxActivities < 0) {
+		http.Error(w, "Horizon must not be negative", http.StatusBadRequest)
+		return
+	}
+
+	jobID, err := h.db.ExtendBackfill(athleteID, body.MaxAgeDays, body.MaxActivities)
+	if !h.checkResyncError(w, err, athleteID) {
+		return
+	}
+
+	h.logger.Info("Queued backfill extension", "athlete_id", athleteID, "job_id", jobID)
+	h.writeJSONStatus(w, http.StatusAccepted, map[string]interface{}{"job_id": jobID})
+}
+
+// HandleResyncAll handles POST /admin/resync
+// Queues a refetch of every athlete's activities at resync priority
+//
+// Authentication: Requires Authorization header
+func (h *AdminHandler) HandleResyncAll(w http.ResponseWriter, r *http.Request) {
+	if !h.authorizePost(w, r) {
+		return
+	}
+
+	count, err := h.db.ResyncAllAthletes()
+	if err != nil {
+		h.logger.Error("Failed to resync athletes", "queued", count, "error", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	h.logger.Info("Queued resync of all athletes", "athletes", count)
+	h.writeJSONStatus(w, http.StatusAccepted, map[string]interface{}{"athletes": count})
+}
+
+// HandleListClients handles GET /admin/clients
+// Lists each client with its athletes, pending migrations and API requests,
+// for rebalancing athletes between clients
+//
+// Authentication: Requires Authorization header
+func (h *AdminHandler) HandleListClients(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if authorizeAPIRequest(w, r, h.config, h.db, database.ScopeAdmin) == nil {
+		return
+	}
+
+	clients, err := h.db.GetClientUsage(h.config.GetClientIDs(), time.Now())
+	if err != nil {
+		h.logger.Error("Failed to get client usage", "error", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	h.writeJSON(w, map[string]interface{}{"clients": clients})
+}
+
+// authorizePost checks the method and authentication of an admin POST request
+// Writes an error response and returns false if the request is not allowed
+func (h *AdminHandler) authorizePost(w http.ResponseWriter, r *http.Request) bool {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return false
+	}
+
+	if authorizeAPIRequest(w, r, h.config, h.db, database.ScopeAdmin) == nil {
+		return false
+	}
+
+	return true
+}
+
+// checkResyncError writes an error response for a failed resync
+// Returns true if there was no error
+func (h *AdminHandler) checkResyncError(w http.ResponseWriter, err error, athleteID int64) bool {
+	switch {
+	case errors.Is(err, database.ErrAthleteNotFound):
+		http.Error(w, "Athlete not found", http.StatusNotFound)
+		return false
+	case err != nil:
+		h.logger.Error("Failed to queue resync", "athlete_id", athleteID, "error", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return false
+	}
+	return true
+}
+
+// parseListRequest authenticates a list request and parses the common filters
+// Writes an error response and returns false if the request is invalid
+func (h *AdminHandler) parseListRequest(w http.ResponseWriter, r *http.Request) (database.QueueFilter, bool) {
+	var filter database.QueueFilter
+
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return filter, false
+	}
+
+	if authorizeAPIRequest(w, r, h.config, h.db, database.ScopeAdmin) == nil {
+		return filter, false
+	}
+
+	query := r.URL.Query()
+
+	if athleteIDStr := query.Get("athlete_id"); athleteIDStr != "" {
+		athleteID, err := strconv.ParseInt(athleteIDStr, 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid athlete_id parameter", http.StatusBadRequest)
+			return filter, false
+		}
+		filter.AthleteID = athleteID
+	}
+
+	if retryCountStr := query.Get("min_retry_count"); retryCountStr != "" {
+		retryCount, err := strconv.Atoi(retryCountStr)
+		if err != nil || retryCount < 0 {
+			http.Error(w, "Invalid min_retry_count parameter", http.StatusBadRequest)
+			return filter, false
+		}
+		filter.MinRetryCount = retryCount
+	}
+
+	filter.LastError = query.Get("last_error")
+
+	filter.Limit = 100
+	if limitStr := query.Get("limit"); limitStr != "" {
+		limit, err := strconv.Atoi(limitStr)
+		if err != nil {
+			http.Error(w, "Invalid limit parameter", http.StatusBadRequest)
+			return filter, false
+		}
+		if limit < 1 || limit > 1000 {
+			http.Error(w, "Limit must be between 1 and 1000", http.StatusBadRequest)
+			return filter, false
+		}
+		filter.Limit = limit
+	}
+
+	return filter, true
+}
+
+// writeJSON writes a JSON response
+func (h *AdminHandler) writeJSON(w http.ResponseWriter, response interface{}) {
+	h.writeJSONStatus(w, http.StatusOK, response)
+}
+
+// writeJSONStatus writes a JSON response with the given status code
+func (h *AdminHandler) writeJSONStatus(w http.ResponseWriter, status int, response interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		h.logger.Error("Failed to encode admin response", "error", err)
+	}
+}
@@ -0,0 +1,418 @@
+package handlers
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"plantopo-strava-sync/internal/config"
+	"plantopo-strava-sync/internal/database"
+)
+
+func setupAdminHandlerTest(t *testing.T) (*AdminHandler, *database.DB) {
+	dbPath := t.TempDir() + "/test.db"
+	db, err := database.Open(dbPath)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+
+	cfg := &config.Config{
+		InternalAPIKey:  "test_api_key",
+		InternalAPIKeys: []string{"test_api_key"},
+	}
+
+	return NewAdminHandler(db, cfg), db
+}
+
+// newAdminActionRequest creates an authorized admin action request with path values set
+func newAdminActionRequest(path string, id int64, action string, body string) *http.Request {
+	req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer test_api_key")
+	req.SetPathValue("id", strconv.FormatInt(id, 10))
+	req.SetPathValue("action", action)
+	return req
+}
+
+func TestHandleListWebhooks_Unauthorized(t *testing.T) {
+	handler, db := setupAdminHandlerTest(t)
+	defer db.Close()
+
+	req := httptest.NewRequest(http.MethodGet, "/admin/webhooks", nil)
+	w := httptest.NewRecorder()
+
+	handler.HandleListWebhooks(w, req)
+
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected status 401, got %d", w.Code)
+	}
+}
+
+func TestHandleListWebhooks_APIKeyScopes(t *testing.T) {
+	handler, db := setupAdminHandlerTest(t)
+	defer db.Close()
+
+	readerKey, _, err := db.CreateAPIKey("reader", []string{database.ScopeEventsRead}, nil)
+	if err != nil {
+		t.Fatalf("Failed to create api key: %v", err)
+	}
+	adminKey, _, err := db.CreateAPIKey("admin", []string{database.ScopeAdmin}, nil)
+	if err != nil {
+		t.Fatalf("Failed to create api key: %v", err)
+	}
+
+	for key, expected := range map[string]int{readerKey: http.StatusForbidden, adminKey: http.StatusOK} {
+		req := httptest.NewRequest(http.MethodGet, "/admin/webhooks", nil)
+		req.Header.Set("Authorization", "Bearer "+key)
+		w := httptest.NewRecorder()
+
+		handler.HandleListWebhooks(w, req)
+
+		if w.Code != expected {
+			t.Errorf("Expected status %d, got %d", expected, w.Code)
+		}
+	}
+}
+
+func TestHandleListWebhooks_Filters(t *testing.T) {
+	handler, db := setupAdminHandlerTest(t)
+	defer db.Close()
+
+	db.EnqueueWebhook(json.RawMessage(`{"object_type": "activity", "object_id": 1, "owner_id": 111}`))
+	db.EnqueueWebhook(json.RawMessage(`{"object_type": "activity", "object_id": 2, "owner_id": 222}`))
+	failedID, _ := db.EnqueueWebhook(json.RawMessage(`{"object_type": "activity", "object_id": 3, "owner_id": 222}`))
+	if _, err := db.ReleaseWebhook(failedID, 0, "failed to get activity: 500"); err != nil {
+		t.Fatalf("Failed to release webhook: %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		query    string
+		expected int
+	}{
+		{"no filters", "", 3},
+		{"athlete", "?athlete_id=222", 2},
+		{"retry count", "?min_retry_count=1", 1},
+		{"last error", "?last_error=500", 1},
+		{"limit", "?limit=1", 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/admin/webhooks"+tt.query, nil)
+			req.Header.Set("Authorization", "Bearer test_api_key")
+			w := httptest.NewRecorder()
+
+			handler.HandleListWebhooks(w, req)
+
+			if w.Code != http.StatusOK {
+				t.Fatalf("Expected status 200, got %d", w.Code)
+			}
+
+			var response struct {
+				Webhooks []database.WebhookQueueItem `json:"webhooks"`
+			}
+			if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
+				t.Fatalf("Failed to decode response: %v", err)
+			}
+
+			if len(response.Webhooks) != tt.expected {
+				t.Errorf("Expected %d webhooks, got %d", tt.expected, len(response.Webhooks))
+			}
+		})
+	}
+}
+
+func TestHandleListSyncJobs_JobTypeFilter(t *testing.T) {
+	handler, db := setupAdminHandlerTest(t)
+	defer db.Close()
+
+	db.EnqueueSyncJob(111, "list_activities")
+	db.EnqueueActivitySyncJob(111, 1001)
+	db.EnqueueActivitySyncJob(222, 1002)
+
+	req := httptest.NewRequest(http.MethodGet, "/admin/sync-jobs?job_type=sync_activity&athlete_id=111", nil)
+	req.Header.Set("Authorization", "Bearer test_api_key")
+	w := httptest.NewRecorder()
+
+	handler.HandleListSyncJobs(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", w.Code)
+	}
+
+	var response struct {
+		SyncJobs []database.SyncJob `json:"sync_jobs"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+
+	if len(response.SyncJobs) != 1 {
+		t.Fatalf("Expected 1 sync job, got %d", len(response.SyncJobs))
+	}
+	if job := response.SyncJobs[0]; job.ActivityID == nil || *job.ActivityID != 1001 {
+		t.Errorf("Expected sync job for activity 1001, got %+v", job)
+	}
+}
+
+func TestHandleWebhookAction_RetryNow(t *testing.T) {
+	handler, db := setupAdminHandlerTest(t)
+	defer db.Close()
+
+	id, _ := db.EnqueueWebhook(json.RawMessage(`{"object_type": "activity", "object_id": 1}`))
+	if _, err := db.ReleaseWebhook(id, 0, "temporary error"); err != nil {
+		t.Fatalf("Failed to release webhook: %v", err)
+	}
+
+	w := httptest.NewRecorder()
+	handler.HandleWebhookAction(w, newAdminActionRequest("/admin/webhooks/1/retry", id, "retry", ""))
+
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("Expected status 204, got %d", w.Code)
+	}
+
+	ready, err := db.GetReadyQueueLength()
+	if err != nil {
+		t.Fatalf("Failed to get ready queue length: %v", err)
+	}
+	if ready != 1 {
+		t.Errorf("Expected webhook to be ready after retry, got %d ready", ready)
+	}
+}
+
+func TestHandleWebhookAction_CancelProcessing(t *testing.T) {
+	handler, db := setupAdminHandlerTest(t)
+	defer db.Close()
+
+	id, _ := db.EnqueueWebhook(json.RawMessage(`{"object_type": "activity", "object_id": 1}`))
+
+	// The worker has claimed the webhook
+	if _, err := db.ClaimWebhook(); err != nil {
+		t.Fatalf("Failed to claim webhook: %v", err)
+	}
+
+	w := httptest.NewRecorder()
+	handler.HandleWebhookAction(w, newAdminActionRequest("/admin/webhooks/1/cancel", id, "cancel", ""))
+
+	if w.Code != http.StatusConflict {
+		t.Errorf("Expected status 409, got %d", w.Code)
+	}
+
+	length, _ := db.GetQueueLength()
+	if length != 1 {
+		t.Errorf("Expected webhook being processed to remain queued, got length %d", length)
+	}
+}
+
+func TestHandleSyncJobAction_CancelAndNotFound(t *testing.T) {
+	handler, db := setupAdminHandlerTest(t)
+	defer db.Close()
+
+	id, _ := db.EnqueueSyncJob(111, "list_activities")
+
+	w := httptest.NewRecorder()
+	handler.HandleSyncJobAction(w, newAdminActionRequest("/admin/sync-jobs/1/cancel", id, "cancel", ""))
+
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("Expected status 204, got %d", w.Code)
+	}
+
+	length, _ := db.GetSyncJobQueueLength()
+	if length != 0 {
+		t.Errorf("Expected cancelled job to be removed, got length %d", length)
+	}
+
+	// Cancelling again finds nothing
+	w = httptest.NewRecorder()
+	handler.HandleSyncJobAction(w, newAdminActionRequest("/admin/sync-jobs/1/cancel", id, "cancel", ""))
+
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected status 404, got %d", w.Code)
+	}
+}
+
+func TestHandleSyncJobAction_Priority(t *testing.T) {
+	handler, db := setupAdminHandlerTest(t)
+	defer db.Close()
+
+	db.EnqueueSyncJob(111, "list_activities")
+	bumpedID, _ := db.EnqueueSyncJob(222, "list_activities")
+
+	w := httptest.NewRecorder()
+	handler.HandleSyncJobAction(w, newAdminActionRequest("/admin/sync-jobs/2/priority", bumpedID, "priority", `{"priority": 10}`))
+
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("Expected status 204, got %d", w.Code)
+	}
+
+	// The bumped job is claimed first
+	job, err := db.ClaimSyncJob()
+	if err != nil {
+		t.Fatalf("Failed to claim sync job: %v", err)
+	}
+	if job == nil || job.ID != bumpedID {
+		t.Errorf("Expected bumped job %d to be claimed first, got %+v", bumpedID, job)
+	}
+
+	// Priority requires a body
+	w = httptest.NewRecorder()
+	handler.HandleSyncJobAction(w, newAdminActionRequest("/admin/sync-jobs/2/priority", bumpedID, "priority", ""))
+
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400, got %d", w.Code)
+	}
+}
+
+func insertAdminTestAthlete(t *testing.T, db *database.DB, athleteID int64) {
+	t.Helper()
+
+	athlete := &database.Athlete{
+		AthleteID:      athleteID,
+		ClientID:       "primary",
+		AccessToken:    "access_token",
+		RefreshToken:   "refresh_token",
+		TokenExpiresAt: time.Now().Add(1 * time.Hour),
+		AthleteSummary: json.RawMessage(`{}`),
+	}
+	if err := db.UpsertAthlete(athlete); err != nil {
+		t.Fatalf("Failed to insert athlete: %v", err)
+	}
+}
+
+// newAdminResyncRequest creates an authorized resync request with path values set
+func newAdminResyncRequest(path string, pathValues map[string]string) *http.Request {
+	req := httptest.NewRequest(http.MethodPost, path, nil)
+	req.Header.Set("Authorization", "Bearer test_api_key")
+	for name, value := range pathValues {
+		req.SetPathValue(name, value)
+	}
+	return req
+}
+
+func TestHandleResyncAthlete(t *testing.T) {
+	handler, db := setupAdminHandlerTest(t)
+	defer db.Close()
+
+	insertAdminTestAthlete(t, db, 111)
+
+	w := httptest.NewRecorder()
+	handler.HandleResyncAthlete(w, newAdminResyncRequest("/admin/athletes/111/resync", map[string]string{"athlete_id": "111"}))
+
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("Expected status 202, got %d", w.Code)
+	}
+
+	job, err := db.ClaimSyncJob()
+	if err != nil {
+		t.Fatalf("Failed to claim sync job: %v", err)
+	}
+	if job == nil || job.JobType != "list_activities" || job.Priority != database.PriorityResync {
+		t.Errorf("Expected list_activities job at resync priority, got %+v", job)
+	}
+
+	// Unknown athletes are not queued
+	w = httptest.NewRecorder()
+	handler.HandleResyncAthlete(w, newAdminResyncRequest("/admin/athletes/222/resync", map[string]string{"athlete_id": "222"}))
+
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected status 404, got %d", w.Code)
+	}
+}
+
+func TestHandleResyncActivity(t *testing.T) {
+	handler, db := setupAdminHandlerTest(t)
+	defer db.Close()
+
+	insertAdminTestAthlete(t, db, 111)
+
+	w := httptest.NewRecorder()
+	handler.HandleResyncActivity(w, newAdminResyncRequest("/admin/athletes/111/activities/1001/resync",
+		map[string]string{"athlete_id": "111", "activity_id": "1001"}))
+
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("Expected status 202, got %d", w.Code)
+	}
+
+	job, err := db.ClaimSyncJob()
+	if err != nil {
+		t.Fatalf("Failed to claim sync job: %v", err)
+	}
+	if job == nil || job.ActivityID == nil || *job.ActivityID != 1001 || job.Priority != database.PriorityResync {
+		t.Errorf("Expected sync_activity job for 1001 at resync priority, got %+v", job)
+	}
+}
+
+func TestHandleResyncAll(t *testing.T) {
+	handler, db := setupAdminHandlerTest(t)
+	defer db.Close()
+
+	insertAdminTestAthlete(t, db, 111)
+	insertAdminTestAthlete(t, db, 222)
+
+	// A newly connected athlete's backfill is claimed before resyncs
+	backfillID, _ := db.EnqueueSyncJob(333, "list_activities")
+
+	w := httptest.NewRecorder()
+	handler.HandleResyncAll(w, newAdminResyncRequest("/admin/resync", nil))
+
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("Expected status 202, got %d", w.Code)
+	}
+
+	var response struct {
+		Athletes int `json:"athletes"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if response.Athletes != 2 {
+		t.Errorf("Expected 2 athletes queued, got %d", response.Athletes)
+	}
+
+	job, err := db.ClaimSyncJob()
+	if err != nil {
+		t.Fatalf("Failed to claim sync job: %v", err)
+	}
+	if job == nil || job.ID != backfillID {
+		t.Errorf("Expected backfill job %d to be claimed before resyncs, got %+v", backfillID, job)
+	}
+}
+
+func TestHandleExtendBackfill(t *testing.T) {
+	handler, db := setupAdminHandlerTest(t)
+	defer db.Close()
+
+	insertAdminTestAthlete(t, db, 111)
+
+	req := newAdminResyncRequest("/admin/athletes/111/backfill", map[string]string{"athlete_id": "111"})
+	req.Body = io.NopCloser(strings.NewReader(`{"max_age_days": 0}`))
+	w := httptest.NewRecorder()
+	handler.HandleExtendBackfill(w, req)
+
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("Expected status 202, got %d", w.Code)
+	}
+
+	state, err := db.GetBackfillState(111)
+	if err != nil {
+		t.Fatalf("Failed to get backfill state: %v", err)
+	}
+	if state.MaxAgeDays == nil || *state.MaxAgeDays != 0 || state.MaxActivities != nil {
+		t.Errorf("Expected unlimited age override only, got %+v", state)
+	}
+
+	// Negative horizons are rejected
+	req = newAdminResyncRequest("/admin/athletes/111/backfill", map[string]string{"athlete_id": "111"})
+	req.Body = io.NopCloser(strings.NewReader(`{"max_activities": -1}`))
+	w = httptest.NewRecorder()
+	handler.HandleExtendBackfill(w, req)
+
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400, got %d", w.Code)
+	}
+}
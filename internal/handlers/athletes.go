@@ -0,0 +1,151 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+
+	"plantopo-strava-sync/internal/config"
+	"plantopo-strava-sync/internal/database"
+	"plantopo-strava-sync/internal/oauth"
+)
+
+// AthletesHandler handles the internal API for managing athletes
+type AthletesHandler struct {
+	db           *database.DB
+	oauthManager *oauth.Manager
+	config       *config.Config
+	logger       *slog.Logger
+}
+
+// NewAthletesHandler creates a new athletes handler
+func NewAthletesHandler(db *database.DB, oauthManager *oauth.Manager, cfg *config.Config) *AthletesHandler {
+	return &AthletesHandler{
+		db:           db,
+		oauthManager: oauthManager,
+		config:       cfg,
+		logger:       slog.Default(),
+	}
+}
+
+// HandleDeleteAthlete handles DELETE /athletes/{athlete_id}
+// Revokes our Strava access and deletes the athlete's tokens, queued work and
+// events, leaving a deauthorization event as the athlete's last event.
+// Query parameters:
+//   - force: If "true", delete the athlete even if Strava deauthorization fails
+//
+// Responds with 200 and {"athlete_id": <id>, "event_id": <id>}, 404 if the
+// athlete isn't connected, or 502 if Strava deauthorization failed
+//
+// Authentication: Requires Authorization header
+func (h *AthletesHandler) HandleDeleteAthlete(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if authorizeAPIRequest(w, r, h.config, h.db, database.ScopeAdmin) == nil {
+		return
+	}
+
+	athleteID, err := strconv.ParseInt(r.PathValue("athlete_id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid athlete_id", http.StatusBadRequest)
+		return
+	}
+
+	force := r.URL.Query().Get("force") == "true"
+
+	eventID, err := h.oauthManager.DisconnectAthlete(athleteID, force)
+	if errors.Is(err, database.ErrAthleteNotFound) {
+		http.Error(w, "Athlete not found", http.StatusNotFound)
+		return
+	}
+	if errors.Is(err, oauth.ErrDeauthorizeFailed) {
+		h.logger.Error("Failed to deauthorize athlete", "athlete_id", athleteID, "error", err)
+		http.Error(w, "Failed to deauthorize athlete with Strava", http.StatusBadGateway)
+		return
+	}
+	if err != nil {
+		h.logger.Error("Failed to delete athlete", "athlete_id", athleteID, "error", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	h.logger.Info("Deleted athlete", "athlete_id", athleteID, "event_id", eventID)
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(map[string]int64{"athlete_id": athleteID, "event_id": eventID}); err != nil {
+		h.logger.Error("Failed to encode delete athlete response", "error", err)
+	}
+}
+
+// HandleMigrateAthlete handles POST /athletes/{athlete_id}/migrate
+// Creates a link inviting the athlete to authorize again under the client in
+// the JSON body {"client_id": <client>}. The athlete keeps their athlete ID,
+// events and sync state, and uses their current client until they follow it.
+//
+// Responds with 201 and {"athlete_id", "from_client_id", "to_client_id",
+// "url", "expires_at"}, 400 if the client isn't configured, 404 if the athlete
+// isn't connected, or 409 if they already use the client
+//
+// Authentication: Requires Authorization header
+func (h *AthletesHandler) HandleMigrateAthlete(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if authorizeAPIRequest(w, r, h.config, h.db, database.ScopeAdmin) == nil {
+		return
+	}
+
+	athleteID, err := strconv.ParseInt(r.PathValue("athlete_id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid athlete_id", http.StatusBadRequest)
+		return
+	}
+
+	var body struct {
+		ClientID string `json:"client_id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.ClientID == "" {
+		http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+		return
+	}
+
+	migration, err := h.oauthManager.CreateClientMigration(athleteID, body.ClientID)
+	switch {
+	case errors.Is(err, oauth.ErrUnknownClient):
+		http.Error(w, "Invalid client_id", http.StatusBadRequest)
+		return
+	case errors.Is(err, oauth.ErrClientDisabled):
+		http.Error(w, "Client is not accepting new connections", http.StatusConflict)
+		return
+	case errors.Is(err, database.ErrAthleteNotFound):
+		http.Error(w, "Athlete not found", http.StatusNotFound)
+		return
+	case errors.Is(err, database.ErrAlreadyOnClient):
+		http.Error(w, "Athlete already uses client", http.StatusConflict)
+		return
+	case err != nil:
+		h.logger.Error("Failed to create client migration", "athlete_id", athleteID, "error", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	err = json.NewEncoder(w).Encode(map[string]interface{}{
+		"athlete_id":     athleteID,
+		"from_client_id": migration.FromClientID,
+		"to_client_id":   migration.ToClientID,
+		"url":            h.oauthManager.MigrationURL(migration),
+		"expires_at":     migration.ExpiresAt,
+	})
+	if err != nil {
+		h.logger.Error("Failed to encode migrate athlete response", "error", err)
+	}
+}
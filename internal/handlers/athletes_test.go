@@ -0,0 +1,180 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"plantopo-strava-sync/internal/config"
+	"plantopo-strava-sync/internal/database"
+	"plantopo-strava-sync/internal/oauth"
+	"plantopo-strava-sync/internal/strava"
+)
+
+func setupAthletesHandlerTest(t *testing.T, deauthStatus int) (*AthletesHandler, *database.DB) {
+	dbPath := t.TempDir() + "/test.db"
+	db, err := database.Open(dbPath)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+
+	cfg := &config.Config{
+		StravaClients: map[string]*config.StravaClientConfig{
+			"primary": {ClientID: "test_client_id", ClientSecret: "test_client_secret"},
+		},
+		InternalAPIKey:  "test_api_key",
+		InternalAPIKeys: []string{"test_api_key"},
+	}
+
+	deauthServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(deauthStatus)
+	}))
+	t.Cleanup(deauthServer.Close)
+
+	stravaClient := strava.NewClient(cfg, db)
+	stravaClient.SetDeauthorizeURL(deauthServer.URL)
+
+	athlete := &database.Athlete{
+		AthleteID:      12345,
+		ClientID:       "primary",
+		AccessToken:    "access_token",
+		RefreshToken:   "refresh_token",
+		TokenExpiresAt: time.Now().Add(1 * time.Hour),
+		AthleteSummary: json.RawMessage(`{"id": 12345}`),
+	}
+	if err := db.UpsertAthlete(athlete); err != nil {
+		t.Fatalf("Failed to insert athlete: %v", err)
+	}
+
+	return NewAthletesHandler(db, oauth.NewManager(cfg, db, stravaClient), cfg), db
+}
+
+// newDeleteAthleteRequest creates a DELETE /athletes/{athlete_id} request
+func newDeleteAthleteRequest(athleteID string, query string, authorized bool) *http.Request {
+	req := httptest.NewRequest(http.MethodDelete, "/athletes/"+athleteID+query, nil)
+	if authorized {
+		req.Header.Set("Authorization", "Bearer test_api_key")
+	}
+	req.SetPathValue("athlete_id", athleteID)
+	return req
+}
+
+func TestHandleDeleteAthlete(t *testing.T) {
+	handler, db := setupAthletesHandlerTest(t, http.StatusOK)
+	defer db.Close()
+
+	w := httptest.NewRecorder()
+	handler.HandleDeleteAthlete(w, newDeleteAthleteRequest("12345", "", false))
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected status 401, got %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	handler.HandleDeleteAthlete(w, newDeleteAthleteRequest("12345", "", true))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", w.Code)
+	}
+
+	var response struct {
+		EventID int64 `json:"event_id"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+
+	events, err := db.ListEvents(12345, 0, 10)
+	if err != nil {
+		t.Fatalf("Failed to list events: %v", err)
+	}
+	if len(events) != 1 || events[0].EventID != response.EventID {
+		t.Errorf("Expected the deauthorization event %d to be the only event, got %d events", response.EventID, len(events))
+	}
+
+	// Deleting again finds nothing
+	w = httptest.NewRecorder()
+	handler.HandleDeleteAthlete(w, newDeleteAthleteRequest("12345", "", true))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected status 404, got %d", w.Code)
+	}
+}
+
+func TestHandleDeleteAthlete_DeauthorizeFails(t *testing.T) {
+	handler, db := setupAthletesHandlerTest(t, http.StatusInternalServerError)
+	defer db.Close()
+
+	w := httptest.NewRecorder()
+	handler.HandleDeleteAthlete(w, newDeleteAthleteRequest("12345", "", true))
+	if w.Code != http.StatusBadGateway {
+		t.Fatalf("Expected status 502, got %d", w.Code)
+	}
+	if athlete, _ := db.GetAthlete(12345); athlete == nil {
+		t.Error("Expected athlete to be kept when deauthorization fails")
+	}
+
+	// Forcing deletes the athlete anyway
+	w = httptest.NewRecorder()
+	handler.HandleDeleteAthlete(w, newDeleteAthleteRequest("12345", "?force=true", true))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", w.Code)
+	}
+	if athlete, _ := db.GetAthlete(12345); athlete != nil {
+		t.Error("Expected athlete to be deleted when forced")
+	}
+}
+
+func TestHandleMigrateAthlete(t *testing.T) {
+	handler, db := setupAthletesHandlerTest(t, http.StatusOK)
+	defer db.Close()
+
+	handler.config.Domain = "sync.example.com"
+	handler.config.ClientMigrationTTL = time.Hour
+	handler.config.StravaClients["secondary"] = &config.StravaClientConfig{ClientID: "test_secondary_client_id"}
+
+	migrate := func(athleteID, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/athletes/"+athleteID+"/migrate", strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer test_api_key")
+		req.SetPathValue("athlete_id", athleteID)
+		w := httptest.NewRecorder()
+		handler.HandleMigrateAthlete(w, req)
+		return w
+	}
+
+	cases := []struct {
+		athleteID string
+		body      string
+		status    int
+	}{
+		{"12345", `{"client_id": "unknown"}`, http.StatusBadRequest},
+		{"12345", `{}`, http.StatusBadRequest},
+		{"999", `{"client_id": "secondary"}`, http.StatusNotFound},
+		{"12345", `{"client_id": "primary"}`, http.StatusConflict},
+	}
+	for _, c := range cases {
+		if w := migrate(c.athleteID, c.body); w.Code != c.status {
+			t.Errorf("Expected status %d for athlete %s with %s, got %d", c.status, c.athleteID, c.body, w.Code)
+		}
+	}
+
+	w := migrate("12345", `{"client_id": "secondary"}`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Expected status 201, got %d: %s", w.Code, w.Body.String())
+	}
+
+	var response struct {
+		FromClientID string `json:"from_client_id"`
+		ToClientID   string `json:"to_client_id"`
+		URL          string `json:"url"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if response.FromClientID != "primary" || response.ToClientID != "secondary" {
+		t.Errorf("Expected migration from primary to secondary, got %+v", response)
+	}
+	if !strings.HasPrefix(response.URL, "https://sync.example.com/oauth-start?migration=") {
+		t.Errorf("Unexpected migration URL %s", response.URL)
+	}
+}
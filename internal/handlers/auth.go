@@ -0,0 +1,52 @@
+package handlers
+
+import (
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"plantopo-strava-sync/internal/config"
+	"plantopo-strava-sync/internal/database"
+	"plantopo-strava-sync/internal/metrics"
+)
+
+// authorizeAPIRequest checks that the request is authorized with a configured
+// internal API key, or an API key with any of scopes. Writes an error response
+// and returns nil if it isn't.
+func authorizeAPIRequest(w http.ResponseWriter, r *http.Request, cfg *config.Config, db *database.DB, scopes ...string) *database.APIKey {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if ok && cfg.IsInternalAPIKey(token) {
+		metrics.APIKeyRequestsTotal.WithLabelValues(metrics.APIKeyInternal, metrics.AuthAuthorized).Inc()
+		return &database.APIKey{Name: metrics.APIKeyInternal, Scopes: []string{database.ScopeAdmin}}
+	}
+
+	var apiKey *database.APIKey
+	if ok && token != "" {
+		var err error
+		if apiKey, err = db.AuthenticateAPIKey(token, time.Now()); err != nil {
+			slog.Error("Failed to authenticate API key", "error", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return nil
+		}
+	}
+
+	if apiKey == nil {
+		slog.Warn("Unauthorized API request", "path", r.URL.Path, "has_auth", r.Header.Get("Authorization") != "")
+		metrics.APIKeyRequestsTotal.WithLabelValues(metrics.APIKeyUnknown, metrics.AuthUnauthorized).Inc()
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return nil
+	}
+
+	for _, scope := range scopes {
+		if apiKey.HasScope(scope) {
+			metrics.APIKeyRequestsTotal.WithLabelValues(apiKey.Name, metrics.AuthAuthorized).Inc()
+			return apiKey
+		}
+	}
+
+	slog.Warn("API key lacks scope", "path", r.URL.Path, "key", apiKey.Name, "required", scopes)
+	metrics.APIKeyRequestsTotal.WithLabelValues(apiKey.Name, metrics.AuthForbidden).Inc()
+	http.Error(w, "Forbidden", http.StatusForbidden)
+	return nil
+}
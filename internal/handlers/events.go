@@ -37,7 +37,8 @@ func NewEventsHandler(db *database.DB, cfg *config.Config) *EventsHandler {
 //   - limit: Maximum events to return (default: 100, max: 1000)
 //   - long_poll: Enable long-polling (default: false)
 //
-// Authentication: Requires Authorization header
+// Authentication: Requires Authorization header with an events:read key, or an
+// athlete:read key which only returns its athlete's events
 func (h *EventsHandler) HandleEvents(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
@@ -45,13 +46,24 @@ func (h *EventsHandler) HandleEvents(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Verify authentication - check Authorization header
-	authHeader := r.Header.Get("Authorization")
-	if authHeader != "Bearer "+h.config.InternalAPIKey {
-		h.logger.Warn("Unauthorized events request", "has_auth", authHeader != "")
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+	apiKey := authorizeAPIRequest(w, r, h.config, h.db, database.ScopeEventsRead, database.ScopeAthleteRead)
+	if apiKey == nil {
 		return
 	}
 
+	// Athlete-scoped keys only see their athlete's events
+	getEvents := h.db.GetEvents
+	if !apiKey.HasScope(database.ScopeEventsRead) {
+		if apiKey.AthleteID == nil {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		athleteID := *apiKey.AthleteID
+		getEvents = func(cursor int64, limit int) ([]*database.Event, error) {
+			return h.db.ListEvents(athleteID, cursor, limit)
+		}
+	}
+
 	// Parse query parameters
 	query := r.URL.Query()
 
@@ -89,15 +101,15 @@ func (h *EventsHandler) HandleEvents(w http.ResponseWriter, r *http.Request) {
 		longPoll = longPollStr == "true" || longPollStr == "1"
 	}
 
-	h.logger.Info("Events request", "cursor", cursor, "limit", limit, "long_poll", longPoll)
+	h.logger.Info("Events request", "cursor", cursor, "limit", limit, "long_poll", longPoll, "api_key", apiKey.Name)
 
 	// Get events (with or without long-polling)
 	var events []*database.Event
 	if longPoll {
-		events = h.longPollEvents(cursor, limit)
+		events = h.longPollEvents(getEvents, cursor, limit)
 	} else {
 		var err error
-		events, err = h.db.GetEvents(cursor, limit)
+		events, err = getEvents(cursor, limit)
 		if err != nil {
 			h.logger.Error("Failed to get events", "error", err)
 			events = []*database.Event{}
@@ -118,13 +130,13 @@ func (h *EventsHandler) HandleEvents(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-// longPollEvents polls for events until some are available or timeout occurs
-func (h *EventsHandler) longPollEvents(cursor int64, limit int) []*database.Event {
+// longPollEvents polls getEvents until some are available or timeout occurs
+func (h *EventsHandler) longPollEvents(getEvents func(cursor int64, limit int) ([]*database.Event, error), cursor int64, limit int) []*database.Event {
 	deadline := time.Now().Add(h.pollTimeout)
 
 	for {
 		// Try to get events
-		events, err := h.db.GetEvents(cursor, limit)
+		events, err := getEvents(cursor, limit)
 		if err != nil {
 			h.logger.Error("Failed to get events", "error", err, "cursor", cursor)
 			return []*database.Event{} // Return empty on error
@@ -19,7 +19,8 @@ func setupEventsHandlerTest(t *testing.T) (*EventsHandler, *database.DB) {
 	}
 
 	cfg := &config.Config{
-		InternalAPIKey: "test_api_key",
+		InternalAPIKey:  "test_api_key",
+		InternalAPIKeys: []string{"test_api_key"},
 	}
 
 	handler := NewEventsHandler(db, cfg)
@@ -36,7 +37,7 @@ func TestHandleEvents_Success(t *testing.T) {
 
 	// Insert test events
 	athleteID := int64(12345)
-	_, err := db.InsertAthleteConnectedEvent(athleteID, json.RawMessage(`{"id": 12345}`))
+	_, err := db.InsertAthleteConnectedEvent(athleteID, json.RawMessage(`{"id": 12345}`), nil, "")
 	if err != nil {
 		t.Fatalf("Failed to insert event: %v", err)
 	}
@@ -225,7 +226,7 @@ func TestHandleEvents_LongPolling(t *testing.T) {
 	// Insert event after a brief delay
 	time.Sleep(50 * time.Millisecond)
 	athleteID := int64(12345)
-	_, err := db.InsertAthleteConnectedEvent(athleteID, json.RawMessage(`{"id": 12345}`))
+	_, err := db.InsertAthleteConnectedEvent(athleteID, json.RawMessage(`{"id": 12345}`), nil, "")
 	if err != nil {
 		t.Fatalf("Failed to insert event: %v", err)
 	}
@@ -263,7 +264,7 @@ func TestHandleEvents_LongPollDisabled(t *testing.T) {
 
 	// Insert test event
 	athleteID := int64(12345)
-	_, err := db.InsertAthleteConnectedEvent(athleteID, json.RawMessage(`{"id": 12345}`))
+	_, err := db.InsertAthleteConnectedEvent(athleteID, json.RawMessage(`{"id": 12345}`), nil, "")
 	if err != nil {
 		t.Fatalf("Failed to insert event: %v", err)
 	}
@@ -299,3 +300,63 @@ func TestHandleEvents_LongPollDisabled(t *testing.T) {
 		t.Errorf("Expected 1 event, got %d", len(events))
 	}
 }
+
+func TestHandleEvents_APIKeyScopes(t *testing.T) {
+	handler, db := setupEventsHandlerTest(t)
+	defer db.Close()
+
+	for _, athleteID := range []int64{111, 222} {
+		if _, err := db.InsertAthleteConnectedEvent(athleteID, json.RawMessage(`{}`), nil, ""); err != nil {
+			t.Fatalf("Failed to insert event: %v", err)
+		}
+	}
+
+	readerKey, _, err := db.CreateAPIKey("reader", []string{database.ScopeEventsRead}, nil)
+	if err != nil {
+		t.Fatalf("Failed to create api key: %v", err)
+	}
+	athlete := int64(222)
+	athleteKey, _, err := db.CreateAPIKey("athlete", []string{database.ScopeAthleteRead}, &athlete)
+	if err != nil {
+		t.Fatalf("Failed to create api key: %v", err)
+	}
+	adminKey, _, err := db.CreateAPIKey("admin", []string{database.ScopeAdmin}, nil)
+	if err != nil {
+		t.Fatalf("Failed to create api key: %v", err)
+	}
+
+	getAthleteIDs := func(key string) (int, []int64) {
+		req := httptest.NewRequest(http.MethodGet, "/events", nil)
+		req.Header.Set("Authorization", "Bearer "+key)
+		w := httptest.NewRecorder()
+		handler.HandleEvents(w, req)
+
+		var response struct {
+			Events []*database.Event `json:"events"`
+		}
+		json.NewDecoder(w.Body).Decode(&response)
+		var athleteIDs []int64
+		for _, event := range response.Events {
+			athleteIDs = append(athleteIDs, event.AthleteID)
+		}
+		return w.Code, athleteIDs
+	}
+
+	if code, ids := getAthleteIDs(readerKey); code != http.StatusOK || len(ids) != 2 {
+		t.Errorf("Expected events:read key to see all events, got %d %v", code, ids)
+	}
+	if code, ids := getAthleteIDs(adminKey); code != http.StatusOK || len(ids) != 2 {
+		t.Errorf("Expected admin key to see all events, got %d %v", code, ids)
+	}
+	if code, ids := getAthleteIDs(athleteKey); code != http.StatusOK || len(ids) != 1 || ids[0] != 222 {
+		t.Errorf("Expected athlete:read key to only see athlete 222's events, got %d %v", code, ids)
+	}
+
+	// Revoked keys are rejected
+	if err := db.RevokeAPIKey("reader", time.Now()); err != nil {
+		t.Fatalf("Failed to revoke api key: %v", err)
+	}
+	if code, _ := getAthleteIDs(readerKey); code != http.StatusUnauthorized {
+		t.Errorf("Expected status 401 for revoked key, got %d", code)
+	}
+}
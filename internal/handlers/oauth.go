@@ -1,14 +1,25 @@
 package handlers
 
 import (
+	"errors"
 	"fmt"
 	"log/slog"
 	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
 
 	"plantopo-strava-sync/internal/config"
 	"plantopo-strava-sync/internal/oauth"
+	"plantopo-strava-sync/internal/strava"
 )
 
+// bindingCookieName is the cookie binding OAuth states to the browser which
+// started the flow. Flows started in several tabs share the same value.
+const bindingCookieName = "strava_oauth_binding"
+
 // OAuthHandler handles OAuth flow endpoints
 type OAuthHandler struct {
 	oauthManager *oauth.Manager
@@ -32,10 +43,36 @@ func (h *OAuthHandler) HandleAuthStart(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Extract client_id from query parameter
+	// Extract client_id from query parameter, new athletes who don't request
+	// a client are assigned one by weight
 	clientID := r.URL.Query().Get("client_id")
-	if clientID == "" {
-		clientID = h.config.GetDefaultClientID()
+	assigned := false
+	if clientID == "" && r.URL.Query().Get("migration") == "" {
+		var err error
+		if clientID, err = h.config.AssignClient(); err != nil {
+			h.logger.Error("No client available for new athlete", "error", err)
+			http.Error(w, "Not accepting new connections", http.StatusServiceUnavailable)
+			return
+		}
+		assigned = true
+	}
+
+	// A client migration link authorizes the athlete under the client they're moving to
+	var opts oauth.FlowOptions
+	if token := r.URL.Query().Get("migration"); token != "" {
+		migration, err := h.oauthManager.GetClientMigration(token)
+		if err != nil {
+			h.logger.Warn("Invalid client migration", "error", err)
+			h.renderOAuthResult(w, r, http.StatusBadRequest, &oauthResult{
+				Status:  oauthOutcomeMigrationInvalid,
+				Title:   "Link Not Valid",
+				Message: "This link has expired or has already been used.",
+				Error:   "invalid_migration",
+			})
+			return
+		}
+		clientID = migration.ToClientID
+		opts.Migration = token
 	}
 
 	// Validate client_id
@@ -45,17 +82,66 @@ func (h *OAuthHandler) HandleAuthStart(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// The plantopo user connecting, signed by plantopo so it can't be forged
+	if token := r.URL.Query().Get("plantopo_user"); token != "" {
+		user, err := oauth.VerifyUserToken(h.config.PlantopoUserSecret, token, time.Now())
+		if err != nil {
+			h.logger.Warn("Invalid plantopo_user", "error", err)
+			http.Error(w, "Invalid plantopo_user", http.StatusBadRequest)
+			return
+		}
+		opts.PlantopoUser = user
+	}
+
+	// Where to send the user afterwards, allow-listed to avoid an open redirect
+	if returnTo := r.URL.Query().Get("return_to"); returnTo != "" {
+		if err := oauth.CheckReturnTo(returnTo, h.config.OAuthReturnToAllowlist); err != nil {
+			h.logger.Warn("Invalid return_to", "error", err)
+			http.Error(w, "Invalid return_to", http.StatusBadRequest)
+			return
+		}
+		opts.ReturnTo = returnTo
+	}
+
+	// Bind the state to this browser, reusing the binding of other flows in progress
+	binding := bindingFromRequest(r)
+	if binding == "" {
+		var err error
+		if binding, err = oauth.NewBinding(); err != nil {
+			h.logger.Error("Failed to generate binding", "error", err)
+			http.Error(w, "Failed to start OAuth flow", http.StatusInternalServerError)
+			return
+		}
+	}
+	opts.Binding = binding
+
 	redirectURI := fmt.Sprintf("https://%s/oauth-callback", h.config.Domain)
 
 	// Generate authorization URL with client ID
-	authURL, state, err := h.oauthManager.GenerateAuthURL(redirectURI, clientID)
+	authURL, state, err := h.oauthManager.GenerateAuthURL(redirectURI, clientID, opts)
+	if errors.Is(err, oauth.ErrClientDisabled) {
+		h.logger.Warn("OAuth flow started through disabled client", "client_id", clientID)
+		http.Error(w, "Client is not accepting new connections", http.StatusBadRequest)
+		return
+	}
 	if err != nil {
 		h.logger.Error("Failed to generate auth URL", "error", err)
 		http.Error(w, "Failed to start OAuth flow", http.StatusInternalServerError)
 		return
 	}
 
-	h.logger.Info("Starting OAuth flow", "state", state, "redirect_uri", redirectURI, "client_id", clientID)
+	// Lax so the cookie is sent with Strava's top-level redirect to the callback
+	http.SetCookie(w, &http.Cookie{
+		Name:     bindingCookieName,
+		Value:    binding,
+		Path:     "/",
+		MaxAge:   int(oauth.StateTTL / time.Second),
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	h.logger.Info("Starting OAuth flow", "state", state, "redirect_uri", redirectURI, "client_id", clientID, "assigned", assigned, "plantopo_user", opts.PlantopoUser, "migration", opts.Migration != "")
 
 	// Redirect user to Strava authorization page
 	http.Redirect(w, r, authURL, http.StatusTemporaryRedirect)
@@ -72,71 +158,159 @@ func (h *OAuthHandler) HandleCallback(w http.ResponseWriter, r *http.Request) {
 	code := r.URL.Query().Get("code")
 	state := r.URL.Query().Get("state")
 	errorParam := r.URL.Query().Get("error")
+	scope := r.URL.Query().Get("scope")
 
 	// Check for authorization denial
 	if errorParam != "" {
 		h.logger.Warn("OAuth authorization denied", "error", errorParam)
-		http.Error(w, fmt.Sprintf("Authorization failed: %s", errorParam), http.StatusBadRequest)
+		flow := h.oauthManager.AbandonFlow(state, bindingFromRequest(r))
+		if flow != nil && flow.ReturnTo != "" {
+			h.redirectToReturnTo(w, r, flow.ReturnTo, url.Values{"status": {"error"}, "error": {errorParam}})
+			return
+		}
+
+		clientID := ""
+		if flow != nil {
+			clientID = flow.ClientID
+		}
+		h.renderOAuthResult(w, r, http.StatusBadRequest, &oauthResult{
+			Status:   oauthOutcomeDenied,
+			Title:    "Authorization Not Completed",
+			Message:  "Strava didn't authorize access to your account.",
+			Error:    errorParam,
+			ClientID: clientID,
+			RetryURL: retryURL(clientID),
+		})
 		return
 	}
 
 	// Validate required parameters
 	if code == "" || state == "" {
 		h.logger.Warn("Missing OAuth parameters", "has_code", code != "", "has_state", state != "")
-		http.Error(w, "Missing code or state parameter", http.StatusBadRequest)
+		h.renderOAuthResult(w, r, http.StatusBadRequest, &oauthResult{
+			Status:   oauthOutcomeError,
+			Title:    "Authorization Failed",
+			Message:  "Missing code or state parameter.",
+			Error:    "invalid_request",
+			RetryURL: retryURL(""),
+		})
 		return
 	}
 
 	h.logger.Info("Processing OAuth callback", "code_length", len(code), "state", state)
 
 	// Handle the callback (exchange code, store athlete, enqueue sync)
-	athleteID, clientID, err := h.oauthManager.HandleCallback(code, state)
+	result, err := h.oauthManager.HandleCallback(code, state, scope, bindingFromRequest(r))
 	if err != nil {
 		h.logger.Error("Failed to handle OAuth callback", "error", err)
 
-		// Provide user-friendly error message
-		errorMsg := "Failed to complete authorization"
-		if err.Error() == "invalid or expired state" {
-			errorMsg = "Invalid or expired authorization request. Please try again."
+		if result == nil && errors.Is(err, oauth.ErrInvalidState) {
+			h.renderOAuthResult(w, r, http.StatusBadRequest, &oauthResult{
+				Status:   oauthOutcomeExpired,
+				Title:    "Authorization Expired",
+				Message:  "Invalid or expired authorization request. Please try again.",
+				Error:    "invalid_state",
+				RetryURL: retryURL(""),
+			})
+			return
+		}
+		if result == nil {
+			h.renderOAuthResult(w, r, http.StatusInternalServerError, &oauthResult{
+				Status:   oauthOutcomeError,
+				Title:    "Authorization Failed",
+				Message:  "Failed to complete authorization.",
+				Error:    "server_error",
+				RetryURL: retryURL(""),
+			})
+			return
+		}
+
+		errorCode := "server_error"
+		switch {
+		case errors.Is(err, oauth.ErrInsufficientScope):
+			errorCode = "insufficient_scope"
+		case errors.Is(err, oauth.ErrMigrationAthleteMismatch):
+			errorCode = "migration_mismatch"
+		}
+
+		if result.ReturnTo != "" {
+			h.redirectToReturnTo(w, r, result.ReturnTo, url.Values{"status": {"error"}, "error": {errorCode}})
+			return
 		}
 
-		http.Error(w, errorMsg, http.StatusBadRequest)
+		if errorCode == "insufficient_scope" {
+			h.renderOAuthResult(w, r, http.StatusBadRequest, &oauthResult{
+				Status:   oauthOutcomeDenied,
+				Title:    "Authorization Not Completed",
+				Message:  "Access to your activities is required. Please try again and allow access to view your activities.",
+				Error:    errorCode,
+				ClientID: result.ClientID,
+				Scopes:   result.Scopes,
+				RetryURL: retryURL(result.ClientID),
+			})
+			return
+		}
+
+		if errorCode == "migration_mismatch" {
+			h.renderOAuthResult(w, r, http.StatusBadRequest, &oauthResult{
+				Status:   oauthOutcomeMigrationInvalid,
+				Title:    "Link Not Valid",
+				Message:  "This link is for a different Strava account. Log in to Strava with the account it was sent to and open the link again.",
+				Error:    errorCode,
+				ClientID: result.ClientID,
+			})
+			return
+		}
+
+		h.renderOAuthResult(w, r, http.StatusInternalServerError, &oauthResult{
+			Status:   oauthOutcomeError,
+			Title:    "Authorization Failed",
+			Message:  "Failed to complete authorization.",
+			Error:    errorCode,
+			ClientID: result.ClientID,
+			RetryURL: retryURL(result.ClientID),
+		})
 		return
 	}
 
-	h.logger.Info("OAuth flow completed successfully", "athlete_id", athleteID, "client_id", clientID)
-
-	// Success! Return simple HTML page
-	w.Header().Set("Content-Type", "text/html; charset=utf-8")
-	w.WriteHeader(http.StatusOK)
-	fmt.Fprintf(w, `<!DOCTYPE html>
-<html>
-<head>
-	<meta charset="utf-8">
-	<title>Authorization Successful</title>
-	<style>
-		body {
-			font-family: -apple-system, BlinkMacSystemFont, "Segoe UI", Helvetica, Arial, sans-serif;
-			max-width: 600px;
-			margin: 100px auto;
-			padding: 20px;
-			text-align: center;
+	athleteID := result.AthleteID
+	h.logger.Info("OAuth flow completed successfully", "athlete_id", athleteID, "client_id", result.ClientID, "plantopo_user", result.PlantopoUser)
+
+	if result.ReturnTo != "" {
+		outcome := url.Values{
+			"status":     {"success"},
+			"athlete_id": {strconv.FormatInt(athleteID, 10)},
 		}
-		h1 { color: #FC4C02; }
-		p { color: #666; line-height: 1.6; }
-		code {
-			background: #f4f4f4;
-			padding: 2px 6px;
-			border-radius: 3px;
-			font-family: monospace;
+		if result.Scopes != nil {
+			outcome.Set("scope", strings.Join(result.Scopes, ","))
 		}
-	</style>
-</head>
-<body>
-	<h1>✓ Authorization Successful</h1>
-	<p>Your Strava account has been connected (Athlete ID: <code>%d</code>)</p>
-	<p>Historical activities are now being synced in the background.</p>
-	<p>You can close this window and return to your application.</p>
-</body>
-</html>`, athleteID)
+		h.redirectToReturnTo(w, r, result.ReturnTo, outcome)
+		return
+	}
+
+	h.renderOAuthResult(w, r, http.StatusOK, &oauthResult{
+		Status:    oauthOutcomeSuccess,
+		Title:     "Authorization Successful",
+		AthleteID: athleteID,
+		ClientID:  result.ClientID,
+		Scopes:    result.Scopes,
+		// Let the athlete know if private activities won't be synced
+		PrivateExcluded: result.Scopes != nil && !slices.Contains(result.Scopes, strava.ScopeActivityReadAll),
+		RetryURL:        retryURL(result.ClientID),
+	})
+}
+
+// bindingFromRequest returns the browser binding cookie, empty if not set
+func bindingFromRequest(r *http.Request) string {
+	cookie, err := r.Cookie(bindingCookieName)
+	if err != nil {
+		return ""
+	}
+	return cookie.Value
+}
+
+// redirectToReturnTo ends a flow by sending the user back to its return_to URL
+// with the outcome added to the query
+func (h *OAuthHandler) redirectToReturnTo(w http.ResponseWriter, r *http.Request, returnTo string, outcome url.Values) {
+	http.Redirect(w, r, oauth.ReturnURL(returnTo, outcome), http.StatusFound)
 }
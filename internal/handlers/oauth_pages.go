@@ -0,0 +1,94 @@
+package handlers
+
+import (
+	"embed"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"plantopo-strava-sync/internal/oauth"
+)
+
+//go:embed templates/oauth/*.html
+var oauthTemplateFS embed.FS
+
+// Outcomes of an OAuth callback, each with its own page
+const (
+	oauthOutcomeSuccess = "success"
+	oauthOutcomeDenied  = "denied"  // The athlete denied authorization or didn't grant activity access
+	oauthOutcomeExpired = "expired" // The state was invalid, expired or already used
+	oauthOutcomeError   = "error"   // Something went wrong on our side or Strava's
+
+	oauthOutcomeMigrationInvalid = "migration_invalid" // A client migration link has expired, been used or is for another athlete
+)
+
+// oauthTemplates holds the page for each outcome, parsed with the shared layout
+var oauthTemplates = func() map[string]*template.Template {
+	templates := make(map[string]*template.Template)
+	for _, outcome := range []string{oauthOutcomeSuccess, oauthOutcomeDenied, oauthOutcomeExpired, oauthOutcomeError, oauthOutcomeMigrationInvalid} {
+		templates[outcome] = template.Must(template.New("layout.html").
+			Funcs(template.FuncMap{"stateTTL": stateTTLText}).
+			ParseFS(oauthTemplateFS,
+				"templates/oauth/layout.html",
+				"templates/oauth/"+outcome+".html"))
+	}
+	return templates
+}()
+
+// stateTTLText describes how long users have to complete authorization, e.g. "10 minutes"
+func stateTTLText() string {
+	minutes := int(oauth.StateTTL / time.Minute)
+	if minutes == 1 {
+		return "1 minute"
+	}
+	return fmt.Sprintf("%d minutes", minutes)
+}
+
+// oauthResult describes the outcome of an OAuth callback, rendered as a page
+// or, for clients which accept JSON, as JSON
+type oauthResult struct {
+	Status          string   `json:"status"` // One of the oauthOutcome constants
+	Title           string   `json:"-"`
+	Message         string   `json:"message,omitempty"`
+	Error           string   `json:"error,omitempty"` // Error code reported by Strava or ours
+	AthleteID       int64    `json:"athlete_id,omitempty"`
+	ClientID        string   `json:"client_id,omitempty"`
+	Scopes          []string `json:"scopes,omitempty"`
+	PrivateExcluded bool     `json:"private_activities_excluded,omitempty"`
+	RetryURL        string   `json:"retry_url,omitempty"`
+}
+
+// retryURL returns the URL which starts the flow again with the same client
+func retryURL(clientID string) string {
+	if clientID == "" {
+		return "/oauth-start"
+	}
+	return "/oauth-start?" + url.Values{"client_id": {clientID}}.Encode()
+}
+
+// wantsJSON returns true if the request prefers a JSON response to a page
+func wantsJSON(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), "application/json")
+}
+
+// renderOAuthResult writes the outcome of an OAuth callback
+func (h *OAuthHandler) renderOAuthResult(w http.ResponseWriter, r *http.Request, statusCode int, result *oauthResult) {
+	if wantsJSON(r) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(statusCode)
+		if err := json.NewEncoder(w).Encode(result); err != nil {
+			h.logger.Error("Failed to encode OAuth result", "error", err)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(statusCode)
+	if err := oauthTemplates[result.Status].Execute(w, result); err != nil {
+		h.logger.Error("Failed to render OAuth page", "status", result.Status, "error", err)
+	}
+}
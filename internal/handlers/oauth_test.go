@@ -1,14 +1,19 @@
 package handlers
 
 import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"plantopo-strava-sync/internal/config"
 	"plantopo-strava-sync/internal/database"
 	"plantopo-strava-sync/internal/oauth"
 	"plantopo-strava-sync/internal/strava"
 	"strings"
 	"testing"
+	"time"
 )
 
 func setupOAuthHandlerTest(t *testing.T) (*OAuthHandler, *database.DB, *oauth.Manager) {
@@ -27,7 +32,10 @@ func setupOAuthHandlerTest(t *testing.T) (*OAuthHandler, *database.DB, *oauth.Ma
 				VerifyToken:  "test_verify_token",
 			},
 		},
-		InternalAPIKey: "test_api_key",
+		InternalAPIKey:         "test_api_key",
+		InternalAPIKeys:        []string{"test_api_key"},
+		PlantopoUserSecret:     "test_user_secret",
+		OAuthReturnToAllowlist: []string{"https://plantopo.com/settings"},
 	}
 
 	stravaClient := strava.NewClient(cfg, db)
@@ -72,6 +80,48 @@ func TestHandleAuthStart_Success(t *testing.T) {
 	}
 }
 
+func TestHandleAuthStart_ClientAssignment(t *testing.T) {
+	handler, db, _ := setupOAuthHandlerTest(t)
+	defer db.Close()
+
+	handler.config.StravaClients["beta"] = &config.StravaClientConfig{
+		ClientID:     "beta_client_id",
+		ClientSecret: "beta_client_secret",
+		VerifyToken:  "beta_verify_token",
+		Weight:       1,
+	}
+	handler.config.StravaClients["primary"].Disabled = true
+
+	start := func(query string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/oauth-start"+query, nil)
+		w := httptest.NewRecorder()
+		handler.HandleAuthStart(w, req)
+		return w
+	}
+
+	// New athletes are only assigned enabled clients
+	for i := 0; i < 10; i++ {
+		w := start("")
+		if w.Code != http.StatusTemporaryRedirect {
+			t.Fatalf("Expected status 307, got %d", w.Code)
+		}
+		if location := w.Header().Get("Location"); !strings.Contains(location, "client_id=beta_client_id") {
+			t.Fatalf("Expected beta client to be assigned, got %s", location)
+		}
+	}
+
+	// A disabled client can't be requested
+	if w := start("?client_id=primary"); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400 for disabled client, got %d", w.Code)
+	}
+
+	// With every client disabled no athletes can connect
+	handler.config.StravaClients["beta"].Disabled = true
+	if w := start(""); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected status 503 with no enabled clients, got %d", w.Code)
+	}
+}
+
 func TestHandleAuthStart_WrongMethod(t *testing.T) {
 	handler, db, _ := setupOAuthHandlerTest(t)
 	defer db.Close()
@@ -150,6 +200,28 @@ func TestHandleCallback_InvalidState(t *testing.T) {
 	if !strings.Contains(body, "Invalid or expired") {
 		t.Error("Expected error message about invalid state")
 	}
+	if !strings.Contains(body, "within 10 minutes") {
+		t.Error("Expected the page to say how long authorization can take")
+	}
+}
+
+func TestHandleCallback_StateDatabaseError(t *testing.T) {
+	handler, db, _ := setupOAuthHandlerTest(t)
+
+	// A database failure isn't reported as an expired state
+	db.Close()
+
+	req := httptest.NewRequest(http.MethodGet, "/oauth-callback?code=test_code&state=some_state", nil)
+	w := httptest.NewRecorder()
+
+	handler.HandleCallback(w, req)
+
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("Expected status 500, got %d", w.Code)
+	}
+	if strings.Contains(w.Body.String(), "Invalid or expired") {
+		t.Error("Expected a server error page rather than the expired page")
+	}
 }
 
 func TestHandleCallback_WrongMethod(t *testing.T) {
@@ -171,7 +243,7 @@ func TestHandleCallback_ConsumedState(t *testing.T) {
 	defer db.Close()
 
 	// Generate a valid state
-	_, state, err := oauthManager.GenerateAuthURL("http://localhost:4101/oauth-callback", "primary")
+	_, state, err := oauthManager.GenerateAuthURL("http://localhost:4101/oauth-callback", "primary", oauth.FlowOptions{})
 	if err != nil {
 		t.Fatalf("Failed to generate auth URL: %v", err)
 	}
@@ -197,3 +269,301 @@ func TestHandleCallback_ConsumedState(t *testing.T) {
 		t.Error("Expected error message about invalid/expired state for reused state")
 	}
 }
+
+func TestHandleAuthStart_UserAndReturnTo(t *testing.T) {
+	handler, db, _ := setupOAuthHandlerTest(t)
+	defer db.Close()
+
+	token, err := oauth.SignUserToken("test_user_secret", "user-42", time.Now().Add(5*time.Minute))
+	if err != nil {
+		t.Fatalf("Failed to sign token: %v", err)
+	}
+
+	start := func(params url.Values) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "http://localhost:4101/oauth-start?"+params.Encode(), nil)
+		w := httptest.NewRecorder()
+		handler.HandleAuthStart(w, req)
+		return w
+	}
+
+	// Forged users and URLs which aren't allow-listed are rejected
+	if w := start(url.Values{"plantopo_user": {token + "x"}}); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400 for a forged plantopo_user, got %d", w.Code)
+	}
+	if w := start(url.Values{"return_to": {"https://evil.com/settings"}}); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400 for a return_to not allow-listed, got %d", w.Code)
+	}
+
+	w := start(url.Values{"plantopo_user": {token}, "return_to": {"https://plantopo.com/settings"}})
+	if w.Code != http.StatusTemporaryRedirect {
+		t.Fatalf("Expected status 307, got %d", w.Code)
+	}
+
+	location, err := url.Parse(w.Header().Get("Location"))
+	if err != nil {
+		t.Fatalf("Failed to parse redirect: %v", err)
+	}
+	state := location.Query().Get("state")
+
+	// Denying authorization returns the user with the error
+	req := httptest.NewRequest(http.MethodGet, "http://localhost:4101/oauth-callback?error=access_denied&state="+url.QueryEscape(state), nil)
+	for _, cookie := range w.Result().Cookies() {
+		req.AddCookie(cookie)
+	}
+	w = httptest.NewRecorder()
+	handler.HandleCallback(w, req)
+
+	if w.Code != http.StatusFound {
+		t.Fatalf("Expected status 302, got %d", w.Code)
+	}
+	expected := "https://plantopo.com/settings?error=access_denied&status=error"
+	if got := w.Header().Get("Location"); got != expected {
+		t.Errorf("Expected redirect to %s, got %s", expected, got)
+	}
+}
+
+func TestHandleCallback_JSON(t *testing.T) {
+	handler, db, _ := setupOAuthHandlerTest(t)
+	defer db.Close()
+
+	req := httptest.NewRequest(http.MethodGet, "/oauth-callback?code=test_code&state=invalid_state", nil)
+	req.Header.Set("Accept", "application/json")
+	w := httptest.NewRecorder()
+
+	handler.HandleCallback(w, req)
+
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400, got %d", w.Code)
+	}
+	if contentType := w.Header().Get("Content-Type"); contentType != "application/json" {
+		t.Errorf("Expected JSON response, got %s", contentType)
+	}
+
+	var result map[string]interface{}
+	if err := json.NewDecoder(w.Body).Decode(&result); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if result["status"] != "expired" || result["error"] != "invalid_state" || result["retry_url"] != "/oauth-start" {
+		t.Errorf("Unexpected result: %v", result)
+	}
+}
+
+func TestHandleCallback_Pages(t *testing.T) {
+	handler, db, oauthManager := setupOAuthHandlerTest(t)
+	defer db.Close()
+
+	_, state, err := oauthManager.GenerateAuthURL("http://localhost:4101/oauth-callback", "primary", oauth.FlowOptions{})
+	if err != nil {
+		t.Fatalf("Failed to generate auth URL: %v", err)
+	}
+
+	// Denial links back to the same client
+	req := httptest.NewRequest(http.MethodGet, "/oauth-callback?error=access_denied&state="+url.QueryEscape(state), nil)
+	w := httptest.NewRecorder()
+	handler.HandleCallback(w, req)
+
+	body := w.Body.String()
+	if !strings.Contains(w.Header().Get("Content-Type"), "text/html") {
+		t.Errorf("Expected HTML response, got %s", w.Header().Get("Content-Type"))
+	}
+	if !strings.Contains(body, "Authorization Not Completed") || !strings.Contains(body, `href="/oauth-start?client_id=primary"`) {
+		t.Errorf("Expected denied page with retry link, got %s", body)
+	}
+
+	// The success page explains that private activities are excluded
+	w = httptest.NewRecorder()
+	handler.renderOAuthResult(w, httptest.NewRequest(http.MethodGet, "/oauth-callback", nil), http.StatusOK, &oauthResult{
+		Status:          oauthOutcomeSuccess,
+		Title:           "Authorization Successful",
+		AthleteID:       12345,
+		PrivateExcluded: true,
+		RetryURL:        retryURL("primary"),
+	})
+
+	body = w.Body.String()
+	if !strings.Contains(body, "<code>12345</code>") || !strings.Contains(body, "Private activities won't be synced") {
+		t.Errorf("Expected success page, got %s", body)
+	}
+}
+
+// startFlow starts an OAuth flow through the handler and returns the Strava
+// authorization URL and the cookies set
+func startFlow(t *testing.T, handler *OAuthHandler) (*url.URL, []*http.Cookie) {
+	t.Helper()
+
+	w := httptest.NewRecorder()
+	handler.HandleAuthStart(w, httptest.NewRequest(http.MethodGet, "http://localhost:4101/oauth-start", nil))
+	if w.Code != http.StatusTemporaryRedirect {
+		t.Fatalf("Expected status 307, got %d", w.Code)
+	}
+
+	location, err := url.Parse(w.Header().Get("Location"))
+	if err != nil {
+		t.Fatalf("Failed to parse redirect: %v", err)
+	}
+	return location, w.Result().Cookies()
+}
+
+func TestHandleAuthStart_BindingCookie(t *testing.T) {
+	handler, db, _ := setupOAuthHandlerTest(t)
+	defer db.Close()
+
+	_, cookies := startFlow(t, handler)
+	if len(cookies) != 1 {
+		t.Fatalf("Expected 1 cookie, got %d", len(cookies))
+	}
+
+	cookie := cookies[0]
+	if cookie.Name != bindingCookieName || cookie.Value == "" {
+		t.Errorf("Expected binding cookie, got %+v", cookie)
+	}
+	if !cookie.HttpOnly || !cookie.Secure || cookie.SameSite != http.SameSiteLaxMode {
+		t.Errorf("Expected HttpOnly, Secure, SameSite=Lax cookie, got %+v", cookie)
+	}
+	if cookie.MaxAge != 600 {
+		t.Errorf("Expected cookie to last as long as the state, got %d", cookie.MaxAge)
+	}
+
+	// Another flow in the same browser keeps the binding
+	req := httptest.NewRequest(http.MethodGet, "http://localhost:4101/oauth-start", nil)
+	req.AddCookie(cookie)
+	w := httptest.NewRecorder()
+	handler.HandleAuthStart(w, req)
+
+	if cookies := w.Result().Cookies(); len(cookies) != 1 || cookies[0].Value != cookie.Value {
+		t.Errorf("Expected binding %s to be reused, got %v", cookie.Value, cookies)
+	}
+}
+
+func TestHandleCallback_BindingAndPKCE(t *testing.T) {
+	dbPath := t.TempDir() + "/test.db"
+	db, err := database.Open(dbPath)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer db.Close()
+
+	cfg := &config.Config{
+		Domain: "localhost:4101",
+		StravaClients: map[string]*config.StravaClientConfig{
+			"primary": {
+				ClientID:     "test_client_id",
+				ClientSecret: "test_client_secret",
+				VerifyToken:  "test_verify_token",
+				PKCE:         true,
+			},
+		},
+		InternalAPIKey:  "test_api_key",
+		InternalAPIKeys: []string{"test_api_key"},
+	}
+
+	var challenge string
+	tokenServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sum := sha256.Sum256([]byte(r.FormValue("code_verifier")))
+		if base64.RawURLEncoding.EncodeToString(sum[:]) != challenge {
+			http.Error(w, "Invalid code_verifier", http.StatusBadRequest)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(strava.TokenResponse{
+			AccessToken:  "test_access_token",
+			RefreshToken: "test_refresh_token",
+			ExpiresAt:    time.Now().Add(6 * time.Hour).Unix(),
+			Athlete:      json.RawMessage(`{"id": 12345}`),
+		})
+	}))
+	defer tokenServer.Close()
+
+	stravaClient := strava.NewClient(cfg, db)
+	stravaClient.SetTokenURL(tokenServer.URL)
+	handler := NewOAuthHandler(oauth.NewManager(cfg, db, stravaClient), cfg)
+
+	callback := func(state string, cookies []*http.Cookie) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/oauth-callback?code=test_code&scope=read,activity:read_all&state="+url.QueryEscape(state), nil)
+		for _, cookie := range cookies {
+			req.AddCookie(cookie)
+		}
+		w := httptest.NewRecorder()
+		handler.HandleCallback(w, req)
+		return w
+	}
+
+	location, cookies := startFlow(t, handler)
+	challenge = location.Query().Get("code_challenge")
+	if challenge == "" || location.Query().Get("code_challenge_method") != "S256" {
+		t.Fatalf("Expected S256 code challenge, got %s", location)
+	}
+
+	// A callback in a browser which didn't start the flow is rejected, as in
+	// a login CSRF, and the state can't be used afterwards
+	attackerLocation, _ := startFlow(t, handler)
+	attackerState := attackerLocation.Query().Get("state")
+	if w := callback(attackerState, cookies); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400 for a state bound to another browser, got %d", w.Code)
+	}
+
+	// The flow completes in the browser which started it, with the code verifier
+	state := location.Query().Get("state")
+	if w := callback(state, cookies); w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+
+	// Replays are rejected
+	w := callback(state, cookies)
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "Invalid or expired") {
+		t.Errorf("Expected replayed state to be rejected, got %d", w.Code)
+	}
+}
+
+func TestHandleAuthStart_Migration(t *testing.T) {
+	handler, db, manager := setupOAuthHandlerTest(t)
+	defer db.Close()
+
+	handler.config.ClientMigrationTTL = time.Hour
+	handler.config.StravaClients["secondary"] = &config.StravaClientConfig{
+		ClientID:     "test_secondary_client_id",
+		ClientSecret: "test_secondary_client_secret",
+	}
+
+	if err := db.UpsertAthlete(&database.Athlete{
+		AthleteID:      12345,
+		ClientID:       "primary",
+		AccessToken:    "access_token",
+		RefreshToken:   "refresh_token",
+		TokenExpiresAt: time.Now().Add(time.Hour),
+		AthleteSummary: json.RawMessage(`{"id": 12345}`),
+	}); err != nil {
+		t.Fatalf("Failed to insert athlete: %v", err)
+	}
+
+	migration, err := manager.CreateClientMigration(12345, "secondary")
+	if err != nil {
+		t.Fatalf("Failed to create migration: %v", err)
+	}
+
+	// The migration's client is used regardless of client_id
+	req := httptest.NewRequest(http.MethodGet, manager.MigrationURL(migration)+"&client_id=primary", nil)
+	w := httptest.NewRecorder()
+	handler.HandleAuthStart(w, req)
+
+	if w.Code != http.StatusTemporaryRedirect {
+		t.Fatalf("Expected status 307, got %d", w.Code)
+	}
+	location, _ := url.Parse(w.Header().Get("Location"))
+	if location.Query().Get("client_id") != "test_secondary_client_id" {
+		t.Errorf("Expected authorization with the secondary client, got %s", location)
+	}
+
+	// Unknown links get a page explaining the link isn't valid
+	req = httptest.NewRequest(http.MethodGet, "/oauth-start?migration=unknown", nil)
+	w = httptest.NewRecorder()
+	handler.HandleAuthStart(w, req)
+
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400, got %d", w.Code)
+	}
+	if !strings.Contains(w.Body.String(), "Link Not Valid") {
+		t.Errorf("Expected invalid link page, got %s", w.Body.String())
+	}
+}
@@ -1,13 +1,19 @@
 package handlers
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"fmt"
 	"io"
 	"log/slog"
 	"net/http"
+	"strings"
+	"time"
 
 	"plantopo-strava-sync/internal/config"
 	"plantopo-strava-sync/internal/database"
+	"plantopo-strava-sync/internal/metrics"
 )
 
 // WebhookHandler handles Strava webhook callbacks
@@ -138,8 +144,22 @@ func (h *WebhookHandler) HandleEvent(w http.ResponseWriter, r *http.Request) {
 		"owner_id", webhookData["owner_id"],
 	)
 
-	// Enqueue webhook for async processing
-	if _, err := h.db.EnqueueWebhook(json.RawMessage(body)); err != nil {
+	deliveryKey, err := webhookDeliveryKey(body)
+	if err != nil {
+		h.logger.Error("Failed to compute webhook delivery key", "error", err)
+		http.Error(w, "Bad request", http.StatusBadRequest)
+		return
+	}
+
+	// Hold back activity updates so that bursts of edits are coalesced by the worker
+	var delay time.Duration
+	if webhookData["object_type"] == "activity" && webhookData["aspect_type"] == "update" {
+		delay = h.config.WebhookUpdateDebounce
+	}
+
+	// Enqueue webhook for async processing, ignoring redeliveries
+	_, enqueued, err := h.db.EnqueueWebhookDelivery(deliveryKey, clientID, json.RawMessage(body), h.config.WebhookDedupWindow, delay)
+	if err != nil {
 		h.logger.Error("Failed to enqueue webhook", "error", err)
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
 		return
@@ -148,5 +168,61 @@ func (h *WebhookHandler) HandleEvent(w http.ResponseWriter, r *http.Request) {
 	// Respond immediately (async processing)
 	w.WriteHeader(http.StatusOK)
 
+	// Redeliveries count too, as they show the subscription is delivering
+	now := time.Now()
+	metrics.WebhookLastReceivedTimestamp.WithLabelValues(clientID).Set(float64(now.Unix()))
+	if err := h.db.RecordWebhookReceived(clientID, now); err != nil {
+		h.logger.Error("Failed to record webhook receipt", "client_id", clientID, "error", err)
+	}
+
+	if !enqueued {
+		h.logger.Info("Ignored duplicate webhook delivery", "client_id", clientID, "delivery_key", deliveryKey)
+		return
+	}
+
 	h.logger.Info("Webhook enqueued successfully", "client_id", clientID)
 }
+
+// webhookDelivery holds the fields which identify a webhook delivery
+type webhookDelivery struct {
+	SubscriptionID json.Number     `json:"subscription_id"`
+	ObjectType     string          `json:"object_type"`
+	ObjectID       json.Number     `json:"object_id"`
+	AspectType     string          `json:"aspect_type"`
+	EventTime      json.Number     `json:"event_time"`
+	Updates        json.RawMessage `json:"updates"`
+}
+
+// webhookDeliveryKey computes a key identifying a webhook delivery, so that
+// redeliveries of the same webhook by Strava can be recognised
+func webhookDeliveryKey(body []byte) (string, error) {
+	var delivery webhookDelivery
+	if err := json.Unmarshal(body, &delivery); err != nil {
+		return "", fmt.Errorf("failed to parse webhook: %w", err)
+	}
+
+	// Re-encode updates so that key order and whitespace don't matter
+	updates := "null"
+	if len(delivery.Updates) > 0 {
+		var decoded interface{}
+		if err := json.Unmarshal(delivery.Updates, &decoded); err != nil {
+			return "", fmt.Errorf("failed to parse webhook updates: %w", err)
+		}
+		canonical, err := json.Marshal(decoded)
+		if err != nil {
+			return "", fmt.Errorf("failed to encode webhook updates: %w", err)
+		}
+		updates = string(canonical)
+	}
+
+	hash := sha256.Sum256([]byte(strings.Join([]string{
+		delivery.SubscriptionID.String(),
+		delivery.ObjectType,
+		delivery.ObjectID.String(),
+		delivery.AspectType,
+		delivery.EventTime.String(),
+		updates,
+	}, "\x00")))
+
+	return hex.EncodeToString(hash[:]), nil
+}
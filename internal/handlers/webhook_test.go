@@ -8,6 +8,7 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 
 	"plantopo-strava-sync/internal/config"
 	"plantopo-strava-sync/internal/database"
@@ -28,6 +29,7 @@ func setupWebhookTest(t *testing.T) (*WebhookHandler, *database.DB) {
 				VerifyToken:  "test_verify_token",
 			},
 		},
+		WebhookDedupWindow: time.Hour,
 	}
 
 	handler := NewWebhookHandler(db, cfg)
@@ -145,6 +147,40 @@ func TestHandleEvent_Success(t *testing.T) {
 	}
 }
 
+func TestHandleEvent_DuplicateDelivery(t *testing.T) {
+	handler, db := setupWebhookTest(t)
+	defer db.Close()
+
+	deliveries := []string{
+		`{"subscription_id":1,"object_type":"activity","object_id":42,"aspect_type":"update","owner_id":98765,"event_time":1700000000,"updates":{"title":"Lunch Ride","type":"Ride"}}`,
+		// Redelivery with different key order and whitespace
+		`{"updates": {"type": "Ride", "title": "Lunch Ride"}, "event_time": 1700000000, "owner_id": 98765, "aspect_type": "update", "object_id": 42, "object_type": "activity", "subscription_id": 1}`,
+		// A later update of the same activity is a different delivery
+		`{"subscription_id":1,"object_type":"activity","object_id":42,"aspect_type":"update","owner_id":98765,"event_time":1700000060,"updates":{"title":"Lunch Ride","type":"Ride"}}`,
+	}
+
+	for _, delivery := range deliveries {
+		req := newRequestWithClient(http.MethodPost, "/webhook-callback/primary", bytes.NewReader([]byte(delivery)), "primary")
+		w := httptest.NewRecorder()
+
+		handler.HandleEvent(w, req)
+
+		// Duplicates are still acknowledged so Strava stops retrying
+		if w.Code != http.StatusOK {
+			t.Errorf("Expected status 200, got %d", w.Code)
+		}
+	}
+
+	length, err := db.GetQueueLength()
+	if err != nil {
+		t.Fatalf("Failed to get queue length: %v", err)
+	}
+
+	if length != 2 {
+		t.Errorf("Expected queue length 2, got %d", length)
+	}
+}
+
 func TestHandleEvent_InvalidJSON(t *testing.T) {
 	handler, db := setupWebhookTest(t)
 	defer db.Close()
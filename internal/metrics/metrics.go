@@ -28,6 +28,8 @@ const (
 	EndpointWebhook       = "webhook_callback"
 	EndpointEvents        = "events"
 	EndpointHealth        = "health"
+	EndpointAdmin         = "admin"
+	EndpointAthletes      = "athletes"
 
 	// Strava API operations
 	OpExchangeCode       = "exchange_code"
@@ -37,6 +39,7 @@ const (
 	OpCreateSubscription = "create_subscription"
 	OpDeleteSubscription = "delete_subscription"
 	OpListSubscriptions  = "list_subscriptions"
+	OpDeauthorize        = "deauthorize"
 
 	// Rate limit types
 	RateLimitOverall15Min = "overall_15min"
@@ -49,27 +52,74 @@ const (
 	BucketUsage = "usage"
 
 	// Database operations
-	DBOpEnqueueWebhook             = "enqueue_webhook"
-	DBOpClaimWebhook               = "claim_webhook"
-	DBOpDeleteWebhook              = "delete_webhook"
-	DBOpReleaseWebhook             = "release_webhook"
-	DBOpGetQueueLength             = "get_queue_length"
-	DBOpGetReadyQueueLength        = "get_ready_queue_length"
-	DBOpGetProcessingQueueLength   = "get_processing_queue_length"
-	DBOpEnqueueSyncJob             = "enqueue_sync_job"
-	DBOpClaimSyncJob               = "claim_sync_job"
-	DBOpDeleteSyncJob              = "delete_sync_job"
-	DBOpReleaseSyncJob             = "release_sync_job"
-	DBOpGetSyncJobQueueLength      = "get_sync_job_queue_length"
-	DBOpGetReadySyncJobQueueLength = "get_ready_sync_job_queue_length"
-	DBOpInsertActivityEvent        = "insert_activity_event"
-	DBOpGetEvents                  = "get_events"
-	DBOpDeleteAthleteEvents        = "delete_athlete_events"
-	DBOpGetAthlete                 = "get_athlete"
-	DBOpUpsertAthlete              = "upsert_athlete"
-	DBOpGetCircuitBreakerState     = "get_circuit_breaker_state"
-	DBOpOpenCircuitBreaker         = "open_circuit_breaker"
-	DBOpTransitionCircuitBreaker   = "transition_circuit_breaker"
+	DBOpEnqueueWebhook              = "enqueue_webhook"
+	DBOpEnqueueWebhookDelivery      = "enqueue_webhook_delivery"
+	DBOpClaimWebhook                = "claim_webhook"
+	DBOpClaimActivityUpdateWebhooks = "claim_activity_update_webhooks"
+	DBOpDeleteWebhook               = "delete_webhook"
+	DBOpReleaseWebhook              = "release_webhook"
+	DBOpGetQueueLength              = "get_queue_length"
+	DBOpGetReadyQueueLength         = "get_ready_queue_length"
+	DBOpGetProcessingQueueLength    = "get_processing_queue_length"
+	DBOpEnqueueSyncJob              = "enqueue_sync_job"
+	DBOpClaimSyncJob                = "claim_sync_job"
+	DBOpDeleteSyncJob               = "delete_sync_job"
+	DBOpReleaseSyncJob              = "release_sync_job"
+	DBOpGetSyncJobQueueLength       = "get_sync_job_queue_length"
+	DBOpGetReadySyncJobQueueLength  = "get_ready_sync_job_queue_length"
+	DBOpInsertActivityEvent         = "insert_activity_event"
+	DBOpGetEvents                   = "get_events"
+	DBOpGetAthlete                  = "get_athlete"
+	DBOpUpsertAthlete               = "upsert_athlete"
+	DBOpGetCircuitBreakerState      = "get_circuit_breaker_state"
+	DBOpOpenCircuitBreaker          = "open_circuit_breaker"
+	DBOpTransitionCircuitBreaker    = "transition_circuit_breaker"
+	DBOpRecordActivityState         = "record_activity_state"
+	DBOpGetActivityFingerprints     = "get_activity_fingerprints"
+	DBOpGetActivityState            = "get_activity_state"
+	DBOpHasPendingActivityWebhook   = "has_pending_activity_webhook"
+	DBOpListQueueItems              = "list_queue_items"
+	DBOpUpdateQueueItem             = "update_queue_item"
+
+	// Backfill outcomes for listed activities
+	BackfillOutcomeUnchanged   = "unchanged"
+	BackfillOutcomeEnqueued    = "enqueued"
+	BackfillOutcomeSummaryOnly = "summary_only"
+	BackfillOutcomeSuperseded  = "superseded"
+
+	// Reasons for detected webhook gaps
+	GapReasonDowntime           = "downtime"
+	GapReasonSubscriptionRepair = "subscription_repair"
+	GapReasonDeliveryGap        = "delivery_gap"
+
+	// Kinds of discrepancy found by reconciliation
+	DiscrepancyDelete = "delete"
+	DiscrepancyUpdate = "update"
+
+	// Reasons for skipping activity create/update webhooks
+	SkipReasonDeleted       = "deleted"
+	SkipReasonPendingDelete = "pending_delete"
+	SkipReasonStale         = "stale"
+
+	// Reasons Strava returned 404 for an activity
+	NotFoundReasonDeleted     = "deleted"
+	NotFoundReasonScopeDenied = "scope_denied"
+
+	// Reasons OAuth callbacks were rejected
+	StateRejectUnknown         = "unknown"
+	StateRejectExpired         = "expired"
+	StateRejectReplayed        = "replayed"
+	StateRejectBindingMismatch = "binding_mismatch"
+
+	// Internal API authorization results
+	AuthAuthorized   = "authorized"
+	AuthUnauthorized = "unauthorized" // Missing or unknown key
+	AuthForbidden    = "forbidden"    // Key lacks the required scope
+
+	// API key labels for requests with a key configured by INTERNAL_API_KEY,
+	// and requests without a known key
+	APIKeyInternal = "internal"
+	APIKeyUnknown  = "unknown"
 )
 
 // HTTP Metrics
@@ -92,6 +142,17 @@ var (
 	)
 )
 
+// API Key Metrics
+var (
+	APIKeyRequestsTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "api_key_requests_total",
+			Help: "Total number of internal API requests by API key name and authorization result",
+		},
+		[]string{"key", "result"},
+	)
+)
+
 // Queue Metrics
 var (
 	QueueDepthTotal = promauto.NewGaugeVec(
@@ -126,6 +187,14 @@ var (
 		[]string{"queue_type"},
 	)
 
+	QueueDeduplicatedTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "queue_deduplicated_total",
+			Help: "Total number of enqueues skipped because an identical item was already queued",
+		},
+		[]string{"queue_type"},
+	)
+
 	QueueDequeueTotal = promauto.NewCounterVec(
 		prometheus.CounterOpts{
 			Name: "queue_dequeue_total",
@@ -189,6 +258,14 @@ var (
 		[]string{"operation", "status_code"},
 	)
 
+	StravaAPIRequestsByClientTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "strava_api_requests_by_client_total",
+			Help: "Total number of authenticated Strava API requests made with each client",
+		},
+		[]string{"client"},
+	)
+
 	StravaAPIRequestDuration = promauto.NewHistogramVec(
 		prometheus.HistogramOpts{
 			Name:    "strava_api_request_duration_seconds",
@@ -205,6 +282,14 @@ var (
 		},
 		[]string{"limit_type", "bucket"},
 	)
+
+	StravaSubscriptionHealthy = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "strava_subscription_healthy",
+			Help: "Whether the client's webhook subscription points at this server (1) or not (0)",
+		},
+		[]string{"client"},
+	)
 )
 
 // Database Metrics
@@ -237,6 +322,28 @@ var (
 		[]string{"object_type", "aspect_type"},
 	)
 
+	WebhookDeliveriesDeduplicatedTotal = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "webhook_deliveries_deduplicated_total",
+			Help: "Total number of webhook deliveries ignored as redeliveries of an already received webhook",
+		},
+	)
+
+	WebhookActivitySkippedTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "webhook_activity_skipped_total",
+			Help: "Total number of activity create/update webhooks not hydrated because they don't reflect the final state, by reason",
+		},
+		[]string{"reason"},
+	)
+
+	WebhookUpdatesCoalescedTotal = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "webhook_updates_coalesced_total",
+			Help: "Total number of activity update webhooks merged into another webhook's event",
+		},
+	)
+
 	SyncJobsCompletedTotal = promauto.NewCounterVec(
 		prometheus.CounterOpts{
 			Name: "sync_jobs_completed_total",
@@ -245,6 +352,14 @@ var (
 		[]string{"job_type"},
 	)
 
+	BackfillActivitiesTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "backfill_activities_total",
+			Help: "Total number of activities handled by backfill by outcome",
+		},
+		[]string{"outcome"},
+	)
+
 	SyncAllActivitiesCount = promauto.NewHistogram(
 		prometheus.HistogramOpts{
 			Name:    "sync_all_activities_count",
@@ -252,6 +367,46 @@ var (
 			Buckets: []float64{0, 1, 5, 10, 25, 50, 100, 250, 500, 1000, 2500, 5000},
 		},
 	)
+
+	WebhookLastReceivedTimestamp = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "webhook_last_received_timestamp_seconds",
+			Help: "Unix time of the latest webhook delivery received for the client",
+		},
+		[]string{"client"},
+	)
+
+	ReconciliationDiscrepanciesTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "reconciliation_discrepancies_total",
+			Help: "Total number of activities found deleted or changed on Strava by reconciliation, by kind",
+		},
+		[]string{"kind"},
+	)
+
+	WebhookGapsDetectedTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "webhook_gaps_detected_total",
+			Help: "Total number of periods in which webhooks may have been lost, by how they were detected",
+		},
+		[]string{"reason"},
+	)
+
+	ActivitiesNotFoundTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "activities_not_found_total",
+			Help: "Total number of activities Strava returned 404 for, by whether they were deleted or hidden by the athlete's granted scopes",
+		},
+		[]string{"reason"},
+	)
+
+	OAuthStateRejectionsTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "oauth_state_rejections_total",
+			Help: "Total number of OAuth callbacks rejected because of their state, by reason",
+		},
+		[]string{"reason"},
+	)
 )
 
 // Circuit Breaker Metrics
@@ -293,3 +448,14 @@ var (
 		[]string{"limit_type"},
 	)
 )
+
+// Configuration Metrics
+var (
+	ConfigReloadsTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "config_reloads_total",
+			Help: "Total number of configuration reloads on SIGHUP by result",
+		},
+		[]string{"result"}, // success, failure
+	)
+)
@@ -0,0 +1,163 @@
+package oauth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+var (
+	// ErrInvalidUserToken is returned when a plantopo_user token is malformed,
+	// has a bad signature or has expired
+	ErrInvalidUserToken = errors.New("invalid plantopo_user token")
+
+	// ErrReturnToNotAllowed is returned when a return_to URL isn't allow-listed
+	ErrReturnToNotAllowed = errors.New("return_to not allowed")
+)
+
+// FlowOptions are optional parameters of an authorization flow, carried
+// through the state to the callback
+type FlowOptions struct {
+	PlantopoUser string // Reference to the plantopo user connecting, from a verified plantopo_user token
+	ReturnTo     string // Allow-listed URL the user is redirected to once the flow ends
+	Binding      string // Browser binding cookie value the callback must present, empty = not bound
+	Migration    string // Token of the client migration the flow completes, see GetClientMigration
+}
+
+// NewBinding generates a random value for a browser binding cookie
+// Binding the state to the browser which started the flow stops a login CSRF
+// completing an attacker's authorization in a victim's browser.
+func NewBinding() (string, error) {
+	return generateRandomState()
+}
+
+// hashBinding returns the hash of a binding stored with the state
+func hashBinding(binding string) string {
+	if binding == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(binding))
+	return hex.EncodeToString(sum[:])
+}
+
+// codeChallenge returns the S256 PKCE code challenge of a code verifier
+func codeChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// userTokenClaims is the payload of a plantopo_user token
+type userTokenClaims struct {
+	User      string `json:"user"`
+	ExpiresAt int64  `json:"exp"` // Unix timestamp
+}
+
+// SignUserToken creates a plantopo_user token for a plantopo user reference
+// The token is base64url(JSON claims) "." base64url(HMAC-SHA256 of the first part)
+func SignUserToken(secret, user string, expiresAt time.Time) (string, error) {
+	claims, err := json.Marshal(userTokenClaims{User: user, ExpiresAt: expiresAt.Unix()})
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal claims: %w", err)
+	}
+
+	payload := base64.RawURLEncoding.EncodeToString(claims)
+	return payload + "." + base64.RawURLEncoding.EncodeToString(signUserTokenPayload(secret, payload)), nil
+}
+
+// VerifyUserToken checks a plantopo_user token's signature and expiry
+// Returns the plantopo user reference, or ErrInvalidUserToken
+func VerifyUserToken(secret, token string, now time.Time) (string, error) {
+	if secret == "" {
+		return "", fmt.Errorf("%w: plantopo_user tokens aren't configured", ErrInvalidUserToken)
+	}
+
+	payload, signature, ok := strings.Cut(token, ".")
+	if !ok {
+		return "", fmt.Errorf("%w: malformed", ErrInvalidUserToken)
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(signature)
+	if err != nil || !hmac.Equal(sig, signUserTokenPayload(secret, payload)) {
+		return "", fmt.Errorf("%w: bad signature", ErrInvalidUserToken)
+	}
+
+	data, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return "", fmt.Errorf("%w: malformed", ErrInvalidUserToken)
+	}
+
+	var claims userTokenClaims
+	if err := json.Unmarshal(data, &claims); err != nil || claims.User == "" {
+		return "", fmt.Errorf("%w: malformed", ErrInvalidUserToken)
+	}
+	if now.Unix() >= claims.ExpiresAt {
+		return "", fmt.Errorf("%w: expired", ErrInvalidUserToken)
+	}
+
+	return claims.User, nil
+}
+
+func signUserTokenPayload(secret, payload string) []byte {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(payload))
+	return mac.Sum(nil)
+}
+
+// CheckReturnTo returns ErrReturnToNotAllowed unless returnTo is an absolute
+// URL with the same scheme and host as an allow-listed URL and a path under
+// the allow-listed path
+func CheckReturnTo(returnTo string, allowlist []string) error {
+	target, err := url.Parse(returnTo)
+	if err != nil || target.User != nil || target.Host == "" {
+		return fmt.Errorf("%w: %s", ErrReturnToNotAllowed, returnTo)
+	}
+
+	for _, entry := range allowlist {
+		allowed, err := url.Parse(entry)
+		if err != nil {
+			continue
+		}
+
+		prefix := allowed.Path
+		if !strings.HasSuffix(prefix, "/") {
+			prefix += "/"
+		}
+
+		path := target.Path
+		if path == "" {
+			path = "/"
+		}
+
+		if strings.EqualFold(target.Scheme, allowed.Scheme) &&
+			strings.EqualFold(target.Host, allowed.Host) &&
+			(path == allowed.Path || strings.HasPrefix(path, prefix)) {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("%w: %s", ErrReturnToNotAllowed, returnTo)
+}
+
+// ReturnURL adds the outcome of a flow to its return_to URL
+// params are added to any query the URL already has
+func ReturnURL(returnTo string, params url.Values) string {
+	target, err := url.Parse(returnTo)
+	if err != nil {
+		return returnTo
+	}
+
+	query := target.Query()
+	for key, values := range params {
+		query[key] = values
+	}
+	target.RawQuery = query.Encode()
+
+	return target.String()
+}
@@ -0,0 +1,94 @@
+package oauth
+
+import (
+	"errors"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestUserToken(t *testing.T) {
+	now := time.Now()
+	token, err := SignUserToken("secret", "user-42", now.Add(5*time.Minute))
+	if err != nil {
+		t.Fatalf("Failed to sign token: %v", err)
+	}
+
+	user, err := VerifyUserToken("secret", token, now)
+	if err != nil {
+		t.Fatalf("Failed to verify token: %v", err)
+	}
+	if user != "user-42" {
+		t.Errorf("Expected user 'user-42', got '%s'", user)
+	}
+
+	tests := []struct {
+		name   string
+		secret string
+		token  string
+		now    time.Time
+	}{
+		{"WrongSecret", "other", token, now},
+		{"Expired", "secret", token, now.Add(10 * time.Minute)},
+		{"Tampered", "secret", "eyJ1c2VyIjoidXNlci00MyIsImV4cCI6OTk5OTk5OTk5OX0" + token[len(token)-44:], now},
+		{"Malformed", "secret", "not-a-token", now},
+		{"NotConfigured", "", token, now},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := VerifyUserToken(tt.secret, tt.token, tt.now); !errors.Is(err, ErrInvalidUserToken) {
+				t.Errorf("Expected ErrInvalidUserToken, got %v", err)
+			}
+		})
+	}
+}
+
+func TestCheckReturnTo(t *testing.T) {
+	allowlist := []string{"https://plantopo.com/settings", "https://dev.plantopo.com"}
+
+	tests := []struct {
+		returnTo string
+		allowed  bool
+	}{
+		{"https://plantopo.com/settings", true},
+		{"https://plantopo.com/settings/strava?tab=1", true},
+		{"https://PLANTOPO.com/settings/strava", true},
+		{"https://dev.plantopo.com/anything", true},
+		{"https://dev.plantopo.com", true},
+		{"https://plantopo.com/settingsx", false},
+		{"https://plantopo.com/", false},
+		{"http://plantopo.com/settings", false},
+		{"https://plantopo.com.evil.com/settings", false},
+		{"https://evil.com@plantopo.com/settings", false},
+		{"/settings", false},
+		{"//evil.com/settings", false},
+	}
+
+	for _, tt := range tests {
+		err := CheckReturnTo(tt.returnTo, allowlist)
+		if tt.allowed && err != nil {
+			t.Errorf("Expected %s to be allowed, got %v", tt.returnTo, err)
+		}
+		if !tt.allowed && !errors.Is(err, ErrReturnToNotAllowed) {
+			t.Errorf("Expected %s not to be allowed, got %v", tt.returnTo, err)
+		}
+	}
+
+	if err := CheckReturnTo("https://plantopo.com/settings", nil); err == nil {
+		t.Error("Expected nothing to be allowed with an empty allow-list")
+	}
+}
+
+func TestReturnURL(t *testing.T) {
+	returnURL := ReturnURL("https://plantopo.com/settings?tab=strava", url.Values{"status": {"success"}, "athlete_id": {"123"}})
+
+	parsed, err := url.Parse(returnURL)
+	if err != nil {
+		t.Fatalf("Failed to parse return URL: %v", err)
+	}
+	query := parsed.Query()
+	if query.Get("tab") != "strava" || query.Get("status") != "success" || query.Get("athlete_id") != "123" {
+		t.Errorf("Expected existing and outcome parameters, got %s", returnURL)
+	}
+}
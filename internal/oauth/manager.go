@@ -2,43 +2,49 @@ package oauth
 
 import (
 	"crypto/rand"
+	"crypto/subtle"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log/slog"
 	"net/url"
-	"sync"
+	"slices"
+	"strings"
 	"time"
 
 	"plantopo-strava-sync/internal/config"
 	"plantopo-strava-sync/internal/database"
+	"plantopo-strava-sync/internal/metrics"
 	"plantopo-strava-sync/internal/strava"
 )
 
 const (
 	authorizationURL = "https://www.strava.com/oauth/authorize"
-	scope            = "activity:read_all" // Read all activities including private ones
+	StateTTL         = 10 * time.Minute            // How long users have to complete authorization
+	defaultScope     = strava.ScopeActivityReadAll // Requested if the client doesn't configure scopes
 )
 
+// ErrDeauthorizeFailed is returned when Strava couldn't revoke an athlete's access
+var ErrDeauthorizeFailed = errors.New("strava deauthorization failed")
+
+// ErrInvalidState is returned when a callback's state is unknown, expired,
+// already used or was issued to a different browser
+var ErrInvalidState = errors.New("invalid or expired state")
+
+// ErrInsufficientScope is returned when an athlete didn't grant access to their activities
+var ErrInsufficientScope = errors.New("activity access not granted")
+
+// ErrClientDisabled is returned when starting a flow through a client which is
+// disabled so its athletes can be drained
+var ErrClientDisabled = errors.New("client is disabled")
+
 // Manager handles OAuth 2.0 flow with Strava
 type Manager struct {
 	config       *config.Config
 	db           *database.DB
 	stravaClient *strava.Client
 	logger       *slog.Logger
-	states       *stateStore // CSRF protection
-}
-
-// stateEntry holds OAuth state information including client ID
-type stateEntry struct {
-	clientID string
-	expiry   time.Time
-}
-
-// stateStore tracks valid OAuth states for CSRF protection
-type stateStore struct {
-	mu     sync.RWMutex
-	states map[string]*stateEntry
 }
 
 // NewManager creates a new OAuth manager
@@ -48,9 +54,6 @@ func NewManager(cfg *config.Config, db *database.DB, stravaClient *strava.Client
 		db:           db,
 		stravaClient: stravaClient,
 		logger:       slog.Default(),
-		states: &stateStore{
-			states: make(map[string]*stateEntry),
-		},
 	}
 
 	// Start background cleanup of expired states
@@ -59,13 +62,28 @@ func NewManager(cfg *config.Config, db *database.DB, stravaClient *strava.Client
 	return mgr
 }
 
+// CallbackResult is the outcome of an authorization flow
+type CallbackResult struct {
+	AthleteID    int64
+	ClientID     string
+	Scopes       []string // Granted scopes, nil if unknown
+	PlantopoUser string   // From the flow's options
+	ReturnTo     string   // From the flow's options
+	Reconnected  bool     // The athlete was already connected
+	Migrated     bool     // The flow completed a client migration
+}
+
 // GenerateAuthURL generates a Strava authorization URL with CSRF protection
-func (m *Manager) GenerateAuthURL(redirectURI, clientID string) (string, string, error) {
+// opts must already have been verified, see VerifyUserToken and CheckReturnTo
+func (m *Manager) GenerateAuthURL(redirectURI, clientID string, opts FlowOptions) (string, string, error) {
 	// Get client config
 	clientConfig, err := m.config.GetClient(clientID)
 	if err != nil {
 		return "", "", fmt.Errorf("invalid client: %w", err)
 	}
+	if clientConfig.Disabled {
+		return "", "", ErrClientDisabled
+	}
 
 	// Generate random state for CSRF protection
 	state, err := generateRandomState()
@@ -73,22 +91,48 @@ func (m *Manager) GenerateAuthURL(redirectURI, clientID string) (string, string,
 		return "", "", fmt.Errorf("failed to generate state: %w", err)
 	}
 
-	// Store state with expiration (10 minutes) and client ID
-	m.states.mu.Lock()
-	m.states.states[state] = &stateEntry{
-		clientID: clientID,
-		expiry:   time.Now().Add(10 * time.Minute),
+	// The verifier is only sent with the code, so an intercepted code is useless
+	var codeVerifier string
+	if clientConfig.PKCE {
+		if codeVerifier, err = generateRandomState(); err != nil {
+			return "", "", fmt.Errorf("failed to generate code verifier: %w", err)
+		}
+		codeVerifier = strings.TrimRight(codeVerifier, "=")
+	}
+
+	// Store state with expiration and client ID, in the database so that the
+	// callback can be handled after a restart or by another instance
+	err = m.db.SaveOAuthState(&database.OAuthState{
+		State:          state,
+		ClientID:       clientID,
+		PlantopoUser:   opts.PlantopoUser,
+		ReturnTo:       opts.ReturnTo,
+		BindingHash:    hashBinding(opts.Binding),
+		CodeVerifier:   codeVerifier,
+		MigrationToken: opts.Migration,
+		ExpiresAt:      time.Now().Add(StateTTL),
+	})
+	if err != nil {
+		return "", "", err
+	}
+
+	scopes := clientConfig.Scopes
+	if len(scopes) == 0 {
+		scopes = []string{defaultScope}
 	}
-	m.states.mu.Unlock()
 
 	// Build authorization URL using client-specific credentials
 	params := url.Values{
 		"client_id":     {clientConfig.ClientID},
 		"redirect_uri":  {redirectURI},
 		"response_type": {"code"},
-		"scope":         {scope},
+		"scope":         {strings.Join(scopes, ",")},
 		"state":         {state},
 	}
+	if codeVerifier != "" {
+		params.Set("code_challenge", codeChallenge(codeVerifier))
+		params.Set("code_challenge_method", "S256")
+	}
 
 	authURL := fmt.Sprintf("%s?%s", authorizationURL, params.Encode())
 
@@ -98,20 +142,40 @@ func (m *Manager) GenerateAuthURL(redirectURI, clientID string) (string, string,
 }
 
 // HandleCallback processes the OAuth callback
-// Returns the athlete ID and client ID on success
-func (m *Manager) HandleCallback(code, state string) (int64, string, error) {
+// grantedScope is the comma separated scope parameter Strava returned, which
+// may be narrower than requested as athletes can untick permissions.
+// binding is the browser binding cookie presented with the callback.
+// Returns ErrInvalidState if the state can't be used, or ErrInsufficientScope
+// if the athlete didn't grant access to their activities. The result is
+// returned with any error once the state has been validated, so that the user
+// can be returned to the flow's return_to URL.
+func (m *Manager) HandleCallback(code, state, grantedScope, binding string) (*CallbackResult, error) {
 	// Validate state and get client ID
-	clientID, valid := m.validateState(state)
-	if !valid {
-		return 0, "", fmt.Errorf("invalid or expired state")
+	flow, err := m.validateState(state, binding)
+	if err != nil {
+		return nil, err
 	}
 
-	m.logger.Info("Handling OAuth callback", "code_length", len(code), "client_id", clientID)
+	clientID := flow.ClientID
+	scopes := ParseScopes(grantedScope)
+	result := &CallbackResult{
+		ClientID:     clientID,
+		Scopes:       scopes,
+		PlantopoUser: flow.PlantopoUser,
+		ReturnTo:     flow.ReturnTo,
+	}
+
+	m.logger.Info("Handling OAuth callback", "code_length", len(code), "client_id", clientID, "scopes", scopes)
+
+	if scopes != nil && !slices.Contains(scopes, strava.ScopeActivityRead) && !slices.Contains(scopes, strava.ScopeActivityReadAll) {
+		m.logger.Warn("Athlete didn't grant activity access", "client_id", clientID, "scopes", scopes)
+		return result, ErrInsufficientScope
+	}
 
 	// Exchange code for tokens using client-specific credentials
-	tokenResp, err := m.stravaClient.ExchangeCode(code, clientID)
+	tokenResp, err := m.stravaClient.ExchangeCode(code, clientID, flow.CodeVerifier)
 	if err != nil {
-		return 0, "", fmt.Errorf("failed to exchange code: %w", err)
+		return result, fmt.Errorf("failed to exchange code: %w", err)
 	}
 
 	// Extract athlete ID from response
@@ -119,13 +183,42 @@ func (m *Manager) HandleCallback(code, state string) (int64, string, error) {
 		ID int64 `json:"id"`
 	}
 	if err := json.Unmarshal(tokenResp.Athlete, &athleteData); err != nil {
-		return 0, "", fmt.Errorf("failed to parse athlete data: %w", err)
+		return result, fmt.Errorf("failed to parse athlete data: %w", err)
 	}
 
 	athleteID := athleteData.ID
+	result.AthleteID = athleteID
 
 	m.logger.Info("Exchanged code for tokens", "athlete_id", athleteID, "client_id", clientID)
 
+	// An athlete who is already connected is authorizing again, perhaps to
+	// change scopes or with a different client
+	previous, err := m.db.GetAthlete(athleteID)
+	if err != nil {
+		return result, fmt.Errorf("failed to get athlete: %w", err)
+	}
+	result.Reconnected = previous != nil
+
+	// A migration link only moves the athlete it was created for, and only once
+	if flow.MigrationToken != "" {
+		_, err := m.db.ClaimClientMigration(flow.MigrationToken, athleteID, time.Now())
+		if errors.Is(err, database.ErrClientMigrationAthleteMismatch) {
+			m.logger.Warn("Migration link used by a different athlete", "athlete_id", athleteID, "client_id", clientID)
+			// Revoke the access just granted, unless the athlete was already
+			// connected with this client
+			if previous == nil || previous.ClientID != clientID {
+				if err := m.stravaClient.DeauthorizeToken(tokenResp.AccessToken); err != nil {
+					m.logger.Error("Failed to deauthorize athlete", "athlete_id", athleteID, "error", err)
+				}
+			}
+			return result, ErrMigrationAthleteMismatch
+		}
+		if err != nil {
+			return result, fmt.Errorf("failed to claim client migration: %w", err)
+		}
+		result.Migrated = true
+	}
+
 	// Create/update athlete record with client ID
 	athlete := &database.Athlete{
 		AthleteID:      athleteID,
@@ -134,57 +227,181 @@ func (m *Manager) HandleCallback(code, state string) (int64, string, error) {
 		RefreshToken:   tokenResp.RefreshToken,
 		TokenExpiresAt: time.Unix(tokenResp.ExpiresAt, 0),
 		AthleteSummary: tokenResp.Athlete,
+		Scopes:         scopes,
 		CreatedAt:      time.Now(),
 		UpdatedAt:      time.Now(),
 	}
 
 	if err := m.db.UpsertAthlete(athlete); err != nil {
-		return 0, "", fmt.Errorf("failed to upsert athlete: %w", err)
+		return result, fmt.Errorf("failed to upsert athlete: %w", err)
 	}
 
 	m.logger.Info("Stored athlete record", "athlete_id", athleteID, "client_id", clientID)
 
+	if result.Migrated {
+		m.logger.Info("Completed client migration", "athlete_id", athleteID, "client_id", clientID)
+	}
+
+	if previous != nil {
+		m.handleReconnect(previous, tokenResp.Athlete, clientID, scopes, flow.PlantopoUser)
+		return result, nil
+	}
+
 	// Insert athlete_connected event
-	eventID, err := m.db.InsertAthleteConnectedEvent(athleteID, tokenResp.Athlete)
+	eventID, err := m.db.InsertAthleteConnectedEvent(athleteID, tokenResp.Athlete, scopes, flow.PlantopoUser)
 	if err != nil {
-		return 0, "", fmt.Errorf("failed to insert athlete_connected event: %w", err)
+		return result, fmt.Errorf("failed to insert athlete_connected event: %w", err)
 	}
 
-	m.logger.Info("Inserted athlete_connected event", "athlete_id", athleteID, "event_id", eventID)
+	m.logger.Info("Inserted athlete_connected event", "athlete_id", athleteID, "event_id", eventID, "plantopo_user", flow.PlantopoUser)
 
 	// Enqueue sync job to trigger historical activity listing
-	if _, err := m.db.EnqueueSyncJob(athleteID, "list_activities"); err != nil {
+	if _, err := m.db.StartBackfill(athleteID, database.PriorityDefault); err != nil {
 		m.logger.Error("Failed to enqueue sync job", "error", err, "athlete_id", athleteID)
 		// Don't fail the OAuth flow if sync enqueueing fails
 	} else {
 		m.logger.Info("Enqueued sync job", "athlete_id", athleteID, "job_type", "list_activities")
 	}
 
-	return athleteID, clientID, nil
+	return result, nil
 }
 
-// validateState checks if a state is valid and removes it (one-time use)
-// Returns the client ID and whether the state is valid
-func (m *Manager) validateState(state string) (string, bool) {
-	m.states.mu.Lock()
-	defer m.states.mu.Unlock()
+// handleReconnect records that an already connected athlete authorized again
+// and catches up on activities they may have recorded while their connection
+// was broken. Their history is already in the event stream, so rather than a
+// full backfill this lists activities since their tokens were last updated,
+// unless they've newly granted access to their private activities, which
+// have never been synced. Backfill skips the activities already synced.
+func (m *Manager) handleReconnect(previous *database.Athlete, athleteSummary json.RawMessage, clientID string, scopes []string, plantopoUser string) {
+	athleteID := previous.AthleteID
+
+	// Unknown scopes are kept by the upsert, so are still the previous ones
+	if scopes == nil {
+		scopes = previous.Scopes
+	}
 
-	entry, exists := m.states.states[state]
-	if !exists {
-		return "", false
+	reconnection := &database.Reconnection{
+		PreviousClientID: previous.ClientID,
+		ClientID:         clientID,
+		PreviousScopes:   previous.Scopes,
+		Scopes:           scopes,
 	}
 
-	// Check if expired
-	if time.Now().After(entry.expiry) {
-		delete(m.states.states, state)
-		return "", false
+	eventID, err := m.db.InsertAthleteReconnectedEvent(athleteID, athleteSummary, reconnection, plantopoUser)
+	if err != nil {
+		// The athlete record is already updated, so don't fail the OAuth flow
+		m.logger.Error("Failed to insert athlete_reconnected event", "error", err, "athlete_id", athleteID)
+	} else {
+		m.logger.Info("Inserted athlete_reconnected event",
+			"athlete_id", athleteID,
+			"event_id", eventID,
+			"previous_client_id", previous.ClientID,
+			"client_id", clientID,
+			"previous_scopes", previous.Scopes,
+			"scopes", scopes,
+			"plantopo_user", plantopoUser)
 	}
 
-	// Remove state after use (one-time use)
-	clientID := entry.clientID
-	delete(m.states.states, state)
+	if slices.Contains(scopes, strava.ScopeActivityReadAll) && !previous.HasScope(strava.ScopeActivityReadAll) {
+		if _, err := m.db.StartBackfill(athleteID, database.PriorityDefault); err != nil {
+			m.logger.Error("Failed to enqueue sync job", "error", err, "athlete_id", athleteID)
+		} else {
+			m.logger.Info("Enqueued sync job", "athlete_id", athleteID, "job_type", "list_activities", "reason", "new scope")
+		}
+	}
 
-	return clientID, true
+	since := previous.UpdatedAt.Add(-m.config.GapSyncLookback)
+	if err := m.db.StartAthleteGapSync(athleteID, since); err != nil {
+		m.logger.Error("Failed to enqueue sync job", "error", err, "athlete_id", athleteID)
+	} else {
+		m.logger.Info("Enqueued sync job", "athlete_id", athleteID, "job_type", "sync_since", "since", since)
+	}
+}
+
+// AbandonFlow ends a flow which won't complete, such as when the athlete
+// denied authorization. Returns the flow, or nil if the state is invalid.
+func (m *Manager) AbandonFlow(state, binding string) *database.OAuthState {
+	flow, err := m.validateState(state, binding)
+	if err != nil {
+		return nil
+	}
+	return flow
+}
+
+// DisconnectAthlete revokes the app's access to an athlete's Strava account and
+// removes everything stored about them. The event stream gets a deauthorization
+// event in the same form as when the athlete revokes access on Strava.
+// If force is true the athlete is removed even if Strava can't be reached.
+// Returns the deauthorization event ID.
+func (m *Manager) DisconnectAthlete(athleteID int64, force bool) (int64, error) {
+	athlete, err := m.db.GetAthlete(athleteID)
+	if err != nil {
+		return 0, err
+	}
+	if athlete == nil {
+		return 0, database.ErrAthleteNotFound
+	}
+
+	if err := m.stravaClient.Deauthorize(athleteID); err != nil {
+		if !force {
+			return 0, fmt.Errorf("%w: %w", ErrDeauthorizeFailed, err)
+		}
+		m.logger.Warn("Failed to deauthorize athlete, disconnecting anyway", "athlete_id", athleteID, "error", err)
+	}
+
+	webhookData, err := json.Marshal(map[string]interface{}{
+		"object_type": "athlete",
+		"object_id":   athleteID,
+		"aspect_type": "update",
+		"owner_id":    athleteID,
+		"updates":     map[string]string{"authorized": "false"},
+		"event_time":  time.Now().Unix(),
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to marshal deauthorization event: %w", err)
+	}
+
+	eventID, err := m.db.DisconnectAthlete(athleteID, webhookData)
+	if err != nil {
+		return 0, err
+	}
+
+	m.logger.Info("Disconnected athlete", "athlete_id", athleteID, "client_id", athlete.ClientID, "event_id", eventID)
+
+	return eventID, nil
+}
+
+// validateState checks if a state is valid and marks it used (one-time use)
+// A state bound to a browser is only valid with the same binding cookie.
+// Returns the flow the state was generated for, or ErrInvalidState if the
+// state can't be used.
+func (m *Manager) validateState(state, binding string) (*database.OAuthState, error) {
+	entry, err := m.db.ConsumeOAuthState(state, time.Now())
+	if err != nil {
+		reason := metrics.StateRejectUnknown
+		switch {
+		case errors.Is(err, database.ErrOAuthStateExpired):
+			reason = metrics.StateRejectExpired
+		case errors.Is(err, database.ErrOAuthStateUsed):
+			reason = metrics.StateRejectReplayed
+		case !errors.Is(err, database.ErrOAuthStateNotFound):
+			m.logger.Error("Failed to validate state", "error", err)
+			return nil, fmt.Errorf("failed to validate state: %w", err)
+		}
+
+		m.logger.Warn("Rejected OAuth state", "reason", reason)
+		metrics.OAuthStateRejectionsTotal.WithLabelValues(reason).Inc()
+		return nil, fmt.Errorf("%w: %s", ErrInvalidState, reason)
+	}
+
+	// States issued before binding was introduced aren't bound
+	if entry.BindingHash != "" && subtle.ConstantTimeCompare([]byte(entry.BindingHash), []byte(hashBinding(binding))) != 1 {
+		m.logger.Warn("Rejected OAuth state", "reason", metrics.StateRejectBindingMismatch, "client_id", entry.ClientID)
+		metrics.OAuthStateRejectionsTotal.WithLabelValues(metrics.StateRejectBindingMismatch).Inc()
+		return nil, fmt.Errorf("%w: %s", ErrInvalidState, metrics.StateRejectBindingMismatch)
+	}
+
+	return entry, nil
 }
 
 // cleanupStates removes expired states every minute
@@ -193,15 +410,26 @@ func (m *Manager) cleanupStates() {
 	defer ticker.Stop()
 
 	for range ticker.C {
-		m.states.mu.Lock()
-		now := time.Now()
-		for state, entry := range m.states.states {
-			if now.After(entry.expiry) {
-				delete(m.states.states, state)
-			}
+		if _, err := m.db.DeleteExpiredOAuthStates(time.Now()); err != nil {
+			m.logger.Error("Failed to clean up expired states", "error", err)
+		}
+	}
+}
+
+// ParseScopes parses the comma separated scope parameter of an OAuth callback
+// Returns nil if the parameter is missing, as the granted scopes are unknown
+func ParseScopes(scope string) []string {
+	if scope == "" {
+		return nil
+	}
+
+	scopes := []string{}
+	for _, s := range strings.Split(scope, ",") {
+		if s = strings.TrimSpace(s); s != "" && !slices.Contains(scopes, s) {
+			scopes = append(scopes, s)
 		}
-		m.states.mu.Unlock()
 	}
+	return scopes
 }
 
 // generateRandomState generates a cryptographically secure random state
@@ -2,10 +2,12 @@ package oauth
 
 import (
 	"encoding/json"
+	"errors"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"reflect"
+	"slices"
 	"strings"
 	"testing"
 	"time"
@@ -47,7 +49,7 @@ func TestGenerateAuthURL(t *testing.T) {
 
 	redirectURI := "http://localhost:4101/oauth-callback"
 	clientID := "primary"
-	authURL, state, err := manager.GenerateAuthURL(redirectURI, clientID)
+	authURL, state, err := manager.GenerateAuthURL(redirectURI, clientID, FlowOptions{})
 
 	if err != nil {
 		t.Fatalf("Failed to generate auth URL: %v", err)
@@ -82,12 +84,10 @@ func TestGenerateAuthURL(t *testing.T) {
 		t.Error("Expected auth URL to contain the state value")
 	}
 
-	// Verify state is stored
-	manager.states.mu.RLock()
-	_, exists := manager.states.states[state]
-	manager.states.mu.RUnlock()
-
-	if !exists {
+	// Verify state is stored, so another instance (or this one after a
+	// restart) can complete the flow
+	other := NewManager(manager.config, db, manager.stravaClient)
+	if flow, err := other.validateState(state, ""); err != nil || flow.ClientID != "primary" {
 		t.Error("Expected state to be stored")
 	}
 }
@@ -97,23 +97,22 @@ func TestValidateState_Valid(t *testing.T) {
 	defer db.Close()
 
 	// Generate a state
-	_, state, err := manager.GenerateAuthURL("http://localhost:4101/oauth-callback", "primary")
+	_, state, err := manager.GenerateAuthURL("http://localhost:4101/oauth-callback", "primary", FlowOptions{})
 	if err != nil {
 		t.Fatalf("Failed to generate auth URL: %v", err)
 	}
 
 	// Validate it
-	clientID, valid := manager.validateState(state)
-	if !valid {
-		t.Error("Expected state to be valid")
+	flow, err := manager.validateState(state, "")
+	if err != nil {
+		t.Fatalf("Expected state to be valid: %v", err)
 	}
-	if clientID != "primary" {
-		t.Errorf("Expected clientID='primary', got '%s'", clientID)
+	if flow.ClientID != "primary" {
+		t.Errorf("Expected clientID='primary', got '%s'", flow.ClientID)
 	}
 
 	// State should be removed after first use
-	_, valid = manager.validateState(state)
-	if valid {
+	if _, err := manager.validateState(state, ""); !errors.Is(err, ErrInvalidState) {
 		t.Error("Expected state to be invalid after first use")
 	}
 }
@@ -123,8 +122,7 @@ func TestValidateState_Invalid(t *testing.T) {
 	defer db.Close()
 
 	// Try to validate a non-existent state
-	_, valid := manager.validateState("invalid_state")
-	if valid {
+	if _, err := manager.validateState("invalid_state", ""); !errors.Is(err, ErrInvalidState) {
 		t.Error("Expected invalid state to fail validation")
 	}
 }
@@ -135,29 +133,61 @@ func TestValidateState_Expired(t *testing.T) {
 
 	// Manually insert an expired state
 	state := "expired_state"
-	manager.states.mu.Lock()
-	manager.states.states[state] = &stateEntry{
-		clientID: "primary",
-		expiry:   time.Now().Add(-1 * time.Minute),
+	err := db.SaveOAuthState(&database.OAuthState{
+		State:     state,
+		ClientID:  "primary",
+		ExpiresAt: time.Now().Add(-1 * time.Minute),
+	})
+	if err != nil {
+		t.Fatalf("Failed to save state: %v", err)
 	}
-	manager.states.mu.Unlock()
 
 	// Should be rejected
-	_, valid := manager.validateState(state)
-	if valid {
+	if _, err := manager.validateState(state, ""); !errors.Is(err, ErrInvalidState) {
 		t.Error("Expected expired state to fail validation")
 	}
 
 	// Should be removed
-	manager.states.mu.RLock()
-	_, exists := manager.states.states[state]
-	manager.states.mu.RUnlock()
-
-	if exists {
+	removed, err := db.DeleteExpiredOAuthStates(time.Now())
+	if err != nil {
+		t.Fatalf("Failed to delete expired states: %v", err)
+	}
+	if removed != 0 {
 		t.Error("Expected expired state to be removed")
 	}
 }
 
+func TestCleanupExpiredStates(t *testing.T) {
+	_, db := setupOAuthTest(t)
+	defer db.Close()
+
+	now := time.Now()
+	for state, expiresAt := range map[string]time.Time{
+		"expired": now.Add(-1 * time.Minute),
+		"valid":   now.Add(StateTTL),
+	} {
+		if err := db.SaveOAuthState(&database.OAuthState{State: state, ClientID: "primary", ExpiresAt: expiresAt}); err != nil {
+			t.Fatalf("Failed to save state: %v", err)
+		}
+	}
+
+	removed, err := db.DeleteExpiredOAuthStates(now)
+	if err != nil {
+		t.Fatalf("Failed to delete expired states: %v", err)
+	}
+	if removed != 1 {
+		t.Errorf("Expected 1 expired state to be removed, got %d", removed)
+	}
+
+	entry, err := db.ConsumeOAuthState("valid", now)
+	if err != nil {
+		t.Fatalf("Failed to consume state: %v", err)
+	}
+	if entry == nil || entry.ClientID != "primary" {
+		t.Errorf("Expected unexpired state to be kept, got %+v", entry)
+	}
+}
+
 func TestHandleCallback_Integration(t *testing.T) {
 	manager, db := setupOAuthTest(t)
 	defer db.Close()
@@ -209,16 +239,22 @@ func TestHandleCallback_Integration(t *testing.T) {
 	stravaClient.SetTokenURL(tokenServer.URL)
 
 	// Generate a valid state
-	_, state, err := manager.GenerateAuthURL("http://localhost:4101/oauth-callback", "primary")
+	opts := FlowOptions{PlantopoUser: "user-42", ReturnTo: "https://plantopo.com/settings"}
+	_, state, err := manager.GenerateAuthURL("http://localhost:4101/oauth-callback", "primary", opts)
 	if err != nil {
 		t.Fatalf("Failed to generate auth URL: %v", err)
 	}
 
 	// Test OAuth callback
-	athleteID, clientID, err := manager.HandleCallback("test_auth_code", state)
+	result, err := manager.HandleCallback("test_auth_code", state, "read,activity:read_all", "")
 	if err != nil {
 		t.Fatalf("Failed to handle callback: %v", err)
 	}
+	athleteID, clientID := result.AthleteID, result.ClientID
+
+	if result.PlantopoUser != "user-42" || result.ReturnTo != "https://plantopo.com/settings" {
+		t.Errorf("Expected flow options to be carried through the state, got %+v", result)
+	}
 
 	if clientID != "primary" {
 		t.Errorf("Expected clientID='primary', got '%s'", clientID)
@@ -242,6 +278,10 @@ func TestHandleCallback_Integration(t *testing.T) {
 		t.Errorf("Expected refresh token 'test_refresh_token', got '%s'", athlete.RefreshToken)
 	}
 
+	if !slices.Equal(athlete.Scopes, []string{"read", "activity:read_all"}) {
+		t.Errorf("Expected granted scopes to be stored, got %v", athlete.Scopes)
+	}
+
 	// Verify athlete_connected event was created
 	events, err := db.GetEvents(0, 10)
 	if err != nil {
@@ -256,6 +296,12 @@ func TestHandleCallback_Integration(t *testing.T) {
 	for _, event := range events {
 		if event.EventType == database.EventTypeAthleteConnected && event.AthleteID == athleteID {
 			foundAthleteConnected = true
+			if !slices.Equal(event.Scopes, []string{"read", "activity:read_all"}) {
+				t.Errorf("Expected athlete_connected event to include granted scopes, got %v", event.Scopes)
+			}
+			if event.PlantopoUser != "user-42" {
+				t.Errorf("Expected athlete_connected event to include plantopo user, got '%s'", event.PlantopoUser)
+			}
 			break
 		}
 	}
@@ -275,6 +321,303 @@ func TestHandleCallback_Integration(t *testing.T) {
 	}
 }
 
+func TestHandleCallback_InsufficientScope(t *testing.T) {
+	manager, db := setupOAuthTest(t)
+	defer db.Close()
+
+	exchanged := false
+	tokenServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		exchanged = true
+		http.Error(w, "Unexpected token exchange", http.StatusBadRequest)
+	}))
+	defer tokenServer.Close()
+	manager.stravaClient.SetTokenURL(tokenServer.URL)
+
+	_, state, err := manager.GenerateAuthURL("http://localhost:4101/oauth-callback", "primary", FlowOptions{})
+	if err != nil {
+		t.Fatalf("Failed to generate auth URL: %v", err)
+	}
+
+	// The athlete unticked activity access
+	_, err = manager.HandleCallback("test_auth_code", state, "read", "")
+	if !errors.Is(err, ErrInsufficientScope) {
+		t.Fatalf("Expected ErrInsufficientScope, got %v", err)
+	}
+
+	if exchanged {
+		t.Error("Expected code not to be exchanged")
+	}
+
+	events, err := db.GetEvents(0, 10)
+	if err != nil {
+		t.Fatalf("Failed to get events: %v", err)
+	}
+	if len(events) != 0 {
+		t.Errorf("Expected no events, got %d", len(events))
+	}
+}
+
+func TestHandleCallback_Reconnect(t *testing.T) {
+	manager, db := setupOAuthTest(t)
+	defer db.Close()
+
+	manager.config.StravaClients["secondary"] = &config.StravaClientConfig{
+		ClientID:     "test_secondary_client_id",
+		ClientSecret: "test_secondary_client_secret",
+	}
+
+	tokenServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		response := strava.TokenResponse{
+			AccessToken:  "new_access_token",
+			RefreshToken: "new_refresh_token",
+			ExpiresAt:    time.Now().Add(6 * time.Hour).Unix(),
+			Athlete:      json.RawMessage(`{"id": 12345}`),
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(response)
+	}))
+	defer tokenServer.Close()
+	manager.stravaClient.SetTokenURL(tokenServer.URL)
+
+	// The athlete is already connected through the primary client
+	athleteID := int64(12345)
+	if err := db.UpsertAthlete(&database.Athlete{
+		AthleteID:      athleteID,
+		ClientID:       "primary",
+		AccessToken:    "old_access_token",
+		RefreshToken:   "old_refresh_token",
+		TokenExpiresAt: time.Now().Add(1 * time.Hour),
+		AthleteSummary: json.RawMessage(`{"id": 12345}`),
+		Scopes:         []string{"read", "activity:read"},
+		CreatedAt:      time.Now(),
+		UpdatedAt:      time.Now(),
+	}); err != nil {
+		t.Fatalf("Failed to insert athlete: %v", err)
+	}
+
+	_, state, err := manager.GenerateAuthURL("http://localhost:4101/oauth-callback", "secondary", FlowOptions{PlantopoUser: "user-42"})
+	if err != nil {
+		t.Fatalf("Failed to generate auth URL: %v", err)
+	}
+
+	result, err := manager.HandleCallback("test_auth_code", state, "read,activity:read_all", "")
+	if err != nil {
+		t.Fatalf("Failed to handle callback: %v", err)
+	}
+	if !result.Reconnected {
+		t.Error("Expected callback to report a reconnection")
+	}
+
+	athlete, err := db.GetAthlete(athleteID)
+	if err != nil {
+		t.Fatalf("Failed to get athlete: %v", err)
+	}
+	if athlete.ClientID != "secondary" || athlete.AccessToken != "new_access_token" {
+		t.Errorf("Expected athlete to move to the secondary client with new tokens, got %+v", athlete)
+	}
+
+	// An athlete_reconnected event replaces athlete_connected
+	events, err := db.GetEvents(0, 10)
+	if err != nil {
+		t.Fatalf("Failed to get events: %v", err)
+	}
+	if len(events) != 1 || events[0].EventType != database.EventTypeAthleteReconnected {
+		t.Fatalf("Expected a single athlete_reconnected event, got %+v", events)
+	}
+	if events[0].PlantopoUser != "user-42" {
+		t.Errorf("Expected event to include plantopo user, got '%s'", events[0].PlantopoUser)
+	}
+
+	var reconnection database.Reconnection
+	if err := json.Unmarshal(events[0].Reconnection, &reconnection); err != nil {
+		t.Fatalf("Failed to parse reconnection: %v", err)
+	}
+	if reconnection.PreviousClientID != "primary" || reconnection.ClientID != "secondary" {
+		t.Errorf("Expected reconnection from primary to secondary, got %+v", reconnection)
+	}
+	if !slices.Equal(reconnection.PreviousScopes, []string{"read", "activity:read"}) ||
+		!slices.Equal(reconnection.Scopes, []string{"read", "activity:read_all"}) {
+		t.Errorf("Expected reconnection to include old and new scopes, got %+v", reconnection)
+	}
+
+	// Newly granting activity:read_all backfills private activities as well
+	// as catching up incrementally
+	if jobTypes := claimSyncJobTypes(t, db); !slices.Equal(jobTypes, []string{"sync_since", "list_activities"}) {
+		t.Errorf("Expected sync_since and list_activities jobs, got %v", jobTypes)
+	}
+
+	// Reconnecting with the same scopes only catches up incrementally
+	_, state, err = manager.GenerateAuthURL("http://localhost:4101/oauth-callback", "secondary", FlowOptions{})
+	if err != nil {
+		t.Fatalf("Failed to generate auth URL: %v", err)
+	}
+	if _, err := manager.HandleCallback("test_auth_code", state, "read,activity:read_all", ""); err != nil {
+		t.Fatalf("Failed to handle callback: %v", err)
+	}
+	if jobTypes := claimSyncJobTypes(t, db); !slices.Equal(jobTypes, []string{"sync_since"}) {
+		t.Errorf("Expected only a sync_since job, got %v", jobTypes)
+	}
+}
+
+// claimSyncJobTypes claims and deletes every ready sync job, returning their
+// types in the order claimed
+func claimSyncJobTypes(t *testing.T, db *database.DB) []string {
+	t.Helper()
+
+	var jobTypes []string
+	for {
+		job, err := db.ClaimSyncJob()
+		if err != nil {
+			t.Fatalf("Failed to claim sync job: %v", err)
+		}
+		if job == nil {
+			return jobTypes
+		}
+		jobTypes = append(jobTypes, job.JobType)
+		if err := db.DeleteSyncJob(job.ID); err != nil {
+			t.Fatalf("Failed to delete sync job: %v", err)
+		}
+	}
+}
+
+func TestHandleCallback_Migration(t *testing.T) {
+	manager, db := setupOAuthTest(t)
+	defer db.Close()
+
+	manager.config.Domain = "sync.example.com"
+	manager.config.ClientMigrationTTL = time.Hour
+	manager.config.StravaClients["secondary"] = &config.StravaClientConfig{
+		ClientID:     "test_secondary_client_id",
+		ClientSecret: "test_secondary_client_secret",
+	}
+
+	tokenAthlete := `{"id": 12345}`
+	tokenServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(strava.TokenResponse{
+			AccessToken:  "new_access_token",
+			RefreshToken: "new_refresh_token",
+			ExpiresAt:    time.Now().Add(6 * time.Hour).Unix(),
+			Athlete:      json.RawMessage(tokenAthlete),
+		})
+	}))
+	defer tokenServer.Close()
+	manager.stravaClient.SetTokenURL(tokenServer.URL)
+
+	var deauthorized []string
+	deauthServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		deauthorized = append(deauthorized, r.FormValue("access_token"))
+	}))
+	defer deauthServer.Close()
+	manager.stravaClient.SetDeauthorizeURL(deauthServer.URL)
+
+	athleteID := int64(12345)
+	if err := db.UpsertAthlete(&database.Athlete{
+		AthleteID:      athleteID,
+		ClientID:       "primary",
+		AccessToken:    "old_access_token",
+		RefreshToken:   "old_refresh_token",
+		TokenExpiresAt: time.Now().Add(1 * time.Hour),
+		AthleteSummary: json.RawMessage(tokenAthlete),
+		CreatedAt:      time.Now(),
+		UpdatedAt:      time.Now(),
+	}); err != nil {
+		t.Fatalf("Failed to insert athlete: %v", err)
+	}
+
+	if _, err := manager.CreateClientMigration(athleteID, "unknown"); !errors.Is(err, ErrUnknownClient) {
+		t.Errorf("Expected ErrUnknownClient, got %v", err)
+	}
+
+	migration, err := manager.CreateClientMigration(athleteID, "secondary")
+	if err != nil {
+		t.Fatalf("Failed to create migration: %v", err)
+	}
+	if !strings.HasPrefix(manager.MigrationURL(migration), "https://sync.example.com/oauth-start?migration=") {
+		t.Errorf("Unexpected migration URL %s", manager.MigrationURL(migration))
+	}
+
+	// The link is only for the athlete it was created for
+	tokenAthlete = `{"id": 999}`
+	_, state, err := manager.GenerateAuthURL("http://localhost:4101/oauth-callback", "secondary", FlowOptions{Migration: migration.Token})
+	if err != nil {
+		t.Fatalf("Failed to generate auth URL: %v", err)
+	}
+	if _, err := manager.HandleCallback("test_auth_code", state, "read,activity:read_all", ""); !errors.Is(err, ErrMigrationAthleteMismatch) {
+		t.Fatalf("Expected ErrMigrationAthleteMismatch, got %v", err)
+	}
+	if other, _ := db.GetAthlete(999); other != nil {
+		t.Error("Expected a different athlete not to be connected by the link")
+	}
+	if !slices.Equal(deauthorized, []string{"new_access_token"}) {
+		t.Errorf("Expected the different athlete's new access to be revoked, got %v", deauthorized)
+	}
+
+	tokenAthlete = `{"id": 12345}`
+	_, state, err = manager.GenerateAuthURL("http://localhost:4101/oauth-callback", "secondary", FlowOptions{Migration: migration.Token})
+	if err != nil {
+		t.Fatalf("Failed to generate auth URL: %v", err)
+	}
+	result, err := manager.HandleCallback("test_auth_code", state, "read,activity:read_all", "")
+	if err != nil {
+		t.Fatalf("Failed to handle callback: %v", err)
+	}
+	if !result.Migrated || !result.Reconnected {
+		t.Errorf("Expected callback to complete the migration, got %+v", result)
+	}
+
+	athlete, _ := db.GetAthlete(athleteID)
+	if athlete.ClientID != "secondary" {
+		t.Errorf("Expected athlete to use the secondary client, got %s", athlete.ClientID)
+	}
+	if _, err := manager.GetClientMigration(migration.Token); !errors.Is(err, database.ErrClientMigrationCompleted) {
+		t.Errorf("Expected migration to be completed, got %v", err)
+	}
+
+	// The link can only be used once
+	_, state, err = manager.GenerateAuthURL("http://localhost:4101/oauth-callback", "secondary", FlowOptions{Migration: migration.Token})
+	if err != nil {
+		t.Fatalf("Failed to generate auth URL: %v", err)
+	}
+	if _, err := manager.HandleCallback("test_auth_code", state, "read,activity:read_all", ""); !errors.Is(err, database.ErrClientMigrationCompleted) {
+		t.Errorf("Expected ErrClientMigrationCompleted, got %v", err)
+	}
+	if len(deauthorized) != 1 {
+		t.Errorf("Expected the migrating athlete's access not to be revoked, got %v", deauthorized)
+	}
+}
+
+func TestGenerateAuthURL_ClientScopes(t *testing.T) {
+	manager, db := setupOAuthTest(t)
+	defer db.Close()
+
+	manager.config.StravaClients["primary"].Scopes = []string{"read", "activity:read"}
+
+	authURL, _, err := manager.GenerateAuthURL("http://localhost:4101/oauth-callback", "primary", FlowOptions{})
+	if err != nil {
+		t.Fatalf("Failed to generate auth URL: %v", err)
+	}
+
+	parsed, err := url.Parse(authURL)
+	if err != nil {
+		t.Fatalf("Failed to parse auth URL: %v", err)
+	}
+	if scope := parsed.Query().Get("scope"); scope != "read,activity:read" {
+		t.Errorf("Expected scope 'read,activity:read', got '%s'", scope)
+	}
+}
+
+func TestParseScopes(t *testing.T) {
+	if scopes := ParseScopes(""); scopes != nil {
+		t.Errorf("Expected nil for a missing scope parameter, got %v", scopes)
+	}
+
+	scopes := ParseScopes("read, activity:read_all,read")
+	if !slices.Equal(scopes, []string{"read", "activity:read_all"}) {
+		t.Errorf("Expected [read activity:read_all], got %v", scopes)
+	}
+}
+
 func TestGenerateRandomState(t *testing.T) {
 	state1, err := generateRandomState()
 	if err != nil {
@@ -339,3 +682,87 @@ func TestEnqueueSyncJob(t *testing.T) {
 		t.Errorf("Expected job type 'sync_all_activities', got '%s'", job.JobType)
 	}
 }
+
+func TestDisconnectAthlete(t *testing.T) {
+	manager, db := setupOAuthTest(t)
+	defer db.Close()
+
+	athleteID := int64(12345)
+	athlete := &database.Athlete{
+		AthleteID:      athleteID,
+		ClientID:       "primary",
+		AccessToken:    "valid_token",
+		RefreshToken:   "refresh_token",
+		TokenExpiresAt: time.Now().Add(1 * time.Hour),
+		AthleteSummary: json.RawMessage(`{"id": 12345}`),
+		CreatedAt:      time.Now(),
+		UpdatedAt:      time.Now(),
+	}
+	if err := db.UpsertAthlete(athlete); err != nil {
+		t.Fatalf("Failed to insert athlete: %v", err)
+	}
+	if _, err := db.InsertAthleteConnectedEvent(athleteID, athlete.AthleteSummary, nil, ""); err != nil {
+		t.Fatalf("Failed to insert event: %v", err)
+	}
+	if _, err := db.StartBackfill(athleteID, database.PriorityDefault); err != nil {
+		t.Fatalf("Failed to start backfill: %v", err)
+	}
+
+	deauthStatus := http.StatusInternalServerError
+	deauthServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue("access_token") != "valid_token" {
+			t.Errorf("Expected deauthorize with athlete's access token, got %q", r.FormValue("access_token"))
+		}
+		w.WriteHeader(deauthStatus)
+	}))
+	defer deauthServer.Close()
+	manager.stravaClient.SetDeauthorizeURL(deauthServer.URL)
+
+	// The athlete is kept if Strava can't deauthorize them
+	if _, err := manager.DisconnectAthlete(athleteID, false); err == nil {
+		t.Fatal("Expected error when deauthorization fails")
+	}
+	if stored, _ := db.GetAthlete(athleteID); stored == nil {
+		t.Fatal("Expected athlete to be kept when deauthorization fails")
+	}
+
+	deauthStatus = http.StatusOK
+	eventID, err := manager.DisconnectAthlete(athleteID, false)
+	if err != nil {
+		t.Fatalf("Failed to disconnect athlete: %v", err)
+	}
+
+	if stored, _ := db.GetAthlete(athleteID); stored != nil {
+		t.Error("Expected athlete tokens to be deleted")
+	}
+
+	length, _ := db.GetSyncJobQueueLength()
+	if length != 0 {
+		t.Errorf("Expected athlete's sync jobs to be deleted, got %d", length)
+	}
+
+	// Only the deauthorization event remains
+	events, err := db.ListEvents(athleteID, 0, 10)
+	if err != nil {
+		t.Fatalf("Failed to list events: %v", err)
+	}
+	if len(events) != 1 || events[0].EventID != eventID {
+		t.Fatalf("Expected only the deauthorization event, got %d events", len(events))
+	}
+
+	var webhook struct {
+		ObjectType string            `json:"object_type"`
+		Updates    map[string]string `json:"updates"`
+	}
+	if err := json.Unmarshal(events[0].WebhookEvent, &webhook); err != nil {
+		t.Fatalf("Failed to unmarshal deauthorization event: %v", err)
+	}
+	if webhook.ObjectType != "athlete" || webhook.Updates["authorized"] != "false" {
+		t.Errorf("Unexpected deauthorization event: %s", events[0].WebhookEvent)
+	}
+
+	// Disconnecting again finds nothing
+	if _, err := manager.DisconnectAthlete(athleteID, false); err != database.ErrAthleteNotFound {
+		t.Errorf("Expected ErrAthleteNotFound, got %v", err)
+	}
+}
@@ -0,0 +1,63 @@
+package oauth
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"time"
+
+	"plantopo-strava-sync/internal/database"
+)
+
+var (
+	// ErrUnknownClient is returned when a client isn't configured
+	ErrUnknownClient = errors.New("unknown client")
+
+	// ErrMigrationAthleteMismatch is returned when a migration link is used to
+	// authorize a different athlete than the one it was created for
+	ErrMigrationAthleteMismatch = errors.New("migration is for a different athlete")
+)
+
+// CreateClientMigration creates a link inviting an athlete to authorize again
+// under a different client, for rebalancing athletes between clients. The
+// athlete keeps using their current client until they follow the link.
+// Returns ErrUnknownClient, ErrClientDisabled, database.ErrAthleteNotFound or
+// database.ErrAlreadyOnClient if the athlete can't be migrated.
+func (m *Manager) CreateClientMigration(athleteID int64, toClientID string) (*database.ClientMigration, error) {
+	client, err := m.config.GetClient(toClientID)
+	if err != nil {
+		return nil, ErrUnknownClient
+	}
+	if client.Disabled {
+		return nil, ErrClientDisabled
+	}
+
+	token, err := generateRandomState()
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate migration token: %w", err)
+	}
+
+	migration, err := m.db.CreateClientMigration(token, athleteID, toClientID, m.config.ClientMigrationTTL)
+	if err != nil {
+		return nil, err
+	}
+
+	m.logger.Info("Created client migration",
+		"athlete_id", athleteID,
+		"from_client_id", migration.FromClientID,
+		"to_client_id", toClientID,
+		"expires_at", migration.ExpiresAt)
+
+	return migration, nil
+}
+
+// GetClientMigration returns a migration which can still be completed
+// See database.GetClientMigration for the errors returned if it can't
+func (m *Manager) GetClientMigration(token string) (*database.ClientMigration, error) {
+	return m.db.GetClientMigration(token, time.Now())
+}
+
+// MigrationURL returns the link which starts a migration's authorization flow
+func (m *Manager) MigrationURL(migration *database.ClientMigration) string {
+	return fmt.Sprintf("https://%s/oauth-start?%s", m.config.Domain, url.Values{"migration": {migration.Token}}.Encode())
+}
@@ -1,17 +1,105 @@
 package strava
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"net/url"
 	"strconv"
+	"strings"
+	"time"
 
 	"plantopo-strava-sync/internal/metrics"
 )
 
+// OAuth scopes giving access to an athlete's activities
+const (
+	ScopeActivityRead    = "activity:read"     // Activities visible to everyone or followers
+	ScopeActivityReadAll = "activity:read_all" // Also "Only You" (private) activities
+)
+
 // ActivitySummary represents a summary of an activity from list endpoints
+// Only the fields used for change detection are decoded; Raw holds the
+// complete summary as returned by Strava
 type ActivitySummary struct {
-	ID int64 `json:"id"`
+	ID                 int64   `json:"id"`
+	Name               string  `json:"name"`
+	SportType          string  `json:"sport_type"`
+	StartDate          string  `json:"start_date"`
+	Distance           float64 `json:"distance"`
+	MovingTime         int64   `json:"moving_time"`
+	ElapsedTime        int64   `json:"elapsed_time"`
+	TotalElevationGain float64 `json:"total_elevation_gain"`
+	GearID             *string `json:"gear_id"`
+	UploadID           *int64  `json:"upload_id"`
+	ExternalID         *string `json:"external_id"`
+	Private            bool    `json:"private"`
+
+	Raw json.RawMessage `json:"-"`
+}
+
+// Fingerprint returns a hash of the fields which identify a version of the
+// activity. Summary and detailed representations of the same version of an
+// activity have the same fingerprint.
+func (s *ActivitySummary) Fingerprint() string {
+	fields := []string{
+		strconv.FormatInt(s.ID, 10),
+		s.Name,
+		s.SportType,
+		s.StartDate,
+		strconv.FormatFloat(s.Distance, 'f', -1, 64),
+		strconv.FormatInt(s.MovingTime, 10),
+		strconv.FormatInt(s.ElapsedTime, 10),
+		strconv.FormatFloat(s.TotalElevationGain, 'f', -1, 64),
+		optionalString(s.GearID),
+		optionalInt(s.UploadID),
+		optionalString(s.ExternalID),
+		strconv.FormatBool(s.Private),
+	}
+
+	sum := sha256.Sum256([]byte(strings.Join(fields, "\x00")))
+	return hex.EncodeToString(sum[:16])
+}
+
+// StartTime parses the activity's start_date
+func (s *ActivitySummary) StartTime() (time.Time, error) {
+	return time.Parse(time.RFC3339, s.StartDate)
+}
+
+// DecodeActivitySummary decodes the summary fields of a summary or detailed
+// activity JSON blob
+func DecodeActivitySummary(data json.RawMessage) (*ActivitySummary, error) {
+	var summary ActivitySummary
+	if err := json.Unmarshal(data, &summary); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal activity: %w", err)
+	}
+	summary.Raw = data
+	return &summary, nil
+}
+
+// FingerprintActivity computes the fingerprint of a summary or detailed
+// activity JSON blob
+func FingerprintActivity(data json.RawMessage) (string, error) {
+	summary, err := DecodeActivitySummary(data)
+	if err != nil {
+		return "", err
+	}
+	return summary.Fingerprint(), nil
+}
+
+func optionalString(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
+
+func optionalInt(i *int64) string {
+	if i == nil {
+		return ""
+	}
+	return strconv.FormatInt(*i, 10)
 }
 
 // GetActivity fetches detailed activity data for a specific activity
@@ -26,20 +114,20 @@ func (c *Client) GetActivity(athleteID int64, activityID int64) (json.RawMessage
 	return json.RawMessage(respBody), nil
 }
 
-// ListActivities fetches a list of activities for an athlete with pagination
-// Returns activity IDs and whether there are more pages available
-func (c *Client) ListActivities(athleteID int64, page, perPage int) ([]int64, bool, error) {
-	if page < 1 {
-		page = 1
-	}
+// ListActivitiesBefore fetches a page of the activities which started before
+// the given Unix time, newest first. A before time of 0 lists the newest activities.
+// Returns activity summaries and whether there may be older activities
+func (c *Client) ListActivitiesBefore(athleteID int64, before int64, perPage int) ([]*ActivitySummary, bool, error) {
 	if perPage < 1 || perPage > 200 {
 		perPage = 200 // Strava max
 	}
 
 	params := url.Values{
-		"page":     {strconv.Itoa(page)},
 		"per_page": {strconv.Itoa(perPage)},
 	}
+	if before > 0 {
+		params.Set("before", strconv.FormatInt(before, 10))
+	}
 
 	path := "/athlete/activities?" + params.Encode()
 
@@ -48,19 +136,24 @@ func (c *Client) ListActivities(athleteID int64, page, perPage int) ([]int64, bo
 		return nil, false, fmt.Errorf("failed to list activities: %w", err)
 	}
 
-	var activities []ActivitySummary
-	if err := json.Unmarshal(respBody, &activities); err != nil {
+	var rawActivities []json.RawMessage
+	if err := json.Unmarshal(respBody, &rawActivities); err != nil {
 		return nil, false, fmt.Errorf("failed to unmarshal activities: %w", err)
 	}
 
-	// Extract activity IDs
-	activityIDs := make([]int64, len(activities))
-	for i, activity := range activities {
-		activityIDs[i] = activity.ID
+	// Decode summaries, keeping the raw payload for summary-only events
+	activities := make([]*ActivitySummary, len(rawActivities))
+	for i, raw := range rawActivities {
+		var summary ActivitySummary
+		if err := json.Unmarshal(raw, &summary); err != nil {
+			return nil, false, fmt.Errorf("failed to unmarshal activity summary: %w", err)
+		}
+		summary.Raw = raw
+		activities[i] = &summary
 	}
 
 	// If we got a full page, there might be more
 	hasMore := len(activities) == perPage
 
-	return activityIDs, hasMore, nil
+	return activities, hasMore, nil
 }
@@ -18,9 +18,10 @@ import (
 )
 
 const (
-	baseURL      = "https://www.strava.com/api/v3"
-	tokenURL     = "https://www.strava.com/oauth/token"
-	tokenBuffer  = 5 * time.Minute // Refresh tokens 5 minutes before expiry
+	baseURL     = "https://www.strava.com/api/v3"
+	tokenURL    = "https://www.strava.com/oauth/token"
+	deauthURL   = "https://www.strava.com/oauth/deauthorize"
+	tokenBuffer = 5 * time.Minute // Refresh tokens 5 minutes before expiry
 )
 
 // Client is the Strava API client
@@ -30,9 +31,13 @@ type Client struct {
 	db         *database.DB
 	rateLimits *RateLimits
 	logger     *slog.Logger
+	// API requests per client and day not yet written to the database
+	usageMu sync.Mutex
+	usage   map[usageKey]int
 	// Test overrides (empty in production)
-	baseURL  string
-	tokenURL string
+	baseURL   string
+	tokenURL  string
+	deauthURL string
 }
 
 // RateLimits tracks Strava API rate limits
@@ -78,9 +83,11 @@ func NewClient(cfg *config.Config, db *database.DB) *Client {
 			readLimit15Min:    100,
 			readLimitDaily:    1000,
 		},
-		logger:   slog.Default(),
-		baseURL:  baseURL,
-		tokenURL: tokenURL,
+		logger:    slog.Default(),
+		usage:     make(map[usageKey]int),
+		baseURL:   baseURL,
+		tokenURL:  tokenURL,
+		deauthURL: deauthURL,
 	}
 }
 
@@ -94,8 +101,14 @@ func (c *Client) SetTokenURL(url string) {
 	c.tokenURL = url
 }
 
+// SetDeauthorizeURL overrides the deauthorize URL (for testing)
+func (c *Client) SetDeauthorizeURL(url string) {
+	c.deauthURL = url
+}
+
 // ExchangeCode exchanges an authorization code for access and refresh tokens
-func (c *Client) ExchangeCode(code string, clientID string) (*TokenResponse, error) {
+// codeVerifier is the PKCE code verifier of the authorization request, empty if PKCE wasn't used
+func (c *Client) ExchangeCode(code string, clientID string, codeVerifier string) (*TokenResponse, error) {
 	start := time.Now()
 
 	// Get client-specific credentials
@@ -110,6 +123,9 @@ func (c *Client) ExchangeCode(code string, clientID string) (*TokenResponse, err
 		"code":          {code},
 		"grant_type":    {"authorization_code"},
 	}
+	if codeVerifier != "" {
+		data.Set("code_verifier", codeVerifier)
+	}
 
 	resp, err := c.httpClient.PostForm(c.tokenURL, data)
 	if err != nil {
@@ -138,6 +154,61 @@ func (c *Client) ExchangeCode(code string, clientID string) (*TokenResponse, err
 	return &tokenResp, nil
 }
 
+// Deauthorize revokes the app's access to an athlete's Strava account
+// Access which has already been revoked (401) is not an error
+func (c *Client) Deauthorize(athleteID int64) error {
+	athlete, err := c.ensureValidToken(athleteID)
+	if err != nil {
+		return err
+	}
+
+	if err := c.DeauthorizeToken(athlete.AccessToken); err != nil {
+		return err
+	}
+
+	c.logger.Info("Deauthorized athlete", "athlete_id", athleteID)
+	return nil
+}
+
+// DeauthorizeToken revokes the app's access granted with an access token, for
+// tokens which aren't stored for an athlete
+// Access which has already been revoked (401) is not an error
+func (c *Client) DeauthorizeToken(accessToken string) error {
+	start := time.Now()
+
+	data := url.Values{
+		"access_token": {accessToken},
+	}
+
+	resp, err := c.httpClient.PostForm(c.deauthURL, data)
+	if err != nil {
+		duration := time.Since(start).Seconds()
+		metrics.StravaAPIRequestsTotal.WithLabelValues(metrics.OpDeauthorize, "error").Inc()
+		metrics.StravaAPIRequestDuration.WithLabelValues(metrics.OpDeauthorize, "error").Observe(duration)
+		return fmt.Errorf("failed to deauthorize: %w", err)
+	}
+	defer resp.Body.Close()
+
+	duration := time.Since(start).Seconds()
+	statusCode := strconv.Itoa(resp.StatusCode)
+	metrics.StravaAPIRequestsTotal.WithLabelValues(metrics.OpDeauthorize, statusCode).Inc()
+	metrics.StravaAPIRequestDuration.WithLabelValues(metrics.OpDeauthorize, statusCode).Observe(duration)
+
+	if resp.StatusCode == http.StatusUnauthorized {
+		c.logger.Info("Access already revoked")
+		return nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return &HTTPError{
+			StatusCode: resp.StatusCode,
+			Body:       string(body),
+		}
+	}
+
+	return nil
+}
+
 // refreshToken refreshes an athlete's access token
 func (c *Client) refreshToken(athlete *database.Athlete) error {
 	start := time.Now()
@@ -248,6 +319,10 @@ func (c *Client) doRequest(method, path string, athleteID int64, body io.Reader,
 	// Update rate limits from response headers
 	c.updateRateLimits(resp)
 
+	// Count usage per client, for rebalancing athletes between clients
+	metrics.StravaAPIRequestsByClientTotal.WithLabelValues(athlete.ClientID).Inc()
+	c.recordUsage(athlete.ClientID, time.Now())
+
 	respBody, err := io.ReadAll(resp.Body)
 	if err != nil {
 		return nil, fmt.Errorf("failed to read response body: %w", err)
@@ -351,7 +426,7 @@ func (c *Client) updateRateLimits(resp *http.Response) {
 	}
 
 	// Update budget availability metrics
-	webhookReservePercent := c.config.RateLimitWebhookReservePercent
+	webhookReservePercent, _, _ := c.config.RateLimitSettings()
 	read15minRemaining := c.rateLimits.readLimit15Min - c.rateLimits.readUsage15Min
 	readDailyRemaining := c.rateLimits.readLimitDaily - c.rateLimits.readUsageDaily
 
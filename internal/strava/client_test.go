@@ -4,6 +4,8 @@ import (
 	"encoding/json"
 	"net/http"
 	"net/http/httptest"
+	"slices"
+	"strconv"
 	"testing"
 	"time"
 
@@ -105,7 +107,7 @@ func TestExchangeCode(t *testing.T) {
 	client.SetTokenURL(tokenServer.URL)
 
 	// Test token exchange
-	tokenResp, err := client.ExchangeCode("test_code", "primary")
+	tokenResp, err := client.ExchangeCode("test_code", "primary", "")
 	if err != nil {
 		t.Fatalf("Failed to exchange code: %v", err)
 	}
@@ -243,3 +245,232 @@ func TestHTTPError_Helpers(t *testing.T) {
 		t.Error("Expected IsTooManyRequests to return true for 429")
 	}
 }
+
+func TestActivityFingerprint(t *testing.T) {
+	summary := json.RawMessage(`{"id": 1001, "resource_state": 2, "name": "Morning Run", "distance": 5000.5, "moving_time": 1500}`)
+	detail := json.RawMessage(`{"id": 1001, "resource_state": 3, "name": "Morning Run", "distance": 5000.5, "moving_time": 1500, "description": "Nice"}`)
+	renamed := json.RawMessage(`{"id": 1001, "resource_state": 3, "name": "Lunch Run", "distance": 5000.5, "moving_time": 1500}`)
+
+	summaryFingerprint, err := FingerprintActivity(summary)
+	if err != nil {
+		t.Fatalf("Failed to fingerprint summary: %v", err)
+	}
+	detailFingerprint, err := FingerprintActivity(detail)
+	if err != nil {
+		t.Fatalf("Failed to fingerprint detail: %v", err)
+	}
+	renamedFingerprint, err := FingerprintActivity(renamed)
+	if err != nil {
+		t.Fatalf("Failed to fingerprint renamed activity: %v", err)
+	}
+
+	if summaryFingerprint != detailFingerprint {
+		t.Error("Expected summary and detail of the same version to have the same fingerprint")
+	}
+	if summaryFingerprint == renamedFingerprint {
+		t.Error("Expected renamed activity to have a different fingerprint")
+	}
+}
+
+func TestDeauthorize_AlreadyRevoked(t *testing.T) {
+	client, db, server := setupTestClient(t)
+	defer db.Close()
+	defer server.Close()
+
+	athlete := &database.Athlete{
+		AthleteID:      12345,
+		ClientID:       "primary",
+		AccessToken:    "revoked_token",
+		RefreshToken:   "refresh_token",
+		TokenExpiresAt: time.Now().Add(1 * time.Hour),
+		AthleteSummary: json.RawMessage(`{"id": 12345}`),
+		CreatedAt:      time.Now(),
+		UpdatedAt:      time.Now(),
+	}
+	if err := db.UpsertAthlete(athlete); err != nil {
+		t.Fatalf("Failed to insert athlete: %v", err)
+	}
+
+	deauthServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, `{"message": "Authorization Error"}`, http.StatusUnauthorized)
+	}))
+	defer deauthServer.Close()
+	client.SetDeauthorizeURL(deauthServer.URL)
+
+	if err := client.Deauthorize(12345); err != nil {
+		t.Errorf("Expected already revoked access not to be an error, got %v", err)
+	}
+}
+
+// newSubscriptionServer mocks Strava's push subscription API, starting with the given subscriptions
+func newSubscriptionServer(t *testing.T, subscriptions []*Subscription) (*httptest.Server, *[]*Subscription) {
+	t.Helper()
+	nextID := 100
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /push_subscriptions", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(subscriptions)
+	})
+	mux.HandleFunc("POST /push_subscriptions", func(w http.ResponseWriter, r *http.Request) {
+		if len(subscriptions) > 0 {
+			http.Error(w, `{"message": "already exists"}`, http.StatusBadRequest)
+			return
+		}
+		nextID++
+		sub := &Subscription{ID: nextID, CallbackURL: r.FormValue("callback_url")}
+		subscriptions = append(subscriptions, sub)
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(sub)
+	})
+	mux.HandleFunc("DELETE /push_subscriptions/{id}", func(w http.ResponseWriter, r *http.Request) {
+		id, _ := strconv.Atoi(r.PathValue("id"))
+		subscriptions = slices.DeleteFunc(subscriptions, func(sub *Subscription) bool { return sub.ID == id })
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return server, &subscriptions
+}
+
+func TestReconcileSubscription(t *testing.T) {
+	const expectedURL = "https://example.com/webhook-callback/primary"
+
+	t.Run("Healthy", func(t *testing.T) {
+		client, db, server := setupTestClient(t)
+		defer db.Close()
+		defer server.Close()
+
+		apiServer, _ := newSubscriptionServer(t, []*Subscription{{ID: 1, CallbackURL: expectedURL}})
+		client.SetBaseURL(apiServer.URL)
+
+		status, err := client.ReconcileSubscription("primary", true)
+		if err != nil {
+			t.Fatalf("ReconcileSubscription failed: %v", err)
+		}
+		if !status.Healthy || status.Created != nil || len(status.Deleted) != 0 {
+			t.Errorf("Expected healthy subscription to be left alone, got %+v", status)
+		}
+	})
+
+	t.Run("MismatchedWithoutFix", func(t *testing.T) {
+		client, db, server := setupTestClient(t)
+		defer db.Close()
+		defer server.Close()
+
+		apiServer, subscriptions := newSubscriptionServer(t, []*Subscription{{ID: 1, CallbackURL: "https://old.example.com/webhook-callback/primary"}})
+		client.SetBaseURL(apiServer.URL)
+
+		status, err := client.ReconcileSubscription("primary", false)
+		if err != nil {
+			t.Fatalf("ReconcileSubscription failed: %v", err)
+		}
+		if status.Healthy {
+			t.Error("Expected mismatched subscription to be unhealthy")
+		}
+		if len(*subscriptions) != 1 || (*subscriptions)[0].ID != 1 {
+			t.Errorf("Expected subscription to be left alone without fix, got %+v", *subscriptions)
+		}
+	})
+
+	t.Run("MismatchedWithFix", func(t *testing.T) {
+		client, db, server := setupTestClient(t)
+		defer db.Close()
+		defer server.Close()
+
+		apiServer, subscriptions := newSubscriptionServer(t, []*Subscription{{ID: 1, CallbackURL: "https://old.example.com/webhook-callback/primary"}})
+		client.SetBaseURL(apiServer.URL)
+
+		status, err := client.ReconcileSubscription("primary", true)
+		if err != nil {
+			t.Fatalf("ReconcileSubscription failed: %v", err)
+		}
+		if !status.Healthy || status.Created == nil || !slices.Equal(status.Deleted, []int{1}) {
+			t.Errorf("Expected mismatched subscription to be replaced, got %+v", status)
+		}
+		if len(*subscriptions) != 1 || (*subscriptions)[0].CallbackURL != expectedURL {
+			t.Errorf("Expected only a subscription for %s, got %+v", expectedURL, *subscriptions)
+		}
+	})
+
+	t.Run("MissingWithFix", func(t *testing.T) {
+		client, db, server := setupTestClient(t)
+		defer db.Close()
+		defer server.Close()
+
+		apiServer, subscriptions := newSubscriptionServer(t, nil)
+		client.SetBaseURL(apiServer.URL)
+
+		status, err := client.ReconcileSubscription("primary", true)
+		if err != nil {
+			t.Fatalf("ReconcileSubscription failed: %v", err)
+		}
+		if !status.Healthy || status.Created == nil {
+			t.Errorf("Expected missing subscription to be created, got %+v", status)
+		}
+		if len(*subscriptions) != 1 {
+			t.Errorf("Expected one subscription, got %d", len(*subscriptions))
+		}
+	})
+}
+
+func TestUsageFlushedToDatabase(t *testing.T) {
+	client, db, server := setupTestClient(t)
+	defer db.Close()
+	defer server.Close()
+
+	athlete := &database.Athlete{
+		AthleteID:      12345,
+		ClientID:       "primary",
+		AccessToken:    "valid_token",
+		RefreshToken:   "refresh_token",
+		TokenExpiresAt: time.Now().Add(1 * time.Hour),
+		AthleteSummary: json.RawMessage(`{"id": 12345}`),
+		CreatedAt:      time.Now(),
+		UpdatedAt:      time.Now(),
+	}
+	if err := db.UpsertAthlete(athlete); err != nil {
+		t.Fatalf("Failed to insert athlete: %v", err)
+	}
+
+	apiServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`[]`))
+	}))
+	defer apiServer.Close()
+	client.SetBaseURL(apiServer.URL)
+
+	for range 2 {
+		if _, _, err := client.ListActivitiesBefore(12345, 0, 200); err != nil {
+			t.Fatalf("Failed to list activities: %v", err)
+		}
+	}
+
+	requestsToday := func() int {
+		t.Helper()
+		usage, err := db.GetClientUsage([]string{"primary"}, time.Now())
+		if err != nil {
+			t.Fatalf("Failed to get client usage: %v", err)
+		}
+		return usage[0].RequestsToday
+	}
+
+	// Requests are only written to the database when flushed
+	if requests := requestsToday(); requests != 0 {
+		t.Errorf("Expected no requests recorded before flushing, got %d", requests)
+	}
+	if err := client.FlushUsage(); err != nil {
+		t.Fatalf("Failed to flush usage: %v", err)
+	}
+	if requests := requestsToday(); requests != 2 {
+		t.Errorf("Expected 2 requests recorded, got %d", requests)
+	}
+
+	// Flushed requests aren't counted again
+	if err := client.FlushUsage(); err != nil {
+		t.Fatalf("Failed to flush usage: %v", err)
+	}
+	if requests := requestsToday(); requests != 2 {
+		t.Errorf("Expected 2 requests recorded after flushing again, got %d", requests)
+	}
+}
@@ -0,0 +1,143 @@
+package strava
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"time"
+
+	"plantopo-strava-sync/internal/metrics"
+)
+
+// SubscriptionStatus describes a client's webhook subscription after reconciliation
+type SubscriptionStatus struct {
+	ClientID            string          `json:"client_id"`
+	ExpectedCallbackURL string          `json:"expected_callback_url"`
+	Subscriptions       []*Subscription `json:"subscriptions"`     // As found on Strava, before any fix
+	Deleted             []int           `json:"deleted,omitempty"` // Mismatched subscriptions removed by the fix
+	Created             *Subscription   `json:"created,omitempty"` // Subscription created by the fix
+	Healthy             bool            `json:"healthy"`
+}
+
+// Active returns the subscription delivering webhooks to this server, nil if unhealthy
+func (s *SubscriptionStatus) Active() *Subscription {
+	if s.Created != nil {
+		return s.Created
+	}
+	for _, sub := range s.Subscriptions {
+		if sub.CallbackURL == s.ExpectedCallbackURL {
+			return sub
+		}
+	}
+	return nil
+}
+
+// ReconcileSubscription checks that the client has a webhook subscription
+// pointing at this server's callback URL. If fix is set, a missing
+// subscription is created and mismatched ones (e.g. for an old domain) are
+// replaced. Strava allows a single subscription per application, so
+// mismatched subscriptions are deleted before the new one is created.
+func (c *Client) ReconcileSubscription(clientID string, fix bool) (*SubscriptionStatus, error) {
+	clientConfig, err := c.config.GetClient(clientID)
+	if err != nil {
+		return nil, fmt.Errorf("invalid client: %w", err)
+	}
+
+	status := &SubscriptionStatus{
+		ClientID:            clientID,
+		ExpectedCallbackURL: c.config.WebhookCallbackURL(clientID),
+	}
+	defer func() {
+		healthy := 0.0
+		if status.Healthy {
+			healthy = 1
+		}
+		metrics.StravaSubscriptionHealthy.WithLabelValues(clientID).Set(healthy)
+	}()
+
+	status.Subscriptions, err = c.ListSubscriptions(clientID)
+	if err != nil {
+		return status, err
+	}
+
+	status.Healthy = slices.ContainsFunc(status.Subscriptions, func(sub *Subscription) bool {
+		return sub.CallbackURL == status.ExpectedCallbackURL
+	})
+	if status.Healthy || !fix {
+		return status, nil
+	}
+
+	for _, sub := range status.Subscriptions {
+		if err := c.DeleteSubscription(sub.ID, clientID); err != nil && !IsNotFound(err) {
+			return status, fmt.Errorf("failed to delete mismatched subscription %d: %w", sub.ID, err)
+		}
+		status.Deleted = append(status.Deleted, sub.ID)
+	}
+
+	status.Created, err = c.CreateSubscription(status.ExpectedCallbackURL, clientConfig.VerifyToken, clientID)
+	if err != nil {
+		return status, err
+	}
+	status.Healthy = true
+
+	return status, nil
+}
+
+// StartSubscriptionReconciler reconciles the subscription of every configured
+// client immediately and then every interval until ctx is cancelled. A zero
+// interval only reconciles once. onChecked, if set, is called with the status
+// of each subscription checked successfully.
+func (c *Client) StartSubscriptionReconciler(ctx context.Context, interval time.Duration, fix bool, onChecked func(*SubscriptionStatus)) {
+	c.reconcileAllSubscriptions(fix, onChecked)
+	if interval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			c.logger.Info("Subscription reconciler stopping")
+			return
+		case <-ticker.C:
+			c.reconcileAllSubscriptions(fix, onChecked)
+		}
+	}
+}
+
+func (c *Client) reconcileAllSubscriptions(fix bool, onChecked func(*SubscriptionStatus)) {
+	clientIDs := c.config.GetClientIDs()
+	slices.Sort(clientIDs)
+
+	for _, clientID := range clientIDs {
+		status, err := c.ReconcileSubscription(clientID, fix)
+		if err != nil {
+			c.logger.Error("Failed to reconcile webhook subscription",
+				"client", clientID,
+				"error", err)
+			continue
+		}
+
+		if onChecked != nil {
+			onChecked(status)
+		}
+
+		switch {
+		case status.Created != nil:
+			c.logger.Warn("Replaced webhook subscription",
+				"client", clientID,
+				"callback_url", status.ExpectedCallbackURL,
+				"deleted", status.Deleted,
+				"subscription_id", status.Created.ID)
+		case !status.Healthy:
+			c.logger.Error("Webhook subscription missing or mismatched, events will not be received",
+				"client", clientID,
+				"expected_callback_url", status.ExpectedCallbackURL,
+				"subscriptions", len(status.Subscriptions))
+		default:
+			c.logger.Debug("Webhook subscription healthy", "client", clientID)
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package strava
+
+import (
+	"context"
+	"time"
+)
+
+// usageKey identifies the API requests made with a client on a day
+type usageKey struct {
+	clientID string
+	day      time.Time // Midnight UTC
+}
+
+// recordUsage counts an API request made with a client. Requests are counted
+// in memory and written to the database by FlushUsage, so that requests don't
+// wait on the database.
+func (c *Client) recordUsage(clientID string, at time.Time) {
+	key := usageKey{clientID: clientID, day: at.UTC().Truncate(24 * time.Hour)}
+
+	c.usageMu.Lock()
+	defer c.usageMu.Unlock()
+	c.usage[key]++
+}
+
+// FlushUsage writes the API requests counted since the last flush to the
+// database. Counts which couldn't be written are kept for the next flush.
+func (c *Client) FlushUsage() error {
+	c.usageMu.Lock()
+	usage := c.usage
+	c.usage = make(map[usageKey]int)
+	c.usageMu.Unlock()
+
+	for key, requests := range usage {
+		if err := c.db.RecordAPIRequests(key.clientID, key.day, requests); err != nil {
+			c.usageMu.Lock()
+			for key, requests := range usage {
+				c.usage[key] += requests
+			}
+			c.usageMu.Unlock()
+			return err
+		}
+		delete(usage, key)
+	}
+
+	return nil
+}
+
+// StartUsageFlusher flushes API usage counts to the database every interval
+// until ctx is cancelled
+func (c *Client) StartUsageFlusher(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			c.logger.Info("Usage flusher stopping")
+			return
+		case <-ticker.C:
+			if err := c.FlushUsage(); err != nil {
+				c.logger.Warn("Failed to flush API usage", "error", err)
+			}
+		}
+	}
+}
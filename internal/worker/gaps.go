@@ -0,0 +1,179 @@
+package worker
+
+import (
+	"context"
+	"log/slog"
+	"slices"
+	"time"
+
+	"plantopo-strava-sync/internal/config"
+	"plantopo-strava-sync/internal/database"
+	"plantopo-strava-sync/internal/metrics"
+	"plantopo-strava-sync/internal/strava"
+)
+
+// GapDetector detects periods in which Strava webhooks may have been lost,
+// such as server downtime, a missing subscription or a long gap in
+// deliveries, and queues sync_since jobs so that the event stream catches up
+// without a full backfill
+type GapDetector struct {
+	db                *database.DB
+	config            *config.Config
+	logger            *slog.Logger
+	heartbeatInterval time.Duration
+}
+
+// NewGapDetector creates a new gap detector
+func NewGapDetector(db *database.DB, cfg *config.Config) *GapDetector {
+	return &GapDetector{
+		db:                db,
+		config:            cfg,
+		logger:            slog.Default(),
+		heartbeatInterval: 1 * time.Minute,
+	}
+}
+
+// CheckDowntime compares the last heartbeat of a previous run with now and
+// queues gap sync for every athlete if the server was down long enough to
+// miss webhooks. It should be called once on startup, before Start.
+func (g *GapDetector) CheckDowntime(now time.Time) error {
+	lastSeen, err := g.db.GetLastHeartbeat()
+	if err != nil {
+		return err
+	}
+
+	if lastSeen != nil && now.Sub(*lastSeen) > g.config.GapDowntimeThreshold {
+		g.logger.Warn("Server was down, webhooks may have been lost",
+			"last_seen", *lastSeen,
+			"downtime", now.Sub(*lastSeen).Round(time.Second))
+		if err := g.syncGap("", *lastSeen, metrics.GapReasonDowntime); err != nil {
+			return err
+		}
+	}
+
+	return g.db.RecordHeartbeat(now)
+}
+
+// Start records heartbeats and checks for gaps in webhook deliveries until
+// ctx is cancelled
+func (g *GapDetector) Start(ctx context.Context) {
+	ticker := time.NewTicker(g.heartbeatInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			g.logger.Info("Gap detector stopping")
+			return
+		case <-ticker.C:
+			now := time.Now()
+			if err := g.db.RecordHeartbeat(now); err != nil {
+				g.logger.Error("Failed to record heartbeat", "error", err)
+			}
+			g.checkDeliveryGaps(now)
+		}
+	}
+}
+
+// checkDeliveryGaps queues gap sync for clients which haven't received a
+// webhook for longer than the delivery threshold, at most once per threshold
+func (g *GapDetector) checkDeliveryGaps(now time.Time) {
+	if g.config.GapDeliveryThreshold <= 0 {
+		return
+	}
+
+	clientIDs := g.config.GetClientIDs()
+	slices.Sort(clientIDs)
+
+	for _, clientID := range clientIDs {
+		health, err := g.db.GetWebhookHealth(clientID)
+		if err != nil {
+			g.logger.Error("Failed to get webhook health", "client", clientID, "error", err)
+			continue
+		}
+
+		// Nothing to compare against until the first webhook is received
+		from := latestTime(health.LastReceivedAt, health.LastGapSyncAt)
+		if from == nil || now.Sub(*from) < g.config.GapDeliveryThreshold {
+			continue
+		}
+
+		g.logger.Warn("No webhooks received, webhooks may have been lost",
+			"client", clientID,
+			"since", *from)
+		if err := g.syncGap(clientID, *from, metrics.GapReasonDeliveryGap); err != nil {
+			g.logger.Error("Failed to queue gap sync", "client", clientID, "error", err)
+			continue
+		}
+		if err := g.db.RecordGapSyncQueued(clientID, now); err != nil {
+			g.logger.Error("Failed to record gap sync", "client", clientID, "error", err)
+		}
+	}
+}
+
+// SubscriptionChecked records a healthy subscription and queues gap sync if
+// it was repaired, i.e. it is a different subscription from the one last
+// confirmed healthy. Webhooks may have been lost since the later of the last
+// webhook received and the previous subscription last being confirmed healthy.
+func (g *GapDetector) SubscriptionChecked(status *strava.SubscriptionStatus) {
+	active := status.Active()
+	if active == nil {
+		return
+	}
+
+	now := time.Now()
+	health, err := g.db.GetWebhookHealth(status.ClientID)
+	if err != nil {
+		g.logger.Error("Failed to get webhook health", "client", status.ClientID, "error", err)
+		return
+	}
+
+	repaired := status.Created != nil || (health.SubscriptionID != nil && *health.SubscriptionID != active.ID)
+	if repaired {
+		from := now
+		if latest := latestTime(health.LastReceivedAt, health.LastHealthyAt); latest != nil {
+			from = *latest
+		}
+
+		g.logger.Warn("Subscription was repaired, webhooks may have been lost",
+			"client", status.ClientID,
+			"subscription_id", active.ID,
+			"since", from)
+		if err := g.syncGap(status.ClientID, from, metrics.GapReasonSubscriptionRepair); err != nil {
+			g.logger.Error("Failed to queue gap sync", "client", status.ClientID, "error", err)
+			return
+		}
+	}
+
+	if err := g.db.RecordSubscriptionHealthy(status.ClientID, active.ID, now); err != nil {
+		g.logger.Error("Failed to record subscription health", "client", status.ClientID, "error", err)
+	}
+}
+
+// syncGap queues sync_since jobs for the client's athletes (every athlete if
+// clientID is empty) covering activities started from the lookback before the
+// gap, as activities uploaded during the gap may have been recorded earlier
+func (g *GapDetector) syncGap(clientID string, from time.Time, reason string) error {
+	metrics.WebhookGapsDetectedTotal.WithLabelValues(reason).Inc()
+
+	since := from.Add(-g.config.GapSyncLookback)
+	count, err := g.db.StartGapSync(clientID, since)
+	if err != nil {
+		return err
+	}
+
+	g.logger.Info("Queued gap sync",
+		"client", clientID,
+		"reason", reason,
+		"since", since,
+		"athletes", count)
+	return nil
+}
+
+// latestTime returns the later of two optional times, nil if neither is set
+func latestTime(a, b *time.Time) *time.Time {
+	if a == nil || (b != nil && b.After(*a)) {
+		return b
+	}
+	return a
+}
@@ -0,0 +1,146 @@
+package worker
+
+import (
+	"slices"
+	"testing"
+	"time"
+
+	"plantopo-strava-sync/internal/database"
+	"plantopo-strava-sync/internal/strava"
+)
+
+func TestGapDetector_DowntimeSyncsActivitiesSinceGap(t *testing.T) {
+	worker, db := setupWorkerTest(t)
+	defer db.Close()
+	worker.listPageSize = 2
+	worker.config.GapDowntimeThreshold = 5 * time.Minute
+	worker.config.GapSyncLookback = 24 * time.Hour
+
+	athleteID := int64(12345)
+	insertTestAthlete(t, db, athleteID)
+
+	now := time.Now().Truncate(time.Second)
+	activities := []backfillActivity{
+		{1, now.Add(-1 * time.Hour)},
+		{2, now.Add(-5 * time.Hour)},
+		{3, now.Add(-20 * time.Hour)},
+		{4, now.Add(-40 * time.Hour)},
+	}
+
+	var befores []string
+	apiServer := newBackfillServer(t, activities, &befores)
+	defer apiServer.Close()
+	worker.stravaClient.SetBaseURL(apiServer.URL)
+
+	// The server was last seen 6 hours ago
+	if err := db.RecordHeartbeat(now.Add(-6 * time.Hour)); err != nil {
+		t.Fatalf("Failed to record heartbeat: %v", err)
+	}
+
+	detector := NewGapDetector(db, worker.config)
+	if err := detector.CheckDowntime(now); err != nil {
+		t.Fatalf("CheckDowntime failed: %v", err)
+	}
+
+	// Activities started within the lookback before the gap are synced
+	synced := processQueuedSyncJobs(t, worker, db)
+	if !slices.Equal(synced, []int64{1, 2, 3}) {
+		t.Errorf("Expected activities 1, 2, 3 to be synced, got %v", synced)
+	}
+
+	state, err := db.GetGapSyncState(athleteID)
+	if err != nil {
+		t.Fatalf("Failed to get gap sync state: %v", err)
+	}
+	if state != nil {
+		t.Errorf("Expected gap sync to be finished, got %+v", state)
+	}
+
+	// A restart shortly after doesn't queue anything
+	if err := detector.CheckDowntime(now.Add(1 * time.Minute)); err != nil {
+		t.Fatalf("CheckDowntime failed: %v", err)
+	}
+	if length, _ := db.GetSyncJobQueueLength(); length != 0 {
+		t.Errorf("Expected no sync jobs after a short restart, got %d", length)
+	}
+}
+
+func TestGapDetector_DeliveryGap(t *testing.T) {
+	worker, db := setupWorkerTest(t)
+	defer db.Close()
+	worker.config.GapDeliveryThreshold = 12 * time.Hour
+
+	insertTestAthlete(t, db, 12345)
+	detector := NewGapDetector(db, worker.config)
+
+	now := time.Now()
+	if err := db.RecordWebhookReceived("primary", now.Add(-13*time.Hour)); err != nil {
+		t.Fatalf("Failed to record webhook receipt: %v", err)
+	}
+
+	detector.checkDeliveryGaps(now)
+	job, err := db.ClaimSyncJob()
+	if err != nil {
+		t.Fatalf("Failed to claim sync job: %v", err)
+	}
+	if job == nil || job.JobType != "sync_since" || job.Priority != database.PriorityGapSync {
+		t.Fatalf("Expected a sync_since job for the delivery gap, got %+v", job)
+	}
+	if err := db.DeleteSyncJob(job.ID); err != nil {
+		t.Fatalf("Failed to delete sync job: %v", err)
+	}
+
+	// The same gap isn't synced again until another threshold has passed
+	detector.checkDeliveryGaps(now.Add(1 * time.Hour))
+	if length, _ := db.GetSyncJobQueueLength(); length != 0 {
+		t.Errorf("Expected the gap not to be synced twice, got %d jobs", length)
+	}
+}
+
+func TestGapDetector_SubscriptionRepair(t *testing.T) {
+	worker, db := setupWorkerTest(t)
+	defer db.Close()
+
+	insertTestAthlete(t, db, 12345)
+	detector := NewGapDetector(db, worker.config)
+
+	callbackURL := "https://example.com/webhook-callback/primary"
+	healthy := &strava.SubscriptionStatus{
+		ClientID:            "primary",
+		ExpectedCallbackURL: callbackURL,
+		Subscriptions:       []*strava.Subscription{{ID: 1, CallbackURL: callbackURL}},
+		Healthy:             true,
+	}
+
+	// Confirming the same subscription doesn't queue anything
+	detector.SubscriptionChecked(healthy)
+	detector.SubscriptionChecked(healthy)
+	if length, _ := db.GetSyncJobQueueLength(); length != 0 {
+		t.Fatalf("Expected no sync jobs for a healthy subscription, got %d", length)
+	}
+
+	// A replacement subscription means webhooks may have been lost
+	replaced := &strava.SubscriptionStatus{
+		ClientID:            "primary",
+		ExpectedCallbackURL: callbackURL,
+		Subscriptions:       []*strava.Subscription{{ID: 2, CallbackURL: callbackURL}},
+		Healthy:             true,
+	}
+	detector.SubscriptionChecked(replaced)
+
+	state, err := db.GetGapSyncState(12345)
+	if err != nil {
+		t.Fatalf("Failed to get gap sync state: %v", err)
+	}
+	if state == nil {
+		t.Fatal("Expected gap sync after the subscription was replaced")
+	}
+
+	health, err := db.GetWebhookHealth("primary")
+	if err != nil {
+		t.Fatalf("Failed to get webhook health: %v", err)
+	}
+	if health.SubscriptionID == nil || *health.SubscriptionID != 2 {
+		t.Errorf("Expected subscription 2 to be recorded as healthy, got %v", health.SubscriptionID)
+	}
+}
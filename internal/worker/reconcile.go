@@ -0,0 +1,265 @@
+package worker
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math"
+	"time"
+
+	"plantopo-strava-sync/internal/config"
+	"plantopo-strava-sync/internal/database"
+	"plantopo-strava-sync/internal/metrics"
+	"plantopo-strava-sync/internal/strava"
+)
+
+// ReconcileScheduler periodically queues reconcile_activities jobs which
+// re-list each athlete's recent activities, catching deletes and edits whose
+// webhooks were lost. The jobs have the lowest priority so they only run
+// when nothing else is waiting, within the usual rate limit throttling.
+type ReconcileScheduler struct {
+	db            *database.DB
+	config        *config.Config
+	logger        *slog.Logger
+	checkInterval time.Duration
+}
+
+// NewReconcileScheduler creates a new reconciliation scheduler
+func NewReconcileScheduler(db *database.DB, cfg *config.Config) *ReconcileScheduler {
+	return &ReconcileScheduler{
+		db:            db,
+		config:        cfg,
+		logger:        slog.Default(),
+		checkInterval: 1 * time.Hour,
+	}
+}
+
+// Start queues reconciliation for athletes who are due immediately and then
+// every check interval until ctx is cancelled. It returns immediately if
+// reconciliation is disabled.
+func (s *ReconcileScheduler) Start(ctx context.Context) {
+	if s.config.ReconcileInterval <= 0 {
+		s.logger.Info("Reconciliation disabled")
+		return
+	}
+
+	s.queueDue(time.Now())
+
+	ticker := time.NewTicker(min(s.checkInterval, s.config.ReconcileInterval))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			s.logger.Info("Reconciliation scheduler stopping")
+			return
+		case <-ticker.C:
+			s.queueDue(time.Now())
+		}
+	}
+}
+
+func (s *ReconcileScheduler) queueDue(now time.Time) {
+	count, err := s.db.StartDueReconciliations(s.config.ReconcileInterval, s.config.ReconcileWindow, now)
+	if err != nil {
+		s.logger.Error("Failed to queue reconciliation", "error", err)
+		return
+	}
+	if count > 0 {
+		s.logger.Info("Queued reconciliation", "athletes", count)
+	}
+}
+
+// reconcileActivities lists the next page of an athlete's recent activities,
+// newest first, and compares it with the activities in the event stream.
+// Activities missing from the page get a reconciled_delete event and changed
+// activities are refetched as reconciled_update events. Activities which
+// aren't in the event stream yet are left to backfill. Returns true if there
+// are more activities to list.
+func (w *Worker) reconcileActivities(athleteID int64, priority int) (bool, error) {
+	state, err := w.db.GetReconcileState(athleteID)
+	if err != nil {
+		return false, err
+	}
+	if state == nil || state.CompletedAt != nil {
+		w.logger.Info("No reconciliation in progress for athlete", "athlete_id", athleteID)
+		return false, nil
+	}
+
+	w.logger.Info("Listing activities for reconciliation",
+		"athlete_id", athleteID,
+		"since", state.Since,
+		"before", state.Cursor)
+
+	summaries, hasMore, err := w.stravaClient.ListActivitiesBefore(athleteID, listBefore(state.Cursor), w.listPageSize)
+	if err != nil {
+		if strava.IsTooManyRequests(err) {
+			w.handle429Error("reconcile_activities")
+			return false, fmt.Errorf("rate limited during reconcile_activities: %w", err)
+		}
+		if strava.IsUnauthorized(err) {
+			w.logger.Warn("Athlete unauthorized during reconciliation, skipping", "athlete_id", athleteID)
+			return false, w.db.FinishReconciliation(athleteID, time.Now())
+		}
+		return false, fmt.Errorf("failed to list activities: %w", err)
+	}
+
+	listed := make(map[int64]bool, len(summaries))
+	for _, summary := range summaries {
+		listed[summary.ID] = true
+	}
+
+	cursor := state.Cursor
+	kept := summaries[:0]
+	for _, summary := range summaries {
+		startTime, err := summary.StartTime()
+		if err != nil {
+			w.logger.Warn("Activity has invalid start_date", "athlete_id", athleteID, "activity_id", summary.ID, "start_date", summary.StartDate)
+			kept = append(kept, summary)
+			continue
+		}
+		if startTime.Unix() < state.Since {
+			hasMore = false
+			break
+		}
+
+		kept = append(kept, summary)
+		cursor = startTime.Unix()
+	}
+
+	if hasMore && (cursor == state.Cursor || len(kept) == 0) {
+		w.logger.Warn("Unable to page past activities, stopping reconciliation", "athlete_id", athleteID, "before", state.Cursor)
+		hasMore = false
+	}
+
+	// The start dates covered by this page, which includes the cursor's second
+	// as it was listed again. Activities which started at the same time as the
+	// oldest listed may continue on the next page.
+	from, to := state.Since, listBefore(state.Cursor)
+	if to == 0 {
+		to = math.MaxInt64
+	}
+	if hasMore {
+		from = cursor + 1
+	}
+
+	deleted, err := w.reconcileDeletes(athleteID, listed, from, to, state.StartedAt)
+	if err != nil {
+		return false, err
+	}
+
+	updated, err := w.reconcileUpdates(athleteID, kept, priority)
+	if err != nil {
+		return false, err
+	}
+
+	w.logger.Info("Reconciled activities page",
+		"athlete_id", athleteID,
+		"count", len(kept),
+		"deleted", deleted,
+		"updated", updated,
+		"more", hasMore)
+
+	if hasMore {
+		return true, w.db.AdvanceReconciliation(athleteID, cursor)
+	}
+
+	metrics.SyncJobsCompletedTotal.WithLabelValues("reconcile_activities").Inc()
+	return false, w.db.FinishReconciliation(athleteID, time.Now())
+}
+
+// reconcileDeletes emits reconciled_delete events for activities in the event
+// stream which started in [from, to) but weren't listed. Activities recorded
+// since the reconciliation started are skipped as they may be newer than the
+// listing, as are activities with a webhook waiting to be processed.
+// Returns the number of activities deleted.
+func (w *Worker) reconcileDeletes(athleteID int64, listed map[int64]bool, from, to int64, startedAt time.Time) (int, error) {
+	stored, err := w.db.ListReconcilableActivities(athleteID, from, to, startedAt.Unix())
+	if err != nil {
+		return 0, err
+	}
+
+	deleted := 0
+	for _, activityID := range stored {
+		if listed[activityID] {
+			continue
+		}
+
+		pending, err := w.db.HasPendingActivityWebhook(activityID)
+		if err != nil {
+			return deleted, fmt.Errorf("failed to check pending webhooks: %w", err)
+		}
+		if pending {
+			continue
+		}
+
+		eventID, err := w.db.InsertReconciledEvent(database.EventTypeReconciledDelete, athleteID, activityID, nil)
+		if err != nil {
+			return deleted, err
+		}
+		if err := w.db.MarkActivityDeleted(athleteID, activityID, database.ActivitySourceReconcile); err != nil {
+			w.logger.Error("Failed to mark activity deleted", "activity_id", activityID, "error", err)
+		}
+		deleted++
+
+		w.logger.Warn("Activity missing from Strava, created reconciled_delete event",
+			"athlete_id", athleteID,
+			"activity_id", activityID,
+			"event_id", eventID)
+		metrics.ReconciliationDiscrepanciesTotal.WithLabelValues(metrics.DiscrepancyDelete).Inc()
+	}
+
+	return deleted, nil
+}
+
+// reconcileUpdates compares listed activities with the versions in the event
+// stream. Changed activities get a reconcile_activity job or, in summary-only
+// mode, a reconciled_update event built from the summary.
+// Returns the number of activities changed.
+func (w *Worker) reconcileUpdates(athleteID int64, summaries []*strava.ActivitySummary, priority int) (int, error) {
+	activityIDs := make([]int64, len(summaries))
+	for i, summary := range summaries {
+		activityIDs[i] = summary.ID
+	}
+
+	known, err := w.db.GetActivityFingerprints(athleteID, activityIDs)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get activity fingerprints: %w", err)
+	}
+
+	updated := 0
+	for _, summary := range summaries {
+		// Unknown activities are left to backfill, and activities with a reset
+		// fingerprint are being resynced
+		fingerprint, ok := known[summary.ID]
+		if !ok || fingerprint == "" || fingerprint == summary.Fingerprint() {
+			continue
+		}
+		updated++
+		metrics.ReconciliationDiscrepanciesTotal.WithLabelValues(metrics.DiscrepancyUpdate).Inc()
+
+		if w.config.BackfillSummaryOnly {
+			eventID, err := w.db.InsertReconciledEvent(database.EventTypeReconciledUpdate, athleteID, summary.ID, summary.Raw)
+			if err != nil {
+				return updated, err
+			}
+			if err := w.db.RecordActivityState(athleteID, summary.ID, summary.Fingerprint(), summaryStartDate(summary), database.ActivitySourceReconcile); err != nil {
+				w.logger.Error("Failed to record activity state", "activity_id", summary.ID, "error", err)
+			}
+			w.logger.Info("Activity changed on Strava, created reconciled_update event",
+				"athlete_id", athleteID,
+				"activity_id", summary.ID,
+				"event_id", eventID)
+			continue
+		}
+
+		if _, err := w.db.EnqueueSyncJobWithPriority(athleteID, "reconcile_activity", &summary.ID, priority); err != nil {
+			w.logger.Error("Failed to enqueue reconcile_activity job",
+				"athlete_id", athleteID,
+				"activity_id", summary.ID,
+				"error", err)
+		}
+	}
+
+	return updated, nil
+}
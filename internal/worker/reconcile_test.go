@@ -0,0 +1,165 @@
+package worker
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"plantopo-strava-sync/internal/database"
+	"plantopo-strava-sync/internal/strava"
+)
+
+func TestReconcileActivities_EmitsDeletesAndUpdates(t *testing.T) {
+	worker, db := setupWorkerTest(t)
+	defer db.Close()
+	worker.listPageSize = 2
+	worker.config.ReconcileWindow = 30 * 24 * time.Hour
+
+	athleteID := int64(12345)
+	insertTestAthlete(t, db, athleteID)
+
+	now := time.Now().Truncate(time.Second)
+	activities := []backfillActivity{
+		{1, now.Add(-1 * 24 * time.Hour)},
+		{2, now.Add(-5 * 24 * time.Hour)},
+		{4, now.Add(-60 * 24 * time.Hour)},
+	}
+
+	var befores []string
+	apiServer := newBackfillServer(t, activities, &befores)
+	defer apiServer.Close()
+	worker.stravaClient.SetBaseURL(apiServer.URL)
+
+	// Record the versions in the event stream: 1 is unchanged, 2 was renamed
+	// on Strava, 3 was deleted on Strava and 4 is outside the window
+	record := func(activityID int64, name string, started time.Time) {
+		t.Helper()
+		data := fmt.Sprintf(`{"id": %d, "name": %q, "start_date": %q}`, activityID, name, started.UTC().Format(time.RFC3339))
+		fingerprint, err := strava.FingerprintActivity(json.RawMessage(data))
+		if err != nil {
+			t.Fatalf("Failed to fingerprint activity: %v", err)
+		}
+		if err := db.RecordActivityState(athleteID, activityID, fingerprint, started.Unix(), database.ActivitySourceBackfill); err != nil {
+			t.Fatalf("Failed to record activity state: %v", err)
+		}
+	}
+	record(1, "Activity 1", activities[0].started)
+	record(2, "Old name", activities[1].started)
+	record(3, "Activity 3", now.Add(-3*24*time.Hour))
+	record(4, "Activity 4", activities[2].started)
+
+	// Start after the activities were recorded, so they are all reconcilable
+	count, err := db.StartDueReconciliations(24*time.Hour, worker.config.ReconcileWindow, now.Add(2*time.Second))
+	if err != nil {
+		t.Fatalf("Failed to start reconciliation: %v", err)
+	}
+	if count != 1 {
+		t.Fatalf("Expected reconciliation for 1 athlete, got %d", count)
+	}
+
+	processQueuedSyncJobs(t, worker, db)
+
+	events, err := db.GetEvents(0, 100)
+	if err != nil {
+		t.Fatalf("Failed to get events: %v", err)
+	}
+	got := make(map[int64]database.EventType)
+	for _, event := range events {
+		got[*event.ActivityID] = event.EventType
+	}
+	expected := map[int64]database.EventType{
+		2: database.EventTypeReconciledUpdate,
+		3: database.EventTypeReconciledDelete,
+	}
+	if len(got) != len(expected) || got[2] != expected[2] || got[3] != expected[3] {
+		t.Errorf("Expected events %v, got %v", expected, got)
+	}
+
+	state, err := db.GetActivityState(3)
+	if err != nil {
+		t.Fatalf("Failed to get activity state: %v", err)
+	}
+	if state == nil || !state.Deleted {
+		t.Errorf("Expected activity 3 to be marked deleted, got %+v", state)
+	}
+
+	reconcileState, err := db.GetReconcileState(athleteID)
+	if err != nil {
+		t.Fatalf("Failed to get reconcile state: %v", err)
+	}
+	if reconcileState == nil || reconcileState.CompletedAt == nil {
+		t.Errorf("Expected reconciliation to be completed, got %+v", reconcileState)
+	}
+
+	// Reconciling again finds nothing new and isn't due until the interval passes
+	if count, _ := db.StartDueReconciliations(24*time.Hour, worker.config.ReconcileWindow, now.Add(1*time.Hour)); count != 0 {
+		t.Errorf("Expected no reconciliation before the interval, got %d", count)
+	}
+	if _, err := db.StartDueReconciliations(24*time.Hour, worker.config.ReconcileWindow, now.Add(25*time.Hour)); err != nil {
+		t.Fatalf("Failed to start reconciliation: %v", err)
+	}
+	processQueuedSyncJobs(t, worker, db)
+	if events, _ := db.GetEvents(0, 100); len(events) != 2 {
+		t.Errorf("Expected no further events, got %d events", len(events))
+	}
+}
+
+func TestReconcileActivities_SameSecondAcrossPages(t *testing.T) {
+	worker, db := setupWorkerTest(t)
+	defer db.Close()
+	worker.listPageSize = 2
+	worker.config.ReconcileWindow = 30 * 24 * time.Hour
+	worker.config.BackfillSummaryOnly = true
+
+	athleteID := int64(12345)
+	insertTestAthlete(t, db, athleteID)
+
+	// Activities 2 and 3 started in the same second, either side of a page boundary
+	now := time.Now().Truncate(time.Second)
+	activities := []backfillActivity{
+		{1, now.Add(-1 * 24 * time.Hour)},
+		{2, now.Add(-3 * 24 * time.Hour)},
+		{3, now.Add(-3 * 24 * time.Hour)},
+	}
+
+	var befores []string
+	apiServer := newBackfillServer(t, activities, &befores)
+	defer apiServer.Close()
+	worker.stravaClient.SetBaseURL(apiServer.URL)
+
+	// 3 was renamed on Strava and 4, which started in the same second, was deleted
+	record := func(activityID int64, name string, started time.Time) {
+		t.Helper()
+		data := fmt.Sprintf(`{"id": %d, "name": %q, "start_date": %q}`, activityID, name, started.UTC().Format(time.RFC3339))
+		fingerprint, err := strava.FingerprintActivity(json.RawMessage(data))
+		if err != nil {
+			t.Fatalf("Failed to fingerprint activity: %v", err)
+		}
+		if err := db.RecordActivityState(athleteID, activityID, fingerprint, started.Unix(), database.ActivitySourceBackfill); err != nil {
+			t.Fatalf("Failed to record activity state: %v", err)
+		}
+	}
+	record(1, "Activity 1", activities[0].started)
+	record(2, "Activity 2", activities[1].started)
+	record(3, "Old name", activities[2].started)
+	record(4, "Activity 4", activities[2].started)
+
+	if _, err := db.StartDueReconciliations(24*time.Hour, worker.config.ReconcileWindow, now.Add(2*time.Second)); err != nil {
+		t.Fatalf("Failed to start reconciliation: %v", err)
+	}
+
+	processQueuedSyncJobs(t, worker, db)
+
+	events, err := db.GetEvents(0, 100)
+	if err != nil {
+		t.Fatalf("Failed to get events: %v", err)
+	}
+	got := make(map[int64]database.EventType)
+	for _, event := range events {
+		got[*event.ActivityID] = event.EventType
+	}
+	if len(got) != 2 || got[3] != database.EventTypeReconciledUpdate || got[4] != database.EventTypeReconciledDelete {
+		t.Errorf("Expected reconciled_update for 3 and reconciled_delete for 4, got %v", got)
+	}
+}
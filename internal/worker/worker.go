@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"log/slog"
+	"sort"
 	"strconv"
 	"time"
 
@@ -21,6 +22,7 @@ type Worker struct {
 	config       *config.Config
 	logger       *slog.Logger
 	pollInterval time.Duration
+	listPageSize int // Activities listed per list_activities job
 }
 
 // NewWorker creates a new webhook worker
@@ -31,6 +33,7 @@ func NewWorker(db *database.DB, stravaClient *strava.Client, cfg *config.Config)
 		config:       cfg,
 		logger:       slog.Default(),
 		pollInterval: 500 * time.Millisecond,
+		listPageSize: 200, // Strava max
 	}
 }
 
@@ -86,10 +89,8 @@ func (w *Worker) Start(ctx context.Context) error {
 			}
 
 			// 5. Proactive throttling: Check budget before claiming sync job
-			allowed, reason := w.stravaClient.CanProcessBackfillJob(
-				w.config.RateLimitWebhookReservePercent,
-				w.config.RateLimitThrottleThreshold,
-			)
+			webhookReservePercent, throttleThreshold, _ := w.config.RateLimitSettings()
+			allowed, reason := w.stravaClient.CanProcessBackfillJob(webhookReservePercent, throttleThreshold)
 			if !allowed {
 				w.logger.Debug("Backfill throttled", "reason", reason)
 				metrics.WorkerPollCyclesTotal.WithLabelValues("throttled").Inc()
@@ -142,7 +143,7 @@ func (w *Worker) handleCircuitBreakerTransitions(state *database.CircuitBreakerS
 
 	case "half_open":
 		// After N consecutive successes, recover to closed
-		if state.ConsecutiveSuccesses >= w.config.RateLimitCircuitRecoveryCount {
+		if _, _, recoveryCount := w.config.RateLimitSettings(); state.ConsecutiveSuccesses >= recoveryCount {
 			w.logger.Info("Circuit breaker recovered after consecutive successes",
 				"successes", state.ConsecutiveSuccesses)
 			if err := w.db.TransitionCircuitBreakerToClosed(); err != nil {
@@ -204,12 +205,55 @@ func (w *Worker) processWebhook(item *database.WebhookQueueItem) {
 		return
 	}
 
+	// An athlete who moved to another client may still have the old client
+	// authorized, whose webhooks would duplicate the new client's events or
+	// disconnect them if they revoke it
+	if item.ClientID != "" {
+		ownerID, _ := webhook["owner_id"].(float64)
+		left, err := w.db.HasLeftClient(int64(ownerID), item.ClientID)
+		if err != nil {
+			w.logger.Error("Failed to check webhook client", "id", item.ID, "error", err)
+			duration := time.Since(start).Seconds()
+			metrics.QueueProcessingDuration.WithLabelValues(metrics.QueueTypeWebhook, metrics.ResultFailure).Observe(duration)
+			metrics.QueueDequeueTotal.WithLabelValues(metrics.QueueTypeWebhook, metrics.ResultRetry).Inc()
+			w.releaseWebhook(item.ID, item.RetryCount, err.Error())
+			return
+		}
+		if left {
+			w.logger.Info("Ignoring webhook from a client the athlete has left",
+				"id", item.ID,
+				"athlete_id", int64(ownerID),
+				"client_id", item.ClientID)
+			if err := w.db.DeleteWebhook(item.ID); err != nil {
+				w.logger.Error("Failed to delete ignored webhook", "id", item.ID, "error", err)
+			}
+			duration := time.Since(start).Seconds()
+			metrics.QueueProcessingDuration.WithLabelValues(metrics.QueueTypeWebhook, metrics.ResultSuccess).Observe(duration)
+			metrics.QueueDequeueTotal.WithLabelValues(metrics.QueueTypeWebhook, metrics.ResultDropped).Inc()
+			return
+		}
+	}
+
 	objectType, _ := webhook["object_type"].(string)
+	aspectType, _ := webhook["aspect_type"].(string)
+
+	// Claim any other queued updates for the same activity so that a burst of
+	// edits results in a single fetch
+	var coalesced []*database.WebhookQueueItem
+	if objectType == "activity" && aspectType == "update" {
+		objectID, _ := webhook["object_id"].(float64)
+		var err error
+		coalesced, err = w.db.ClaimActivityUpdateWebhooks(int64(objectID), item.ID)
+		if err != nil {
+			w.logger.Error("Failed to claim related update webhooks", "id", item.ID, "error", err)
+			coalesced = nil
+		}
+	}
 
 	var err error
 	switch objectType {
 	case "activity":
-		err = w.handleActivity(webhook)
+		err = w.handleActivity(webhook, coalescedPayloads(item, coalesced))
 	case "athlete":
 		err = w.handleAthlete(webhook)
 	default:
@@ -231,18 +275,47 @@ func (w *Worker) processWebhook(item *database.WebhookQueueItem) {
 		metrics.QueueDequeueTotal.WithLabelValues(metrics.QueueTypeWebhook, metrics.ResultRetry).Inc()
 		metrics.QueueRetryTotal.WithLabelValues(metrics.QueueTypeWebhook, strconv.Itoa(item.RetryCount+1)).Inc()
 		w.releaseWebhook(item.ID, item.RetryCount, err.Error())
+		for _, other := range coalesced {
+			w.releaseWebhook(other.ID, other.RetryCount, err.Error())
+		}
 		return
 	}
 
-	// Success - delete webhook from queue
+	// Success - delete webhook (and any coalesced into it) from queue
+	for _, other := range coalesced {
+		if err := w.db.DeleteWebhook(other.ID); err != nil {
+			w.logger.Error("Failed to delete coalesced webhook", "id", other.ID, "error", err)
+		}
+	}
+	if len(coalesced) > 0 {
+		metrics.WebhookUpdatesCoalescedTotal.Add(float64(len(coalesced)))
+	}
+
 	if err := w.db.DeleteWebhook(item.ID); err != nil {
 		w.logger.Error("Failed to delete completed webhook", "id", item.ID, "error", err)
 	} else {
 		duration := time.Since(start).Seconds()
 		metrics.QueueProcessingDuration.WithLabelValues(metrics.QueueTypeWebhook, metrics.ResultSuccess).Observe(duration)
 		metrics.QueueDequeueTotal.WithLabelValues(metrics.QueueTypeWebhook, metrics.ResultSuccess).Inc()
-		w.logger.Info("Webhook processed successfully", "id", item.ID)
+		w.logger.Info("Webhook processed successfully", "id", item.ID, "coalesced", len(coalesced))
+	}
+}
+
+// coalescedPayloads returns the raw data of a webhook and the webhooks coalesced
+// into it ordered by queue ID, or nil if nothing was coalesced
+func coalescedPayloads(item *database.WebhookQueueItem, coalesced []*database.WebhookQueueItem) []json.RawMessage {
+	if len(coalesced) == 0 {
+		return nil
+	}
+
+	items := append([]*database.WebhookQueueItem{item}, coalesced...)
+	sort.Slice(items, func(i, j int) bool { return items[i].ID < items[j].ID })
+
+	payloads := make([]json.RawMessage, len(items))
+	for i, queued := range items {
+		payloads[i] = queued.Data
 	}
+	return payloads
 }
 
 // processSyncJob handles a single sync job
@@ -255,22 +328,31 @@ func (w *Worker) processSyncJob(job *database.SyncJob) {
 		"retry_count", job.RetryCount)
 
 	var err error
+	var listMore bool
 	switch job.JobType {
 	case "list_activities":
-		err = w.listActivities(job.AthleteID)
-	case "sync_activity":
+		listMore, err = w.listActivities(job.AthleteID, job.Priority)
+	case "sync_since":
+		listMore, err = w.syncSince(job.AthleteID, job.Priority)
+	case "reconcile_activities":
+		listMore, err = w.reconcileActivities(job.AthleteID, job.Priority)
+	case "sync_activity", "reconcile_activity":
 		if job.ActivityID == nil {
-			w.logger.Error("sync_activity job missing activity_id", "id", job.ID)
+			w.logger.Error("Activity sync job missing activity_id", "id", job.ID, "job_type", job.JobType)
 			// Invalid job - delete it
 			if err := w.db.DeleteSyncJob(job.ID); err != nil {
-				w.logger.Error("Failed to delete invalid sync_activity job", "id", job.ID, "error", err)
+				w.logger.Error("Failed to delete invalid activity sync job", "id", job.ID, "error", err)
 			}
 			duration := time.Since(start).Seconds()
 			metrics.QueueProcessingDuration.WithLabelValues(metrics.QueueTypeSyncJob, metrics.ResultSuccess).Observe(duration)
 			metrics.QueueDequeueTotal.WithLabelValues(metrics.QueueTypeSyncJob, metrics.ResultDropped).Inc()
 			return
 		}
-		err = w.syncActivity(job.AthleteID, *job.ActivityID)
+		eventType := database.EventTypeBackfill
+		if job.JobType == "reconcile_activity" {
+			eventType = database.EventTypeReconciledUpdate
+		}
+		err = w.syncActivity(job.AthleteID, *job.ActivityID, job.CreatedAt, eventType)
 	default:
 		w.logger.Warn("Unknown sync job type", "id", job.ID, "job_type", job.JobType)
 		// Unknown types are not retryable - complete them
@@ -283,6 +365,14 @@ func (w *Worker) processSyncJob(job *database.SyncJob) {
 		return
 	}
 
+	// Queue the next page behind the activities just listed. This job is only
+	// deleted once the next one is queued, so that listing can't stop early.
+	if err == nil && listMore {
+		if _, enqueueErr := w.db.EnqueueSyncJobWithPriority(job.AthleteID, job.JobType, nil, job.Priority); enqueueErr != nil {
+			err = fmt.Errorf("failed to enqueue next list job: %w", enqueueErr)
+		}
+	}
+
 	if err != nil {
 		w.logger.Error("Failed to process sync job", "id", job.ID, "error", err)
 		duration := time.Since(start).Seconds()
@@ -296,79 +386,293 @@ func (w *Worker) processSyncJob(job *database.SyncJob) {
 	// Success - delete sync job from queue
 	if err := w.db.DeleteSyncJob(job.ID); err != nil {
 		w.logger.Error("Failed to delete completed sync job", "id", job.ID, "error", err)
-	} else {
-		duration := time.Since(start).Seconds()
-		metrics.QueueProcessingDuration.WithLabelValues(metrics.QueueTypeSyncJob, metrics.ResultSuccess).Observe(duration)
-		metrics.QueueDequeueTotal.WithLabelValues(metrics.QueueTypeSyncJob, metrics.ResultSuccess).Inc()
-		w.logger.Info("Sync job processed successfully", "id", job.ID)
+		return
 	}
+
+	duration := time.Since(start).Seconds()
+	metrics.QueueProcessingDuration.WithLabelValues(metrics.QueueTypeSyncJob, metrics.ResultSuccess).Observe(duration)
+	metrics.QueueDequeueTotal.WithLabelValues(metrics.QueueTypeSyncJob, metrics.ResultSuccess).Inc()
+	w.logger.Info("Sync job processed successfully", "id", job.ID)
 }
 
-// listActivities lists all activities for an athlete and creates sync_activity jobs
-func (w *Worker) listActivities(athleteID int64) error {
-	w.logger.Info("Starting list_activities for athlete", "athlete_id", athleteID)
+// listActivities lists the next page of an athlete's activities, newest first,
+// and creates sync_activity jobs with the same priority as the list job
+// Activities whose summary fingerprint matches the stored state are skipped.
+// Listing stops at the athlete's backfill horizon. Returns true if there are
+// more activities to list, in which case another list job should be queued
+// so that the page's activities are fetched first.
+func (w *Worker) listActivities(athleteID int64, priority int) (bool, error) {
+	state, err := w.db.GetBackfillState(athleteID)
+	if err != nil {
+		return false, err
+	}
 
-	page := 1
-	perPage := 200
-	totalActivities := 0
+	maxAge, maxActivities, err := w.backfillHorizon(state)
+	if err != nil {
+		return false, err
+	}
 
-	for {
-		activityIDs, hasMore, err := w.stravaClient.ListActivities(athleteID, page, perPage)
+	if maxActivities > 0 && state.ListedCount >= maxActivities {
+		w.logger.Info("Backfill horizon reached", "athlete_id", athleteID, "listed", state.ListedCount)
+		return false, nil
+	}
+
+	w.logger.Info("Listing activities for athlete", "athlete_id", athleteID, "before", state.Cursor)
+
+	summaries, hasMore, err := w.stravaClient.ListActivitiesBefore(athleteID, listBefore(state.Cursor), w.listPageSize)
+	if err != nil {
+		// Check if it's a rate limit error
+		if strava.IsTooManyRequests(err) {
+			w.handle429Error("list_activities")
+			return false, fmt.Errorf("rate limited during list_activities: %w", err)
+		}
+		// Check if it's an auth error
+		if strava.IsUnauthorized(err) {
+			w.logger.Warn("Athlete unauthorized during list, skipping", "athlete_id", athleteID)
+			return false, nil // Don't retry unauthorized athletes
+		}
+		return false, fmt.Errorf("failed to list activities: %w", err)
+	}
+
+	// Drop activities beyond the horizon, leaving the cursor at the oldest
+	// activity kept so that extending the horizon continues from there.
+	// Activities relisted from the cursor's second were counted last page.
+	cursor := state.Cursor
+	var oldestAllowed time.Time
+	if maxAge > 0 {
+		oldestAllowed = time.Now().Add(-maxAge)
+	}
+	kept := summaries[:0]
+	listed := 0
+	for _, summary := range summaries {
+		if maxActivities > 0 && state.ListedCount+listed >= maxActivities {
+			hasMore = false
+			break
+		}
+
+		startTime, err := summary.StartTime()
 		if err != nil {
-			// Check if it's a rate limit error
-			if strava.IsTooManyRequests(err) {
-				w.handle429Error("list_activities")
-				return fmt.Errorf("rate limited during list_activities: %w", err)
-			}
-			// Check if it's an auth error
-			if strava.IsUnauthorized(err) {
-				w.logger.Warn("Athlete unauthorized during list, skipping", "athlete_id", athleteID)
-				return nil // Don't retry unauthorized athletes
-			}
-			return fmt.Errorf("failed to list activities (page %d): %w", page, err)
+			w.logger.Warn("Activity has invalid start_date", "athlete_id", athleteID, "activity_id", summary.ID, "start_date", summary.StartDate)
+			kept = append(kept, summary)
+			listed++
+			continue
+		}
+		if startTime.Before(oldestAllowed) {
+			hasMore = false
+			break
 		}
 
-		// Create sync job for each activity
-		for _, activityID := range activityIDs {
-			if _, err := w.db.EnqueueActivitySyncJob(athleteID, activityID); err != nil {
-				w.logger.Error("Failed to enqueue activity sync job",
-					"athlete_id", athleteID,
-					"activity_id", activityID,
-					"error", err)
-				// Continue with other activities
-			}
+		kept = append(kept, summary)
+		if state.Cursor == 0 || startTime.Unix() != state.Cursor {
+			listed++
 		}
+		cursor = startTime.Unix()
+	}
+
+	if hasMore && (cursor == state.Cursor || len(kept) == 0) {
+		w.logger.Warn("Unable to page past activities, stopping backfill", "athlete_id", athleteID, "before", state.Cursor)
+		hasMore = false
+	}
+
+	changed, err := w.processActivitySummaries(athleteID, kept, priority)
+	if err != nil {
+		return false, err
+	}
+
+	if err := w.db.AdvanceBackfill(athleteID, cursor, listed); err != nil {
+		return false, err
+	}
 
-		totalActivities += len(activityIDs)
-		w.logger.Info("Listed activities page and created sync jobs",
+	w.logger.Info("Listed activities page",
+		"athlete_id", athleteID,
+		"count", len(kept),
+		"changed", changed,
+		"total", state.ListedCount+listed,
+		"more", hasMore)
+
+	if !hasMore {
+		w.logger.Info("Completed list_activities for athlete",
 			"athlete_id", athleteID,
-			"page", page,
-			"count", len(activityIDs),
-			"total", totalActivities)
+			"total_activities", state.ListedCount+listed)
+
+		// Record business metrics
+		metrics.SyncJobsCompletedTotal.WithLabelValues("list_activities").Inc()
+		metrics.SyncAllActivitiesCount.Observe(float64(state.ListedCount + listed))
+	}
 
-		if !hasMore {
+	return hasMore, nil
+}
+
+// syncSince lists the next page of an athlete's activities, newest first, back
+// to the start of their gap sync, queueing new or changed activities like
+// backfill does. This recovers activities whose webhooks were lost during an
+// outage. Returns true if there are more activities to list.
+func (w *Worker) syncSince(athleteID int64, priority int) (bool, error) {
+	state, err := w.db.GetGapSyncState(athleteID)
+	if err != nil {
+		return false, err
+	}
+	if state == nil {
+		w.logger.Info("No gap sync in progress for athlete", "athlete_id", athleteID)
+		return false, nil
+	}
+
+	w.logger.Info("Listing activities for gap sync",
+		"athlete_id", athleteID,
+		"since", state.Since,
+		"before", state.Cursor)
+
+	summaries, hasMore, err := w.stravaClient.ListActivitiesBefore(athleteID, listBefore(state.Cursor), w.listPageSize)
+	if err != nil {
+		if strava.IsTooManyRequests(err) {
+			w.handle429Error("sync_since")
+			return false, fmt.Errorf("rate limited during sync_since: %w", err)
+		}
+		if strava.IsUnauthorized(err) {
+			w.logger.Warn("Athlete unauthorized during gap sync, skipping", "athlete_id", athleteID)
+			return false, w.db.FinishGapSync(athleteID)
+		}
+		return false, fmt.Errorf("failed to list activities: %w", err)
+	}
+
+	cursor := state.Cursor
+	kept := summaries[:0]
+	for _, summary := range summaries {
+		startTime, err := summary.StartTime()
+		if err != nil {
+			w.logger.Warn("Activity has invalid start_date", "athlete_id", athleteID, "activity_id", summary.ID, "start_date", summary.StartDate)
+			kept = append(kept, summary)
+			continue
+		}
+		if startTime.Unix() < state.Since {
+			hasMore = false
 			break
 		}
 
-		page++
+		kept = append(kept, summary)
+		cursor = startTime.Unix()
+	}
+
+	if hasMore && (cursor == state.Cursor || len(kept) == 0) {
+		w.logger.Warn("Unable to page past activities, stopping gap sync", "athlete_id", athleteID, "before", state.Cursor)
+		hasMore = false
+	}
 
-		// Small delay between pages to be respectful of rate limits
-		time.Sleep(100 * time.Millisecond)
+	changed, err := w.processActivitySummaries(athleteID, kept, priority)
+	if err != nil {
+		return false, err
 	}
 
-	w.logger.Info("Completed list_activities for athlete",
+	w.logger.Info("Listed gap sync page",
 		"athlete_id", athleteID,
-		"total_activities", totalActivities)
+		"count", len(kept),
+		"changed", changed,
+		"more", hasMore)
+
+	if hasMore {
+		return true, w.db.AdvanceGapSync(athleteID, cursor)
+	}
 
-	// Record business metrics
-	metrics.SyncJobsCompletedTotal.WithLabelValues("list_activities").Inc()
-	metrics.SyncAllActivitiesCount.Observe(float64(totalActivities))
+	metrics.SyncJobsCompletedTotal.WithLabelValues("sync_since").Inc()
+	return false, w.db.FinishGapSync(athleteID)
+}
 
-	return nil
+// listBefore returns the before parameter for listing the page of activities
+// after cursor, the start time of the oldest activity already listed, or 0 for
+// the newest activities. Strava's before is exclusive, so activities which
+// started in the same second as the cursor are listed again in case the last
+// page ended partway through them. Their fingerprints are unchanged, so those
+// already listed aren't synced twice.
+func listBefore(cursor int64) int64 {
+	if cursor == 0 {
+		return 0
+	}
+	return cursor + 1
+}
+
+// backfillHorizon returns how far back an athlete's activities are backfilled,
+// from the athlete's overrides or else their client's configuration. 0 = unlimited.
+func (w *Worker) backfillHorizon(state *database.BackfillState) (time.Duration, int, error) {
+	maxAgeDays, maxActivities := 0, 0
+
+	athlete, err := w.db.GetAthlete(state.AthleteID)
+	if err != nil {
+		return 0, 0, err
+	}
+	if athlete != nil {
+		if client, err := w.config.GetClient(athlete.ClientID); err == nil {
+			maxAgeDays = client.BackfillMaxAgeDays
+			maxActivities = client.BackfillMaxActivities
+		}
+	}
+
+	if state.MaxAgeDays != nil {
+		maxAgeDays = *state.MaxAgeDays
+	}
+	if state.MaxActivities != nil {
+		maxActivities = *state.MaxActivities
+	}
+
+	return time.Duration(maxAgeDays) * 24 * time.Hour, maxActivities, nil
+}
+
+// processActivitySummaries compares a page of listed activities against the stored
+// activity state. New or changed activities either get a sync_activity job or, in
+// summary-only mode, a backfill event built from the summary.
+// Returns the number of new or changed activities.
+func (w *Worker) processActivitySummaries(athleteID int64, summaries []*strava.ActivitySummary, priority int) (int, error) {
+	activityIDs := make([]int64, len(summaries))
+	for i, summary := range summaries {
+		activityIDs[i] = summary.ID
+	}
+
+	known, err := w.db.GetActivityFingerprints(athleteID, activityIDs)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get activity fingerprints: %w", err)
+	}
+
+	changed := 0
+	for _, summary := range summaries {
+		fingerprint := summary.Fingerprint()
+		if known[summary.ID] == fingerprint {
+			metrics.BackfillActivitiesTotal.WithLabelValues(metrics.BackfillOutcomeUnchanged).Inc()
+			continue
+		}
+		changed++
+
+		if w.config.BackfillSummaryOnly {
+			eventID, err := w.db.InsertBackfillEvent(athleteID, summary.ID, summary.Raw)
+			if err != nil {
+				return changed, fmt.Errorf("failed to insert summary backfill event: %w", err)
+			}
+			if err := w.db.RecordActivityState(athleteID, summary.ID, fingerprint, summaryStartDate(summary), database.ActivitySourceBackfill); err != nil {
+				w.logger.Error("Failed to record activity state", "activity_id", summary.ID, "error", err)
+			}
+			w.logger.Debug("Created summary backfill event",
+				"athlete_id", athleteID,
+				"activity_id", summary.ID,
+				"event_id", eventID)
+			metrics.BackfillActivitiesTotal.WithLabelValues(metrics.BackfillOutcomeSummaryOnly).Inc()
+			continue
+		}
+
+		if _, err := w.db.EnqueueSyncJobWithPriority(athleteID, "sync_activity", &summary.ID, priority); err != nil {
+			w.logger.Error("Failed to enqueue activity sync job",
+				"athlete_id", athleteID,
+				"activity_id", summary.ID,
+				"error", err)
+			// Continue with other activities
+			continue
+		}
+		metrics.BackfillActivitiesTotal.WithLabelValues(metrics.BackfillOutcomeEnqueued).Inc()
+	}
+
+	return changed, nil
 }
 
 // handleActivity processes an activity webhook (create, update, delete)
-func (w *Worker) handleActivity(webhook map[string]interface{}) error {
+// coalesced holds the raw data of every update webhook merged into this one (nil if none)
+func (w *Worker) handleActivity(webhook map[string]interface{}, coalesced []json.RawMessage) error {
 	ownerID, ok := webhook["owner_id"].(float64)
 	if !ok {
 		return fmt.Errorf("invalid owner_id in activity webhook")
@@ -382,6 +686,7 @@ func (w *Worker) handleActivity(webhook map[string]interface{}) error {
 	activityID := int64(objectID)
 
 	aspectType, _ := webhook["aspect_type"].(string)
+	eventTime := latestEventTime(webhook, coalesced)
 
 	// Marshal webhook back to JSON for storage
 	webhookData, err := json.Marshal(webhook)
@@ -396,7 +701,25 @@ func (w *Worker) handleActivity(webhook map[string]interface{}) error {
 
 	switch aspectType {
 	case "create", "update":
-		return w.processWebhookActivity(athleteID, activityID, aspectType, webhookData)
+		reason, err := w.activityWebhookSkipReason(activityID, eventTime)
+		if err != nil {
+			return err
+		}
+		if reason != "" {
+			w.logger.Info("Skipping activity webhook which doesn't reflect final state",
+				"athlete_id", athleteID,
+				"activity_id", activityID,
+				"aspect_type", aspectType,
+				"reason", reason)
+			metrics.WebhookActivitySkippedTotal.WithLabelValues(reason).Inc()
+			return nil
+		}
+
+		if err := w.processWebhookActivity(athleteID, activityID, aspectType, webhookData, coalesced); err != nil {
+			return err
+		}
+		w.recordActivityEventTime(activityID, eventTime)
+		return nil
 
 	case "delete":
 		// Insert a delete event (no activity data for deletes)
@@ -408,6 +731,10 @@ func (w *Worker) handleActivity(webhook map[string]interface{}) error {
 			"athlete_id", athleteID,
 			"activity_id", activityID,
 			"event_id", eventID)
+		if err := w.db.MarkActivityDeleted(athleteID, activityID, database.ActivitySourceWebhook); err != nil {
+			w.logger.Error("Failed to mark activity deleted", "activity_id", activityID, "error", err)
+		}
+		w.recordActivityEventTime(activityID, eventTime)
 		return nil
 
 	default:
@@ -418,6 +745,61 @@ func (w *Worker) handleActivity(webhook map[string]interface{}) error {
 	}
 }
 
+// activityWebhookSkipReason checks whether hydrating a create or update webhook would
+// emit an event which doesn't reflect the activity's final state. Returns the reason
+// to skip it, or "" if it should be processed.
+func (w *Worker) activityWebhookSkipReason(activityID, eventTime int64) (string, error) {
+	state, err := w.db.GetActivityState(activityID)
+	if err != nil {
+		return "", fmt.Errorf("failed to get activity state: %w", err)
+	}
+	if state != nil {
+		// Deletion is final, so a create or update processed late must not revive the activity
+		if state.Deleted {
+			return metrics.SkipReasonDeleted, nil
+		}
+		// A newer webhook has already fetched the activity
+		if eventTime < state.LastEventTime {
+			return metrics.SkipReasonStale, nil
+		}
+	}
+
+	// The activity is about to be deleted, so don't spend budget fetching it
+	pendingDelete, err := w.db.HasPendingActivityDelete(activityID)
+	if err != nil {
+		return "", fmt.Errorf("failed to check for pending delete: %w", err)
+	}
+	if pendingDelete {
+		return metrics.SkipReasonPendingDelete, nil
+	}
+
+	return "", nil
+}
+
+// recordActivityEventTime records the event_time of an applied webhook (logs errors)
+func (w *Worker) recordActivityEventTime(activityID, eventTime int64) {
+	if err := w.db.RecordActivityEventTime(activityID, eventTime); err != nil {
+		w.logger.Error("Failed to record activity event time", "activity_id", activityID, "error", err)
+	}
+}
+
+// latestEventTime returns the latest event_time of a webhook and any coalesced into it
+func latestEventTime(webhook map[string]interface{}, coalesced []json.RawMessage) int64 {
+	eventTime, _ := webhook["event_time"].(float64)
+	latest := int64(eventTime)
+
+	for _, data := range coalesced {
+		var payload struct {
+			EventTime int64 `json:"event_time"`
+		}
+		if err := json.Unmarshal(data, &payload); err == nil && payload.EventTime > latest {
+			latest = payload.EventTime
+		}
+	}
+
+	return latest
+}
+
 // handleAthlete processes an athlete webhook (deauthorization)
 func (w *Worker) handleAthlete(webhook map[string]interface{}) error {
 	ownerID, ok := webhook["owner_id"].(float64)
@@ -449,6 +831,17 @@ func (w *Worker) handleAthlete(webhook map[string]interface{}) error {
 		return nil
 	}
 
+	// Strava sends this webhook after we deauthorize an athlete, by which
+	// time they've already been disconnected
+	disconnected, err := w.db.IsAthleteDisconnected(athleteID)
+	if err != nil {
+		return err
+	}
+	if disconnected {
+		w.logger.Info("Ignoring deauthorization of disconnected athlete", "athlete_id", athleteID)
+		return nil
+	}
+
 	w.logger.Info("Processing athlete deauthorization",
 		"athlete_id", athleteID)
 
@@ -458,40 +851,58 @@ func (w *Worker) handleAthlete(webhook map[string]interface{}) error {
 		return fmt.Errorf("failed to marshal webhook data: %w", err)
 	}
 
-	// Insert deauthorization event
-	eventID, err := w.db.InsertActivityEvent(athleteID, nil, nil, webhookData)
+	// Replace the athlete's events with the deauthorization event and delete
+	// their tokens, which are no longer valid
+	eventID, err := w.db.DisconnectAthlete(athleteID, webhookData)
 	if err != nil {
-		return fmt.Errorf("failed to insert deauthorization event: %w", err)
+		return fmt.Errorf("failed to disconnect athlete: %w", err)
 	}
 
-	w.logger.Info("Inserted deauthorization event",
+	w.logger.Info("Disconnected deauthorized athlete",
 		"athlete_id", athleteID,
 		"event_id", eventID)
 
-	// Delete all athlete's events except the deauthorization event
-	if err := w.db.DeleteAthleteEvents(athleteID, eventID); err != nil {
-		return fmt.Errorf("failed to delete athlete events: %w", err)
-	}
-
-	w.logger.Info("Deleted athlete events",
-		"athlete_id", athleteID,
-		"except_event_id", eventID)
-
 	// Record business metric
 	metrics.WebhookEventsProcessedTotal.WithLabelValues("athlete", "deauthorization").Inc()
 
 	return nil
 }
 
+// handleActivityNotFound logs an activity Strava returned 404 for. Athletes
+// who didn't grant activity:read_all get 404s for their private activities,
+// which still exist, so these are distinguished from genuine deletions. Neither
+// changes the event stream: deletions arrive as delete webhooks or are found by
+// reconciliation, and hidden activities are fetched if they're made visible.
+func (w *Worker) handleActivityNotFound(athleteID, activityID int64) {
+	athlete, err := w.db.GetAthlete(athleteID)
+	if err != nil {
+		w.logger.Error("Failed to get athlete", "athlete_id", athleteID, "error", err)
+	}
+
+	if athlete != nil && !athlete.HasScope(strava.ScopeActivityReadAll) {
+		w.logger.Info("Activity not visible with granted scopes, skipping",
+			"athlete_id", athleteID,
+			"activity_id", activityID,
+			"scopes", athlete.Scopes)
+		metrics.ActivitiesNotFoundTotal.WithLabelValues(metrics.NotFoundReasonScopeDenied).Inc()
+		return
+	}
+
+	w.logger.Warn("Activity not found, skipping", "athlete_id", athleteID, "activity_id", activityID)
+	metrics.ActivitiesNotFoundTotal.WithLabelValues(metrics.NotFoundReasonDeleted).Inc()
+}
+
 // processWebhookActivity fetches activity details from Strava and inserts a webhook event
 // This is for real Strava webhook events (create/update) with webhook data
-func (w *Worker) processWebhookActivity(athleteID, activityID int64, aspectType string, webhookData json.RawMessage) error {
+// When several updates were coalesced the event records the latest as its webhook data
+// and every raw payload in coalesced
+func (w *Worker) processWebhookActivity(athleteID, activityID int64, aspectType string, webhookData json.RawMessage, coalesced []json.RawMessage) error {
 	// Fetch activity details
 	activityData, err := w.stravaClient.GetActivity(athleteID, activityID)
 	if err != nil {
 		// Check for specific error types
 		if strava.IsNotFound(err) {
-			w.logger.Warn("Activity not found, skipping", "activity_id", activityID)
+			w.handleActivityNotFound(athleteID, activityID)
 			return nil // Don't retry 404s
 		}
 		if strava.IsUnauthorized(err) {
@@ -505,17 +916,23 @@ func (w *Worker) processWebhookActivity(athleteID, activityID int64, aspectType
 		return fmt.Errorf("failed to get activity: %w", err)
 	}
 
+	if len(coalesced) > 0 {
+		webhookData = coalesced[len(coalesced)-1]
+	}
+
 	// Insert event with webhook data
-	eventID, err := w.db.InsertActivityEvent(athleteID, &activityID, activityData, webhookData)
+	eventID, err := w.db.InsertCoalescedActivityEvent(athleteID, &activityID, activityData, webhookData, coalesced)
 	if err != nil {
 		return fmt.Errorf("failed to insert activity event: %w", err)
 	}
+	w.recordActivityState(athleteID, activityID, activityData, database.ActivitySourceWebhook)
 
 	w.logger.Info("Processed webhook activity",
 		"athlete_id", athleteID,
 		"activity_id", activityID,
 		"aspect_type", aspectType,
-		"event_id", eventID)
+		"event_id", eventID,
+		"coalesced", len(coalesced))
 
 	// Record business metric
 	metrics.WebhookEventsProcessedTotal.WithLabelValues("activity", aspectType).Inc()
@@ -523,15 +940,29 @@ func (w *Worker) processWebhookActivity(athleteID, activityID int64, aspectType
 	return nil
 }
 
-// syncActivity fetches activity details from Strava during sync operations
-// This does NOT create events - sync operations don't generate event stream entries
-func (w *Worker) syncActivity(athleteID, activityID int64) error {
+// syncActivity fetches activity details from Strava during sync operations and inserts a backfill
+// event, or a reconciled_update event for activities found changed by reconciliation
+// The fetch is skipped if a webhook has already recorded (or is about to record) a newer version
+// of the activity than the one listed when the job was queued
+func (w *Worker) syncActivity(athleteID, activityID int64, queuedAt time.Time, eventType database.EventType) error {
+	superseded, err := w.isSupersededByWebhook(activityID, queuedAt)
+	if err != nil {
+		return err
+	}
+	if superseded {
+		w.logger.Debug("Activity superseded by webhook, skipping sync",
+			"athlete_id", athleteID,
+			"activity_id", activityID)
+		metrics.BackfillActivitiesTotal.WithLabelValues(metrics.BackfillOutcomeSuperseded).Inc()
+		return nil
+	}
+
 	// Fetch activity details
 	activityData, err := w.stravaClient.GetActivity(athleteID, activityID)
 	if err != nil {
 		// Check for specific error types
 		if strava.IsNotFound(err) {
-			w.logger.Warn("Activity not found during sync, skipping", "activity_id", activityID)
+			w.handleActivityNotFound(athleteID, activityID)
 			return nil // Don't retry 404s
 		}
 		if strava.IsUnauthorized(err) {
@@ -545,11 +976,26 @@ func (w *Worker) syncActivity(athleteID, activityID int64) error {
 		return fmt.Errorf("failed to get activity: %w", err)
 	}
 
+	if eventType == database.EventTypeReconciledUpdate {
+		eventID, err := w.db.InsertReconciledEvent(eventType, athleteID, activityID, activityData)
+		if err != nil {
+			return err
+		}
+		w.recordActivityState(athleteID, activityID, activityData, database.ActivitySourceReconcile)
+
+		w.logger.Info("Created reconciled_update event",
+			"athlete_id", athleteID,
+			"activity_id", activityID,
+			"event_id", eventID)
+		return nil
+	}
+
 	// Insert backfill event
 	eventID, err := w.db.InsertBackfillEvent(athleteID, activityID, activityData)
 	if err != nil {
 		return fmt.Errorf("failed to insert backfill event: %w", err)
 	}
+	w.recordActivityState(athleteID, activityID, activityData, database.ActivitySourceBackfill)
 
 	w.logger.Debug("Synced activity and created backfill event",
 		"athlete_id", athleteID,
@@ -560,6 +1006,46 @@ func (w *Worker) syncActivity(athleteID, activityID int64) error {
 	return nil
 }
 
+// isSupersededByWebhook returns true if a webhook-derived version of the activity has been
+// recorded since queuedAt, or a webhook for the activity is waiting to be processed
+func (w *Worker) isSupersededByWebhook(activityID int64, queuedAt time.Time) (bool, error) {
+	state, err := w.db.GetActivityState(activityID)
+	if err != nil {
+		return false, fmt.Errorf("failed to get activity state: %w", err)
+	}
+	if state != nil && state.Source == database.ActivitySourceWebhook && !state.UpdatedAt.Before(queuedAt) {
+		return true, nil
+	}
+
+	pending, err := w.db.HasPendingActivityWebhook(activityID)
+	if err != nil {
+		return false, fmt.Errorf("failed to check pending webhooks: %w", err)
+	}
+	return pending, nil
+}
+
+// recordActivityState stores the fingerprint of activity data just written to the event stream
+// Failures are logged rather than returned as the event has already been written
+func (w *Worker) recordActivityState(athleteID, activityID int64, activityData json.RawMessage, source string) {
+	summary, err := strava.DecodeActivitySummary(activityData)
+	if err != nil {
+		w.logger.Error("Failed to fingerprint activity", "activity_id", activityID, "error", err)
+		return
+	}
+	if err := w.db.RecordActivityState(athleteID, activityID, summary.Fingerprint(), summaryStartDate(summary), source); err != nil {
+		w.logger.Error("Failed to record activity state", "activity_id", activityID, "error", err)
+	}
+}
+
+// summaryStartDate returns the Unix time an activity started, 0 if unknown
+func summaryStartDate(summary *strava.ActivitySummary) int64 {
+	startTime, err := summary.StartTime()
+	if err != nil {
+		return 0
+	}
+	return startTime.Unix()
+}
+
 // releaseWebhook releases a webhook back to the queue with exponential backoff
 func (w *Worker) releaseWebhook(webhookID int64, currentRetryCount int, errorMsg string) {
 	shouldRetry, err := w.db.ReleaseWebhook(webhookID, currentRetryCount, errorMsg)
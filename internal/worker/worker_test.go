@@ -7,6 +7,8 @@ import (
 	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"slices"
+	"strconv"
 	"strings"
 	"testing"
 	"time"
@@ -157,7 +159,7 @@ func TestHandleActivity_Delete(t *testing.T) {
 		"event_time":  time.Now().Unix(),
 	}
 
-	err := worker.handleActivity(webhook)
+	err := worker.handleActivity(webhook, nil)
 	if err != nil {
 		t.Fatalf("Failed to handle delete webhook: %v", err)
 	}
@@ -196,7 +198,7 @@ func TestHandleActivity_InvalidOwnerID(t *testing.T) {
 		"aspect_type": "create",
 	}
 
-	err := worker.handleActivity(webhook)
+	err := worker.handleActivity(webhook, nil)
 	if err == nil {
 		t.Error("Expected error for invalid owner_id")
 	}
@@ -213,7 +215,7 @@ func TestHandleActivity_InvalidObjectID(t *testing.T) {
 		"aspect_type": "create",
 	}
 
-	err := worker.handleActivity(webhook)
+	err := worker.handleActivity(webhook, nil)
 	if err == nil {
 		t.Error("Expected error for invalid object_id")
 	}
@@ -231,7 +233,7 @@ func TestHandleActivity_UnknownAspectType(t *testing.T) {
 	}
 
 	// Should not return error for unknown aspect types (just skip)
-	err := worker.handleActivity(webhook)
+	err := worker.handleActivity(webhook, nil)
 	if err != nil {
 		t.Errorf("Expected no error for unknown aspect type, got: %v", err)
 	}
@@ -252,7 +254,7 @@ func TestSyncAllActivities_InvalidAthleteID(t *testing.T) {
 	defer db.Close()
 
 	// Test with non-existent athlete (should fail with unauthorized)
-	err := worker.listActivities(99999)
+	_, err := worker.listActivities(99999, database.PriorityDefault)
 	// Should not error, just logs and skips
 	if err != nil {
 		t.Logf("Got expected error for non-existent athlete: %v", err)
@@ -346,7 +348,7 @@ func TestProcessWebhookActivity_Integration(t *testing.T) {
 	webhookData := json.RawMessage(`{"aspect_type":"create","object_type":"activity","object_id":67890,"owner_id":12345}`)
 
 	// Test processing webhook activity
-	err = worker.processWebhookActivity(athleteID, activityID, "create", webhookData)
+	err = worker.processWebhookActivity(athleteID, activityID, "create", webhookData, nil)
 	if err != nil {
 		t.Fatalf("Failed to process webhook activity: %v", err)
 	}
@@ -470,7 +472,7 @@ func TestSyncAllActivities_Integration(t *testing.T) {
 	worker.stravaClient.SetBaseURL(apiServer.URL)
 
 	// Test listActivities
-	err = worker.listActivities(athleteID)
+	_, err = worker.listActivities(athleteID, database.PriorityDefault)
 	if err != nil {
 		t.Fatalf("Failed to list activities: %v", err)
 	}
@@ -507,7 +509,7 @@ func TestHandleAthlete_Deauthorization(t *testing.T) {
 	athleteID := int64(12345)
 
 	// Insert some existing events for the athlete
-	eventID1, err := db.InsertAthleteConnectedEvent(athleteID, json.RawMessage(`{"id": 12345}`))
+	eventID1, err := db.InsertAthleteConnectedEvent(athleteID, json.RawMessage(`{"id": 12345}`), nil, "")
 	if err != nil {
 		t.Fatalf("Failed to insert athlete_connected event: %v", err)
 	}
@@ -580,6 +582,119 @@ func TestHandleAthlete_Deauthorization(t *testing.T) {
 	t.Logf("Deauthorization event ID: %d (old events %d, %d were deleted)", events[0].EventID, eventID1, eventID2)
 }
 
+func TestHandleAthlete_DeauthorizationIsIdempotent(t *testing.T) {
+	worker, db := setupWorkerTest(t)
+	defer db.Close()
+
+	athleteID := int64(12345)
+	insertTestAthlete(t, db, athleteID)
+
+	webhook := map[string]interface{}{
+		"object_type": "athlete",
+		"object_id":   float64(athleteID),
+		"owner_id":    float64(athleteID),
+		"aspect_type": "update",
+		"updates": map[string]interface{}{
+			"authorized": "false",
+		},
+		"event_time": 1516126040,
+	}
+
+	if err := worker.handleAthlete(webhook); err != nil {
+		t.Fatalf("Failed to handle deauthorization: %v", err)
+	}
+
+	// The athlete's tokens are deleted
+	if athlete, _ := db.GetAthlete(athleteID); athlete != nil {
+		t.Error("Expected athlete to be deleted after deauthorization")
+	}
+
+	events, err := db.ListEvents(athleteID, 0, 100)
+	if err != nil {
+		t.Fatalf("Failed to list events: %v", err)
+	}
+	if len(events) != 1 {
+		t.Fatalf("Expected 1 deauthorization event, got %d", len(events))
+	}
+	firstEventID := events[0].EventID
+
+	// Strava's follow-up webhook (e.g. after we deauthorized the athlete) changes nothing
+	if err := worker.handleAthlete(webhook); err != nil {
+		t.Fatalf("Failed to handle repeated deauthorization: %v", err)
+	}
+
+	events, err = db.ListEvents(athleteID, 0, 100)
+	if err != nil {
+		t.Fatalf("Failed to list events: %v", err)
+	}
+	if len(events) != 1 || events[0].EventID != firstEventID {
+		t.Errorf("Expected only the original deauthorization event %d, got %d events", firstEventID, len(events))
+	}
+}
+
+func TestHandleAthlete_ReconnectAfterDeauthorizationBackfillsHistory(t *testing.T) {
+	worker, db := setupWorkerTest(t)
+	defer db.Close()
+
+	athleteID := int64(12345)
+	insertTestAthlete(t, db, athleteID)
+
+	now := time.Now().Truncate(time.Second)
+	activities := []backfillActivity{
+		{1, now.Add(-1 * time.Hour)},
+		{2, now.Add(-2 * time.Hour)},
+	}
+
+	var befores []string
+	apiServer := newBackfillServer(t, activities, &befores)
+	defer apiServer.Close()
+	worker.stravaClient.SetBaseURL(apiServer.URL)
+
+	if _, err := db.StartBackfill(athleteID, database.PriorityDefault); err != nil {
+		t.Fatalf("Failed to start backfill: %v", err)
+	}
+	if synced := processQueuedSyncJobs(t, worker, db); !slices.Equal(synced, []int64{1, 2}) {
+		t.Fatalf("Expected activities 1, 2 to be synced, got %v", synced)
+	}
+
+	webhook := map[string]interface{}{
+		"object_type": "athlete",
+		"object_id":   float64(athleteID),
+		"owner_id":    float64(athleteID),
+		"aspect_type": "update",
+		"updates": map[string]interface{}{
+			"authorized": "false",
+		},
+		"event_time": 1516126040,
+	}
+	if err := worker.handleAthlete(webhook); err != nil {
+		t.Fatalf("Failed to handle deauthorization: %v", err)
+	}
+
+	// The athlete reconnects, and their whole history is emitted again
+	insertTestAthlete(t, db, athleteID)
+	if _, err := db.StartBackfill(athleteID, database.PriorityDefault); err != nil {
+		t.Fatalf("Failed to start backfill: %v", err)
+	}
+	if synced := processQueuedSyncJobs(t, worker, db); !slices.Equal(synced, []int64{1, 2}) {
+		t.Errorf("Expected activities 1, 2 to be synced after reconnecting, got %v", synced)
+	}
+
+	events, err := db.ListEvents(athleteID, 0, 100)
+	if err != nil {
+		t.Fatalf("Failed to list events: %v", err)
+	}
+	var activityEvents int
+	for _, event := range events {
+		if event.ActivityID != nil {
+			activityEvents++
+		}
+	}
+	if activityEvents != 2 {
+		t.Errorf("Expected 2 activity events after reconnecting, got %d", activityEvents)
+	}
+}
+
 func TestHandleAthlete_NonDeauthorization(t *testing.T) {
 	worker, db := setupWorkerTest(t)
 	defer db.Close()
@@ -614,3 +729,828 @@ func TestHandleAthlete_NonDeauthorization(t *testing.T) {
 		t.Errorf("Expected 0 events for non-deauthorization, got %d", len(events))
 	}
 }
+
+func TestProcessWebhook_IgnoresClientAthleteLeft(t *testing.T) {
+	worker, db := setupWorkerTest(t)
+	defer db.Close()
+
+	// The athlete reconnected from primary to secondary but still has primary authorized
+	athleteID := int64(12345)
+	insertTestAthlete(t, db, athleteID)
+	athlete, err := db.GetAthlete(athleteID)
+	if err != nil {
+		t.Fatalf("Failed to get athlete: %v", err)
+	}
+	athlete.ClientID = "secondary"
+	if err := db.UpsertAthlete(athlete); err != nil {
+		t.Fatalf("Failed to set athlete client: %v", err)
+	}
+	reconnection := &database.Reconnection{PreviousClientID: "primary", ClientID: "secondary"}
+	if _, err := db.InsertAthleteReconnectedEvent(athleteID, json.RawMessage(`{"id": 12345}`), reconnection, ""); err != nil {
+		t.Fatalf("Failed to insert reconnected event: %v", err)
+	}
+
+	// Revoking the old client doesn't disconnect the athlete
+	deauth := fmt.Sprintf(`{"object_type": "athlete", "object_id": %d, "owner_id": %d, "aspect_type": "update", "updates": {"authorized": "false"}, "event_time": 1516126040}`, athleteID, athleteID)
+	if _, _, err := db.EnqueueWebhookDelivery("delivery-deauth", "primary", json.RawMessage(deauth), time.Hour, 0); err != nil {
+		t.Fatalf("Failed to enqueue webhook: %v", err)
+	}
+	processQueuedWebhooks(t, worker, db)
+
+	if athlete, _ := db.GetAthlete(athleteID); athlete == nil {
+		t.Fatal("Expected athlete to stay connected when the client they left is revoked")
+	}
+	if length, _ := db.GetQueueLength(); length != 0 {
+		t.Errorf("Expected ignored webhook to be removed from the queue, got %d", length)
+	}
+
+	// The current client's webhooks are still processed
+	if _, _, err := db.EnqueueWebhookDelivery("delivery-deauth-current", "secondary", json.RawMessage(deauth), time.Hour, 0); err != nil {
+		t.Fatalf("Failed to enqueue webhook: %v", err)
+	}
+	processQueuedWebhooks(t, worker, db)
+
+	if athlete, _ := db.GetAthlete(athleteID); athlete != nil {
+		t.Error("Expected athlete to be disconnected when their current client is revoked")
+	}
+}
+
+// insertTestAthlete inserts an athlete with a valid access token
+func insertTestAthlete(t *testing.T, db *database.DB, athleteID int64) {
+	t.Helper()
+
+	athlete := &database.Athlete{
+		AthleteID:      athleteID,
+		ClientID:       "primary",
+		AccessToken:    "valid_token",
+		RefreshToken:   "refresh_token",
+		TokenExpiresAt: time.Now().Add(1 * time.Hour),
+		AthleteSummary: json.RawMessage(fmt.Sprintf(`{"id": %d}`, athleteID)),
+		CreatedAt:      time.Now(),
+		UpdatedAt:      time.Now(),
+	}
+	if err := db.UpsertAthlete(athlete); err != nil {
+		t.Fatalf("Failed to insert athlete: %v", err)
+	}
+}
+
+// newActivityListServer serves a single page of activity summaries and counts detail requests
+func newActivityListServer(t *testing.T, summaries string, detailRequests *int) *httptest.Server {
+	t.Helper()
+
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if strings.Contains(r.URL.Path, "/athlete/activities") {
+			w.Write([]byte(summaries))
+			return
+		}
+		*detailRequests++
+		http.Error(w, "Not found", http.StatusNotFound)
+	}))
+}
+
+func TestListActivities_SkipsUnchangedActivities(t *testing.T) {
+	worker, db := setupWorkerTest(t)
+	defer db.Close()
+
+	athleteID := int64(12345)
+	insertTestAthlete(t, db, athleteID)
+
+	unchanged := `{"id": 1001, "name": "Morning Run", "distance": 5000, "moving_time": 1500}`
+	renamed := `{"id": 1002, "name": "Renamed Ride", "distance": 20000, "moving_time": 3600}`
+	added := `{"id": 1003, "name": "New Swim", "distance": 1000, "moving_time": 1200}`
+
+	// Record the state we previously wrote for 1001 and 1002
+	unchangedFingerprint, _ := strava.FingerprintActivity(json.RawMessage(unchanged))
+	if err := db.RecordActivityState(athleteID, 1001, unchangedFingerprint, 0, database.ActivitySourceBackfill); err != nil {
+		t.Fatalf("Failed to record activity state: %v", err)
+	}
+	oldFingerprint, _ := strava.FingerprintActivity(json.RawMessage(`{"id": 1002, "name": "Ride", "distance": 20000, "moving_time": 3600}`))
+	if err := db.RecordActivityState(athleteID, 1002, oldFingerprint, 0, database.ActivitySourceWebhook); err != nil {
+		t.Fatalf("Failed to record activity state: %v", err)
+	}
+
+	detailRequests := 0
+	apiServer := newActivityListServer(t, "["+unchanged+","+renamed+","+added+"]", &detailRequests)
+	defer apiServer.Close()
+	worker.stravaClient.SetBaseURL(apiServer.URL)
+
+	if _, err := worker.listActivities(athleteID, database.PriorityDefault); err != nil {
+		t.Fatalf("Failed to list activities: %v", err)
+	}
+
+	// Only the renamed and new activities need detail fetches
+	readyJobs, err := db.GetReadySyncJobQueueLength()
+	if err != nil {
+		t.Fatalf("Failed to get sync job queue length: %v", err)
+	}
+	if readyJobs != 2 {
+		t.Errorf("Expected 2 sync jobs (changed + new), got %d", readyJobs)
+	}
+
+	for i := 0; i < readyJobs; i++ {
+		job, err := db.ClaimSyncJob()
+		if err != nil {
+			t.Fatalf("Failed to claim sync job: %v", err)
+		}
+		if job.ActivityID == nil || *job.ActivityID == 1001 {
+			t.Errorf("Unexpected sync job for activity %v", job.ActivityID)
+		}
+	}
+
+	if detailRequests != 0 {
+		t.Errorf("Expected no detail requests from listActivities, got %d", detailRequests)
+	}
+}
+
+func TestListActivities_SummaryOnly(t *testing.T) {
+	worker, db := setupWorkerTest(t)
+	defer db.Close()
+	worker.config.BackfillSummaryOnly = true
+
+	athleteID := int64(12345)
+	insertTestAthlete(t, db, athleteID)
+
+	detailRequests := 0
+	apiServer := newActivityListServer(t, `[{"id": 1001, "resource_state": 2, "name": "Morning Run"}]`, &detailRequests)
+	defer apiServer.Close()
+	worker.stravaClient.SetBaseURL(apiServer.URL)
+
+	if _, err := worker.listActivities(athleteID, database.PriorityDefault); err != nil {
+		t.Fatalf("Failed to list activities: %v", err)
+	}
+
+	// No detail jobs should be queued
+	length, err := db.GetSyncJobQueueLength()
+	if err != nil {
+		t.Fatalf("Failed to get sync job queue length: %v", err)
+	}
+	if length != 0 {
+		t.Errorf("Expected no sync jobs in summary-only mode, got %d", length)
+	}
+
+	// A backfill event should be emitted from the summary
+	events, err := db.ListEvents(athleteID, 0, 10)
+	if err != nil {
+		t.Fatalf("Failed to list events: %v", err)
+	}
+	if len(events) != 1 {
+		t.Fatalf("Expected 1 backfill event, got %d", len(events))
+	}
+	if events[0].EventType != database.EventTypeBackfill {
+		t.Errorf("Expected event type 'backfill', got '%s'", events[0].EventType)
+	}
+
+	// Listing again should not emit a duplicate event
+	if _, err := worker.listActivities(athleteID, database.PriorityDefault); err != nil {
+		t.Fatalf("Failed to list activities: %v", err)
+	}
+	events, err = db.ListEvents(athleteID, 0, 10)
+	if err != nil {
+		t.Fatalf("Failed to list events: %v", err)
+	}
+	if len(events) != 1 {
+		t.Errorf("Expected unchanged activity not to emit another event, got %d events", len(events))
+	}
+}
+
+func TestListActivities_ResyncRefetchesAtResyncPriority(t *testing.T) {
+	worker, db := setupWorkerTest(t)
+	defer db.Close()
+
+	athleteID := int64(12345)
+	insertTestAthlete(t, db, athleteID)
+
+	unchanged := `{"id": 1001, "name": "Morning Run", "distance": 5000, "moving_time": 1500}`
+	fingerprint, _ := strava.FingerprintActivity(json.RawMessage(unchanged))
+	if err := db.RecordActivityState(athleteID, 1001, fingerprint, 0, database.ActivitySourceBackfill); err != nil {
+		t.Fatalf("Failed to record activity state: %v", err)
+	}
+
+	detailRequests := 0
+	apiServer := newActivityListServer(t, "["+unchanged+"]", &detailRequests)
+	defer apiServer.Close()
+	worker.stravaClient.SetBaseURL(apiServer.URL)
+
+	if _, err := db.ResyncAthlete(athleteID); err != nil {
+		t.Fatalf("Failed to resync athlete: %v", err)
+	}
+
+	listJob, err := db.ClaimSyncJob()
+	if err != nil || listJob == nil {
+		t.Fatalf("Failed to claim list job: %v", err)
+	}
+	if listJob.Priority != database.PriorityResync {
+		t.Errorf("Expected list job priority %d, got %d", database.PriorityResync, listJob.Priority)
+	}
+
+	if _, err := worker.listActivities(athleteID, listJob.Priority); err != nil {
+		t.Fatalf("Failed to list activities: %v", err)
+	}
+	if err := db.DeleteSyncJob(listJob.ID); err != nil {
+		t.Fatalf("Failed to delete list job: %v", err)
+	}
+
+	// The unchanged activity is fetched again, at the same priority
+	job, err := db.ClaimSyncJob()
+	if err != nil {
+		t.Fatalf("Failed to claim sync job: %v", err)
+	}
+	if job == nil || job.ActivityID == nil || *job.ActivityID != 1001 {
+		t.Fatalf("Expected sync job for activity 1001, got %+v", job)
+	}
+	if job.Priority != database.PriorityResync {
+		t.Errorf("Expected sync job priority %d, got %d", database.PriorityResync, job.Priority)
+	}
+}
+
+func TestSyncActivity_SkipsWhenWebhookRecordedNewerVersion(t *testing.T) {
+	worker, db := setupWorkerTest(t)
+	defer db.Close()
+
+	athleteID := int64(12345)
+	activityID := int64(1001)
+	insertTestAthlete(t, db, athleteID)
+
+	detailRequests := 0
+	apiServer := newActivityListServer(t, `[]`, &detailRequests)
+	defer apiServer.Close()
+	worker.stravaClient.SetBaseURL(apiServer.URL)
+
+	// The job was queued before the webhook recorded the activity
+	queuedAt := time.Now().Add(-1 * time.Minute)
+	if err := db.RecordActivityState(athleteID, activityID, "fingerprint", 0, database.ActivitySourceWebhook); err != nil {
+		t.Fatalf("Failed to record activity state: %v", err)
+	}
+
+	if err := worker.syncActivity(athleteID, activityID, queuedAt, database.EventTypeBackfill); err != nil {
+		t.Fatalf("Failed to sync activity: %v", err)
+	}
+
+	if detailRequests != 0 {
+		t.Errorf("Expected no detail requests for superseded activity, got %d", detailRequests)
+	}
+
+	events, err := db.ListEvents(athleteID, 0, 10)
+	if err != nil {
+		t.Fatalf("Failed to list events: %v", err)
+	}
+	if len(events) != 0 {
+		t.Errorf("Expected no backfill event for superseded activity, got %d", len(events))
+	}
+}
+
+func TestSyncActivity_SkipsWhenWebhookPending(t *testing.T) {
+	worker, db := setupWorkerTest(t)
+	defer db.Close()
+
+	athleteID := int64(12345)
+	activityID := int64(1001)
+	insertTestAthlete(t, db, athleteID)
+
+	detailRequests := 0
+	apiServer := newActivityListServer(t, `[]`, &detailRequests)
+	defer apiServer.Close()
+	worker.stravaClient.SetBaseURL(apiServer.URL)
+
+	// A create webhook for the same activity is waiting to be processed
+	webhookData := json.RawMessage(`{"aspect_type":"create","object_type":"activity","object_id":1001,"owner_id":12345}`)
+	if _, err := db.EnqueueWebhook(webhookData); err != nil {
+		t.Fatalf("Failed to enqueue webhook: %v", err)
+	}
+
+	if err := worker.syncActivity(athleteID, activityID, time.Now(), database.EventTypeBackfill); err != nil {
+		t.Fatalf("Failed to sync activity: %v", err)
+	}
+
+	if detailRequests != 0 {
+		t.Errorf("Expected no detail requests while webhook is pending, got %d", detailRequests)
+	}
+}
+
+func TestProcessWebhook_CoalescesActivityUpdates(t *testing.T) {
+	worker, db := setupWorkerTest(t)
+	defer db.Close()
+
+	athleteID := int64(12345)
+	insertTestAthlete(t, db, athleteID)
+
+	detailRequests := 0
+	apiServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		detailRequests++
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"id": 1001, "name": "Final Title", "resource_state": 3}`))
+	}))
+	defer apiServer.Close()
+	worker.stravaClient.SetBaseURL(apiServer.URL)
+
+	updates := []string{
+		`{"aspect_type":"update","object_type":"activity","object_id":1001,"owner_id":12345,"event_time":1700000000,"updates":{"title":"First Title"}}`,
+		`{"aspect_type":"update","object_type":"activity","object_id":1001,"owner_id":12345,"event_time":1700000005,"updates":{"description":"New description"}}`,
+		`{"aspect_type":"update","object_type":"activity","object_id":1001,"owner_id":12345,"event_time":1700000010,"updates":{"title":"Final Title"}}`,
+	}
+	for i, update := range updates {
+		// Later updates are still within their debounce window
+		delay := time.Duration(0)
+		if i > 0 {
+			delay = time.Minute
+		}
+		if _, _, err := db.EnqueueWebhookDelivery(fmt.Sprintf("delivery-%d", i), "primary", json.RawMessage(update), time.Hour, delay); err != nil {
+			t.Fatalf("Failed to enqueue webhook: %v", err)
+		}
+	}
+
+	// An update for a different activity is not coalesced
+	other := `{"aspect_type":"update","object_type":"activity","object_id":2002,"owner_id":12345,"event_time":1700000010,"updates":{"title":"Other"}}`
+	if _, _, err := db.EnqueueWebhookDelivery("delivery-other", "primary", json.RawMessage(other), time.Hour, time.Minute); err != nil {
+		t.Fatalf("Failed to enqueue webhook: %v", err)
+	}
+
+	item, err := db.ClaimWebhook()
+	if err != nil {
+		t.Fatalf("Failed to claim webhook: %v", err)
+	}
+	if item == nil {
+		t.Fatal("Expected webhook item, got nil")
+	}
+
+	worker.processWebhook(item)
+
+	if detailRequests != 1 {
+		t.Errorf("Expected 1 detail request for coalesced updates, got %d", detailRequests)
+	}
+
+	length, err := db.GetQueueLength()
+	if err != nil {
+		t.Fatalf("Failed to get queue length: %v", err)
+	}
+	if length != 1 {
+		t.Errorf("Expected only the unrelated webhook to remain queued, got %d", length)
+	}
+
+	events, err := db.ListEvents(athleteID, 0, 10)
+	if err != nil {
+		t.Fatalf("Failed to list events: %v", err)
+	}
+	if len(events) != 1 {
+		t.Fatalf("Expected 1 event, got %d", len(events))
+	}
+
+	var webhookEvent map[string]interface{}
+	if err := json.Unmarshal(events[0].WebhookEvent, &webhookEvent); err != nil {
+		t.Fatalf("Failed to unmarshal webhook event: %v", err)
+	}
+	if webhookEvent["event_time"] != float64(1700000010) {
+		t.Errorf("Expected event to record the latest webhook, got event_time %v", webhookEvent["event_time"])
+	}
+
+	var coalesced []map[string]interface{}
+	if err := json.Unmarshal(events[0].CoalescedEvents, &coalesced); err != nil {
+		t.Fatalf("Failed to unmarshal coalesced events: %v", err)
+	}
+	if len(coalesced) != len(updates) {
+		t.Fatalf("Expected %d coalesced events, got %d", len(updates), len(coalesced))
+	}
+	for i, payload := range coalesced {
+		if payload["event_time"] != float64(1700000000+5*i) {
+			t.Errorf("Expected coalesced event %d to have event_time %d, got %v", i, 1700000000+5*i, payload["event_time"])
+		}
+	}
+}
+
+// newActivityDetailServer serves activity details for any activity and counts requests
+func newActivityDetailServer(t *testing.T, detailRequests *int) *httptest.Server {
+	t.Helper()
+
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		*detailRequests++
+		activityID := r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:]
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"id": %s, "resource_state": 3}`, activityID)
+	}))
+}
+
+// processQueuedWebhooks claims and processes webhooks until none are ready
+func processQueuedWebhooks(t *testing.T, worker *Worker, db *database.DB) {
+	t.Helper()
+
+	for {
+		item, err := db.ClaimWebhook()
+		if err != nil {
+			t.Fatalf("Failed to claim webhook: %v", err)
+		}
+		if item == nil {
+			return
+		}
+		worker.processWebhook(item)
+	}
+}
+
+// webhookAspects returns the aspect_type of each event's webhook data in order
+func webhookAspects(t *testing.T, events []*database.Event) []string {
+	t.Helper()
+
+	aspects := make([]string, len(events))
+	for i, event := range events {
+		var webhook map[string]interface{}
+		if err := json.Unmarshal(event.WebhookEvent, &webhook); err != nil {
+			t.Fatalf("Failed to unmarshal webhook event: %v", err)
+		}
+		aspects[i], _ = webhook["aspect_type"].(string)
+	}
+	return aspects
+}
+
+func TestProcessWebhook_CreateThenDeleteSkipsHydration(t *testing.T) {
+	worker, db := setupWorkerTest(t)
+	defer db.Close()
+
+	athleteID := int64(12345)
+	insertTestAthlete(t, db, athleteID)
+
+	detailRequests := 0
+	apiServer := newActivityDetailServer(t, &detailRequests)
+	defer apiServer.Close()
+	worker.stravaClient.SetBaseURL(apiServer.URL)
+
+	// Both webhooks are queued before the worker gets to the create
+	webhooks := []string{
+		`{"aspect_type":"create","object_type":"activity","object_id":1001,"owner_id":12345,"event_time":1700000000}`,
+		`{"aspect_type":"delete","object_type":"activity","object_id":1001,"owner_id":12345,"event_time":1700000060}`,
+	}
+	for _, webhook := range webhooks {
+		if _, err := db.EnqueueWebhook(json.RawMessage(webhook)); err != nil {
+			t.Fatalf("Failed to enqueue webhook: %v", err)
+		}
+	}
+
+	processQueuedWebhooks(t, worker, db)
+
+	if detailRequests != 0 {
+		t.Errorf("Expected no detail requests for an activity pending deletion, got %d", detailRequests)
+	}
+
+	events, err := db.ListEvents(athleteID, 0, 10)
+	if err != nil {
+		t.Fatalf("Failed to list events: %v", err)
+	}
+	if aspects := webhookAspects(t, events); len(aspects) != 1 || aspects[0] != "delete" {
+		t.Errorf("Expected only a delete event, got %v", aspects)
+	}
+}
+
+func TestHandleActivity_CreateAfterDeleteIsSkipped(t *testing.T) {
+	worker, db := setupWorkerTest(t)
+	defer db.Close()
+
+	athleteID := int64(12345)
+	insertTestAthlete(t, db, athleteID)
+
+	detailRequests := 0
+	apiServer := newActivityDetailServer(t, &detailRequests)
+	defer apiServer.Close()
+	worker.stravaClient.SetBaseURL(apiServer.URL)
+
+	// A retried create is processed after the delete that followed it
+	deleteWebhook := map[string]interface{}{
+		"aspect_type": "delete",
+		"object_type": "activity",
+		"object_id":   float64(1001),
+		"owner_id":    float64(athleteID),
+		"event_time":  float64(1700000060),
+	}
+	createWebhook := map[string]interface{}{
+		"aspect_type": "create",
+		"object_type": "activity",
+		"object_id":   float64(1001),
+		"owner_id":    float64(athleteID),
+		"event_time":  float64(1700000000),
+	}
+
+	if err := worker.handleActivity(deleteWebhook, nil); err != nil {
+		t.Fatalf("Failed to handle delete: %v", err)
+	}
+	if err := worker.handleActivity(createWebhook, nil); err != nil {
+		t.Fatalf("Failed to handle create: %v", err)
+	}
+
+	if detailRequests != 0 {
+		t.Errorf("Expected no detail requests for a deleted activity, got %d", detailRequests)
+	}
+
+	events, err := db.ListEvents(athleteID, 0, 10)
+	if err != nil {
+		t.Fatalf("Failed to list events: %v", err)
+	}
+	if aspects := webhookAspects(t, events); len(aspects) != 1 || aspects[0] != "delete" {
+		t.Errorf("Expected only a delete event, got %v", aspects)
+	}
+}
+
+func TestHandleActivity_StaleUpdateIsSkipped(t *testing.T) {
+	worker, db := setupWorkerTest(t)
+	defer db.Close()
+
+	athleteID := int64(12345)
+	insertTestAthlete(t, db, athleteID)
+
+	detailRequests := 0
+	apiServer := newActivityDetailServer(t, &detailRequests)
+	defer apiServer.Close()
+	worker.stravaClient.SetBaseURL(apiServer.URL)
+
+	newer := map[string]interface{}{
+		"aspect_type": "update",
+		"object_type": "activity",
+		"object_id":   float64(1001),
+		"owner_id":    float64(athleteID),
+		"event_time":  float64(1700000060),
+	}
+	older := map[string]interface{}{
+		"aspect_type": "update",
+		"object_type": "activity",
+		"object_id":   float64(1001),
+		"owner_id":    float64(athleteID),
+		"event_time":  float64(1700000000),
+	}
+
+	if err := worker.handleActivity(newer, nil); err != nil {
+		t.Fatalf("Failed to handle newer update: %v", err)
+	}
+	if err := worker.handleActivity(older, nil); err != nil {
+		t.Fatalf("Failed to handle older update: %v", err)
+	}
+
+	if detailRequests != 1 {
+		t.Errorf("Expected 1 detail request, got %d", detailRequests)
+	}
+
+	events, err := db.ListEvents(athleteID, 0, 10)
+	if err != nil {
+		t.Fatalf("Failed to list events: %v", err)
+	}
+	if len(events) != 1 {
+		t.Errorf("Expected 1 event, got %d", len(events))
+	}
+}
+
+func TestProcessWebhook_OrdersByEventTime(t *testing.T) {
+	worker, db := setupWorkerTest(t)
+	defer db.Close()
+
+	athleteID := int64(12345)
+	insertTestAthlete(t, db, athleteID)
+
+	detailRequests := 0
+	apiServer := newActivityDetailServer(t, &detailRequests)
+	defer apiServer.Close()
+	worker.stravaClient.SetBaseURL(apiServer.URL)
+
+	// The update was queued before the create it follows (e.g. the create was redelivered)
+	webhooks := []string{
+		`{"aspect_type":"update","object_type":"activity","object_id":1001,"owner_id":12345,"event_time":1700000060,"updates":{"title":"Renamed"}}`,
+		`{"aspect_type":"create","object_type":"activity","object_id":2002,"owner_id":12345,"event_time":1700000030}`,
+		`{"aspect_type":"create","object_type":"activity","object_id":1001,"owner_id":12345,"event_time":1700000000}`,
+	}
+	for _, webhook := range webhooks {
+		if _, err := db.EnqueueWebhook(json.RawMessage(webhook)); err != nil {
+			t.Fatalf("Failed to enqueue webhook: %v", err)
+		}
+	}
+
+	processQueuedWebhooks(t, worker, db)
+
+	events, err := db.ListEvents(athleteID, 0, 10)
+	if err != nil {
+		t.Fatalf("Failed to list events: %v", err)
+	}
+
+	// Activity 1001's create is processed before its update, other activities keep queue order
+	if len(events) != 3 {
+		t.Fatalf("Expected 3 events, got %d", len(events))
+	}
+	var activity1001 []*database.Event
+	for _, event := range events {
+		if event.ActivityID != nil && *event.ActivityID == 1001 {
+			activity1001 = append(activity1001, event)
+		}
+	}
+	aspects := webhookAspects(t, activity1001)
+	if len(aspects) != 2 || aspects[0] != "create" || aspects[1] != "update" {
+		t.Errorf("Expected create then update for activity 1001, got %v", aspects)
+	}
+	if events[2].ActivityID == nil || *events[2].ActivityID != 2002 {
+		t.Errorf("Expected activity 2002 to be processed after activity 1001's webhooks")
+	}
+}
+
+// backfillActivity is an activity served by newBackfillServer
+type backfillActivity struct {
+	id      int64
+	started time.Time
+}
+
+// newBackfillServer serves activities newest first, honouring before and per_page,
+// and activity details. Records the before parameter of each list request.
+func newBackfillServer(t *testing.T, activities []backfillActivity, befores *[]string) *httptest.Server {
+	t.Helper()
+
+	activityJSON := func(activity backfillActivity) string {
+		return fmt.Sprintf(`{"id": %d, "name": "Activity %d", "start_date": %q}`,
+			activity.id, activity.id, activity.started.UTC().Format(time.RFC3339))
+	}
+
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		if strings.Contains(r.URL.Path, "/athlete/activities") {
+			before := r.URL.Query().Get("before")
+			*befores = append(*befores, before)
+			perPage, _ := strconv.Atoi(r.URL.Query().Get("per_page"))
+
+			var beforeTime int64
+			if before != "" {
+				var err error
+				if beforeTime, err = strconv.ParseInt(before, 10, 64); err != nil {
+					t.Errorf("Invalid before %q: %v", before, err)
+				}
+			}
+
+			var page []string
+			for _, activity := range activities {
+				if before != "" && activity.started.Unix() >= beforeTime {
+					continue
+				}
+				if len(page) == perPage {
+					break
+				}
+				page = append(page, activityJSON(activity))
+			}
+			fmt.Fprintf(w, "[%s]", strings.Join(page, ","))
+			return
+		}
+
+		activityID := r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:]
+		for _, activity := range activities {
+			if strconv.FormatInt(activity.id, 10) == activityID {
+				w.Write([]byte(activityJSON(activity)))
+				return
+			}
+		}
+		http.Error(w, "Not found", http.StatusNotFound)
+	}))
+}
+
+// processQueuedSyncJobs claims and processes sync jobs until none are ready
+// Returns the activity IDs of the sync_activity jobs in the order processed
+func processQueuedSyncJobs(t *testing.T, worker *Worker, db *database.DB) []int64 {
+	t.Helper()
+
+	var activityIDs []int64
+	for {
+		job, err := db.ClaimSyncJob()
+		if err != nil {
+			t.Fatalf("Failed to claim sync job: %v", err)
+		}
+		if job == nil {
+			return activityIDs
+		}
+		if job.ActivityID != nil {
+			activityIDs = append(activityIDs, *job.ActivityID)
+		}
+		worker.processSyncJob(job)
+	}
+}
+
+func TestListActivities_NewestFirstWithinHorizon(t *testing.T) {
+	worker, db := setupWorkerTest(t)
+	defer db.Close()
+	worker.listPageSize = 2
+	worker.config.StravaClients["primary"].BackfillMaxAgeDays = 365
+
+	athleteID := int64(12345)
+	insertTestAthlete(t, db, athleteID)
+
+	// Unix timestamps compare correctly as strings in the fake server
+	now := time.Now().Truncate(time.Second)
+	activities := []backfillActivity{
+		{1, now.Add(-24 * time.Hour)},
+		{2, now.Add(-48 * time.Hour)},
+		{3, now.Add(-10 * 24 * time.Hour)},
+		{4, now.Add(-400 * 24 * time.Hour)},
+		{5, now.Add(-800 * 24 * time.Hour)},
+	}
+
+	var befores []string
+	apiServer := newBackfillServer(t, activities, &befores)
+	defer apiServer.Close()
+	worker.stravaClient.SetBaseURL(apiServer.URL)
+
+	if _, err := db.StartBackfill(athleteID, database.PriorityDefault); err != nil {
+		t.Fatalf("Failed to start backfill: %v", err)
+	}
+
+	// Details are fetched newest first, stopping at the horizon
+	synced := processQueuedSyncJobs(t, worker, db)
+	if !slices.Equal(synced, []int64{1, 2, 3}) {
+		t.Errorf("Expected activities 1, 2, 3 to be synced in order, got %v", synced)
+	}
+
+	// The first page's details are fetched before the second page is listed.
+	// Each page starts from the second of the oldest activity listed.
+	expectedBefores := []string{
+		"",
+		strconv.FormatInt(activities[1].started.Unix()+1, 10),
+		strconv.FormatInt(activities[2].started.Unix()+1, 10),
+	}
+	if !slices.Equal(befores, expectedBefores) {
+		t.Errorf("Expected list requests with before %q, got %q", expectedBefores, befores)
+	}
+
+	// Extending the horizon continues from the oldest activity listed
+	befores = nil
+	unlimited := 0
+	if _, err := db.ExtendBackfill(athleteID, &unlimited, nil); err != nil {
+		t.Fatalf("Failed to extend backfill: %v", err)
+	}
+
+	synced = processQueuedSyncJobs(t, worker, db)
+	if !slices.Equal(synced, []int64{4, 5}) {
+		t.Errorf("Expected only activities 4, 5 to be synced after extending, got %v", synced)
+	}
+	if len(befores) == 0 || befores[0] != strconv.FormatInt(activities[2].started.Unix()+1, 10) {
+		t.Errorf("Expected extension to list from activity 3, got %q", befores)
+	}
+}
+
+func TestListActivities_SameSecondAcrossPages(t *testing.T) {
+	worker, db := setupWorkerTest(t)
+	defer db.Close()
+	worker.listPageSize = 3
+
+	athleteID := int64(12345)
+	insertTestAthlete(t, db, athleteID)
+
+	// Activities 3 and 4 started in the same second, either side of a page boundary
+	now := time.Now().Truncate(time.Second)
+	activities := []backfillActivity{
+		{1, now.Add(-1 * time.Hour)},
+		{2, now.Add(-2 * time.Hour)},
+		{3, now.Add(-3 * time.Hour)},
+		{4, now.Add(-3 * time.Hour)},
+		{5, now.Add(-4 * time.Hour)},
+	}
+
+	var befores []string
+	apiServer := newBackfillServer(t, activities, &befores)
+	defer apiServer.Close()
+	worker.stravaClient.SetBaseURL(apiServer.URL)
+
+	if _, err := db.StartBackfill(athleteID, database.PriorityDefault); err != nil {
+		t.Fatalf("Failed to start backfill: %v", err)
+	}
+
+	// Activity 3 is listed again with the next page but only synced once
+	synced := processQueuedSyncJobs(t, worker, db)
+	if !slices.Equal(synced, []int64{1, 2, 3, 4, 5}) {
+		t.Errorf("Expected every activity to be synced once, got %v", synced)
+	}
+
+	state, err := db.GetBackfillState(athleteID)
+	if err != nil {
+		t.Fatalf("Failed to get backfill state: %v", err)
+	}
+	if state.ListedCount > len(activities) {
+		t.Errorf("Expected relisted activities not to be counted twice, got %d listed", state.ListedCount)
+	}
+}
+
+func TestListActivities_MaxActivitiesHorizon(t *testing.T) {
+	worker, db := setupWorkerTest(t)
+	defer db.Close()
+	worker.config.StravaClients["primary"].BackfillMaxActivities = 2
+
+	athleteID := int64(12345)
+	insertTestAthlete(t, db, athleteID)
+
+	now := time.Now().Truncate(time.Second)
+	activities := []backfillActivity{
+		{1, now.Add(-1 * time.Hour)},
+		{2, now.Add(-2 * time.Hour)},
+		{3, now.Add(-3 * time.Hour)},
+	}
+
+	var befores []string
+	apiServer := newBackfillServer(t, activities, &befores)
+	defer apiServer.Close()
+	worker.stravaClient.SetBaseURL(apiServer.URL)
+
+	if _, err := db.StartBackfill(athleteID, database.PriorityDefault); err != nil {
+		t.Fatalf("Failed to start backfill: %v", err)
+	}
+
+	synced := processQueuedSyncJobs(t, worker, db)
+	if !slices.Equal(synced, []int64{1, 2}) {
+		t.Errorf("Expected the newest 2 activities to be synced, got %v", synced)
+	}
+}
@@ -6,9 +6,11 @@ import (
 	"flag"
 	"fmt"
 	"log/slog"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"slices"
 	"strconv"
 	"strings"
 	"syscall"
@@ -31,10 +33,86 @@ func main() {
 	listSubscriptions := flag.Bool("list-strava-subscriptions", false, "List all Strava webhook subscriptions")
 	deleteSubscription := flag.String("delete-strava-subscription", "", "Delete a Strava webhook subscription by ID")
 	createSubscription := flag.Bool("create-strava-subscription", false, "Create a Strava webhook subscription for configuration")
-	clientID := flag.String("client-id", "", "Strava client identifier (primary or secondary)")
+	reconcileSubscriptions := flag.Bool("reconcile-subscriptions", false, "Check that each client's webhook subscription points at this server (all clients unless --client-id)")
+	fix := flag.Bool("fix", false, "With --reconcile-subscriptions, create or replace missing and mismatched subscriptions")
+	clientID := flag.String("client-id", "", "Strava client name (as configured in STRAVA_CLIENTS)")
+	resyncAthlete := flag.String("resync-athlete", "", "Resync all activities of an athlete by ID")
+	resyncActivity := flag.String("resync-activity", "", "Resync a single activity: --resync-activity <athlete_id> <activity_id>")
+	resyncAll := flag.Bool("resync-all", false, "Resync all activities of every athlete")
+	extendBackfill := flag.String("extend-backfill", "", "Extend an athlete's backfill horizon by athlete ID (with --max-age-days and/or --max-activities)")
+	maxAgeDays := flag.Int("max-age-days", -1, "Backfill activities started in the last N days (0 = unlimited)")
+	maxActivities := flag.Int("max-activities", -1, "Backfill the newest N activities (0 = unlimited)")
+	listAthletes := flag.Bool("list-athletes", false, "List connected athletes")
+	showAthlete := flag.String("show-athlete", "", "Show a connected athlete by ID")
+	disconnectAthlete := flag.String("disconnect-athlete", "", "Deauthorize an athlete on Strava and delete their tokens and events by ID")
+	moveAthleteClient := flag.String("move-athlete-client", "", "Same as --migrate-athlete-client, as athletes must authorize a new client themselves")
+	migrateAthleteClient := flag.String("migrate-athlete-client", "", "Create a link inviting an athlete to reconnect under the client given by --client-id by ID")
+	listClients := flag.Bool("list-clients", false, "List clients with their athletes and API usage")
+	force := flag.Bool("force", false, "With --disconnect-athlete, disconnect even if Strava deauthorization fails")
+	jsonOutput := flag.Bool("json", false, "Output athlete and API key commands as JSON")
+	createAPIKey := flag.String("create-api-key", "", "Create an internal API key by name (with --scopes and, for athlete:read, --athlete-id)")
+	scopes := flag.String("scopes", "", "With --create-api-key, comma separated scopes: events:read, athlete:read, admin")
+	athleteID := flag.String("athlete-id", "", "With --create-api-key, the athlete an athlete:read key can read")
+	listAPIKeys := flag.Bool("list-api-keys", false, "List internal API keys")
+	revokeAPIKey := flag.String("revoke-api-key", "", "Revoke an internal API key by name")
+	configFile := flag.String("config", "", "Read settings from a YAML config file (overrides CONFIG_FILE)")
+	checkConfig := flag.Bool("check-config", false, "Validate the configuration and exit")
 
 	flag.Parse()
 
+	if *configFile != "" {
+		os.Setenv("CONFIG_FILE", *configFile)
+	}
+
+	if *checkConfig {
+		runCheckConfigCLI()
+		return
+	}
+
+	athleteCmd := athleteCommand{
+		list:        *listAthletes,
+		show:        *showAthlete,
+		disconnect:  *disconnectAthlete,
+		move:        *moveAthleteClient,
+		migrate:     *migrateAthleteClient,
+		listClients: *listClients,
+		clientID:    *clientID,
+		force:       *force,
+		jsonOutput:  *jsonOutput,
+	}
+	if athleteCmd.requested() {
+		runAthleteCLI(athleteCmd)
+		return
+	}
+
+	apiKeyCmd := apiKeyCommand{
+		create:     *createAPIKey,
+		list:       *listAPIKeys,
+		revoke:     *revokeAPIKey,
+		scopes:     *scopes,
+		athleteID:  *athleteID,
+		jsonOutput: *jsonOutput,
+	}
+	if apiKeyCmd.requested() {
+		runAPIKeyCLI(apiKeyCmd)
+		return
+	}
+
+	if *resyncAthlete != "" || *resyncActivity != "" || *resyncAll {
+		runResyncCLI(*resyncAthlete, *resyncActivity, flag.Arg(0), *resyncAll)
+		return
+	}
+
+	if *extendBackfill != "" {
+		runExtendBackfillCLI(*extendBackfill, *maxAgeDays, *maxActivities)
+		return
+	}
+
+	if *reconcileSubscriptions {
+		runReconcileSubscriptionsCLI(*clientID, *fix)
+		return
+	}
+
 	// Check if any CLI command was requested
 	if *listSubscriptions || *deleteSubscription != "" || *createSubscription {
 		runCLI(*listSubscriptions, *deleteSubscription, *createSubscription, *clientID)
@@ -149,7 +227,7 @@ func handleCreateSubscription(client *strava.Client, cfg *config.Config, clientI
 	}
 
 	// Build callback URL with client path parameter
-	callbackURL := fmt.Sprintf("https://%s/webhook-callback/%s", cfg.Domain, clientID)
+	callbackURL := cfg.WebhookCallbackURL(clientID)
 
 	fmt.Printf("Creating webhook subscription...\n")
 	fmt.Printf("Client: %s\n", clientID)
@@ -172,24 +250,222 @@ func handleCreateSubscription(client *strava.Client, cfg *config.Config, clientI
 	fmt.Printf("  ID: %d\n", subscription.ID)
 }
 
-func runServer() {
-	// Load configuration
+// runReconcileSubscriptionsCLI reports whether each client's webhook
+// subscription points at this server, fixing it if requested. It exits
+// non-zero if any subscription is left unhealthy.
+func runReconcileSubscriptionsCLI(clientID string, fix bool) {
+	cfg, db := openCLIDatabase()
+	defer db.Close()
+
+	clientIDs := cfg.GetClientIDs()
+	slices.Sort(clientIDs)
+	if clientID != "" {
+		if !cfg.HasClient(clientID) {
+			fmt.Fprintf(os.Stderr, "Error: Unknown client_id: %s\n", clientID)
+			fmt.Fprintf(os.Stderr, "Available clients: %v\n", clientIDs)
+			os.Exit(1)
+		}
+		clientIDs = []string{clientID}
+	}
+
+	client := strava.NewClient(cfg, db)
+	gapDetector := worker.NewGapDetector(db, cfg)
+
+	allHealthy := true
+	for _, id := range clientIDs {
+		fmt.Printf("Client: %s\n", id)
+		status, err := client.ReconcileSubscription(id, fix)
+		if status != nil {
+			fmt.Printf("  Expected callback URL: %s\n", status.ExpectedCallbackURL)
+			for _, sub := range status.Subscriptions {
+				fmt.Printf("  Found subscription %d: %s\n", sub.ID, sub.CallbackURL)
+			}
+			for _, subID := range status.Deleted {
+				fmt.Printf("  Deleted subscription %d\n", subID)
+			}
+			if status.Created != nil {
+				fmt.Printf("  Created subscription %d\n", status.Created.ID)
+			}
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "  Error: %v\n", err)
+			allHealthy = false
+			continue
+		}
+
+		// Queue gap sync if the subscription was replaced
+		gapDetector.SubscriptionChecked(status)
+
+		if status.Healthy {
+			fmt.Println("  ✓ Healthy")
+		} else {
+			fmt.Println("  ✗ Missing or mismatched (use --fix to replace)")
+			allHealthy = false
+		}
+	}
+
+	if !allHealthy {
+		os.Exit(1)
+	}
+}
+
+// runCheckConfigCLI validates the configuration, listing every problem found.
+// It exits non-zero if the configuration is invalid.
+func runCheckConfigCLI() {
 	cfg, err := config.Load()
 	if err != nil {
-		slog.Error("Failed to load configuration", "error", err)
+		var validationErr *config.ValidationError
+		if !errors.As(err, &validationErr) {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Fprintln(os.Stderr, "✗ Invalid configuration:")
+		for _, problem := range validationErr.Problems {
+			fmt.Fprintf(os.Stderr, "  %s\n", problem)
+		}
+		os.Exit(1)
+	}
+
+	fmt.Println("✓ Configuration is valid")
+	if cfg.File != "" {
+		fmt.Printf("  Config file: %s\n", cfg.File)
+	}
+	fmt.Printf("  Server: %s:%d\n", cfg.Host, cfg.Port)
+	if cfg.MetricsEnabled {
+		fmt.Printf("  Metrics: %s:%d\n", cfg.MetricsHost, cfg.MetricsPort)
+	}
+	for _, id := range cfg.GetClientIDs() {
+		client := cfg.StravaClients[id]
+		status := "enabled"
+		if client.Disabled {
+			status = "disabled"
+		}
+		fmt.Printf("  Client %s: %s, weight %d, %s\n", id, client.ClientID, client.Weight, status)
+	}
+}
+
+// runResyncCLI queues resync jobs for the running server's worker to process
+func runResyncCLI(athleteIDStr, activityAthleteIDStr, activityIDStr string, all bool) {
+	_, db := openCLIDatabase()
+	defer db.Close()
+
+	switch {
+	case all:
+		count, err := db.ResyncAllAthletes()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: Failed to resync athletes: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Queued resync of %d athletes\n", count)
+
+	case athleteIDStr != "":
+		athleteID := parseIDArg("athlete", athleteIDStr)
+		jobID, err := db.ResyncAthlete(athleteID)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: Failed to resync athlete %d: %v\n", athleteID, err)
+			os.Exit(1)
+		}
+		fmt.Printf("Queued resync of athlete %d (job %d)\n", athleteID, jobID)
+
+	default:
+		if activityIDStr == "" {
+			fmt.Fprintln(os.Stderr, "Usage: --resync-activity <athlete_id> <activity_id>")
+			os.Exit(1)
+		}
+		athleteID := parseIDArg("athlete", activityAthleteIDStr)
+		activityID := parseIDArg("activity", activityIDStr)
+		jobID, err := db.ResyncActivity(athleteID, activityID)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: Failed to resync activity %d: %v\n", activityID, err)
+			os.Exit(1)
+		}
+		fmt.Printf("Queued resync of activity %d for athlete %d (job %d)\n", activityID, athleteID, jobID)
+	}
+}
+
+// runExtendBackfillCLI overrides an athlete's backfill horizon and queues the
+// continuation of their backfill. Negative values leave the horizon unchanged.
+func runExtendBackfillCLI(athleteIDStr string, maxAgeDays, maxActivities int) {
+	if maxAgeDays < 0 && maxActivities < 0 {
+		fmt.Fprintln(os.Stderr, "Usage: --extend-backfill <athlete_id> [--max-age-days N] [--max-activities N]")
 		os.Exit(1)
 	}
 
-	// Set up logger
-	logLevel := slog.LevelInfo
-	switch cfg.LogLevel {
+	_, db := openCLIDatabase()
+	defer db.Close()
+
+	var maxAgeDaysOverride, maxActivitiesOverride *int
+	if maxAgeDays >= 0 {
+		maxAgeDaysOverride = &maxAgeDays
+	}
+	if maxActivities >= 0 {
+		maxActivitiesOverride = &maxActivities
+	}
+
+	athleteID := parseIDArg("athlete", athleteIDStr)
+	jobID, err := db.ExtendBackfill(athleteID, maxAgeDaysOverride, maxActivitiesOverride)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: Failed to extend backfill for athlete %d: %v\n", athleteID, err)
+		os.Exit(1)
+	}
+	fmt.Printf("Queued backfill extension for athlete %d (job %d)\n", athleteID, jobID)
+}
+
+// parseIDArg parses a numeric ID from the command line, exiting if it is invalid
+func parseIDArg(name, value string) int64 {
+	id, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: Invalid %s ID: %s\n", name, value)
+		os.Exit(1)
+	}
+	return id
+}
+
+// parseLogLevel returns the slog level of a LOG_LEVEL setting
+func parseLogLevel(level string) slog.Level {
+	switch level {
 	case "debug":
-		logLevel = slog.LevelDebug
+		return slog.LevelDebug
 	case "warn":
-		logLevel = slog.LevelWarn
+		return slog.LevelWarn
 	case "error":
-		logLevel = slog.LevelError
+		return slog.LevelError
+	}
+	return slog.LevelInfo
+}
+
+// reloadConfig loads the configuration again and applies the settings which
+// can change while running. The current configuration is kept if the new one
+// is invalid.
+func reloadConfig(cfg *config.Config, logLevel *slog.LevelVar) {
+	next, err := config.Load()
+	if err != nil {
+		slog.Error("Failed to reload configuration, keeping current configuration", "error", err)
+		metrics.ConfigReloadsTotal.WithLabelValues(metrics.ResultFailure).Inc()
+		return
+	}
+
+	applied, needRestart := cfg.Reload(next)
+	logLevel.Set(parseLogLevel(cfg.GetLogLevel()))
+	metrics.ConfigReloadsTotal.WithLabelValues(metrics.ResultSuccess).Inc()
+
+	slog.Info("Reloaded configuration", "applied", applied)
+	if len(needRestart) > 0 {
+		slog.Warn("Changed settings need a restart to take effect", "settings", needRestart)
 	}
+}
+
+func runServer() {
+	// Load configuration
+	cfg, err := config.Load()
+	if err != nil {
+		slog.Error("Failed to load configuration", "error", err)
+		os.Exit(1)
+	}
+
+	// Set up logger, with a level which can change on reload
+	logLevel := new(slog.LevelVar)
+	logLevel.Set(parseLogLevel(cfg.LogLevel))
 
 	logger := slog.New(slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{
 		Level: logLevel,
@@ -200,10 +476,11 @@ func runServer() {
 		"host", cfg.Host,
 		"port", cfg.Port,
 		"database", cfg.DatabasePath,
-		"log_level", cfg.LogLevel)
+		"log_level", cfg.LogLevel,
+		"config_file", cfg.File)
 
 	cfgClientLogMsg := "Configured strava clients: "
-	for name := range cfg.StravaClients {
+	for _, name := range cfg.GetClientIDs() {
 		cfgClientLogMsg += fmt.Sprintf("%s (%s), ", name, cfg.StravaClients[name].ClientID)
 	}
 	logger.Info(cfgClientLogMsg)
@@ -228,6 +505,8 @@ func runServer() {
 	oauthHandler := handlers.NewOAuthHandler(oauthManager, cfg)
 	webhookHandler := handlers.NewWebhookHandler(db, cfg)
 	eventsHandler := handlers.NewEventsHandler(db, cfg)
+	adminHandler := handlers.NewAdminHandler(db, cfg)
+	athletesHandler := handlers.NewAthletesHandler(db, oauthManager, cfg)
 
 	// Set up HTTP routes
 	mux := http.NewServeMux()
@@ -263,6 +542,21 @@ func runServer() {
 	// Events API endpoint
 	mux.Handle("/events", middleware.WrapHandler(metrics.EndpointEvents, eventsHandler.HandleEvents))
 
+	// Athletes API endpoint
+	mux.Handle("DELETE /athletes/{athlete_id}", middleware.WrapHandler(metrics.EndpointAthletes, athletesHandler.HandleDeleteAthlete))
+	mux.Handle("POST /athletes/{athlete_id}/migrate", middleware.WrapHandler(metrics.EndpointAthletes, athletesHandler.HandleMigrateAthlete))
+
+	// Admin API endpoints
+	mux.Handle("GET /admin/webhooks", middleware.WrapHandler(metrics.EndpointAdmin, adminHandler.HandleListWebhooks))
+	mux.Handle("POST /admin/webhooks/{id}/{action}", middleware.WrapHandler(metrics.EndpointAdmin, adminHandler.HandleWebhookAction))
+	mux.Handle("GET /admin/sync-jobs", middleware.WrapHandler(metrics.EndpointAdmin, adminHandler.HandleListSyncJobs))
+	mux.Handle("POST /admin/sync-jobs/{id}/{action}", middleware.WrapHandler(metrics.EndpointAdmin, adminHandler.HandleSyncJobAction))
+	mux.Handle("GET /admin/clients", middleware.WrapHandler(metrics.EndpointAdmin, adminHandler.HandleListClients))
+	mux.Handle("POST /admin/resync", middleware.WrapHandler(metrics.EndpointAdmin, adminHandler.HandleResyncAll))
+	mux.Handle("POST /admin/athletes/{athlete_id}/resync", middleware.WrapHandler(metrics.EndpointAdmin, adminHandler.HandleResyncAthlete))
+	mux.Handle("POST /admin/athletes/{athlete_id}/backfill", middleware.WrapHandler(metrics.EndpointAdmin, adminHandler.HandleExtendBackfill))
+	mux.Handle("POST /admin/athletes/{athlete_id}/activities/{activity_id}/resync", middleware.WrapHandler(metrics.EndpointAdmin, adminHandler.HandleResyncActivity))
+
 	// Health check endpoint
 	mux.Handle("/health", middleware.WrapHandler(metrics.EndpointHealth, func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusOK)
@@ -279,6 +573,12 @@ func runServer() {
 		IdleTimeout:  120 * time.Second,
 	}
 
+	// Sync any webhooks missed while the server was down
+	gapDetector := worker.NewGapDetector(db, cfg)
+	if err := gapDetector.CheckDowntime(time.Now()); err != nil {
+		logger.Error("Failed to check downtime", "error", err)
+	}
+
 	// Start webhook worker in background
 	workerInstance := worker.NewWorker(db, stravaClient, cfg)
 	workerCtx, workerCancel := context.WithCancel(context.Background())
@@ -291,6 +591,18 @@ func runServer() {
 		}
 	}()
 
+	go func() {
+		logger.Info("Starting gap detector")
+		gapDetector.Start(workerCtx)
+	}()
+
+	go func() {
+		logger.Info("Starting reconciliation scheduler",
+			"interval", cfg.ReconcileInterval,
+			"window", cfg.ReconcileWindow)
+		worker.NewReconcileScheduler(db, cfg).Start(workerCtx)
+	}()
+
 	// Start queue depth collector if metrics are enabled
 	if cfg.MetricsEnabled {
 		go func() {
@@ -319,19 +631,44 @@ func runServer() {
 		}()
 	}
 
+	// Listen before reconciling subscriptions, as Strava verifies the
+	// callback URL while a subscription is being created
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		logger.Error("HTTP server failed to listen", "error", err)
+		os.Exit(1)
+	}
+
 	// Start HTTP server in background
 	go func() {
 		logger.Info("HTTP server listening", "addr", addr)
-		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
 			logger.Error("HTTP server failed", "error", err)
 			os.Exit(1)
 		}
 	}()
 
-	// Wait for interrupt signal
+	// Check webhook subscriptions at startup and periodically
+	go func() {
+		logger.Info("Starting subscription reconciler",
+			"interval", cfg.SubscriptionCheckInterval,
+			"auto_fix", cfg.SubscriptionAutoFix)
+		stravaClient.StartSubscriptionReconciler(workerCtx, cfg.SubscriptionCheckInterval, cfg.SubscriptionAutoFix, gapDetector.SubscriptionChecked)
+	}()
+
+	// Write API usage per client to the database in the background, rather
+	// than with every request
+	go func() {
+		logger.Info("Starting API usage flusher")
+		stravaClient.StartUsageFlusher(workerCtx, 1*time.Minute)
+	}()
+
+	// Wait for interrupt signal, reloading configuration on SIGHUP
 	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
-	<-sigChan
+	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+	for sig := <-sigChan; sig == syscall.SIGHUP; sig = <-sigChan {
+		reloadConfig(cfg, logLevel)
+	}
 
 	logger.Info("Shutting down gracefully...")
 
@@ -352,5 +689,9 @@ func runServer() {
 		}
 	}
 
+	if err := stravaClient.FlushUsage(); err != nil {
+		logger.Error("Failed to flush API usage", "error", err)
+	}
+
 	logger.Info("Server stopped")
 }